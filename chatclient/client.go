@@ -0,0 +1,246 @@
+// Package chatclient is a Go client of the chatroom server. It wraps the gRPC
+// ChatService with the login and the token handling, and keeps chat streams open
+// across network drops:
+//
+//	conn, err := grpc.NewClient("localhost:8082", grpc.WithTransportCredentials(insecure.NewCredentials()))
+//	...
+//	c := chatclient.New(conn, chatclient.WithCredentials("alice", chatclient.Password("secret")))
+//	if err := c.LogIn(ctx); err != nil {
+//		...
+//	}
+//	session := c.Chat(ctx)
+//	session.Send("hello")
+//	for msg := range session.Messages() {
+//		fmt.Println(msg.GetUsername(), msg.GetTextContent())
+//	}
+package chatclient
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/tokensource"
+)
+
+const (
+	// DefaultInitialBackoff is the delay before the first reconnect, doubled per attempt.
+	DefaultInitialBackoff = 500 * time.Millisecond
+	// DefaultMaxBackoff is the upper bound of the reconnect delay.
+	DefaultMaxBackoff = 30 * time.Second
+)
+
+// PasswordFunc returns the password of the user, e.g. by prompting for it. It is
+// called on every login, so that the password need not be kept in memory.
+type PasswordFunc func(ctx context.Context) (string, error)
+
+// Password returns a PasswordFunc of a fixed password.
+func Password(password string) PasswordFunc {
+	return func(context.Context) (string, error) { return password, nil }
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithToken makes the client start with a token, e.g. one cached by an earlier run.
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithCredentials sets the user the client logs in as. A client with credentials
+// logs in again when the server rejects its token, e.g. after the server restarted
+// with another signing key. A nil password logs in by the client certificate of
+// the connection.
+func WithCredentials(username string, password PasswordFunc) Option {
+	return func(c *Client) { c.username, c.password = username, password }
+}
+
+// WithTokenHandler sets a function called with every token the client gets by
+// logging in, e.g. to cache it.
+func WithTokenHandler(fn func(token string)) Option {
+	return func(c *Client) { c.onToken = fn }
+}
+
+// WithTransportSecurity makes gRPC refuse to send the token over connections
+// without TLS. Set it for clients connecting with TLS.
+func WithTransportSecurity() Option {
+	return func(c *Client) { c.secure = true }
+}
+
+// WithReconnectBackoff sets the delays between the reconnects of chat sessions,
+// starting at initial and doubling up to max. The defaults are
+// DefaultInitialBackoff and DefaultMaxBackoff.
+func WithReconnectBackoff(initial, max time.Duration) Option {
+	return func(c *Client) { c.initialBackoff, c.maxBackoff = initial, max }
+}
+
+// WithoutReconnect makes chat sessions end at the first error instead of reconnecting.
+func WithoutReconnect() Option {
+	return func(c *Client) { c.reconnect = false }
+}
+
+// Client is a client of the chatroom server, safe for concurrent use.
+type Client struct {
+	cc  grpc.ClientConnInterface
+	rpc pb.ChatServiceClient
+
+	username string
+	password PasswordFunc
+	onToken  func(token string)
+	secure   bool
+
+	reconnect      bool
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+
+	mu    sync.Mutex // mu guards token and serializes logins
+	token string
+}
+
+// New returns a client of the server at the other end of cc, usually a *grpc.ClientConn.
+func New(cc grpc.ClientConnInterface, opts ...Option) *Client {
+	c := &Client{
+		cc:             cc,
+		reconnect:      true,
+		initialBackoff: DefaultInitialBackoff,
+		maxBackoff:     DefaultMaxBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.rpc = pb.NewChatServiceClient(&authConn{c: c})
+	return c
+}
+
+// RPC returns the ChatService of the server, authenticated by the token of the
+// client. Unary calls rejected for the token are retried once after logging in
+// again, if the client has credentials.
+func (c *Client) RPC() pb.ChatServiceClient {
+	return c.rpc
+}
+
+// Token returns the current token of the client, "" before logging in.
+func (c *Client) Token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+// Username returns the user of the credentials of the client.
+func (c *Client) Username() string {
+	return c.username
+}
+
+// callCredentials returns the call option authenticating RPCs by token.
+func (c *Client) callCredentials(token string) grpc.CallOption {
+	if c.secure {
+		return grpc.PerRPCCredentials(tokensource.NewSecure(token))
+	}
+	return grpc.PerRPCCredentials(tokensource.New(token))
+}
+
+// LogIn logs in with the credentials of the client, registering the user if the
+// server does not know it yet.
+func (c *Client) LogIn(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.logInLocked(ctx)
+}
+
+// logInLocked logs in and sets the token.
+// NOTE: The caller must hold c.mu.
+func (c *Client) logInLocked(ctx context.Context) error {
+	if c.username == "" {
+		return status.Errorf(codes.FailedPrecondition, "the client has no credentials to log in with")
+	}
+	var password string
+	if c.password != nil {
+		var err error
+		if password, err = c.password(ctx); err != nil {
+			return err
+		}
+	}
+	resp, err := pb.NewChatServiceClient(c.cc).LogInOrRegister(ctx, &pb.LogInOrRegisterRequest{
+		Username: c.username,
+		Password: password,
+	})
+	if err != nil {
+		return err
+	}
+	if resp.GetToken() == "" {
+		return status.Errorf(codes.Internal, "server returned an empty token")
+	}
+	c.token = resp.GetToken()
+	if c.onToken != nil {
+		c.onToken(c.token)
+	}
+	return nil
+}
+
+// refresh logs in again after the server rejected stale, unless another call
+// already did. It reports whether there is a new token to retry with.
+func (c *Client) refresh(ctx context.Context, stale string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != stale {
+		return true, nil
+	}
+	if c.username == "" {
+		return false, nil
+	}
+	if err := c.logInLocked(ctx); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// LogOut ends the session of the user on the server and forgets the token. Users
+// who were not logged in on the server are not an error.
+func (c *Client) LogOut(ctx context.Context) error {
+	c.mu.Lock()
+	token := c.token
+	c.token = ""
+	c.mu.Unlock()
+	if token == "" {
+		return nil
+	}
+
+	// Logging in again to log out makes no sense, so this bypasses RPC.
+	_, err := pb.NewChatServiceClient(c.cc).LogOut(ctx, &pb.LogOutRequest{}, c.callCredentials(token))
+	// The server forgets sessions when it restarts.
+	if code := status.Code(err); code == codes.NotFound || code == codes.Unauthenticated {
+		return nil
+	}
+	return err
+}
+
+// authConn adds the token of the client to every call, and logs in again when a
+// unary call is rejected for the token.
+type authConn struct {
+	c *Client
+}
+
+func (a *authConn) Invoke(ctx context.Context, method string, args any, reply any, opts ...grpc.CallOption) error {
+	token := a.c.Token()
+	err := a.c.cc.Invoke(ctx, method, args, reply, append(opts, a.c.callCredentials(token))...)
+	if status.Code(err) != codes.Unauthenticated || method == pb.ChatService_LogInOrRegister_FullMethodName {
+		return err
+	}
+	retry, refreshErr := a.c.refresh(ctx, token)
+	if refreshErr != nil {
+		return refreshErr
+	}
+	if !retry {
+		return err
+	}
+	return a.c.cc.Invoke(ctx, method, args, reply, append(opts, a.c.callCredentials(a.c.Token()))...)
+}
+
+func (a *authConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return a.c.cc.NewStream(ctx, desc, method, append(opts, a.c.callCredentials(a.c.Token()))...)
+}
@@ -0,0 +1,199 @@
+//go:build unit_test
+
+package chatclient
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeServer logs in alice with the password "secret" and the token "good".
+// Its Chat stream fails the first failures streams with failCode, then echoes
+// the lines it receives.
+type fakeServer struct {
+	pb.UnimplementedChatServiceServer
+	logins   atomic.Int32
+	failures int32
+	failCode codes.Code
+	calls    atomic.Int32
+	events   []*pb.Event
+}
+
+// authenticate checks that ctx carries the token "good".
+func authenticate(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if auth := md.Get("authorization"); len(auth) == 0 || auth[0] != "bearer good" {
+		return status.Errorf(codes.Unauthenticated, "invalid auth token")
+	}
+	return nil
+}
+
+func (s *fakeServer) LogInOrRegister(_ context.Context, req *pb.LogInOrRegisterRequest) (*pb.LogInOrRegisterResponse, error) {
+	if req.GetUsername() != "alice" || req.GetPassword() != "secret" {
+		return nil, status.Errorf(codes.Unauthenticated, "incorrect password")
+	}
+	s.logins.Add(1)
+	return &pb.LogInOrRegisterResponse{Token: "good"}, nil
+}
+
+func (s *fakeServer) LogOut(ctx context.Context, _ *pb.LogOutRequest) (*pb.LogOutResponse, error) {
+	if err := authenticate(ctx); err != nil {
+		return nil, err
+	}
+	return nil, status.Errorf(codes.NotFound, "user: alice not found")
+}
+
+func (s *fakeServer) WhoAmI(ctx context.Context, _ *pb.WhoAmIRequest) (*pb.WhoAmIResponse, error) {
+	if err := authenticate(ctx); err != nil {
+		return nil, err
+	}
+	return &pb.WhoAmIResponse{Username: "alice"}, nil
+}
+
+func (s *fakeServer) Subscribe(_ *pb.SubscribeRequest, stream grpc.ServerStreamingServer[pb.Event]) error {
+	if err := authenticate(stream.Context()); err != nil {
+		return err
+	}
+	for _, evt := range s.events {
+		if err := stream.Send(evt); err != nil {
+			return err
+		}
+	}
+	return status.Errorf(codes.Unavailable, "server is shutting down")
+}
+
+func (s *fakeServer) Chat(stream grpc.BidiStreamingServer[pb.ChatRequest, pb.ChatResponse]) error {
+	if err := authenticate(stream.Context()); err != nil {
+		return err
+	}
+	if s.calls.Add(1) <= s.failures {
+		return status.Errorf(s.failCode, "server is restarting")
+	}
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&pb.ChatResponse{Message: req.GetMessage()}); err != nil {
+			return err
+		}
+	}
+}
+
+// newTestClient returns a client of srv served over an in-memory connection.
+func newTestClient(t *testing.T, srv pb.ChatServiceServer, opts ...Option) *Client {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	pb.RegisterChatServiceServer(grpcServer, srv)
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return New(conn, opts...)
+}
+
+func TestLogIn(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option
+		wantCode codes.Code
+	}{
+		{name: "logged in", opts: []Option{WithCredentials("alice", Password("secret"))}, wantCode: codes.OK},
+		{name: "incorrect password", opts: []Option{WithCredentials("alice", Password("wrong"))}, wantCode: codes.Unauthenticated},
+		{name: "no credentials", wantCode: codes.FailedPrecondition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			var handled string
+			c := newTestClient(t, &fakeServer{}, append(tt.opts, WithTokenHandler(func(token string) { handled = token }))...)
+
+			err := c.LogIn(context.Background())
+			require.Equal(tt.wantCode, status.Code(err))
+			if tt.wantCode != codes.OK {
+				require.Empty(c.Token())
+				return
+			}
+			require.Equal("good", c.Token())
+			require.Equal("good", handled)
+
+			resp, err := c.RPC().WhoAmI(context.Background(), &pb.WhoAmIRequest{})
+			require.NoError(err)
+			require.Equal("alice", resp.GetUsername())
+		})
+	}
+}
+
+func TestRefreshRejectedToken(t *testing.T) {
+	require := require.New(t)
+	srv := &fakeServer{}
+	c := newTestClient(t, srv, WithToken("stale"), WithCredentials("alice", Password("secret")))
+
+	// The rejected call is retried after logging in again.
+	resp, err := c.RPC().WhoAmI(context.Background(), &pb.WhoAmIRequest{})
+	require.NoError(err)
+	require.Equal("alice", resp.GetUsername())
+	require.Equal("good", c.Token())
+
+	_, err = c.RPC().WhoAmI(context.Background(), &pb.WhoAmIRequest{})
+	require.NoError(err)
+	require.EqualValues(1, srv.logins.Load())
+
+	// Without credentials the error is returned.
+	c = newTestClient(t, srv, WithToken("stale"))
+	_, err = c.RPC().WhoAmI(context.Background(), &pb.WhoAmIRequest{})
+	require.Equal(codes.Unauthenticated, status.Code(err))
+}
+
+func TestLogOut(t *testing.T) {
+	require := require.New(t)
+	c := newTestClient(t, &fakeServer{}, WithToken("good"))
+
+	// Users unknown to the server are logged out already.
+	require.NoError(c.LogOut(context.Background()))
+	require.Empty(c.Token())
+	require.NoError(c.LogOut(context.Background()))
+}
+
+func TestSubscribe(t *testing.T) {
+	require := require.New(t)
+	srv := &fakeServer{events: []*pb.Event{
+		{Id: "1", Type: pb.EventType_EVENT_TYPE_USER_JOIN, Username: "bob"},
+		{Id: "2", Type: pb.EventType_EVENT_TYPE_USER_LEAVE, Username: "bob"},
+	}}
+	c := newTestClient(t, srv, WithToken("good"))
+
+	sub, err := c.Subscribe(context.Background(), &pb.SubscribeRequest{})
+	require.NoError(err)
+	var ids []string
+	for evt := range sub.Events() {
+		ids = append(ids, evt.GetId())
+	}
+	require.Equal([]string{"1", "2"}, ids)
+	require.Equal(codes.Unavailable, status.Code(sub.Err()))
+}
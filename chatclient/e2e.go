@@ -0,0 +1,250 @@
+package chatclient
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+)
+
+// End-to-end encrypted direct messages are encrypted by AES-256-GCM with a random
+// message key, bound to their sender and recipient. The message key is wrapped for
+// every device of the recipient and of the sender: an ephemeral X25519 key agrees
+// on a secret with the device key, from which HKDF-SHA256 derives the AES-256-GCM
+// key sealing the message key. The server only relays and stores the ciphertext
+// and the wrapped keys.
+const (
+	// messageAAD prefixes the additional data of the ciphertexts of messages.
+	messageAAD = "grpc-go-chatroom e2e v1\x00"
+	// wrapInfo is the HKDF info of the keys wrapping message keys.
+	wrapInfo = "grpc-go-chatroom e2e v1 key wrap"
+	// messageKeySize is the size of the AES-256 keys of messages.
+	messageKeySize = 32
+)
+
+// ErrNoDeviceKey is returned by Decrypt for messages not encrypted for the device.
+var ErrNoDeviceKey = errors.New("the message is not encrypted for this device")
+
+// DeviceKey is the X25519 key pair of a device, registered with the server by
+// Client.RegisterDeviceKey. The private key never leaves the device.
+type DeviceKey struct {
+	// ID identifies the device among the devices of the user.
+	ID string
+	// PrivateKey is the X25519 private key of the device.
+	PrivateKey *ecdh.PrivateKey
+}
+
+// GenerateDeviceKey returns a new device key, whose ID is derived from its public key.
+func GenerateDeviceKey() (*DeviceKey, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key.PublicKey().Bytes())
+	return &DeviceKey{ID: hex.EncodeToString(sum[:8]), PrivateKey: key}, nil
+}
+
+// NewDeviceKey returns the device key of id with the X25519 private key privateKey,
+// e.g. one loaded from a file.
+func NewDeviceKey(id string, privateKey []byte) (*DeviceKey, error) {
+	key, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &DeviceKey{ID: id, PrivateKey: key}, nil
+}
+
+// PublicKey returns the X25519 public key of the device.
+func (k *DeviceKey) PublicKey() []byte {
+	return k.PrivateKey.PublicKey().Bytes()
+}
+
+// Encrypt encrypts text from sender to recipient for the devices of the users in
+// devices, keyed by username. It returns the ciphertext and the wrapped keys of a
+// MESSAGE_TYPE_ENCRYPTED message.
+func Encrypt(sender, recipient, text string, devices map[string][]*pb.DeviceKey) ([]byte, []*pb.WrappedKey, error) {
+	messageKey := make([]byte, messageKeySize)
+	if _, err := io.ReadFull(rand.Reader, messageKey); err != nil {
+		return nil, nil, err
+	}
+	aead, err := newGCM(messageKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+	ciphertext := aead.Seal(nonce, nonce, []byte(text), messageAdditionalData(sender, recipient))
+
+	var keys []*pb.WrappedKey
+	for username, userDevices := range devices {
+		for _, device := range userDevices {
+			key, err := wrapKey(messageKey, username, device)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to wrap the key for device %s of %s: %w", device.GetDeviceId(), username, err)
+			}
+			keys = append(keys, key)
+		}
+	}
+	return ciphertext, keys, nil
+}
+
+// Decrypt returns the text of the encrypted msg received by the device of username
+// with key. It returns ErrNoDeviceKey if msg was not encrypted for the device.
+func Decrypt(msg *pb.Message, username string, key *DeviceKey) (string, error) {
+	var wrapped *pb.WrappedKey
+	for _, k := range msg.GetWrappedKeys() {
+		if k.GetUsername() == username && k.GetDeviceId() == key.ID {
+			wrapped = k
+			break
+		}
+	}
+	if wrapped == nil {
+		return "", ErrNoDeviceKey
+	}
+	messageKey, err := unwrapKey(wrapped, key)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := newGCM(messageKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext := msg.GetBinaryContent()
+	if len(ciphertext) < aead.NonceSize() {
+		return "", errors.New("the ciphertext is too short")
+	}
+	text, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():],
+		messageAdditionalData(msg.GetUsername(), msg.GetRecipient()))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt the message: %w", err)
+	}
+	return string(text), nil
+}
+
+// messageAdditionalData binds the ciphertext of a message to its sender and recipient.
+func messageAdditionalData(sender, recipient string) []byte {
+	return []byte(messageAAD + sender + "\x00" + recipient)
+}
+
+// wrapKey seals messageKey for the device of username.
+func wrapKey(messageKey []byte, username string, device *pb.DeviceKey) (*pb.WrappedKey, error) {
+	devicePublic, err := ecdh.X25519().NewPublicKey(device.GetPublicKey())
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := wrapCipher(ephemeral, devicePublic, ephemeral.PublicKey().Bytes(), device.GetPublicKey())
+	if err != nil {
+		return nil, err
+	}
+	// The wrapping key is used once, as its ephemeral key is, so a zero nonce is safe.
+	nonce := make([]byte, aead.NonceSize())
+	return &pb.WrappedKey{
+		Username:           username,
+		DeviceId:           device.GetDeviceId(),
+		EphemeralPublicKey: ephemeral.PublicKey().Bytes(),
+		WrappedKey:         aead.Seal(nil, nonce, messageKey, []byte(username+"\x00"+device.GetDeviceId())),
+	}, nil
+}
+
+// unwrapKey opens the message key wrapped for the device of key.
+func unwrapKey(wrapped *pb.WrappedKey, key *DeviceKey) ([]byte, error) {
+	ephemeralPublic, err := ecdh.X25519().NewPublicKey(wrapped.GetEphemeralPublicKey())
+	if err != nil {
+		return nil, fmt.Errorf("invalid ephemeral key: %w", err)
+	}
+	aead, err := wrapCipher(key.PrivateKey, ephemeralPublic, wrapped.GetEphemeralPublicKey(), key.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	messageKey, err := aead.Open(nil, nonce, wrapped.GetWrappedKey(), []byte(wrapped.GetUsername()+"\x00"+wrapped.GetDeviceId()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap the message key: %w", err)
+	}
+	return messageKey, nil
+}
+
+// wrapCipher returns the AES-256-GCM cipher wrapping message keys, keyed by the
+// X25519 shared secret of private and public, and salted with both public keys.
+func wrapCipher(private *ecdh.PrivateKey, public *ecdh.PublicKey, ephemeralPublic, devicePublic []byte) (cipher.AEAD, error) {
+	secret, err := private.ECDH(public)
+	if err != nil {
+		return nil, err
+	}
+	salt := append(append([]byte{}, ephemeralPublic...), devicePublic...)
+	wrappingKey := make([]byte, messageKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(wrapInfo)), wrappingKey); err != nil {
+		return nil, err
+	}
+	return newGCM(wrappingKey)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// RegisterDeviceKey registers the public key of the device of key with the
+// server, so that encrypted messages to the user are encrypted for it too.
+func (c *Client) RegisterDeviceKey(ctx context.Context, key *DeviceKey) error {
+	_, err := c.rpc.RegisterDeviceKey(ctx, &pb.RegisterDeviceKeyRequest{DeviceId: key.ID, PublicKey: key.PublicKey()})
+	return err
+}
+
+// SendEncrypted sends text to recipient as an end-to-end encrypted message,
+// encrypted for the devices of recipient and of the user, so that the user's
+// other devices can read it too. It fails with FailedPrecondition if recipient
+// has not registered any device.
+func (c *Client) SendEncrypted(ctx context.Context, recipient, text string) (*pb.Message, error) {
+	sender := c.username
+	if sender == "" {
+		resp, err := c.rpc.WhoAmI(ctx, &pb.WhoAmIRequest{})
+		if err != nil {
+			return nil, err
+		}
+		sender = resp.GetUsername()
+	}
+	devices := map[string][]*pb.DeviceKey{}
+	for _, username := range []string{recipient, sender} {
+		resp, err := c.rpc.GetUserKeys(ctx, &pb.GetUserKeysRequest{Username: username})
+		if err != nil {
+			return nil, err
+		}
+		devices[username] = resp.GetKeys()
+	}
+	if len(devices[recipient]) == 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "%s has not registered any device for encrypted messages", recipient)
+	}
+
+	ciphertext, keys, err := Encrypt(sender, recipient, text, devices)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.rpc.PostMessage(ctx, &pb.PostMessageRequest{Recipient: recipient, BinaryContent: ciphertext, WrappedKeys: keys})
+	if err != nil {
+		return nil, err
+	}
+	return resp.GetMessage(), nil
+}
@@ -0,0 +1,141 @@
+//go:build unit_test
+
+package chatclient
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// keyServer keeps the device keys registered by alice, and the encrypted messages
+// posted to it.
+type keyServer struct {
+	fakeServer
+	keys   map[string][]*pb.DeviceKey
+	posted []*pb.PostMessageRequest
+}
+
+func (s *keyServer) RegisterDeviceKey(ctx context.Context, req *pb.RegisterDeviceKeyRequest) (*pb.RegisterDeviceKeyResponse, error) {
+	if err := authenticate(ctx); err != nil {
+		return nil, err
+	}
+	key := &pb.DeviceKey{DeviceId: req.GetDeviceId(), PublicKey: req.GetPublicKey()}
+	s.keys["alice"] = append(s.keys["alice"], key)
+	return &pb.RegisterDeviceKeyResponse{Key: key}, nil
+}
+
+func (s *keyServer) GetUserKeys(ctx context.Context, req *pb.GetUserKeysRequest) (*pb.GetUserKeysResponse, error) {
+	if err := authenticate(ctx); err != nil {
+		return nil, err
+	}
+	keys, ok := s.keys[req.GetUsername()]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "user: %s not found", req.GetUsername())
+	}
+	return &pb.GetUserKeysResponse{Keys: keys}, nil
+}
+
+func (s *keyServer) PostMessage(ctx context.Context, req *pb.PostMessageRequest) (*pb.PostMessageResponse, error) {
+	if err := authenticate(ctx); err != nil {
+		return nil, err
+	}
+	s.posted = append(s.posted, req)
+	return &pb.PostMessageResponse{Message: &pb.Message{
+		Type: pb.MessageType_MESSAGE_TYPE_ENCRYPTED, Username: "alice", Recipient: req.GetRecipient(),
+		BinaryContent: req.GetBinaryContent(), WrappedKeys: req.GetWrappedKeys(),
+	}}, nil
+}
+
+// mustGenerateDeviceKey returns a new device key and its registration.
+func mustGenerateDeviceKey(t *testing.T) (*DeviceKey, *pb.DeviceKey) {
+	t.Helper()
+	key, err := GenerateDeviceKey()
+	require.NoError(t, err)
+	return key, &pb.DeviceKey{DeviceId: key.ID, PublicKey: key.PublicKey()}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	require := require.New(t)
+	aliceLaptop, aliceLaptopPub := mustGenerateDeviceKey(t)
+	bobPhone, bobPhonePub := mustGenerateDeviceKey(t)
+	bobLaptop, bobLaptopPub := mustGenerateDeviceKey(t)
+	mallory, _ := mustGenerateDeviceKey(t)
+
+	ciphertext, keys, err := Encrypt("alice", "bob", "meet me at noon", map[string][]*pb.DeviceKey{
+		"alice": {aliceLaptopPub},
+		"bob":   {bobPhonePub, bobLaptopPub},
+	})
+	require.NoError(err)
+	require.Len(keys, 3)
+	require.NotContains(string(ciphertext), "noon")
+	msg := &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_ENCRYPTED, Username: "alice", Recipient: "bob", BinaryContent: ciphertext, WrappedKeys: keys}
+
+	// Every device of both users reads it
+	for _, device := range []struct {
+		username string
+		key      *DeviceKey
+	}{{"bob", bobPhone}, {"bob", bobLaptop}, {"alice", aliceLaptop}} {
+		text, err := Decrypt(msg, device.username, device.key)
+		require.NoError(err)
+		require.Equal("meet me at noon", text)
+	}
+
+	_, err = Decrypt(msg, "mallory", mallory)
+	require.ErrorIs(err, ErrNoDeviceKey)
+	// A device claiming the ID of another cannot unwrap its key
+	_, err = Decrypt(msg, "bob", &DeviceKey{ID: bobPhone.ID, PrivateKey: mallory.PrivateKey})
+	require.ErrorContains(err, "failed to unwrap the message key")
+
+	// The ciphertext is bound to its sender and recipient
+	forged := &pb.Message{Username: "carol", Recipient: "bob", BinaryContent: ciphertext, WrappedKeys: keys}
+	_, err = Decrypt(forged, "bob", bobPhone)
+	require.ErrorContains(err, "failed to decrypt the message")
+}
+
+func TestNewDeviceKey(t *testing.T) {
+	require := require.New(t)
+	key, _ := mustGenerateDeviceKey(t)
+	require.Len(key.ID, 16)
+
+	loaded, err := NewDeviceKey(key.ID, key.PrivateKey.Bytes())
+	require.NoError(err)
+	require.Equal(key.PublicKey(), loaded.PublicKey())
+	_, err = NewDeviceKey("laptop", []byte("short"))
+	require.Error(err)
+}
+
+func TestSendEncrypted(t *testing.T) {
+	require := require.New(t)
+	bobPhone, bobPhonePub := mustGenerateDeviceKey(t)
+	aliceLaptop, _ := mustGenerateDeviceKey(t)
+	srv := &keyServer{keys: map[string][]*pb.DeviceKey{"bob": {bobPhonePub}, "carol": {}}}
+	c := newTestClient(t, srv, WithCredentials("alice", Password("secret")))
+	ctx := context.Background()
+	require.NoError(c.LogIn(ctx))
+	require.NoError(c.RegisterDeviceKey(ctx, aliceLaptop))
+
+	msg, err := c.SendEncrypted(ctx, "bob", "hi bob")
+	require.NoError(err)
+	require.Len(srv.posted, 1)
+	require.Empty(srv.posted[0].GetTextContent())
+	require.Len(srv.posted[0].GetWrappedKeys(), 2)
+	for _, device := range []struct {
+		username string
+		key      *DeviceKey
+	}{{"bob", bobPhone}, {"alice", aliceLaptop}} {
+		text, err := Decrypt(msg, device.username, device.key)
+		require.NoError(err)
+		require.Equal("hi bob", text)
+	}
+
+	_, err = c.SendEncrypted(ctx, "carol", "hi carol")
+	require.Equal(codes.FailedPrecondition, status.Code(err))
+	_, err = c.SendEncrypted(ctx, "dave", "hi dave")
+	require.Equal(codes.NotFound, status.Code(err))
+	require.Len(srv.posted, 1)
+}
@@ -0,0 +1,408 @@
+package chatclient
+
+import (
+	"context"
+	"io"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+)
+
+// State is the state of the connection of a Session.
+type State int
+
+const (
+	// Connected means the session joined the chatroom, for the first time or again.
+	Connected State = iota
+	// Disconnected means the stream dropped and the session reconnects after a delay.
+	Disconnected
+)
+
+func (s State) String() string {
+	switch s {
+	case Connected:
+		return "connected"
+	case Disconnected:
+		return "disconnected"
+	default:
+		return "unknown"
+	}
+}
+
+// StateChange is a change of the connection of a Session.
+type StateChange struct {
+	State State
+	// Reconnected is set for Connected after a drop.
+	Reconnected bool
+	// Err is why the stream dropped, and RetryIn the delay before the next
+	// attempt, for Disconnected.
+	Err     error
+	RetryIn time.Duration
+}
+
+const (
+	// messageBuffer is the number of messages a Session buffers for a slow reader.
+	messageBuffer = 64
+	// stateBuffer is the number of state changes buffered, later ones are dropped.
+	stateBuffer = 16
+	// defaultRoom is the room the server puts every new chat stream in.
+	defaultRoom = "general"
+	// historyPage is the number of messages asked for by a GetHistory call catching up.
+	historyPage = 100
+	// maxCatchUp is the maximum number of missed messages fetched after reconnecting,
+	// older ones are skipped.
+	maxCatchUp = 1000
+)
+
+// Session is a chat stream kept open by Client.Chat, which reconnects with
+// exponential backoff when the connection drops, unless the client is created
+// WithoutReconnect. Lines are queued until a stream accepts them, so that lines
+// sent while disconnected are sent after reconnecting. After reconnecting, the
+// session joins its room again and fetches the messages of the room broadcast
+// while it was disconnected from the history, before any newer message. Private
+// and encrypted messages are not kept in the history, those are lost.
+//
+// A session ends when it is closed and the server ended the stream, its context
+// is done, or the stream fails with an error that is not worth retrying, e.g. the
+// user was kicked. Messages and States are then closed, and Err tells why.
+type Session struct {
+	c *Client
+
+	messages chan *pb.Message
+	states   chan StateChange
+	done     chan struct{}
+	err      error
+
+	// last and room are only used by the receiving goroutine of the current stream.
+	last uint64 // the number of the last message sent to messages
+	room string // the room of the session, as told by the last room message
+
+	mu      sync.Mutex
+	pending []string      // lines not accepted by a stream yet
+	closed  bool          // no more lines will be sent
+	wake    chan struct{} // signals pending or closed changed
+}
+
+// Chat opens a chat session, which runs until ctx is done or it ends otherwise.
+func (c *Client) Chat(ctx context.Context) *Session {
+	s := &Session{
+		c:        c,
+		messages: make(chan *pb.Message, messageBuffer),
+		states:   make(chan StateChange, stateBuffer),
+		done:     make(chan struct{}),
+		wake:     make(chan struct{}, 1),
+	}
+	go func() {
+		s.err = s.run(ctx)
+		close(s.messages)
+		close(s.states)
+		close(s.done)
+	}()
+	return s
+}
+
+// Messages returns the channel of the messages from the server. It must be
+// drained, or the session stops receiving.
+func (s *Session) Messages() <-chan *pb.Message {
+	return s.messages
+}
+
+// States returns the channel of the connection changes. Changes are dropped
+// when it is full, so it needs not be read.
+func (s *Session) States() <-chan StateChange {
+	return s.states
+}
+
+// Done returns a channel closed when the session ended.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why the session ended, nil if it was closed or its context is done.
+// It must be called after Done is closed.
+func (s *Session) Err() error {
+	return s.err
+}
+
+// Send queues text, a message or a slash command, to be sent to the server.
+func (s *Session) Send(text string) {
+	s.mu.Lock()
+	s.pending = append(s.pending, text)
+	s.mu.Unlock()
+	s.notify()
+}
+
+// Close ends the session once the queued lines are sent.
+func (s *Session) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.notify()
+}
+
+func (s *Session) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default: // a wake up is already pending
+	}
+}
+
+func (s *Session) setState(change StateChange) {
+	select {
+	case s.states <- change:
+	default: // nobody is listening
+	}
+}
+
+// receive sends the messages of a stream to Messages until it fails. A resuming
+// stream first catches up with the missed messages, once it joined the room again
+// if rejoin is set, as told by the first system message, the reply to `/join`.
+// Meanwhile, the other messages of the default room are dropped.
+func (s *Session) receive(ctx context.Context, recv func() (*pb.ChatResponse, error), resuming, rejoin bool) error {
+	// Direct messages received before catching up are newer than the missed ones.
+	since := s.last
+	if resuming && !rejoin {
+		if err := s.catchUp(ctx, since); err != nil {
+			return err
+		}
+		resuming = false
+	}
+	for {
+		resp, err := recv()
+		if err != nil {
+			return err
+		}
+		msg := resp.GetMessage()
+		if resuming {
+			if msg.GetType() != pb.MessageType_MESSAGE_TYPE_SYSTEM {
+				if isDirectMessage(msg) {
+					if err := s.deliver(ctx, msg); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if err := s.catchUp(ctx, since); err != nil {
+				return err
+			}
+			resuming = false
+		}
+		// Messages fetched by catchUp may be received again.
+		if msg.GetMessageNumber() != 0 && msg.GetMessageNumber() <= s.last {
+			continue
+		}
+		if err := s.deliver(ctx, msg); err != nil {
+			return err
+		}
+	}
+}
+
+// deliver sends msg to Messages, and records the last message and the room.
+func (s *Session) deliver(ctx context.Context, msg *pb.Message) error {
+	select {
+	case s.messages <- msg:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if msg.GetMessageNumber() > s.last {
+		s.last = msg.GetMessageNumber()
+	}
+	if msg.GetRoom() != "" && !isDirectMessage(msg) {
+		s.room = msg.GetRoom()
+	}
+	return nil
+}
+
+// catchUp sends the messages of the room of the session with a number greater than
+// since to Messages, paging back through the history.
+func (s *Session) catchUp(ctx context.Context, since uint64) error {
+	room := s.room
+	if room == "" {
+		room = defaultRoom
+	}
+	var missed []*pb.Message
+	var before uint64
+	for len(missed) < maxCatchUp {
+		resp, err := s.c.rpc.GetHistory(ctx, &pb.GetHistoryRequest{Room: room, Limit: historyPage, Before: before})
+		if err != nil {
+			return err
+		}
+		page := resp.GetMessages()
+		i := sort.Search(len(page), func(i int) bool { return page[i].GetMessageNumber() > since })
+		missed = append(page[i:], missed...)
+		if i > 0 || len(page) < historyPage {
+			break
+		}
+		before = page[0].GetMessageNumber()
+	}
+
+	username := s.c.Username()
+	for _, msg := range missed {
+		// The client shows the lines of the user when they are sent.
+		if msg.GetType() == pb.MessageType_MESSAGE_TYPE_NORMAL && msg.GetUsername() == username {
+			s.last = max(s.last, msg.GetMessageNumber())
+			continue
+		}
+		if err := s.deliver(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isDirectMessage reports whether msg is a private or encrypted message to a single recipient.
+func isDirectMessage(msg *pb.Message) bool {
+	return msg.GetType() == pb.MessageType_MESSAGE_TYPE_PRIVATE || msg.GetType() == pb.MessageType_MESSAGE_TYPE_ENCRYPTED
+}
+
+// backoff returns the delay before the reconnect following attempt, with jitter so
+// that clients dropped together don't reconnect together.
+func (s *Session) backoff(attempt int) time.Duration {
+	delay := s.c.initialBackoff << (attempt - 1)
+	if delay <= 0 || delay > s.c.maxBackoff {
+		delay = s.c.maxBackoff
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// retryable reports whether err of a Chat stream is worth reconnecting after, e.g.
+// a network drop or a server restart, rather than a rejected login or a kick.
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Internal, codes.Unknown, codes.DeadlineExceeded:
+		return true
+	default:
+		return false
+	}
+}
+
+// run keeps the session connected until it ends.
+func (s *Session) run(ctx context.Context) error {
+	attempt := 0
+	refreshed := false
+	for {
+		stale := s.c.Token()
+		err := s.stream(ctx, func() {
+			s.setState(StateChange{State: Connected, Reconnected: attempt > 0})
+			attempt, refreshed = 0, false
+		})
+		if err == nil || ctx.Err() != nil {
+			return nil
+		}
+		if status.Code(err) == codes.Unauthenticated && !refreshed {
+			// Log in again and reconnect right away, if the client can.
+			retry, refreshErr := s.c.refresh(ctx, stale)
+			if refreshErr != nil {
+				return refreshErr
+			}
+			if retry {
+				refreshed = true
+				continue
+			}
+		}
+		if !s.c.reconnect || !retryable(err) {
+			return err
+		}
+		attempt++
+		delay := s.backoff(attempt)
+		s.setState(StateChange{State: Disconnected, Err: err, RetryIn: delay})
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// stream runs one Chat stream, calling connected once the server accepted it. It
+// returns nil if the stream ended after the session was closed.
+func (s *Session) stream(ctx context.Context, connected func()) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := s.c.rpc.Chat(ctx)
+	if err != nil {
+		return err
+	}
+	// The server sends the header once the user joined. Nothing is sent before, so
+	// that no line is lost in a stream that is rejected right away, whose error is
+	// returned by Recv.
+	md, err := stream.Header()
+	if err != nil {
+		return err
+	}
+	if md == nil {
+		if _, err := stream.Recv(); err != io.EOF {
+			return err
+		}
+		return status.Errorf(codes.Unavailable, "the server closed the stream")
+	}
+	connected()
+	// The server put the stream in the default room, the user left it before.
+	resuming := s.last != 0
+	rejoin := resuming && s.room != "" && s.room != defaultRoom
+	if rejoin {
+		s.mu.Lock()
+		s.pending = append([]string{"/join " + s.room}, s.pending...)
+		s.mu.Unlock()
+	}
+
+	recvErr := make(chan error, 1)
+	recvDone := make(chan struct{})
+	// The receiving goroutine must be gone before the session closes Messages.
+	defer func() {
+		cancel()
+		<-recvDone
+	}()
+	go func() {
+		defer close(recvDone)
+		recvErr <- s.receive(ctx, stream.Recv, resuming, rejoin)
+	}()
+
+	// Lines queued while disconnected are sent right away.
+	s.notify()
+	closeSent := false
+	for {
+		select {
+		case err := <-recvErr:
+			if err != io.EOF {
+				return err
+			}
+			if !closeSent {
+				return status.Errorf(codes.Unavailable, "the server closed the stream")
+			}
+			return nil
+		case <-s.wake:
+		}
+
+		for {
+			s.mu.Lock()
+			if len(s.pending) == 0 {
+				closed := s.closed
+				s.mu.Unlock()
+				if closed && !closeSent {
+					stream.CloseSend()
+					closeSent = true
+				}
+				break
+			}
+			text := s.pending[0]
+			s.mu.Unlock()
+
+			msg := &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_NORMAL, TextContent: text}
+			if err := stream.Send(&pb.ChatRequest{Message: msg}); err != nil {
+				// The line stays queued, and the cause is returned by Recv.
+				break
+			}
+			s.mu.Lock()
+			s.pending = s.pending[1:]
+			s.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,216 @@
+//go:build unit_test
+
+package chatclient
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestSessionBackoff(t *testing.T) {
+	s := &Session{c: &Client{initialBackoff: time.Second, maxBackoff: 5 * time.Second}}
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 100: 5 * time.Second} {
+		delay := s.backoff(attempt)
+		require.GreaterOrEqual(t, delay, want/2)
+		require.LessOrEqual(t, delay, want)
+	}
+}
+
+func TestSessionReconnect(t *testing.T) {
+	require := require.New(t)
+	c := newTestClient(t, &fakeServer{failures: 2, failCode: codes.Unavailable},
+		WithToken("good"), WithReconnectBackoff(time.Millisecond, 5*time.Millisecond))
+
+	session := c.Chat(context.Background())
+	// Lines sent while disconnected are sent after reconnecting
+	session.Send("hello")
+
+	change := <-session.States()
+	require.Equal(Disconnected, change.State)
+	require.Contains(change.Err.Error(), "server is restarting")
+	require.Equal(Disconnected, (<-session.States()).State)
+	require.Equal(StateChange{State: Connected, Reconnected: true}, <-session.States())
+
+	require.Equal("hello", (<-session.Messages()).GetTextContent())
+	session.Send("bye")
+	require.Equal("bye", (<-session.Messages()).GetTextContent())
+	session.Close()
+	<-session.Done()
+	require.NoError(session.Err())
+
+	// The channels are closed once the session ended.
+	_, ok := <-session.Messages()
+	require.False(ok)
+}
+
+func TestSessionEnds(t *testing.T) {
+	tests := []struct {
+		name     string
+		srv      *fakeServer
+		opts     []Option
+		wantCode codes.Code
+	}{
+		{
+			name:     "not retryable",
+			srv:      &fakeServer{failures: 1, failCode: codes.Aborted},
+			opts:     []Option{WithToken("good")},
+			wantCode: codes.Aborted,
+		},
+		{
+			name:     "without reconnect",
+			srv:      &fakeServer{failures: 1, failCode: codes.Unavailable},
+			opts:     []Option{WithToken("good"), WithoutReconnect()},
+			wantCode: codes.Unavailable,
+		},
+		{
+			name:     "rejected token without credentials",
+			srv:      &fakeServer{},
+			opts:     []Option{WithToken("stale")},
+			wantCode: codes.Unauthenticated,
+		},
+		{
+			name:     "rejected password",
+			srv:      &fakeServer{},
+			opts:     []Option{WithToken("stale"), WithCredentials("alice", Password("wrong"))},
+			wantCode: codes.Unauthenticated,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newTestClient(t, tt.srv, tt.opts...).Chat(context.Background())
+			<-session.Done()
+			require.Equal(t, tt.wantCode, status.Code(session.Err()))
+		})
+	}
+}
+
+func TestSessionLogsInAgain(t *testing.T) {
+	require := require.New(t)
+	srv := &fakeServer{}
+	c := newTestClient(t, srv, WithToken("stale"), WithCredentials("alice", Password("secret")))
+
+	session := c.Chat(context.Background())
+	require.Equal(StateChange{State: Connected}, <-session.States())
+	require.EqualValues(1, srv.logins.Load())
+	require.Equal("good", c.Token())
+	session.Close()
+	<-session.Done()
+	require.NoError(session.Err())
+}
+
+func TestSessionCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	session := newTestClient(t, &fakeServer{}, WithToken("good")).Chat(ctx)
+	require.Equal(t, Connected, (<-session.States()).State)
+	cancel()
+	<-session.Done()
+	require.NoError(t, session.Err())
+}
+
+// resumeServer drops the first Chat stream of alice in #random, while messages
+// keep being broadcast, and serves them from the history to the next stream.
+type resumeServer struct {
+	fakeServer
+	mu      sync.Mutex
+	history []*pb.Message
+	streams int
+}
+
+func (s *resumeServer) broadcast(msgs ...*pb.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history = append(s.history, msgs...)
+}
+
+func (s *resumeServer) GetHistory(ctx context.Context, req *pb.GetHistoryRequest) (*pb.GetHistoryResponse, error) {
+	if err := authenticate(ctx); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res []*pb.Message
+	for _, msg := range s.history {
+		if msg.GetRoom() == req.GetRoom() && (req.GetBefore() == 0 || msg.GetMessageNumber() < req.GetBefore()) {
+			res = append(res, msg)
+		}
+	}
+	if len(res) > int(req.GetLimit()) {
+		res = res[len(res)-int(req.GetLimit()):]
+	}
+	return &pb.GetHistoryResponse{Messages: res}, nil
+}
+
+func (s *resumeServer) Chat(stream grpc.BidiStreamingServer[pb.ChatRequest, pb.ChatResponse]) error {
+	if err := authenticate(stream.Context()); err != nil {
+		return err
+	}
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	send := func(msg *pb.Message) error { return stream.Send(&pb.ChatResponse{Message: msg}) }
+	s.mu.Lock()
+	s.streams++
+	first := s.streams == 1
+	s.mu.Unlock()
+
+	if first {
+		send(&pb.Message{Type: pb.MessageType_MESSAGE_TYPE_SYSTEM, Room: "random", TextContent: "you joined #random"})
+		one := &pb.Message{MessageNumber: 1, Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Room: "random", Username: "bob", TextContent: "one"}
+		s.broadcast(one)
+		send(one)
+		// Broadcast while alice is disconnected, her own line is shown by her client
+		s.broadcast(
+			&pb.Message{MessageNumber: 2, Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Room: "random", Username: "bob", TextContent: "two"},
+			&pb.Message{MessageNumber: 3, Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Room: "random", Username: "alice", TextContent: "mine"},
+			&pb.Message{MessageNumber: 4, Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Room: "general", Username: "carol", TextContent: "elsewhere"},
+		)
+		return status.Errorf(codes.Unavailable, "server is restarting")
+	}
+
+	// The new stream is in #general until it joins #random again
+	send(&pb.Message{MessageNumber: 5, Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Room: "general", Username: "carol", TextContent: "not for alice"})
+	send(&pb.Message{MessageNumber: 6, Type: pb.MessageType_MESSAGE_TYPE_PRIVATE, Room: "general", Username: "carol", Recipient: "alice", TextContent: "psst"})
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if req.GetMessage().GetTextContent() != "/join random" {
+		return status.Errorf(codes.InvalidArgument, "unexpected line %q", req.GetMessage().GetTextContent())
+	}
+	// Broadcast after joining, before the history is fetched, so received twice
+	seven := &pb.Message{MessageNumber: 7, Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Room: "random", Username: "bob", TextContent: "seven"}
+	s.broadcast(seven)
+	send(&pb.Message{Type: pb.MessageType_MESSAGE_TYPE_SYSTEM, Room: "random", TextContent: "you joined #random"})
+	send(seven)
+	send(&pb.Message{MessageNumber: 8, Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Room: "random", Username: "bob", TextContent: "eight"})
+	<-stream.Context().Done()
+	return nil
+}
+
+func TestSessionResumes(t *testing.T) {
+	require := require.New(t)
+	c := newTestClient(t, &resumeServer{}, WithCredentials("alice", Password("secret")), WithReconnectBackoff(time.Millisecond, 5*time.Millisecond))
+	require.NoError(c.LogIn(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	session := c.Chat(ctx)
+	var texts []string
+	for msg := range session.Messages() {
+		texts = append(texts, msg.GetTextContent())
+		if msg.GetTextContent() == "eight" {
+			break
+		}
+	}
+	require.Equal([]string{"you joined #random", "one", "psst", "two", "seven", "you joined #random", "eight"}, texts)
+}
@@ -0,0 +1,53 @@
+package chatclient
+
+import (
+	"context"
+	"io"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+)
+
+// Subscription is a stream of the server's events, opened by Client.Subscribe.
+type Subscription struct {
+	events chan *pb.Event
+	err    error
+}
+
+// Subscribe streams the events selected by req until ctx is done or the stream
+// fails. Unlike chat sessions it does not reconnect, events are not replayed anyway.
+func (c *Client) Subscribe(ctx context.Context, req *pb.SubscribeRequest) (*Subscription, error) {
+	stream, err := c.rpc.Subscribe(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	sub := &Subscription{events: make(chan *pb.Event, messageBuffer)}
+	go func() {
+		defer close(sub.events)
+		for {
+			evt, err := stream.Recv()
+			if err != nil {
+				if ctx.Err() == nil && err != io.EOF {
+					sub.err = err
+				}
+				return
+			}
+			select {
+			case sub.events <- evt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
+
+// Events returns the channel of the events, closed when the stream ends.
+func (s *Subscription) Events() <-chan *pb.Event {
+	return s.events
+}
+
+// Err returns why the stream ended, nil if its context is done. It must be
+// called after Events is closed.
+func (s *Subscription) Err() error {
+	return s.err
+}
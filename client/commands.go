@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"github.com/zjy-dev/grpc-go-chatroom/chatclient"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/archive"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+)
+
+// Exit codes of the subcommands, mapped from the gRPC status codes so that scripts
+// can tell the failures apart.
+const (
+	exitError           = 1 // any other error
+	exitInvalidArgument = 2
+	exitUnauthenticated = 3
+	exitPermission      = 4
+	exitNotFound        = 5
+	exitRateLimited     = 6
+	exitUnavailable     = 7
+)
+
+// exitCode returns the exit code of err.
+func exitCode(err error) int {
+	switch status.Code(err) {
+	case codes.OK:
+		return 0
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return exitInvalidArgument
+	case codes.Unauthenticated:
+		return exitUnauthenticated
+	case codes.PermissionDenied:
+		return exitPermission
+	case codes.NotFound:
+		return exitNotFound
+	case codes.ResourceExhausted:
+		return exitRateLimited
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return exitUnavailable
+	default:
+		return exitError
+	}
+}
+
+// exit wraps err to make the app exit with the code of err.
+func exit(err error) error {
+	if err == nil {
+		return nil
+	}
+	return cli.Exit("error: "+status.Convert(err).Message(), exitCode(err))
+}
+
+var outputFlag = &cli.StringFlag{
+	Name:    "output",
+	Aliases: []string{"o"},
+	Value:   "text",
+	Usage:   "output format: text, or json for one JSON object per line",
+}
+
+var roomFlag = &cli.StringFlag{
+	Name:    "room",
+	Aliases: []string{"r"},
+	Usage:   "the room, general if empty",
+}
+
+// printer writes the results of a subcommand in the format chosen by --output.
+type printer struct {
+	w    io.Writer
+	json bool
+}
+
+func newPrinter(cCtx *cli.Context) (*printer, error) {
+	switch output := cCtx.String("output"); output {
+	case "text":
+		return &printer{w: os.Stdout}, nil
+	case "json":
+		return &printer{w: os.Stdout, json: true}, nil
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid --output %q, must be text or json", output)
+	}
+}
+
+// print writes m as JSON, or text otherwise. Empty text writes nothing.
+func (p *printer) print(m proto.Message, text string) error {
+	if p.json {
+		data, err := protojson.Marshal(m)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(p.w, "%s\n", data)
+		return err
+	}
+	if text == "" {
+		return nil
+	}
+	_, err := fmt.Fprintln(p.w, text)
+	return err
+}
+
+// subcommand is the action of a subcommand, run by a logged in client.
+type subcommand func(ctx context.Context, cCtx *cli.Context, client *chatclient.Client, out *printer) error
+
+// run connects and logs in, then calls action. Errors make the app exit with the
+// code of their gRPC status.
+func run(action subcommand) cli.ActionFunc {
+	return func(cCtx *cli.Context) error {
+		out, err := newPrinter(cCtx)
+		if err != nil {
+			return exit(err)
+		}
+		cfg, err := loadConfig(cCtx)
+		if err != nil {
+			return exit(status.Error(codes.InvalidArgument, err.Error()))
+		}
+		conn := mustDial(cfg.Server, cfg.TLS)
+		defer conn.Close()
+		client := newClient(conn, cfg)
+		if err := login(cCtx.Context, client); err != nil {
+			return exit(err)
+		}
+		if cfg.TokenCache == "" {
+			// Without the cache every run logs in, so don't leave the sessions behind.
+			defer client.LogOut(context.Background())
+		}
+
+		// Ctrl-C ends tail without an error.
+		ctx, stop := signal.NotifyContext(cCtx.Context, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		return exit(action(ctx, cCtx, client, out))
+	}
+}
+
+// commands returns the non-interactive subcommands.
+func commands() []*cli.Command {
+	return []*cli.Command{
+		{
+			Name:      "send",
+			Usage:     "send a message to a room",
+			ArgsUsage: "[text...], read from the standard input if empty or -",
+			Flags:     []cli.Flag{roomFlag, outputFlag},
+			Action:    run(send),
+		},
+		{
+			Name:      "dm",
+			Usage:     "send an end-to-end encrypted message to a user, readable on the devices registered by `keys register`",
+			ArgsUsage: "<user> [text...], the text read from the standard input if empty or -",
+			Flags:     []cli.Flag{outputFlag},
+			Action:    run(dm),
+		},
+		keysCommand(),
+		{
+			Name:  "tail",
+			Usage: "print the messages of rooms as they are sent, until interrupted",
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{Name: "room", Aliases: []string{"r"}, Usage: "the rooms to follow, all rooms if not set"},
+				outputFlag,
+			},
+			Action: run(tail),
+		},
+		{
+			Name:  "history",
+			Usage: "print the past messages of a room, oldest first",
+			Flags: []cli.Flag{
+				roomFlag,
+				&cli.UintFlag{Name: "limit", Value: 50, Usage: "the number of messages, at most 500"},
+				&cli.Uint64Flag{Name: "before", Usage: "only print messages with a smaller message number, for paging"},
+				outputFlag,
+			},
+			Action: run(history),
+		},
+		{
+			Name:   "whoami",
+			Usage:  "print the logged in user",
+			Flags:  []cli.Flag{outputFlag},
+			Action: run(whoami),
+		},
+		{
+			Name:   "rooms",
+			Usage:  "list the rooms",
+			Flags:  []cli.Flag{outputFlag},
+			Action: run(rooms),
+		},
+		{
+			Name:  "export",
+			Usage: "export the chat history to an archive, admin only",
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{Name: "room", Aliases: []string{"r"}, Usage: "the rooms to export, all rooms if not set"},
+				&cli.StringFlag{Name: "since", Usage: "only export the messages sent at or after this RFC 3339 time"},
+				&cli.StringFlag{Name: "until", Usage: "only export the messages sent before this RFC 3339 time"},
+				&cli.BoolFlag{Name: "private", Usage: "export the private and encrypted messages too"},
+				&cli.StringFlag{Name: "format", Value: string(archive.JSONLines), Usage: "archive format: jsonl, or mbox for mail clients"},
+				&cli.StringFlag{Name: "file", Aliases: []string{"f"}, Usage: "the archive file, the standard output if empty or -"},
+			},
+			Action: run(export),
+		},
+		{
+			Name:  "import",
+			Usage: "import an archive written by export, admin only, messages already imported are skipped",
+			Description: "The users of the archive who are not on the server are created without a password,\n" +
+				"so they can not log in with a password, only with a client certificate of their name.",
+			ArgsUsage: "[file], read from the standard input if empty or -",
+			Flags:     []cli.Flag{outputFlag},
+			Action:    run(importArchive),
+		},
+		{
+			Name:   "logout",
+			Usage:  "log out and forget the cached token",
+			Action: logout,
+		},
+	}
+}
+
+// argsOrStdin returns the text of a message in args, or in the standard input if
+// args are empty or -.
+func argsOrStdin(args []string) (string, error) {
+	text := strings.Join(args, " ")
+	if text == "" || text == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", err
+		}
+		text = strings.TrimRight(string(data), "\r\n")
+	}
+	if text == "" {
+		return "", status.Errorf(codes.InvalidArgument, "the message is empty")
+	}
+	return text, nil
+}
+
+// send posts the text in the arguments, or in the standard input.
+func send(ctx context.Context, cCtx *cli.Context, client *chatclient.Client, out *printer) error {
+	text, err := argsOrStdin(cCtx.Args().Slice())
+	if err != nil {
+		return err
+	}
+	resp, err := client.RPC().PostMessage(ctx, &pb.PostMessageRequest{TextContent: text, Room: cCtx.String("room")})
+	if err != nil {
+		return err
+	}
+	return out.print(resp.GetMessage(), "")
+}
+
+// tail prints the messages sent to the rooms until ctx is done.
+func tail(ctx context.Context, cCtx *cli.Context, client *chatclient.Client, out *printer) error {
+	sub, err := client.Subscribe(ctx, &pb.SubscribeRequest{
+		EventTypes: []pb.EventType{pb.EventType_EVENT_TYPE_MESSAGE},
+		Rooms:      cCtx.StringSlice("room"),
+	})
+	if err != nil {
+		return err
+	}
+	for evt := range sub.Events() {
+		if err := out.print(evt.GetMessage(), formatMessage(evt.GetMessage())); err != nil {
+			return err
+		}
+	}
+	return sub.Err()
+}
+
+// history prints the past messages of a room.
+func history(ctx context.Context, cCtx *cli.Context, client *chatclient.Client, out *printer) error {
+	resp, err := client.RPC().GetHistory(ctx, &pb.GetHistoryRequest{
+		Room:   cCtx.String("room"),
+		Limit:  uint32(cCtx.Uint("limit")),
+		Before: cCtx.Uint64("before"),
+	})
+	if err != nil {
+		return err
+	}
+	for _, msg := range resp.GetMessages() {
+		if err := out.print(msg, formatMessage(msg)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// export writes the archive streamed by ExportHistory. A failed export removes
+// the archive file.
+func export(ctx context.Context, cCtx *cli.Context, client *chatclient.Client, _ *printer) (err error) {
+	format, err := archive.ParseFormat(cCtx.String("format"))
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	req := &pb.ExportHistoryRequest{Rooms: cCtx.StringSlice("room"), IncludePrivate: cCtx.Bool("private")}
+	for _, flag := range []struct {
+		name string
+		unix *int64
+	}{{"since", &req.Since}, {"until", &req.Until}} {
+		if value := cCtx.String(flag.name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return status.Errorf(codes.InvalidArgument, "invalid --%s %q, must be an RFC 3339 time", flag.name, value)
+			}
+			*flag.unix = t.Unix()
+		}
+	}
+
+	stream, err := client.RPC().ExportHistory(ctx, req)
+	if err != nil {
+		return err
+	}
+	var f io.Writer = os.Stdout
+	if name := cCtx.String("file"); name != "" && name != "-" {
+		file, err := os.Create(name)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(name)
+			}
+		}()
+		f = file
+	}
+
+	w := archive.NewWriter(f, format)
+	for {
+		rec, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+		if err := w.Write(rec); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// importArchive streams the archive in the file of the first argument, or in the
+// standard input, to ImportHistory.
+func importArchive(ctx context.Context, cCtx *cli.Context, client *chatclient.Client, out *printer) error {
+	var in io.Reader = os.Stdin
+	if name := cCtx.Args().First(); name != "" && name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	// Canceling the stream keeps the server from importing a truncated archive.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.RPC().ImportHistory(ctx)
+	if err != nil {
+		return err
+	}
+	r := archive.NewReader(in)
+	for {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid %s archive: %v", r.Format(), err)
+		}
+		// The server ended the stream, CloseAndRecv returns its error.
+		if err := stream.Send(&pb.ImportHistoryRequest{Record: rec}); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	return out.print(resp, fmt.Sprintf("restored %d topic(s), created %d user(s), imported %d message(s), skipped %d message(s) already imported",
+		resp.GetTopicsRestored(), resp.GetUsersCreated(), resp.GetMessagesImported(), resp.GetMessagesSkipped()))
+}
+
+// whoami prints the logged in user.
+func whoami(ctx context.Context, _ *cli.Context, client *chatclient.Client, out *printer) error {
+	resp, err := client.RPC().WhoAmI(ctx, &pb.WhoAmIRequest{})
+	if err != nil {
+		return err
+	}
+	return out.print(resp, formatWhoAmI(resp))
+}
+
+// rooms prints the rooms, one JSON object per room with --output json.
+func rooms(ctx context.Context, _ *cli.Context, client *chatclient.Client, out *printer) error {
+	resp, err := client.RPC().ListRooms(ctx, &pb.ListRoomsRequest{})
+	if err != nil {
+		return err
+	}
+	if out.json {
+		for _, room := range resp.GetRooms() {
+			if err := out.print(room, ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(out.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ROOM\tUSERS\tTOPIC")
+	for _, room := range resp.GetRooms() {
+		fmt.Fprintf(w, "#%s\t%d\t%s\n", room.GetName(), room.GetUserCount(), room.GetTopic())
+	}
+	return w.Flush()
+}
+
+// formatWhoAmI formats the user described by resp as lines of the terminal.
+func formatWhoAmI(resp *pb.WhoAmIResponse) string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "username:\t%s\n", resp.GetUsername())
+	if resp.GetDisplayName() != "" {
+		fmt.Fprintf(w, "display name:\t%s\n", resp.GetDisplayName())
+	}
+	if resp.GetOnline() {
+		fmt.Fprintf(w, "online:\tyes, in #%s\n", resp.GetRoom())
+	} else {
+		fmt.Fprintf(w, "online:\tno\n")
+	}
+	if resp.GetBot() {
+		fmt.Fprintf(w, "bot:\tyes, scopes %s\n", strings.Join(resp.GetScopes(), ","))
+	}
+	if resp.GetAdmin() {
+		fmt.Fprintf(w, "admin:\tyes\n")
+	}
+	w.Flush()
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// logout ends the session of the user on the server and forgets the cached token.
+// Without a cached token there is nothing to do.
+func logout(cCtx *cli.Context) error {
+	cfg, err := loadConfig(cCtx)
+	if err != nil {
+		return exit(status.Error(codes.InvalidArgument, err.Error()))
+	}
+	cache := tokenCache{file: cfg.TokenCache}
+	address := cfg.Server.String()
+	if cache.load(address, username) == "" {
+		return nil
+	}
+
+	conn := mustDial(cfg.Server, cfg.TLS)
+	defer conn.Close()
+	if err := newClient(conn, cfg).LogOut(cCtx.Context); err != nil {
+		return exit(err)
+	}
+	return exit(cache.remove(address, username))
+}
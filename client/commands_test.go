@@ -0,0 +1,210 @@
+//go:build unit_test
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/chatclient"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{err: nil, want: 0},
+		{err: status.Error(codes.InvalidArgument, "bad"), want: exitInvalidArgument},
+		{err: status.Error(codes.Unauthenticated, "who"), want: exitUnauthenticated},
+		{err: status.Error(codes.PermissionDenied, "no"), want: exitPermission},
+		{err: status.Error(codes.NotFound, "gone"), want: exitNotFound},
+		{err: status.Error(codes.ResourceExhausted, "slow down"), want: exitRateLimited},
+		{err: status.Error(codes.Unavailable, "down"), want: exitUnavailable},
+		{err: status.Error(codes.Internal, "oops"), want: exitError},
+		{err: errors.New("plain"), want: exitError},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, exitCode(tt.err), "%v", tt.err)
+	}
+
+	var exitErr cli.ExitCoder
+	require.ErrorAs(t, exit(status.Error(codes.NotFound, "user: bob not found")), &exitErr)
+	require.Equal(t, exitNotFound, exitErr.ExitCode())
+	require.Equal(t, "error: user: bob not found", exitErr.Error())
+}
+
+func TestPrinter(t *testing.T) {
+	require := require.New(t)
+	msg := &pb.Message{Username: "alice", TextContent: "hi"}
+
+	var buf bytes.Buffer
+	require.NoError((&printer{w: &buf}).print(msg, "text"))
+	require.NoError((&printer{w: &buf}).print(msg, ""))
+	require.Equal("text\n", buf.String())
+
+	buf.Reset()
+	require.NoError((&printer{w: &buf, json: true}).print(msg, "text"))
+	require.JSONEq(`{"username": "alice", "textContent": "hi"}`, buf.String())
+}
+
+func TestFormatWhoAmI(t *testing.T) {
+	require.Equal(t, "username:  alice\nonline:    yes, in #general\nadmin:     yes",
+		formatWhoAmI(&pb.WhoAmIResponse{Username: "alice", Online: true, Room: "general", Admin: true}))
+	require.Equal(t, "username:  ci\nonline:    no\nbot:       yes, scopes messages:read",
+		formatWhoAmI(&pb.WhoAmIResponse{Username: "ci", Bot: true, Scopes: []string{"messages:read"}}))
+}
+
+// newTestClient returns a client of srv served over an in-memory connection.
+func newTestClient(t *testing.T, srv pb.ChatServiceServer) *chatclient.Client {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	pb.RegisterChatServiceServer(grpcServer, srv)
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return chatclient.New(conn)
+}
+
+// historyServer serves the history of a room.
+type historyServer struct {
+	pb.UnimplementedChatServiceServer
+	requests chan *pb.GetHistoryRequest
+}
+
+func (s *historyServer) GetHistory(_ context.Context, req *pb.GetHistoryRequest) (*pb.GetHistoryResponse, error) {
+	s.requests <- req
+	return &pb.GetHistoryResponse{Messages: []*pb.Message{
+		{Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Username: "alice", Room: req.GetRoom(), TextContent: "first", MessageNumber: 1},
+		{Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Username: "bob", Room: req.GetRoom(), TextContent: "second", MessageNumber: 2},
+	}}, nil
+}
+
+func TestHistory(t *testing.T) {
+	require := require.New(t)
+	srv := &historyServer{requests: make(chan *pb.GetHistoryRequest, 1)}
+	client := newTestClient(t, srv)
+
+	set := flag.NewFlagSet("history", flag.ContinueOnError)
+	set.String("room", "", "")
+	set.Uint("limit", 50, "")
+	set.Uint64("before", 0, "")
+	require.NoError(set.Parse([]string{"--room", "random", "--limit", "2"}))
+
+	var buf bytes.Buffer
+	require.NoError(history(context.Background(), cli.NewContext(nil, set, nil), client, &printer{w: &buf, json: true}))
+	req := <-srv.requests
+	require.Equal("random", req.GetRoom())
+	require.EqualValues(2, req.GetLimit())
+	require.Zero(req.GetBefore())
+	require.Equal(2, bytes.Count(buf.Bytes(), []byte("\n")))
+	require.Contains(buf.String(), `"textContent":"first"`)
+}
+
+// archiveServer exports and imports a fixed archive.
+type archiveServer struct {
+	pb.UnimplementedChatServiceServer
+	requests chan *pb.ExportHistoryRequest
+	imported []*pb.ExportRecord
+}
+
+var testArchive = []*pb.ExportRecord{
+	{Record: &pb.ExportRecord_Header{Header: &pb.ExportHeader{Version: 1, ExportedAt: 1723766400}}},
+	{Record: &pb.ExportRecord_Room{Room: &pb.ExportedRoom{Name: "general", MessageCount: 1}}},
+	{Record: &pb.ExportRecord_User{User: &pb.ExportedUser{Profile: &pb.UserProfile{Username: "alice"}}}},
+	{Record: &pb.ExportRecord_Message{Message: &pb.Message{
+		MessageNumber: 1, Username: "alice", Room: "general", TextContent: "first\nFrom me", Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Timestamp: 1723680000,
+	}}},
+}
+
+func (s *archiveServer) ExportHistory(req *pb.ExportHistoryRequest, stream grpc.ServerStreamingServer[pb.ExportRecord]) error {
+	s.requests <- req
+	for _, rec := range testArchive {
+		if err := stream.Send(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *archiveServer) ImportHistory(stream grpc.ClientStreamingServer[pb.ImportHistoryRequest, pb.ImportHistoryResponse]) error {
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(&pb.ImportHistoryResponse{MessagesImported: 1})
+		} else if err != nil {
+			return err
+		}
+		s.imported = append(s.imported, req.GetRecord())
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	for _, format := range []string{"jsonl", "mbox"} {
+		t.Run(format, func(t *testing.T) {
+			require := require.New(t)
+			srv := &archiveServer{requests: make(chan *pb.ExportHistoryRequest, 1)}
+			client := newTestClient(t, srv)
+			file := filepath.Join(t.TempDir(), "history."+format)
+
+			set := flag.NewFlagSet("export", flag.ContinueOnError)
+			set.Var(cli.NewStringSlice(), "room", "")
+			set.String("since", "", "")
+			set.String("until", "", "")
+			set.Bool("private", false, "")
+			set.String("format", "", "")
+			set.String("file", "", "")
+			require.NoError(set.Parse([]string{"--room", "general", "--since", "2024-08-15T00:00:00Z", "--format", format, "--file", file}))
+			require.NoError(export(context.Background(), cli.NewContext(nil, set, nil), client, &printer{}))
+			req := <-srv.requests
+			require.Equal([]string{"general"}, req.GetRooms())
+			require.EqualValues(1723680000, req.GetSince())
+			require.Zero(req.GetUntil())
+
+			set = flag.NewFlagSet("import", flag.ContinueOnError)
+			require.NoError(set.Parse([]string{file}))
+			var buf bytes.Buffer
+			require.NoError(importArchive(context.Background(), cli.NewContext(nil, set, nil), client, &printer{w: &buf}))
+			require.Equal("restored 0 topic(s), created 0 user(s), imported 1 message(s), skipped 0 message(s) already imported\n", buf.String())
+			require.Len(srv.imported, len(testArchive))
+			for i, rec := range testArchive {
+				require.True(proto.Equal(rec, srv.imported[i]), "record %d: %v", i, srv.imported[i])
+			}
+		})
+	}
+}
+
+func TestExportInvalidFlags(t *testing.T) {
+	set := flag.NewFlagSet("export", flag.ContinueOnError)
+	set.String("since", "yesterday", "")
+	set.String("format", "jsonl", "")
+	err := export(context.Background(), cli.NewContext(nil, set, nil), nil, &printer{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	set = flag.NewFlagSet("export", flag.ContinueOnError)
+	set.String("format", "csv", "")
+	err = export(context.Background(), cli.NewContext(nil, set, nil), nil, &printer{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
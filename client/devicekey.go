@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"github.com/zjy-dev/grpc-go-chatroom/chatclient"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+)
+
+var (
+	// keyFile is the file of the key of this device, set by loadConfig.
+	keyFile deviceKeyFile
+	// deviceKey is the key of this device decrypting the encrypted messages, nil if
+	// none was created.
+	deviceKey *chatclient.DeviceKey
+)
+
+// deviceKeyFile stores the key of this device. The private key never leaves it.
+type deviceKeyFile struct {
+	file string
+}
+
+// storedDeviceKey is the content of a device key file.
+type storedDeviceKey struct {
+	DeviceID   string `json:"device_id"`
+	PrivateKey []byte `json:"private_key"`
+}
+
+// load returns the key of the file, or nil if there is none.
+func (f deviceKeyFile) load() (*chatclient.DeviceKey, error) {
+	if f.file == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(f.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var stored storedDeviceKey
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to parse device key %s: %w", f.file, err)
+	}
+	key, err := chatclient.NewDeviceKey(stored.DeviceID, stored.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid device key %s: %w", f.file, err)
+	}
+	return key, nil
+}
+
+// loadOrCreate returns the key of the file, creating it readable by the user only
+// if there is none.
+func (f deviceKeyFile) loadOrCreate() (*chatclient.DeviceKey, error) {
+	if f.file == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "device_key is not set, encrypted messages are disabled")
+	}
+	key, err := f.load()
+	if err != nil || key != nil {
+		return key, err
+	}
+	if key, err = chatclient.GenerateDeviceKey(); err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(storedDeviceKey{DeviceID: key.ID, PrivateKey: key.PrivateKey.Bytes()}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.file), 0o700); err != nil {
+		return nil, err
+	}
+	// O_EXCL keeps a key created by another run meanwhile.
+	file, err := os.OpenFile(f.file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, os.ErrExist) {
+		return f.load()
+	} else if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(f.file)
+		return nil, err
+	}
+	return key, file.Close()
+}
+
+// decryptedText returns the text of msg, decrypted if msg is an encrypted message.
+func decryptedText(msg *pb.Message) string {
+	if msg.GetType() != pb.MessageType_MESSAGE_TYPE_ENCRYPTED {
+		return msg.GetTextContent()
+	}
+	if deviceKey == nil {
+		return "(encrypted, run `keys register` to read encrypted messages on this device)"
+	}
+	text, err := chatclient.Decrypt(msg, username, deviceKey)
+	if errors.Is(err, chatclient.ErrNoDeviceKey) {
+		return "(encrypted for other devices)"
+	} else if err != nil {
+		return "(encrypted, " + err.Error() + ")"
+	}
+	return text
+}
+
+// keysCommand manages the device keys of encrypted messages.
+func keysCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "keys",
+		Usage: "manage the device keys of end-to-end encrypted messages",
+		Subcommands: []*cli.Command{
+			{
+				Name:   "register",
+				Usage:  "create the key of this device if needed, and register its public key",
+				Flags:  []cli.Flag{outputFlag},
+				Action: run(registerKey),
+			},
+			{
+				Name:      "list",
+				Usage:     "list the devices a user can read encrypted messages on",
+				ArgsUsage: "[user], yourself if empty",
+				Flags:     []cli.Flag{outputFlag},
+				Action:    run(listKeys),
+			},
+		},
+	}
+}
+
+// registerKey registers the key of this device, creating it first if needed.
+func registerKey(ctx context.Context, _ *cli.Context, client *chatclient.Client, out *printer) error {
+	key, err := keyFile.loadOrCreate()
+	if err != nil {
+		return err
+	}
+	resp, err := client.RPC().RegisterDeviceKey(ctx, &pb.RegisterDeviceKeyRequest{DeviceId: key.ID, PublicKey: key.PublicKey()})
+	if err != nil {
+		return err
+	}
+	return out.print(resp.GetKey(), fmt.Sprintf("registered device %s, fingerprint %s", key.ID, fingerprint(key.PublicKey())))
+}
+
+// listKeys prints the device keys of a user.
+func listKeys(ctx context.Context, cCtx *cli.Context, client *chatclient.Client, out *printer) error {
+	resp, err := client.RPC().GetUserKeys(ctx, &pb.GetUserKeysRequest{Username: cCtx.Args().First()})
+	if err != nil {
+		return err
+	}
+	if out.json {
+		for _, key := range resp.GetKeys() {
+			if err := out.print(key, ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(out.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tFINGERPRINT\tREGISTERED")
+	for _, key := range resp.GetKeys() {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", key.GetDeviceId(), fingerprint(key.GetPublicKey()),
+			time.Unix(key.GetCreatedAt(), 0).Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// fingerprint formats a public key for people to compare, in groups of 4 hex digits.
+func fingerprint(publicKey []byte) string {
+	var groups []string
+	for i := 0; i+2 <= len(publicKey); i += 2 {
+		groups = append(groups, fmt.Sprintf("%x", publicKey[i:i+2]))
+	}
+	return strings.Join(groups, " ")
+}
+
+// dm sends an end-to-end encrypted message with the text in the arguments after
+// the recipient, or in the standard input.
+func dm(ctx context.Context, cCtx *cli.Context, client *chatclient.Client, out *printer) error {
+	recipient := cCtx.Args().First()
+	if recipient == "" {
+		return status.Errorf(codes.InvalidArgument, "usage: dm <user> [text...]")
+	}
+	text, err := argsOrStdin(cCtx.Args().Tail())
+	if err != nil {
+		return err
+	}
+	msg, err := client.SendEncrypted(ctx, recipient, text)
+	if err != nil {
+		return err
+	}
+	return out.print(msg, "")
+}
@@ -0,0 +1,125 @@
+//go:build unit_test
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/chatclient"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDeviceKeyFile(t *testing.T) {
+	require := require.New(t)
+	f := deviceKeyFile{file: filepath.Join(t.TempDir(), "grpc-go-chatroom", "device_key.json")}
+
+	key, err := f.load()
+	require.NoError(err)
+	require.Nil(key)
+
+	created, err := f.loadOrCreate()
+	require.NoError(err)
+	info, err := os.Stat(f.file)
+	require.NoError(err)
+	require.Equal(os.FileMode(0o600), info.Mode().Perm())
+
+	// The key is created once
+	loaded, err := f.loadOrCreate()
+	require.NoError(err)
+	require.Equal(created.ID, loaded.ID)
+	require.Equal(created.PublicKey(), loaded.PublicKey())
+
+	require.NoError(os.WriteFile(f.file, []byte(`{"device_id": "laptop", "private_key": "c2hvcnQ="}`), 0o600))
+	_, err = f.load()
+	require.ErrorContains(err, "invalid device key")
+
+	_, err = deviceKeyFile{}.loadOrCreate()
+	require.Equal(codes.FailedPrecondition, status.Code(err))
+}
+
+func TestDecryptedText(t *testing.T) {
+	require := require.New(t)
+	defer func(name string) { username, deviceKey = name, nil }(username)
+	bobPhone, err := chatclient.GenerateDeviceKey()
+	require.NoError(err)
+	ciphertext, keys, err := chatclient.Encrypt("alice", "bob", "see you", map[string][]*pb.DeviceKey{
+		"bob": {{DeviceId: bobPhone.ID, PublicKey: bobPhone.PublicKey()}},
+	})
+	require.NoError(err)
+	msg := &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_ENCRYPTED, Username: "alice", Recipient: "bob", BinaryContent: ciphertext, WrappedKeys: keys}
+
+	username, deviceKey = "bob", nil
+	require.Contains(decryptedText(msg), "run `keys register`")
+
+	deviceKey = bobPhone
+	require.Equal("see you", decryptedText(msg))
+	require.Contains(formatMessage(msg), "<encrypted> alice see you")
+
+	otherDevice, err := chatclient.GenerateDeviceKey()
+	require.NoError(err)
+	deviceKey = otherDevice
+	require.Equal("(encrypted for other devices)", decryptedText(msg))
+}
+
+// dmServer serves the device keys of bob and carol, who has none, and keeps the
+// encrypted messages posted by alice.
+type dmServer struct {
+	pb.UnimplementedChatServiceServer
+	keys   map[string][]*pb.DeviceKey
+	posted []*pb.PostMessageRequest
+}
+
+func (s *dmServer) WhoAmI(context.Context, *pb.WhoAmIRequest) (*pb.WhoAmIResponse, error) {
+	return &pb.WhoAmIResponse{Username: "alice"}, nil
+}
+
+func (s *dmServer) GetUserKeys(_ context.Context, req *pb.GetUserKeysRequest) (*pb.GetUserKeysResponse, error) {
+	return &pb.GetUserKeysResponse{Keys: s.keys[req.GetUsername()]}, nil
+}
+
+func (s *dmServer) PostMessage(_ context.Context, req *pb.PostMessageRequest) (*pb.PostMessageResponse, error) {
+	s.posted = append(s.posted, req)
+	return &pb.PostMessageResponse{Message: &pb.Message{
+		Type: pb.MessageType_MESSAGE_TYPE_ENCRYPTED, Username: "alice", Recipient: req.GetRecipient(),
+		BinaryContent: req.GetBinaryContent(), WrappedKeys: req.GetWrappedKeys(),
+	}}, nil
+}
+
+func TestDM(t *testing.T) {
+	require := require.New(t)
+	bobPhone, err := chatclient.GenerateDeviceKey()
+	require.NoError(err)
+	srv := &dmServer{keys: map[string][]*pb.DeviceKey{"bob": {{DeviceId: bobPhone.ID, PublicKey: bobPhone.PublicKey()}}}}
+	client := newTestClient(t, srv)
+	dmContext := func(args ...string) *cli.Context {
+		set := flag.NewFlagSet("dm", flag.ContinueOnError)
+		require.NoError(set.Parse(args))
+		return cli.NewContext(nil, set, nil)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(dm(context.Background(), dmContext("bob", "lunch", "at", "noon?"), client, &printer{w: &buf}))
+	require.Len(srv.posted, 1)
+	require.Equal("bob", srv.posted[0].GetRecipient())
+	require.Empty(srv.posted[0].GetTextContent())
+	text, err := chatclient.Decrypt(&pb.Message{
+		Username: "alice", Recipient: "bob", BinaryContent: srv.posted[0].GetBinaryContent(), WrappedKeys: srv.posted[0].GetWrappedKeys(),
+	}, "bob", bobPhone)
+	require.NoError(err)
+	require.Equal("lunch at noon?", text)
+
+	err = dm(context.Background(), dmContext("carol", "hi"), client, &printer{w: &buf})
+	require.Equal(codes.FailedPrecondition, status.Code(err))
+	err = dm(context.Background(), dmContext(), client, &printer{w: &buf})
+	require.Equal(codes.InvalidArgument, status.Code(err))
+	require.Len(srv.posted, 1)
+}
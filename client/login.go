@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/zjy-dev/grpc-go-chatroom/chatclient"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/config"
+	"golang.org/x/term"
+	"google.golang.org/grpc"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+)
+
+// newClient returns a client of the server at conn, logging in as the configured
+// user with the token cached for the server if any, and caching the tokens it gets.
+func newClient(conn grpc.ClientConnInterface, cfg *config.ClientConfig) *chatclient.Client {
+	cache := tokenCache{file: cfg.TokenCache}
+	address := cfg.Server.String()
+
+	// Users with a client certificate log in without a password
+	var password chatclient.PasswordFunc
+	if cfg.TLS.CertFile == "" {
+		password = func(context.Context) (string, error) { return readPassword(cfg.PasswordFile) }
+	}
+	opts := []chatclient.Option{
+		chatclient.WithToken(cache.load(address, username)),
+		chatclient.WithCredentials(username, password),
+		chatclient.WithTokenHandler(func(token string) {
+			if err := cache.store(address, username, token); err != nil {
+				log.Printf("failed to cache the token: %v", err)
+			}
+		}),
+	}
+	if cfg.TLS.IsEnabled() {
+		opts = append(opts, chatclient.WithTransportSecurity())
+	}
+	return chatclient.New(conn, opts...)
+}
+
+// login logs in the user to the chatroom, unless the server accepts the cached token.
+// The password is asked for here rather than in the middle of a chat.
+func login(ctx context.Context, client *chatclient.Client) error {
+	if client.Token() == "" {
+		return client.LogIn(ctx)
+	}
+	// Check the cached token with a cheap call, which logs in again if it is rejected
+	_, err := client.RPC().WhoAmI(ctx, &pb.WhoAmIRequest{})
+	return err
+}
+
+// tokenCache stores the tokens issued by the servers in a file, so that users log
+// in once instead of on every run. An empty file disables the cache.
+type tokenCache struct {
+	file string
+}
+
+// cacheKey returns the key of the token of username on the server at address.
+func cacheKey(address, username string) string {
+	return username + "@" + address
+}
+
+func (c tokenCache) read() (map[string]string, error) {
+	tokens := map[string]string{}
+	data, err := os.ReadFile(c.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return tokens, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("failed to parse token cache %s: %w", c.file, err)
+	}
+	return tokens, nil
+}
+
+// write replaces the cache file atomically, readable by the user only.
+func (c tokenCache) write(tokens map[string]string) error {
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.file), 0o700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(c.file), ".tokens-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.file)
+}
+
+// load returns the cached token of username on the server at address, or "" if
+// there is none.
+func (c tokenCache) load(address, username string) string {
+	if c.file == "" {
+		return ""
+	}
+	tokens, err := c.read()
+	if err != nil {
+		return ""
+	}
+	return tokens[cacheKey(address, username)]
+}
+
+// store caches the token of username on the server at address.
+func (c tokenCache) store(address, username, token string) error {
+	if c.file == "" {
+		return nil
+	}
+	tokens, err := c.read()
+	if err != nil {
+		// A broken cache is replaced rather than blocking logins.
+		tokens = map[string]string{}
+	}
+	tokens[cacheKey(address, username)] = token
+	return c.write(tokens)
+}
+
+// remove forgets the token of username on the server at address.
+func (c tokenCache) remove(address, username string) error {
+	if c.file == "" {
+		return nil
+	}
+	tokens, err := c.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := tokens[cacheKey(address, username)]; !ok {
+		return nil
+	}
+	delete(tokens, cacheKey(address, username))
+	return c.write(tokens)
+}
+
+// readPassword reads the password of username from passwordFile, or prompts for it
+// without echoing it when passwordFile is empty.
+func readPassword(passwordFile string) (string, error) {
+	if passwordFile != "" {
+		data, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read password file: %w", err)
+		}
+		// Only the first line counts, so that files ending with a newline work.
+		password, _, _ := strings.Cut(string(data), "\n")
+		return strings.TrimSuffix(password, "\r"), nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", errors.New("can not prompt for the password, the standard input is not a terminal, use --password-file")
+	}
+	fmt.Fprintf(os.Stderr, "Password for %s: ", username)
+	password, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password: %w", err)
+	}
+	return string(password), nil
+}
@@ -0,0 +1,49 @@
+//go:build unit_test
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenCache(t *testing.T) {
+	require := require.New(t)
+	cache := tokenCache{file: filepath.Join(t.TempDir(), "grpc-go-chatroom", "tokens.json")}
+
+	require.Empty(cache.load("localhost:8082", "alice"))
+	require.NoError(cache.store("localhost:8082", "alice", "token1"))
+	require.NoError(cache.store("chat.example.com:443", "alice", "token2"))
+	require.Equal("token1", cache.load("localhost:8082", "alice"))
+	require.Equal("token2", cache.load("chat.example.com:443", "alice"))
+	require.Empty(cache.load("localhost:8082", "bob"))
+
+	// Tokens are secrets
+	info, err := os.Stat(cache.file)
+	require.NoError(err)
+	require.Equal(os.FileMode(0o600), info.Mode().Perm())
+
+	require.NoError(cache.remove("localhost:8082", "alice"))
+	require.Empty(cache.load("localhost:8082", "alice"))
+	require.Equal("token2", cache.load("chat.example.com:443", "alice"))
+
+	// An empty file disables the cache
+	disabled := tokenCache{}
+	require.NoError(disabled.store("localhost:8082", "alice", "token1"))
+	require.Empty(disabled.load("localhost:8082", "alice"))
+}
+
+func TestReadPasswordFile(t *testing.T) {
+	require := require.New(t)
+	file := filepath.Join(t.TempDir(), "password")
+	require.NoError(os.WriteFile(file, []byte("s3cret\r\n"), 0o600))
+	password, err := readPassword(file)
+	require.NoError(err)
+	require.Equal("s3cret", password)
+
+	_, err = readPassword(filepath.Join(t.TempDir(), "missing"))
+	require.Error(err)
+}
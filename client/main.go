@@ -4,123 +4,182 @@ import (
 	"bufio"
 	"context"
 	"fmt"
-	"io"
 	"log"
+	"net"
 	"os"
 	"time"
 
 	"github.com/urfave/cli/v2"
+	"github.com/zjy-dev/grpc-go-chatroom/chatclient"
 	"github.com/zjy-dev/grpc-go-chatroom/internal/config"
-	"github.com/zjy-dev/grpc-go-chatroom/internal/tokensource"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/tlsutil"
+	"golang.org/x/term"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+	"google.golang.org/grpc/status"
 
 	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
 )
 
-var (
-	username string
-	token    string
-)
-
-// mustLogin function logs in the user to the chatroom
-func mustLogin(client pb.ChatServiceClient) {
-
-	// Send a login request to the server
-	loginResp, err := client.LogInOrRegister(context.Background(), &pb.LogInOrRegisterRequest{
-		Username: username,
-	})
-	if err != nil {
-		log.Fatalf("client.LogIn failed: %v", err)
-	}
+var username string
 
-	// Check if the server returned an empty response
-	if loginResp == nil {
-		log.Fatalf("server returned an empty client.LogIn response: %v", err)
-	}
-	// Check if the server returned an empty token
-	if len(loginResp.GetToken()) == 0 {
-		log.Fatalf("server returned an empty token: %v", err)
-	}
+// chat runs the chatroom line by line on the standard input and output, which
+// suits scripts and pipes
+func chat(client *chatclient.Client) {
+	session := client.Chat(context.Background())
 
-	// Set the token
-	token = loginResp.GetToken()
-}
-
-// chat
-func chat(client pb.ChatServiceClient) {
-	if len(token) == 0 {
-		log.Panicln("no token found")
-	}
+	// Read from standard input in another goroutine, lines are queued while the
+	// session reconnects
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			session.Send(scanner.Text())
+		}
 
-	// Create a stream to the server
-	stream, err := client.Chat(context.Background(), grpc.PerRPCCredentials(tokensource.New(token)))
-	if err != nil {
-		log.Panicf("client.Chat failed: %v\n", err)
-	}
-	// Create a channel to wait for the server to send a message
-	waitc := make(chan struct{})
+		// Check if there was an error reading from standard input
+		if err := scanner.Err(); err != nil {
+			log.Fatalf("reading standard input: %v", err)
+		}
+		// Wait for the server to end the stream after the queued lines
+		session.Close()
+	}()
 
-	// Start a goroutine to receive messages from the server
 	go func() {
-		for {
-			resp, err := stream.Recv()
-			if err == io.EOF {
-				close(waitc)
-				return
-			}
-			if err != nil {
-				log.Fatalf("failed to receive from server: %v", err)
+		for change := range session.States() {
+			if line := formatState(change); line != "" {
+				fmt.Fprintln(os.Stderr, "*** "+line)
 			}
-
-			// Print the message from the server
-			fmt.Printf("[%s] %s %s\n", time.Unix(resp.GetMessage().GetTimestamp(), 0).Format("2006-01-02 15:04:05"),
-				resp.GetMessage().GetUsername(), resp.GetMessage().GetTextContent())
 		}
 	}()
+	for msg := range session.Messages() {
+		fmt.Println(formatMessage(msg))
+	}
+	<-session.Done()
+	if err := session.Err(); err != nil {
+		log.Fatalf("chat failed: %v", err)
+	}
+}
 
-	// Create a scanner to read from standard input
-	scanner := bufio.NewScanner(os.Stdin)
+// formatState describes a change of the connection, "" for the first connect
+func formatState(change chatclient.StateChange) string {
+	switch {
+	case change.State == chatclient.Disconnected:
+		return fmt.Sprintf("disconnected: %s, reconnecting in %s", status.Convert(change.Err).Message(), change.RetryIn.Round(100*time.Millisecond))
+	case change.Reconnected:
+		return "reconnected"
+	default:
+		return ""
+	}
+}
 
-	for scanner.Scan() {
-		// Create a message to send to the server
-		msg := &pb.Message{
-			Type:        pb.MessageType_MESSAGE_TYPE_NORMAL,
-			TextContent: scanner.Text(),
-		}
+// formatMessage formats a message from the server as a line of the terminal
+func formatMessage(msg *pb.Message) string {
+	timestamp := time.Unix(msg.GetTimestamp(), 0).Format("2006-01-02 15:04:05")
+	name := displayName(msg)
 
-		// Send the request to the server
-		err := stream.Send(&pb.ChatRequest{Message: msg})
-		if err != nil {
-			log.Fatalf("%v.Send(%v) = %v", client, msg, err)
-		}
+	switch msg.GetType() {
+	case pb.MessageType_MESSAGE_TYPE_SYSTEM:
+		return fmt.Sprintf("[%s] *** %s", timestamp, msg.GetTextContent())
+	case pb.MessageType_MESSAGE_TYPE_ACTION:
+		return fmt.Sprintf("[%s] #%s * %s %s", timestamp, msg.GetRoom(), name, msg.GetTextContent())
+	case pb.MessageType_MESSAGE_TYPE_PRIVATE:
+		return fmt.Sprintf("[%s] <private> %s %s", timestamp, name, msg.GetTextContent())
+	case pb.MessageType_MESSAGE_TYPE_ENCRYPTED:
+		return fmt.Sprintf("[%s] <encrypted> %s %s", timestamp, name, decryptedText(msg))
+	default:
+		return fmt.Sprintf("[%s] #%s %s %s", timestamp, msg.GetRoom(), name, msg.GetTextContent())
+	}
+}
+
+// displayName returns the name the sender of msg is shown as
+func displayName(msg *pb.Message) string {
+	name := msg.GetUsername()
+	if msg.GetDisplayName() != "" {
+		name = msg.GetDisplayName()
 	}
+	if msg.GetBot() {
+		name += " [bot]"
+	}
+	return name
+}
 
-	// Check if there was an error reading from standard input
-	if err := scanner.Err(); err != nil {
-		stream.CloseSend()
-		log.Fatalf("reading standard input: %v", err)
+// useTUI reports whether to run the terminal UI in ui mode
+func useTUI(ui string) (bool, error) {
+	switch ui {
+	case "tui":
+		return true, nil
+	case "line":
+		return false, nil
+	case "auto":
+		// Scripts and pipes get the line-based mode
+		return term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd())), nil
+	default:
+		return false, fmt.Errorf("invalid --ui %q, must be one of auto, tui and line", ui)
 	}
-	stream.CloseSend()
+}
 
-	// Wait for the server to send a message
-	<-waitc
+// dialTarget returns the gRPC target of the server addresses, with the options
+// resolving it. A single address is resolved by DNS, so names with several
+// records fail over between them, and a list is tried in order
+func dialTarget(addrs []string) (string, []grpc.DialOption) {
+	if len(addrs) == 1 {
+		return addrs[0], nil
+	}
+	state := resolver.State{}
+	for _, addr := range addrs {
+		host, _, _ := net.SplitHostPort(addr)
+		// Verify every server by its own name with TLS
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: addr, ServerName: host})
+	}
+	r := manual.NewBuilderWithScheme("chatroom")
+	r.InitialState(state)
+	return r.Scheme() + ":///servers", []grpc.DialOption{grpc.WithResolvers(r)}
 }
 
-// mustNewClient function creates a new client connection to the server
-func mustNewClient() (*grpc.ClientConn, pb.ChatServiceClient) {
+// mustDial function creates a new client connection to the server
+func mustDial(server config.ClientServerSettings, tlsConfig config.ClientTLSConfig) *grpc.ClientConn {
+	creds := insecure.NewCredentials()
+	if tlsConfig.IsEnabled() {
+		tlsCfg, err := tlsutil.ClientConfig(tlsConfig)
+		if err != nil {
+			log.Fatalf("failed to set up TLS: %v", err)
+		}
+		creds = credentials.NewTLS(tlsCfg)
+	}
 
 	// Create a new client connection to the server
-	conn, err := grpc.NewClient(fmt.Sprintf("localhost:%d", config.Server.Port),
-		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	target, opts := dialTarget(server.Addresses())
+	conn, err := grpc.NewClient(target, append(opts, grpc.WithTransportCredentials(creds))...)
 
 	if err != nil {
 		log.Fatalf("fail to dial: %v", err)
 	}
-	fmt.Println("connecting to server")
 
-	// Return the connection and client
-	return conn, pb.NewChatServiceClient(conn)
+	return conn
+}
+
+// loadConfig loads the configuration, with only the flags set by the user
+// overriding the config file and env vars, and sets username and keyFile
+func loadConfig(cCtx *cli.Context) (*config.ClientConfig, error) {
+	flags := map[string]any{}
+	for name, key := range map[string]string{
+		"server": "server.address", "host": "server.host", "port": "server.port", "name": "username", "password-file": "password_file",
+		"tls": "tls.enabled", "ca": "tls.ca_file", "cert": "tls.cert_file", "key": "tls.key_file",
+	} {
+		if cCtx.IsSet(name) {
+			flags[key] = cCtx.Value(name)
+		}
+	}
+	cfg, err := config.LoadClient(config.Options{File: cCtx.String("config"), Flags: flags, Profile: cCtx.String("profile")})
+	if err != nil {
+		return nil, err
+	}
+	username = cfg.Username
+	keyFile = deviceKeyFile{file: cfg.DeviceKey}
+	return cfg, nil
 }
 
 // main function is the entry point of the program
@@ -132,36 +191,105 @@ func main() {
 
 		// Define the action to be taken when the app is run
 		Action: func(cCtx *cli.Context) error {
+			cfg, err := loadConfig(cCtx)
+			if err != nil {
+				return err
+			}
+			tui, err := useTUI(cCtx.String("ui"))
+			if err != nil {
+				return err
+			}
 
 			// Create a new client connection to the server
-			conn, client := mustNewClient()
+			conn := mustDial(cfg.Server, cfg.TLS)
 			defer conn.Close()
+			fmt.Println("connecting to server")
 
 			// Log in the user to the chatroom
-			mustLogin(client)
+			client := newClient(conn, cfg)
+			if err := login(cCtx.Context, client); err != nil {
+				log.Fatalf("client.LogIn failed: %v", err)
+			}
+			if deviceKey, err = keyFile.load(); err != nil {
+				log.Printf("failed to load the device key, encrypted messages can't be read: %v", err)
+			}
 
+			if tui {
+				return newTUI(client).run()
+			}
 			fmt.Printf("Hello, %s! Welcome to the chatroom!\n", username)
 			fmt.Println("Input your message and hit enter to shoot it, and havvvve a nice chat!")
+			fmt.Println("Type /help to list the commands.")
 			// Run the chatroom
 			chat(client)
 			return nil
 		},
-		// Define the flags for the app
+		// Non-interactive subcommands for scripts
+		Commands: commands(),
+		// Define the flags for the app, which override the config file and env vars
 		Flags: []cli.Flag{
-			&cli.Uint64Flag{
-				Name:        "port",
-				Aliases:     []string{"p"},
-				Value:       config.Server.Port,
-				Usage:       "the server port",
-				Destination: nil,
+			&cli.StringFlag{
+				Name:  "config",
+				Usage: "path of the YAML or TOML config file, defaults to client.yaml in the user config dir",
+			},
+
+			&cli.StringFlag{
+				Name:  "profile",
+				Usage: "the profile of the config file to use, e.g. for another deployment",
+			},
+
+			&cli.StringFlag{
+				Name:    "server",
+				Aliases: []string{"s"},
+				Usage:   "the server host:port, or comma separated addresses tried in order, overriding --host and --port",
+			},
+
+			&cli.StringFlag{
+				Name:  "host",
+				Usage: "the server host (default: localhost)",
+			},
+
+			&cli.IntFlag{
+				Name:    "port",
+				Aliases: []string{"p"},
+				Usage:   "the server port (default: 8082)",
+			},
+
+			&cli.StringFlag{
+				Name:    "name",
+				Aliases: []string{"n"},
+				Usage:   "username for the chatroom",
+			},
+
+			&cli.StringFlag{
+				Name:  "password-file",
+				Usage: "file holding the password, which is prompted for otherwise",
+			},
+
+			&cli.StringFlag{
+				Name:  "ui",
+				Value: "auto",
+				Usage: "the user interface: tui for the full screen terminal UI, line for the line-based mode suiting scripts, auto for tui on terminals",
+			},
+
+			&cli.BoolFlag{
+				Name:  "tls",
+				Usage: "connect with TLS, verifying the server by the system CA certificates",
+			},
+
+			&cli.StringFlag{
+				Name:  "ca",
+				Usage: "CA certificate file verifying the server, implies --tls",
+			},
+
+			&cli.StringFlag{
+				Name:  "cert",
+				Usage: "client certificate file, for servers requiring one, implies --tls",
 			},
 
 			&cli.StringFlag{
-				Name:        "name",
-				Aliases:     []string{"n"},
-				Required:    true,
-				Usage:       "username for the chatroom",
-				Destination: &username,
+				Name:  "key",
+				Usage: "private key file of --cert",
 			},
 		},
 	}
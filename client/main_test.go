@@ -1,3 +1,72 @@
+//go:build unit_test
+
 package main
 
-// TODO
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/config"
+	"google.golang.org/grpc"
+)
+
+// whoAmIServer answers WhoAmI with its name.
+type whoAmIServer struct {
+	pb.UnimplementedChatServiceServer
+	name string
+}
+
+func (s *whoAmIServer) WhoAmI(context.Context, *pb.WhoAmIRequest) (*pb.WhoAmIResponse, error) {
+	return &pb.WhoAmIResponse{Username: s.name}, nil
+}
+
+// serve serves srv on a local port and returns its address.
+func serve(t *testing.T, srv pb.ChatServiceServer) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	grpcServer := grpc.NewServer()
+	pb.RegisterChatServiceServer(grpcServer, srv)
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+	return lis.Addr().String()
+}
+
+// unusedAddress returns a local address nothing listens on.
+func unusedAddress(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := lis.Addr().String()
+	require.NoError(t, lis.Close())
+	return addr
+}
+
+func TestDialTarget(t *testing.T) {
+	target, opts := dialTarget([]string{"chat.example.com:8082"})
+	require.Equal(t, "chat.example.com:8082", target)
+	require.Empty(t, opts)
+
+	target, opts = dialTarget([]string{"a.example.com:8082", "b.example.com:8082"})
+	require.Equal(t, "chatroom:///servers", target)
+	require.Len(t, opts, 1)
+}
+
+func TestMustDialFailover(t *testing.T) {
+	require := require.New(t)
+	down, up := unusedAddress(t), serve(t, &whoAmIServer{name: "second"})
+
+	conn := mustDial(config.ClientServerSettings{Address: down + "," + up}, config.ClientTLSConfig{})
+	defer conn.Close()
+	client := pb.NewChatServiceClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := client.WhoAmI(ctx, &pb.WhoAmIRequest{}, grpc.WaitForReady(true))
+	require.NoError(err)
+	require.Equal("second", resp.GetUsername())
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+	"github.com/zjy-dev/grpc-go-chatroom/chatclient"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+)
+
+const (
+	// defaultRoom is the room users are in after logging in.
+	defaultRoom = "general"
+	// maxScrollback is the number of lines of history kept in the message pane.
+	maxScrollback = 5000
+	// sidebarRefreshInterval refreshes the sidebars even without join or leave
+	// events, e.g. to pick up topic changes.
+	sidebarRefreshInterval = 30 * time.Second
+)
+
+// userColors are the colors usernames are drawn in, picked by a hash of the
+// username so that a user keeps the same color.
+var userColors = []string{
+	"red", "green", "yellow", "blue", "fuchsia", "aqua",
+	"orange", "lime", "violet", "turquoise", "salmon", "gold",
+}
+
+// userColor returns the color of username.
+func userColor(username string) string {
+	h := fnv.New32a()
+	h.Write([]byte(username))
+	return userColors[h.Sum32()%uint32(len(userColors))]
+}
+
+// formatTUIMessage formats a message from the server as a line of the message pane,
+// with the user text escaped so that it can't inject color tags.
+func formatTUIMessage(msg *pb.Message) string {
+	timestamp := time.Unix(msg.GetTimestamp(), 0).Format("15:04:05")
+	name := fmt.Sprintf("[%s]%s[-]", userColor(msg.GetUsername()), tview.Escape(displayName(msg)))
+	text := tview.Escape(msg.GetTextContent())
+
+	switch msg.GetType() {
+	case pb.MessageType_MESSAGE_TYPE_SYSTEM:
+		return fmt.Sprintf("[gray]%s[-] [yellow]*** %s[-]", timestamp, text)
+	case pb.MessageType_MESSAGE_TYPE_ACTION:
+		return fmt.Sprintf("[gray]%s[-] * %s %s", timestamp, name, text)
+	case pb.MessageType_MESSAGE_TYPE_PRIVATE:
+		return fmt.Sprintf("[gray]%s[-] [::b]<private>[::-] %s: %s", timestamp, name, text)
+	case pb.MessageType_MESSAGE_TYPE_ENCRYPTED:
+		return fmt.Sprintf("[gray]%s[-] [::b]<encrypted>[::-] %s: %s", timestamp, name, tview.Escape(decryptedText(msg)))
+	default:
+		return fmt.Sprintf("[gray]%s[-] %s: %s", timestamp, name, text)
+	}
+}
+
+// tui is the full screen terminal UI of the chatroom.
+type tui struct {
+	client  *chatclient.Client
+	session *chatclient.Session
+	app     *tview.Application
+
+	messages *tview.TextView   // the chat history of the current room
+	input    *tview.InputField // the line the user types messages and commands in
+	users    *tview.TextView   // the online users in the current room
+	rooms    *tview.List       // all rooms, selecting one joins it
+
+	refresh chan struct{} // asks for the sidebars to be refreshed
+}
+
+// newTUI lays out the terminal UI:
+//
+//	+----------------------+---------+
+//	| messages             | users   |
+//	|                      +---------+
+//	|                      | rooms   |
+//	+----------------------+---------+
+//	| input                          |
+//	+--------------------------------+
+func newTUI(client *chatclient.Client) *tui {
+	t := &tui{
+		client:   client,
+		app:      tview.NewApplication(),
+		messages: tview.NewTextView(),
+		input:    tview.NewInputField(),
+		users:    tview.NewTextView(),
+		rooms:    tview.NewList(),
+		refresh:  make(chan struct{}, 1),
+	}
+
+	t.messages.SetDynamicColors(true).SetScrollable(true).SetWordWrap(true).SetMaxLines(maxScrollback)
+	t.messages.SetBorder(true).SetTitle(" #" + defaultRoom + " ")
+	t.users.SetDynamicColors(true).SetBorder(true).SetTitle(" Users ")
+	t.rooms.ShowSecondaryText(false).SetBorder(true).SetTitle(" Rooms ")
+	t.rooms.SetSelectedFunc(func(_ int, _ string, room string, _ rune) {
+		t.send("/join " + room)
+		t.app.SetFocus(t.input)
+	})
+	t.input.SetLabel(tview.Escape(username) + "> ").SetFieldBackgroundColor(tcell.ColorDefault)
+	t.input.SetDoneFunc(func(key tcell.Key) {
+		if key != tcell.KeyEnter || t.input.GetText() == "" {
+			return
+		}
+		t.send(t.input.GetText())
+		t.input.SetText("")
+		t.messages.ScrollToEnd()
+	})
+
+	sidebar := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(t.users, 0, 2, false).
+		AddItem(t.rooms, 0, 1, false)
+	main := tview.NewFlex().
+		AddItem(t.messages, 0, 4, false).
+		AddItem(sidebar, 24, 0, false)
+	layout := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(main, 0, 1, false).
+		AddItem(t.input, 1, 0, true)
+
+	t.app.SetRoot(layout, true).SetInputCapture(t.handleKey)
+	return t
+}
+
+// handleKey implements the global keybindings:
+//
+//   - PgUp/PgDn scroll the history a page, Home/End jump to its start/end;
+//   - Tab/Shift-Tab move the focus between the input line, the history and the room list;
+//   - Ctrl-C quits.
+func (t *tui) handleKey(event *tcell.EventKey) *tcell.EventKey {
+	switch event.Key() {
+	case tcell.KeyPgUp, tcell.KeyPgDn:
+		t.scrollMessages(event)
+	case tcell.KeyHome, tcell.KeyEnd:
+		// The input line moves its cursor with these keys.
+		if t.input.HasFocus() {
+			return event
+		}
+		t.scrollMessages(event)
+	case tcell.KeyTab:
+		t.cycleFocus(1)
+	case tcell.KeyBacktab:
+		t.cycleFocus(-1)
+	default:
+		return event
+	}
+	return nil
+}
+
+// scrollMessages scrolls the message pane by a key, wherever the focus is.
+func (t *tui) scrollMessages(event *tcell.EventKey) {
+	t.messages.InputHandler()(event, func(p tview.Primitive) { t.app.SetFocus(p) })
+}
+
+func (t *tui) cycleFocus(step int) {
+	order := []tview.Primitive{t.input, t.messages, t.rooms}
+	for i, p := range order {
+		if p.HasFocus() {
+			t.app.SetFocus(order[(i+step+len(order))%len(order)])
+			return
+		}
+	}
+	t.app.SetFocus(t.input)
+}
+
+// println appends a line to the message pane. It must be called from the UI goroutine.
+func (t *tui) println(line string) {
+	fmt.Fprintln(t.messages, line)
+}
+
+// send sends a line the user typed, it is kept while reconnecting.
+func (t *tui) send(text string) {
+	t.session.Send(text)
+}
+
+// run opens the chat session and runs the UI until the user quits.
+func (t *tui) run() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t.session = t.client.Chat(ctx)
+	go t.showMessages()
+	go t.showStates()
+	go t.watchEvents(ctx)
+	go t.refreshSidebars(ctx)
+
+	t.println("[yellow]*** Welcome to the chatroom, " + tview.Escape(username) + "! Type /help to list the commands.[-]")
+	t.println("[gray]*** PgUp/PgDn scroll, Tab switches between the input, the history and the rooms, Ctrl-C quits.[-]")
+	return t.app.Run()
+}
+
+// showMessages appends the messages of the session to the message pane until it ends.
+func (t *tui) showMessages() {
+	for msg := range t.session.Messages() {
+		t.app.QueueUpdateDraw(func() { t.println(formatTUIMessage(msg)) })
+	}
+	<-t.session.Done()
+	if err := t.session.Err(); err != nil {
+		line := fmt.Sprintf("[red]*** disconnected from the server: %s, press Ctrl-C to quit[-]", tview.Escape(status.Convert(err).Message()))
+		t.app.QueueUpdateDraw(func() { t.println(line) })
+	}
+}
+
+// showStates tells the user about the drops and reconnects of the session.
+func (t *tui) showStates() {
+	for change := range t.session.States() {
+		line := formatState(change)
+		if line == "" {
+			continue
+		}
+		t.app.QueueUpdateDraw(func() { t.println("[red]*** " + tview.Escape(line) + "[-]") })
+		// Users may have come and gone while disconnected.
+		t.requestRefresh()
+	}
+}
+
+// watchEvents asks for the sidebars to be refreshed whenever a user joins or leaves a room.
+func (t *tui) watchEvents(ctx context.Context) {
+	t.requestRefresh()
+	sub, err := t.client.Subscribe(ctx, &pb.SubscribeRequest{
+		EventTypes: []pb.EventType{pb.EventType_EVENT_TYPE_USER_JOIN, pb.EventType_EVENT_TYPE_USER_LEAVE},
+	})
+	if err != nil {
+		return
+	}
+	// Without events, the sidebars are still refreshed periodically.
+	for range sub.Events() {
+		t.requestRefresh()
+	}
+}
+
+func (t *tui) requestRefresh() {
+	select {
+	case t.refresh <- struct{}{}:
+	default: // a refresh is already pending
+	}
+}
+
+// refreshSidebars loads the online users and the rooms when asked to, and periodically.
+func (t *tui) refreshSidebars(ctx context.Context) {
+	ticker := time.NewTicker(sidebarRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-t.refresh:
+		}
+
+		usersResp, err := t.client.RPC().ListOnlineUsers(ctx, &pb.ListOnlineUsersRequest{})
+		if err != nil {
+			continue
+		}
+		roomsResp, err := t.client.RPC().ListRooms(ctx, &pb.ListRoomsRequest{})
+		if err != nil {
+			continue
+		}
+		t.app.QueueUpdateDraw(func() { t.updateSidebars(usersResp.GetUsers(), roomsResp.GetRooms()) })
+	}
+}
+
+// updateSidebars shows the users in the current room of the user, and all rooms.
+func (t *tui) updateSidebars(users []*pb.OnlineUser, rooms []*pb.Room) {
+	currentRoom := defaultRoom
+	for _, user := range users {
+		if user.GetUsername() == username {
+			currentRoom = user.GetRoom()
+		}
+	}
+	t.messages.SetTitle(" #" + tview.Escape(currentRoom) + " ")
+
+	t.users.Clear()
+	for _, user := range users {
+		if user.GetRoom() != currentRoom {
+			continue
+		}
+		name := user.GetUsername()
+		if user.GetDisplayName() != "" {
+			name = user.GetDisplayName()
+		}
+		fmt.Fprintf(t.users, "[%s]%s[-]\n", userColor(user.GetUsername()), tview.Escape(name))
+	}
+
+	selected := t.rooms.GetCurrentItem()
+	t.rooms.Clear()
+	for _, room := range rooms {
+		text := fmt.Sprintf("#%s (%d)", tview.Escape(room.GetName()), room.GetUserCount())
+		if room.GetName() == currentRoom {
+			text = "[::b]" + text + "[::-]"
+		}
+		// The room name is kept as the secondary text, which is hidden, for SetSelectedFunc.
+		t.rooms.AddItem(text, room.GetName(), 0, nil)
+	}
+	t.rooms.SetCurrentItem(selected)
+}
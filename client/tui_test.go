@@ -0,0 +1,74 @@
+//go:build unit_test
+
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+)
+
+func TestUserColor(t *testing.T) {
+	require := require.New(t)
+	require.Equal(userColor("alice"), userColor("alice"))
+	require.Contains(userColors, userColor("bob"))
+}
+
+func TestFormatTUIMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *pb.Message
+		want string
+	}{
+		{
+			name: "normal",
+			msg:  &pb.Message{Username: "alice", TextContent: "hi"},
+			want: "[" + userColor("alice") + "]alice[-]: hi",
+		},
+		{
+			name: "color tags are escaped",
+			msg:  &pb.Message{Username: "alice", DisplayName: "[red]Alice", TextContent: "[::b]loud"},
+			want: "[" + userColor("alice") + "][red[]Alice[-]: [::b[]loud",
+		},
+		{
+			name: "bot",
+			msg:  &pb.Message{Username: "ci", Bot: true, TextContent: "build passed"},
+			want: "[" + userColor("ci") + "]ci [bot[][-]: build passed",
+		},
+		{
+			name: "system",
+			msg:  &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_SYSTEM, TextContent: "alice joined"},
+			want: "[yellow]*** alice joined[-]",
+		},
+		{
+			name: "encrypted without a device key",
+			msg:  &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_ENCRYPTED, Username: "alice", Recipient: "bob"},
+			want: "[::b]<encrypted>[::-] [" + userColor("alice") + "]alice[-]: (encrypted, run `keys register` to read encrypted messages on this device)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Skip the timestamp
+			line := formatTUIMessage(tt.msg)
+			require.Equal(t, tt.want, line[len("[gray]15:04:05[-] "):])
+		})
+	}
+}
+
+func TestUseTUI(t *testing.T) {
+	require := require.New(t)
+	tui, err := useTUI("tui")
+	require.NoError(err)
+	require.True(tui)
+	tui, err = useTUI("line")
+	require.NoError(err)
+	require.False(tui)
+	// Tests don't run on a terminal
+	tui, err = useTUI("auto")
+	require.NoError(err)
+	require.False(tui)
+	_, err = useTUI("gui")
+	require.Error(err)
+}
@@ -0,0 +1,81 @@
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	// Prefix is the beginning of every API key, it tells API keys apart from JWT tokens.
+	Prefix = "gcb_"
+
+	// ScopeMessagesWrite allows posting messages.
+	ScopeMessagesWrite = "messages:write"
+	// ScopeMessagesRead allows reading messages.
+	ScopeMessagesRead = "messages:read"
+
+	// displayPrefixLen is the length of the key prefix stored in plaintext for display.
+	displayPrefixLen = len(Prefix) + 8
+	// secretLen is the number of random bytes in a key.
+	secretLen = 32
+)
+
+// AllScopes contains every scope a key can be granted.
+var AllScopes = []string{ScopeMessagesRead, ScopeMessagesWrite}
+
+// Key is a newly generated API key.
+type Key struct {
+	Plaintext     string // shown to the user once and never stored
+	DisplayPrefix string // stored in plaintext to tell keys apart
+	Hash          string // stored to verify the key
+}
+
+// Generate generates a new random API key.
+func Generate() (*Key, error) {
+	secret := make([]byte, secretLen)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate api key: %v", err)
+	}
+
+	plaintext := Prefix + base64.RawURLEncoding.EncodeToString(secret)
+	return &Key{
+		Plaintext:     plaintext,
+		DisplayPrefix: plaintext[:displayPrefixLen],
+		Hash:          Hash(plaintext),
+	}, nil
+}
+
+// Hash returns the hex encoded SHA-256 hash of key.
+// API keys are long random strings, so a fast hash is enough unlike passwords.
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsAPIKey reports whether token looks like an API key rather than a JWT token.
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, Prefix)
+}
+
+// ParseScopes parses the comma separated scopes stored in the database.
+func ParseScopes(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// FormatScopes validates scopes and formats them to be stored in the database.
+func FormatScopes(scopes []string) (string, error) {
+	for _, scope := range scopes {
+		if !slices.Contains(AllScopes, scope) {
+			return "", fmt.Errorf("unknown scope: %q", scope)
+		}
+	}
+	return strings.Join(scopes, ","), nil
+}
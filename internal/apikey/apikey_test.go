@@ -0,0 +1,69 @@
+//go:build unit_test
+
+package apikey
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerate(t *testing.T) {
+	require := require.New(t)
+
+	key, err := Generate()
+	require.NoError(err)
+	require.True(IsAPIKey(key.Plaintext))
+	require.True(len(key.Plaintext) > displayPrefixLen)
+	require.Equal(key.Plaintext[:displayPrefixLen], key.DisplayPrefix)
+	require.Equal(Hash(key.Plaintext), key.Hash)
+
+	another, err := Generate()
+	require.NoError(err)
+	require.NotEqual(key.Plaintext, another.Plaintext)
+}
+
+func TestIsAPIKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		want  bool
+	}{
+		{name: "api key", token: "gcb_abc", want: true},
+		{name: "jwt token", token: "eyJhbGciOiJIUzI1NiJ9.e30.sig", want: false},
+		{name: "empty", token: "", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, IsAPIKey(tt.token))
+		})
+	}
+}
+
+func TestFormatScopes(t *testing.T) {
+	tests := []struct {
+		name    string
+		scopes  []string
+		want    string
+		wantErr bool
+	}{
+		{name: "one scope", scopes: []string{ScopeMessagesWrite}, want: "messages:write"},
+		{name: "all scopes", scopes: AllScopes, want: "messages:read,messages:write"},
+		{name: "unknown scope", scopes: []string{"admin"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			got, err := FormatScopes(tt.scopes)
+			if tt.wantErr {
+				require.Error(err)
+				return
+			}
+			require.NoError(err)
+			require.Equal(tt.want, got)
+			require.Equal(tt.scopes, ParseScopes(got))
+		})
+	}
+}
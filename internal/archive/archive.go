@@ -0,0 +1,318 @@
+// Package archive reads and writes the chat history archives of ExportHistory,
+// as JSON Lines or as mbox files readable by mail clients.
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Format is the format of an archive.
+type Format string
+
+const (
+	// JSONLines archives hold a protojson ExportRecord per line.
+	JSONLines Format = "jsonl"
+	// Mbox archives hold a mail per record in the mboxrd format. Messages are
+	// plain text mails, the other records and the encrypted messages, whose
+	// ciphertext is binary, are mails with a JSON body.
+	Mbox Format = "mbox"
+)
+
+// ParseFormat returns the format named s.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case JSONLines, Mbox:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown archive format %q, use %s or %s", s, JSONLines, Mbox)
+}
+
+// Mbox headers of the records.
+const (
+	recordHeader    = "X-Chatroom-Record"
+	roomHeader      = "X-Chatroom-Room"
+	typeHeader      = "X-Chatroom-Type"
+	recipientHeader = "X-Chatroom-Recipient"
+)
+
+// mboxSender is the envelope sender of the mails of mbox archives.
+const mboxSender = "chatroom@grpc-go-chatroom"
+
+// messageIDDomain is the domain of the Message-ID of the messages of mbox archives.
+const messageIDDomain = "grpc-go-chatroom"
+
+// Writer writes the records of an archive.
+type Writer struct {
+	w          *bufio.Writer
+	format     Format
+	exportedAt int64 // the date of the mails of the records other than messages
+}
+
+// NewWriter returns a Writer of an archive in format to w.
+// Flush must be called after the last record.
+func NewWriter(w io.Writer, format Format) *Writer {
+	return &Writer{w: bufio.NewWriter(w), format: format}
+}
+
+// Write writes rec to the archive.
+func (w *Writer) Write(rec *pb.ExportRecord) error {
+	if w.format == Mbox {
+		return w.writeMail(rec)
+	}
+	data, err := protojson.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	w.w.Write(data)
+	return w.w.WriteByte('\n')
+}
+
+// Flush writes the buffered records to the underlying writer.
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// writeMail writes rec as a mail of an mbox archive.
+func (w *Writer) writeMail(rec *pb.ExportRecord) error {
+	var headers [][2]string
+	var body string
+	date := w.exportedAt
+	if header := rec.GetHeader(); header != nil {
+		w.exportedAt = header.GetExportedAt()
+		date = w.exportedAt
+	}
+	if msg := rec.GetMessage(); msg != nil && len(msg.GetBinaryContent()) == 0 && len(msg.GetWrappedKeys()) == 0 {
+		date = msg.GetTimestamp()
+		to := "#" + msg.GetRoom()
+		if msg.GetRecipient() != "" {
+			to = msg.GetRecipient()
+		}
+		headers = [][2]string{
+			{"Message-ID", fmt.Sprintf("<%d@%s>", msg.GetMessageNumber(), messageIDDomain)},
+			{"Date", time.Unix(date, 0).UTC().Format(time.RFC1123Z)},
+			{"From", msg.GetUsername()},
+			{"To", to},
+			{"Subject", msg.GetRoom()},
+			{recordHeader, "message"},
+			{roomHeader, msg.GetRoom()},
+			{typeHeader, msg.GetType().String()},
+		}
+		if msg.GetRecipient() != "" {
+			headers = append(headers, [2]string{recipientHeader, msg.GetRecipient()})
+		}
+		headers = append(headers, [2]string{"Content-Type", "text/plain; charset=utf-8"})
+		body = msg.GetTextContent()
+	} else {
+		if msg := rec.GetMessage(); msg != nil {
+			date = msg.GetTimestamp()
+		}
+		data, err := protojson.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		headers = [][2]string{
+			{recordHeader, recordName(rec)},
+			{"Content-Type", "application/json"},
+		}
+		body = string(data)
+	}
+
+	fmt.Fprintf(w.w, "From %s %s\n", mboxSender, time.Unix(date, 0).UTC().Format(time.ANSIC))
+	for _, h := range headers {
+		fmt.Fprintf(w.w, "%s: %s\n", h[0], mime.QEncoding.Encode("utf-8", h[1]))
+	}
+	w.w.WriteByte('\n')
+	for _, line := range strings.Split(body, "\n") {
+		// mboxrd quotes the lines starting with From, with any number of >.
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			w.w.WriteByte('>')
+		}
+		w.w.WriteString(line)
+		w.w.WriteByte('\n')
+	}
+	// A blank line separates the mails.
+	return w.w.WriteByte('\n')
+}
+
+// recordName returns the X-Chatroom-Record value of rec.
+func recordName(rec *pb.ExportRecord) string {
+	switch rec.GetRecord().(type) {
+	case *pb.ExportRecord_Header:
+		return "header"
+	case *pb.ExportRecord_Room:
+		return "room"
+	case *pb.ExportRecord_User:
+		return "user"
+	case *pb.ExportRecord_Attachment:
+		return "attachment"
+	}
+	return "message"
+}
+
+// Reader reads the records of an archive.
+type Reader struct {
+	r      *bufio.Reader
+	format Format
+	line   int
+	next   string // the From line of the next mail of an mbox archive
+}
+
+// NewReader returns a Reader of the archive of r, whose format is detected from
+// its first bytes.
+func NewReader(r io.Reader) *Reader {
+	br := bufio.NewReader(r)
+	format := JSONLines
+	if prefix, _ := br.Peek(len("From ")); string(prefix) == "From " {
+		format = Mbox
+	}
+	return &Reader{r: br, format: format}
+}
+
+// Format returns the format of the archive.
+func (r *Reader) Format() Format {
+	return r.format
+}
+
+// Read returns the next record of the archive, or io.EOF after the last one.
+func (r *Reader) Read() (*pb.ExportRecord, error) {
+	if r.format == Mbox {
+		return r.readMail()
+	}
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		rec := &pb.ExportRecord{}
+		if err := protojson.Unmarshal([]byte(line), rec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", r.line, err)
+		}
+		return rec, nil
+	}
+}
+
+// readLine returns the next line of the archive without its line break.
+func (r *Reader) readLine() (string, error) {
+	line, err := r.r.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	r.line++
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+// readMail returns the record of the next mail of an mbox archive.
+func (r *Reader) readMail() (*pb.ExportRecord, error) {
+	if r.next == "" {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "From ") {
+			return nil, fmt.Errorf("line %d: expected a From line", r.line)
+		}
+	}
+	start := r.line
+	r.next = ""
+
+	headers := map[string]string{}
+	var dec mime.WordDecoder
+	for {
+		line, err := r.readLine()
+		if err == io.EOF {
+			return nil, fmt.Errorf("line %d: unexpected end of mail headers", r.line)
+		} else if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			return nil, fmt.Errorf("line %d: malformed header", r.line)
+		}
+		if headers[name], err = dec.DecodeHeader(value); err != nil {
+			return nil, fmt.Errorf("line %d: %w", r.line, err)
+		}
+	}
+
+	var body bytes.Buffer
+	for {
+		line, err := r.readLine()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(line, "From ") {
+			r.next = line
+			break
+		}
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			line = line[1:]
+		}
+		body.WriteString(line)
+		body.WriteByte('\n')
+	}
+	// Drop the line break of the last line and the blank line separating the mails.
+	text := strings.TrimSuffix(strings.TrimSuffix(body.String(), "\n"), "\n")
+
+	rec, err := mailRecord(headers, text)
+	if err != nil {
+		return nil, fmt.Errorf("mail at line %d: %w", start, err)
+	}
+	return rec, nil
+}
+
+// mailRecord returns the record of a mail of an mbox archive.
+func mailRecord(headers map[string]string, body string) (*pb.ExportRecord, error) {
+	if headers[recordHeader] != "message" || headers["Content-Type"] == "application/json" {
+		rec := &pb.ExportRecord{}
+		if err := protojson.Unmarshal([]byte(body), rec); err != nil {
+			return nil, err
+		}
+		if recordName(rec) != headers[recordHeader] || rec.GetRecord() == nil {
+			return nil, fmt.Errorf("the body is not a %s record", headers[recordHeader])
+		}
+		return rec, nil
+	}
+
+	id := strings.TrimSuffix(strings.TrimPrefix(headers["Message-ID"], "<"), "@"+messageIDDomain+">")
+	number, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Message-ID %q", headers["Message-ID"])
+	}
+	date, err := time.Parse(time.RFC1123Z, headers["Date"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid Date: %w", err)
+	}
+	msgType, ok := pb.MessageType_value[headers[typeHeader]]
+	if !ok {
+		return nil, fmt.Errorf("invalid %s %q", typeHeader, headers[typeHeader])
+	}
+	return &pb.ExportRecord{Record: &pb.ExportRecord_Message{Message: &pb.Message{
+		MessageNumber: number,
+		Timestamp:     date.Unix(),
+		Username:      headers["From"],
+		Room:          headers[roomHeader],
+		Recipient:     headers[recipientHeader],
+		Type:          pb.MessageType(msgType),
+		TextContent:   body,
+	}}}, nil
+}
@@ -0,0 +1,139 @@
+//go:build unit_test
+
+package archive
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+var testRecords = []*pb.ExportRecord{
+	{Record: &pb.ExportRecord_Header{Header: &pb.ExportHeader{
+		Version:    1,
+		ExportedAt: 1723766400,
+		Filter:     &pb.ExportHistoryRequest{Rooms: []string{"general"}, IncludePrivate: true},
+	}}},
+	{Record: &pb.ExportRecord_Room{Room: &pb.ExportedRoom{Name: "general", Topic: "Anything goes", MessageCount: 3}}},
+	{Record: &pb.ExportRecord_User{User: &pb.ExportedUser{
+		Profile:   &pb.UserProfile{Username: "alice", DisplayName: "Alice Liddell", Bio: "Down the\nrabbit hole"},
+		CreatedAt: 1723680000,
+	}}},
+	{Record: &pb.ExportRecord_Message{Message: &pb.Message{
+		MessageNumber: 11, Username: "alice", Room: "general", Type: pb.MessageType_MESSAGE_TYPE_NORMAL,
+		Timestamp: 1723680000, TextContent: "Hello\nFrom Wonderland\n>From the other side\n",
+	}}},
+	{Record: &pb.ExportRecord_Message{Message: &pb.Message{
+		MessageNumber: 12, Username: "alice", Room: "général", Type: pb.MessageType_MESSAGE_TYPE_PRIVATE,
+		Recipient: "bob", Timestamp: 1723680001,
+	}}},
+	{Record: &pb.ExportRecord_Message{Message: &pb.Message{
+		MessageNumber: 13, Username: "alice", Room: "general", Type: pb.MessageType_MESSAGE_TYPE_ENCRYPTED,
+		Recipient: "bob", Timestamp: 1723680002, BinaryContent: []byte("From ciphertext\n"),
+		WrappedKeys: []*pb.WrappedKey{{Username: "bob", DeviceId: "phone", EphemeralPublicKey: []byte("ephemeral"), WrappedKey: []byte("wrapped")}},
+	}}},
+	{Record: &pb.ExportRecord_Attachment{Attachment: &pb.ExportedAttachment{MessageNumber: 11, Name: "cat.png", Size: 1024}}},
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, format := range []Format{JSONLines, Mbox} {
+		t.Run(string(format), func(t *testing.T) {
+			require := require.New(t)
+			var buf bytes.Buffer
+			w := NewWriter(&buf, format)
+			for _, rec := range testRecords {
+				require.NoError(w.Write(rec))
+			}
+			require.NoError(w.Flush())
+
+			r := NewReader(&buf)
+			require.Equal(format, r.Format())
+			for _, expected := range testRecords {
+				rec, err := r.Read()
+				require.NoError(err)
+				require.True(proto.Equal(expected, rec), "expected %v, got %v", expected, rec)
+			}
+			_, err := r.Read()
+			require.Equal(io.EOF, err)
+		})
+	}
+}
+
+func TestMboxMessage(t *testing.T) {
+	require := require.New(t)
+	var buf bytes.Buffer
+	w := NewWriter(&buf, Mbox)
+	require.NoError(w.Write(testRecords[3]))
+	require.NoError(w.Flush())
+	require.Equal("From chatroom@grpc-go-chatroom Thu Aug 15 00:00:00 2024\n"+
+		"Message-ID: <11@grpc-go-chatroom>\n"+
+		"Date: Thu, 15 Aug 2024 00:00:00 +0000\n"+
+		"From: alice\n"+
+		"To: #general\n"+
+		"Subject: general\n"+
+		"X-Chatroom-Record: message\n"+
+		"X-Chatroom-Room: general\n"+
+		"X-Chatroom-Type: MESSAGE_TYPE_NORMAL\n"+
+		"Content-Type: text/plain; charset=utf-8\n"+
+		"\n"+
+		"Hello\n"+
+		">From Wonderland\n"+
+		">>From the other side\n"+
+		"\n"+
+		"\n", buf.String())
+}
+
+func TestReadErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		archive       string
+		expectedError string
+	}{
+		{
+			name:          "invalid JSON",
+			archive:       "\n{\"room\": {\"name\": \"general\"}}\n{\"room\": \n",
+			expectedError: "line 3: ",
+		},
+		{
+			name:          "truncated mail",
+			archive:       "From chatroom@grpc-go-chatroom Thu Aug 15 00:00:00 2024\nX-Chatroom-Record: room\n",
+			expectedError: "line 2: unexpected end of mail headers",
+		},
+		{
+			name: "mismatched record",
+			archive: "From chatroom@grpc-go-chatroom Thu Aug 15 00:00:00 2024\nX-Chatroom-Record: user\n\n" +
+				"{\"room\": {\"name\": \"general\"}}\n\n",
+			expectedError: "mail at line 1: the body is not a user record",
+		},
+		{
+			name: "invalid Message-ID",
+			archive: "From chatroom@grpc-go-chatroom Thu Aug 15 00:00:00 2024\nMessage-ID: <abc@example.com>\n" +
+				"X-Chatroom-Record: message\n\nHello\n\n",
+			expectedError: "mail at line 1: invalid Message-ID \"<abc@example.com>\"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(strings.NewReader(tt.archive))
+			var err error
+			for err == nil {
+				_, err = r.Read()
+			}
+			require.ErrorContains(t, err, tt.expectedError)
+		})
+	}
+}
+
+func TestParseFormat(t *testing.T) {
+	f, err := ParseFormat("mbox")
+	require.NoError(t, err)
+	require.Equal(t, Mbox, f)
+	_, err = ParseFormat("csv")
+	require.EqualError(t, err, `unknown archive format "csv", use jsonl or mbox`)
+}
@@ -1,129 +1,779 @@
+// Package config loads the configurations of the server and the client.
+//
+// Every setting has a key like "server.port", and is read from these layers,
+// the later overriding the earlier:
+//
+//  1. the defaults below
+//  2. a YAML or TOML file, see Options.File
+//  3. environment variables, GRPC_GO_CHATROOM_ followed by the key in upper case with
+//     dots replaced by underscores, e.g. GRPC_GO_CHATROOM_SERVER_PORT. Lists are comma separated.
+//  4. command line flags, see Options.Flags
+//
+// The client's file may also hold named profiles, whose settings override the
+// rest of the file when the profile is selected, see Options.Profile.
 package config
 
 import (
-	"embed"
-	"io"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 )
 
-var (
-	//go:embed config.yaml
-	configFS embed.FS
+// EnvPrefix prefixes the environment variables read by Load.
+const EnvPrefix = "GRPC_GO_CHATROOM"
 
-	Mysql  *mysqlConfig
-	Server *serverConfig
-	JWT    *jwtConfig
-)
+// ConfigFileEnv names the config file when Options.File is empty.
+const ConfigFileEnv = EnvPrefix + "_CONFIG"
 
-type mysqlConfig struct {
-	Host     string
-	Port     uint64
-	User     string
-	Password string
-	DBName   string
-}
+// ProfileEnv names the profile to apply when Options.Profile is empty.
+const ProfileEnv = EnvPrefix + "_PROFILE"
 
-type serverConfig struct {
-	Port uint64
+// Options tells where to read the configuration from besides the defaults and the environment.
+type Options struct {
+	// File is the path of a YAML or TOML config file. If empty, the file named by
+	// GRPC_GO_CHATROOM_CONFIG is read, or else the default file of the schema if it exists.
+	File string
+	// Flags holds the command line flags set by the user, keyed by config key.
+	Flags map[string]any
+	// Profile names the section under "profiles" of the file to apply, for schemas
+	// supporting profiles. If empty, the profile named by GRPC_GO_CHATROOM_PROFILE is
+	// applied, or else the one named by the "profile" key of the file, if any.
+	Profile string
+	// LookupEnv looks up environment variables, os.LookupEnv if nil.
+	LookupEnv func(key string) (string, bool)
 }
 
-type jwtConfig struct {
-	JWTKey string
+// schema describes the settings of a binary.
+type schema struct {
+	// defaults holds every known key with its default value.
+	defaults map[string]any
+	// legacyEnv maps keys to the environment variables used before the generic names.
+	legacyEnv map[string]string
+	// renamedSections maps sections to their new names. Their keys are still read
+	// under the old names, from files and env vars, unless set under the new ones.
+	renamedSections map[string]string
+	// defaultFile is read if it exists and no file is given.
+	defaultFile string
+	// profiles enables the named profiles of the file.
+	profiles bool
 }
 
-func init() {
-	loadConfigs()
+// file returns the config file to read, or "" if there is none.
+func (s schema) file(opts Options) string {
+	lookupEnv := opts.LookupEnv
+	if lookupEnv == nil {
+		lookupEnv = os.LookupEnv
+	}
+	if opts.File != "" {
+		return opts.File
+	}
+	if file, _ := lookupEnv(ConfigFileEnv); file != "" {
+		return file
+	}
+	if s.defaultFile != "" {
+		if _, err := os.Stat(s.defaultFile); err == nil {
+			return s.defaultFile
+		}
+	}
+	return ""
 }
 
-func loadConfigs() {
+// load reads the layers of s into out.
+func load(s schema, opts Options, out any) error {
+	lookupEnv := opts.LookupEnv
+	if lookupEnv == nil {
+		lookupEnv = os.LookupEnv
+	}
 
-	content, err := configFS.ReadFile("config.yaml")
-	if err != nil || len(content) == 0 {
-		log.Fatalf("failed to read embed config file: %v", err)
+	v := viper.New()
+	for key, value := range s.defaults {
+		v.SetDefault(key, value)
 	}
 
-	config := viper.New()
-	config.SetConfigFile("config.yaml")
-	config.SetConfigType("yaml")
+	if file := s.file(opts); file != "" {
+		v.SetConfigFile(file)
+		if err := v.ReadInConfig(); err != nil {
+			return fmt.Errorf("failed to read config file %s: %w", file, err)
+		}
+	}
+	if s.profiles {
+		if err := applyProfile(v, s, opts, lookupEnv); err != nil {
+			return err
+		}
+	}
+	for _, key := range sortedKeys(s.defaults) {
+		if oldKey := s.oldKey(key); oldKey != "" && v.InConfig(oldKey) && !v.InConfig(key) {
+			v.Set(key, v.Get(oldKey))
+		}
+	}
 
-	configFile, err := configFS.Open("config.yaml")
-	if err != nil {
-		log.Fatalf("failed to open embed config file: %v", err)
+	// Set overrides the file and the defaults, and flags are set last to win over env vars.
+	for _, key := range sortedKeys(s.defaults) {
+		names := []string{EnvName(key)}
+		if oldKey := s.oldKey(key); oldKey != "" {
+			names = append(names, EnvName(oldKey))
+		}
+		if name, ok := s.legacyEnv[key]; ok {
+			names = append(names, name)
+		}
+		for _, name := range names {
+			if value, ok := lookupEnv(name); ok {
+				v.Set(key, value)
+				break
+			}
+		}
+	}
+	for key, value := range opts.Flags {
+		if _, ok := s.defaults[key]; !ok {
+			return fmt.Errorf("unknown config key of flag: %s", key)
+		}
+		v.Set(key, value)
 	}
 
-	err = config.ReadConfig(configFile)
+	err := v.Unmarshal(out, viper.DecodeHook(mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+	)))
 	if err != nil {
-		log.Fatalf("failed to read config: %v", err)
+		return fmt.Errorf("failed to decode config: %w", err)
+	}
+	return nil
+}
+
+// oldKey returns the name of key before its section was renamed, or "" if it was not.
+func (s schema) oldKey(key string) string {
+	for old, section := range s.renamedSections {
+		if rest, ok := strings.CutPrefix(key, section+"."); ok {
+			return old + "." + rest
+		}
+	}
+	return ""
+}
+
+// applyProfile overrides the settings of the file by those of the selected profile.
+func applyProfile(v *viper.Viper, s schema, opts Options, lookupEnv func(string) (string, bool)) error {
+	name := opts.Profile
+	if name == "" {
+		name, _ = lookupEnv(ProfileEnv)
+	}
+	if name == "" {
+		name = v.GetString("profile")
+	}
+	if name == "" {
+		return nil
+	}
+
+	profiles := v.GetStringMap("profiles")
+	if len(profiles) == 0 {
+		return fmt.Errorf("unknown profile %q, the config file has no profiles", name)
+	}
+	if _, ok := profiles[strings.ToLower(name)]; !ok {
+		return fmt.Errorf("unknown profile %q, the config file has: %s", name, strings.Join(sortedKeys(profiles), ", "))
+	}
+	profile := v.Sub("profiles." + name)
+	if profile == nil {
+		return fmt.Errorf("profile %q: must be a table of settings", name)
 	}
+	for _, key := range sortedKeys(s.defaults) {
+		if profile.IsSet(key) {
+			v.Set(key, profile.Get(key))
+		}
+	}
+	return nil
+}
 
-	// Mysql
-	dbPortStr := os.Getenv("GRPC_GO_CHATROOM_DBPORT")
-	if dbPortStr == "" {
-		log.Fatal("dbport is not set or invalid, check environment variables")
+// EnvName returns the environment variable of key, e.g. GRPC_GO_CHATROOM_SERVER_PORT for "server.port".
+func EnvName(key string) string {
+	return EnvPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// readSecretFile returns the trimmed content of file, or "" if it does not exist.
+func readSecretFile(file string) (string, error) {
+	if file == "" {
+		return "", nil
+	}
+	content, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
 	}
-	dbPort, err := strconv.Atoi(dbPortStr)
 	if err != nil {
-		log.Fatalf("failed to parse dbport: %v", err)
+		return "", fmt.Errorf("failed to read secret file: %w", err)
 	}
-	mysqlPass := ""
-	if t := os.Getenv("GRPC_GO_CHATROOM_DBPASS"); t != "" {
-		mysqlPass = t
-	} else {
-		f, err := os.Open("/run/secrets/db-password")
-		if err != nil {
-			log.Fatalf("failed to open dbpass secret file: %v", err)
+	return strings.TrimSpace(string(content)), nil
+}
+
+// validationErrors collects the problems of a config, so that all of them are reported at once.
+type validationErrors []error
+
+func (errs *validationErrors) addf(format string, args ...any) {
+	*errs = append(*errs, fmt.Errorf(format, args...))
+}
+
+func (errs validationErrors) err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid config: %w", errors.Join(errs...))
+}
+
+// validateCertPair checks that the certificate and key files under section are set together.
+func validateCertPair(errs *validationErrors, section, certFile, keyFile string) {
+	if certFile != "" && keyFile == "" {
+		errs.addf("%s.key_file: is required with %s.cert_file", section, section)
+	}
+	if certFile == "" && keyFile != "" {
+		errs.addf("%s.cert_file: is required with %s.key_file", section, section)
+	}
+}
+
+func validatePort(errs *validationErrors, key string, port int) {
+	if port <= 0 || port > 65535 {
+		errs.addf("%s: must be between 1 and 65535, got %d", key, port)
+	}
+}
+
+func validateDuration(errs *validationErrors, key string, d time.Duration) {
+	if d < 0 {
+		errs.addf("%s: must not be negative, got %s", key, d)
+	}
+}
+
+// ServerConfig is the configuration of the server.
+// The limits, content_filter and retention sections, log.level and server.allowed_origins
+// can be changed at runtime, see Reloader.
+type ServerConfig struct {
+	Server        ServerSettings      `mapstructure:"server"`
+	Database      DatabaseConfig      `mapstructure:"database"`
+	JWT           JWTConfig           `mapstructure:"jwt"`
+	Limits        LimitsConfig        `mapstructure:"limits"`
+	ContentFilter ContentFilterConfig `mapstructure:"content_filter"`
+	Retention     RetentionConfig     `mapstructure:"retention"`
+	Log           LogConfig           `mapstructure:"log"`
+	TLS           TLSConfig           `mapstructure:"tls"`
+	Tracing       TracingConfig       `mapstructure:"tracing"`
+}
+
+type ServerSettings struct {
+	Port           int      `mapstructure:"port"`
+	Admins         []string `mapstructure:"admins"`          // usernames allowed to call admin RPCs
+	AllowedOrigins []string `mapstructure:"allowed_origins"` // origins allowed to call the HTTP API and open websockets besides the server's own
+}
+
+// Drivers of the database.
+const (
+	DatabaseDriverMySQL    = "mysql"
+	DatabaseDriverPostgres = "postgres"
+)
+
+// DatabaseConfig configures the database. The section was named "mysql" before
+// PostgreSQL was supported, and that name still works.
+type DatabaseConfig struct {
+	Driver       string `mapstructure:"driver"` // DatabaseDriverMySQL or DatabaseDriverPostgres
+	Host         string `mapstructure:"host"`
+	Port         int    `mapstructure:"port"` // 0 for the default port of the driver
+	User         string `mapstructure:"user"`
+	Password     string `mapstructure:"password"`
+	PasswordFile string `mapstructure:"password_file"` // read if Password is empty, e.g. a docker secret
+	DBName       string `mapstructure:"dbname"`
+	AutoMigrate  bool   `mapstructure:"auto_migrate"` // apply the pending schema migrations on startup
+
+	MaxOpenConns    int           `mapstructure:"max_open_conns"`     // 0 for no limit
+	MaxIdleConns    int           `mapstructure:"max_idle_conns"`     // kept open for reuse
+	ConnMaxLifetime time.Duration `mapstructure:"conn_max_lifetime"`  // 0 to reuse connections forever
+	ConnMaxIdleTime time.Duration `mapstructure:"conn_max_idle_time"` // 0 to keep idle connections forever
+	ConnectTimeout  time.Duration `mapstructure:"connect_timeout"`    // how long to wait for the database on startup, 0 to try once
+	QueryTimeout    time.Duration `mapstructure:"query_timeout"`      // bounds every query, 0 for no bound
+}
+
+// DefaultPort returns the port the database listens on by default, 0 for an unknown driver.
+func (c DatabaseConfig) DefaultPort() int {
+	switch c.Driver {
+	case DatabaseDriverMySQL:
+		return 3306
+	case DatabaseDriverPostgres:
+		return 5432
+	}
+	return 0
+}
+
+type JWTConfig struct {
+	Key     string `mapstructure:"key"`
+	KeyFile string `mapstructure:"key_file"` // read if Key is empty, e.g. a docker secret
+}
+
+// LimitsConfig limits the messages sent by every user, zero disables a limit.
+type LimitsConfig struct {
+	MaxMessageLength  int     `mapstructure:"max_message_length"`  // in bytes
+	MessagesPerSecond float64 `mapstructure:"messages_per_second"` // including commands
+	MessageBurst      int     `mapstructure:"message_burst"`       // messages allowed at once above the rate
+}
+
+// Actions of the content filter.
+const (
+	FilterActionMask   = "mask"   // replace the blocked words with asterisks
+	FilterActionReject = "reject" // reject the whole message
+)
+
+// ContentFilterConfig filters the messages sent by users and bots.
+type ContentFilterConfig struct {
+	BlockedWords []string `mapstructure:"blocked_words"` // matched case-insensitively anywhere in a message
+	Action       string   `mapstructure:"action"`        // FilterActionMask or FilterActionReject
+}
+
+// RetentionConfig deletes the old messages periodically. The rooms listed in Rooms
+// follow their own policy instead of the global one, zero keeps messages.
+type RetentionConfig struct {
+	MaxAge      time.Duration   `mapstructure:"max_age"`      // delete older messages
+	MaxMessages int             `mapstructure:"max_messages"` // keep the newest messages of every room
+	Rooms       []RoomRetention `mapstructure:"rooms"`        // only read from the config file
+	LegalHold   LegalHoldConfig `mapstructure:"legal_hold"`
+	Interval    time.Duration   `mapstructure:"interval"`    // between purges, 0 disables them
+	BatchSize   int             `mapstructure:"batch_size"`  // messages deleted per statement
+	BatchPause  time.Duration   `mapstructure:"batch_pause"` // between the statements of a purge, letting other queries in
+}
+
+// Policy returns the max age and max messages applying to room.
+func (c RetentionConfig) Policy(room string) (maxAge time.Duration, maxMessages int) {
+	for _, r := range c.Rooms {
+		if r.Room == room {
+			return r.MaxAge, r.MaxMessages
 		}
-		dbPassRaw, err := io.ReadAll(f)
-		dbPass := strings.TrimSpace(string(dbPassRaw))
-		if err != nil || dbPass == "" {
-			log.Fatalf("failed to read dbpass secret file: %v", err)
+	}
+	return c.MaxAge, c.MaxMessages
+}
+
+// Enabled reports whether any message may be purged.
+func (c RetentionConfig) Enabled() bool {
+	if c.Interval == 0 {
+		return false
+	}
+	if c.MaxAge > 0 || c.MaxMessages > 0 {
+		return true
+	}
+	for _, r := range c.Rooms {
+		if r.MaxAge > 0 || r.MaxMessages > 0 {
+			return true
 		}
-		mysqlPass = string(dbPass)
 	}
+	return false
+}
+
+// RoomRetention is the retention policy of one room.
+type RoomRetention struct {
+	Room        string        `mapstructure:"room"`
+	MaxAge      time.Duration `mapstructure:"max_age"`
+	MaxMessages int           `mapstructure:"max_messages"`
+}
+
+// LegalHoldConfig exempts messages from retention, e.g. during an investigation.
+type LegalHoldConfig struct {
+	Rooms []string `mapstructure:"rooms"`
+	Users []string `mapstructure:"users"` // the messages sent by these users are kept
+}
+
+type LogConfig struct {
+	Level  string `mapstructure:"level"`  // debug, info, warn or error
+	Format string `mapstructure:"format"` // text or json, only read at startup
+}
+
+// SlogLevel returns the validated level as a slog.Level.
+func (c LogConfig) SlogLevel() slog.Level {
+	var level slog.Level
+	// Validate has already checked the level.
+	level.UnmarshalText([]byte(c.Level))
+	return level
+}
+
+// Client certificate policies of the server.
+const (
+	ClientAuthNone     = "none"     // do not ask for client certificates
+	ClientAuthOptional = "optional" // verify client certificates if given
+	ClientAuthRequire  = "require"  // reject clients without a valid certificate
+)
+
+// TLSConfig enables TLS on the server if CertFile is set. The certificate and key
+// files are loaded again when they change, so that they can be rotated without a restart.
+type TLSConfig struct {
+	CertFile     string `mapstructure:"cert_file"`
+	KeyFile      string `mapstructure:"key_file"`
+	ClientCAFile string `mapstructure:"client_ca_file"` // CA certificates verifying client certificates
+	ClientAuth   string `mapstructure:"client_auth"`    // ClientAuthNone, ClientAuthOptional or ClientAuthRequire
+}
+
+// Enabled reports whether the server serves TLS.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != ""
+}
+
+// Exporters of the traces.
+const (
+	TracingExporterNone   = "none"   // traces are not exported, but still propagated
+	TracingExporterOTLP   = "otlp"   // OTLP over gRPC to a collector
+	TracingExporterStdout = "stdout" // JSON on stdout, for development
+)
+
+// TracingConfig configures the OpenTelemetry traces, only read at startup.
+type TracingConfig struct {
+	Exporter    string  `mapstructure:"exporter"`     // TracingExporterNone, TracingExporterOTLP or TracingExporterStdout
+	Endpoint    string  `mapstructure:"endpoint"`     // host:port of the OTLP collector
+	Insecure    bool    `mapstructure:"insecure"`     // connect to the collector without TLS
+	SampleRatio float64 `mapstructure:"sample_ratio"` // of the traces started by the server, others follow their parent
+	ServiceName string  `mapstructure:"service_name"`
+}
+
+var serverSchema = schema{
+	defaults: map[string]any{
+		"server.port":                 8082,
+		"server.admins":               []string{},
+		"server.allowed_origins":      []string{},
+		"database.driver":             DatabaseDriverMySQL,
+		"database.host":               "127.0.0.1",
+		"database.port":               0,
+		"database.user":               "",
+		"database.password":           "",
+		"database.password_file":      "/run/secrets/db-password",
+		"database.dbname":             "",
+		"database.auto_migrate":       false,
+		"database.max_open_conns":     20,
+		"database.max_idle_conns":     10,
+		"database.conn_max_lifetime":  "30m",
+		"database.conn_max_idle_time": "5m",
+		"database.connect_timeout":    "1m",
+		"database.query_timeout":      "5s",
+		"jwt.key":                     "",
+		"jwt.key_file":                "/run/secrets/jwt-key",
+
+		"limits.max_message_length":    4096,
+		"limits.messages_per_second":   5,
+		"limits.message_burst":         10,
+		"content_filter.blocked_words": []string{},
+		"content_filter.action":        FilterActionMask,
+		"retention.max_age":            "0s",
+		"retention.max_messages":       0,
+		"retention.rooms":              []any{},
+		"retention.legal_hold.rooms":   []string{},
+		"retention.legal_hold.users":   []string{},
+		"retention.interval":           "1h",
+		"retention.batch_size":         1000,
+		"retention.batch_pause":        "100ms",
+		"log.level":                    "info",
+		"log.format":                   "text",
+		"tls.cert_file":                "",
+		"tls.key_file":                 "",
+		"tls.client_ca_file":           "",
+		"tls.client_auth":              ClientAuthNone,
+		"tracing.exporter":             TracingExporterNone,
+		"tracing.endpoint":             "localhost:4317",
+		"tracing.insecure":             true,
+		"tracing.sample_ratio":         1.0,
+		"tracing.service_name":         "grpc-go-chatroom",
+	},
+	legacyEnv: map[string]string{
+		"server.admins":          EnvPrefix + "_ADMINS",
+		"server.allowed_origins": EnvPrefix + "_ALLOWED_ORIGINS",
+		"database.host":          EnvPrefix + "_DBHOST",
+		"database.port":          EnvPrefix + "_DBPORT",
+		"database.user":          EnvPrefix + "_DBUSER",
+		"database.password":      EnvPrefix + "_DBPASS",
+		"database.dbname":        EnvPrefix + "_DBNAME",
+		"jwt.key":                EnvPrefix + "_JWT_KEY",
+	},
+	renamedSections: map[string]string{"mysql": "database"},
+	defaultFile:     "config.yaml",
+}
 
-	Mysql = &mysqlConfig{
-		Host:     os.Getenv("GRPC_GO_CHATROOM_DBHOST"),
-		Port:     uint64(dbPort),
-		User:     os.Getenv("GRPC_GO_CHATROOM_DBUSER"),
-		DBName:   os.Getenv("GRPC_GO_CHATROOM_DBNAME"),
-		Password: mysqlPass,
+// LoadServer loads and validates the configuration of the server.
+func LoadServer(opts Options) (*ServerConfig, error) {
+	cfg := &ServerConfig{}
+	if err := load(serverSchema, opts, cfg); err != nil {
+		return nil, err
 	}
 
-	if Mysql.Host == "" || Mysql.Port <= 0 || Mysql.DBName == "" || Mysql.User == "" || Mysql.Password == "" {
-		log.Fatal("invalid mysql config, check env vars")
+	var err error
+	if cfg.Database.Password == "" {
+		if cfg.Database.Password, err = readSecretFile(cfg.Database.PasswordFile); err != nil {
+			return nil, fmt.Errorf("database.password_file: %w", err)
+		}
+	}
+	if cfg.Database.Port == 0 {
+		cfg.Database.Port = cfg.Database.DefaultPort()
+	}
+	if cfg.JWT.Key == "" {
+		if cfg.JWT.Key, err = readSecretFile(cfg.JWT.KeyFile); err != nil {
+			return nil, fmt.Errorf("jwt.key_file: %w", err)
+		}
 	}
 
-	// Server
-	Server = &serverConfig{
-		Port: uint64(config.GetInt("server.port")),
+	if err := cfg.Validate(); err != nil {
+		return nil, err
 	}
+	return cfg, nil
+}
 
-	if Server.Port <= 0 {
-		log.Fatalf("invalid server config, check config.yaml")
+// Validate reports all the invalid settings of cfg.
+func (cfg *ServerConfig) Validate() error {
+	var errs validationErrors
+	validatePort(&errs, "server.port", cfg.Server.Port)
+	switch cfg.Database.Driver {
+	case DatabaseDriverMySQL, DatabaseDriverPostgres:
+	default:
+		errs.addf("database.driver: must be %q or %q, got %q", DatabaseDriverMySQL, DatabaseDriverPostgres, cfg.Database.Driver)
+	}
+	validatePort(&errs, "database.port", cfg.Database.Port)
+	if cfg.Database.Host == "" {
+		errs.addf("database.host: is required")
+	}
+	if cfg.Database.User == "" {
+		errs.addf("database.user: is required")
+	}
+	if cfg.Database.Password == "" {
+		errs.addf("database.password: is required, set it or database.password_file")
+	}
+	if cfg.Database.DBName == "" {
+		errs.addf("database.dbname: is required")
+	}
+	if cfg.Database.MaxOpenConns < 0 {
+		errs.addf("database.max_open_conns: must not be negative, got %d", cfg.Database.MaxOpenConns)
+	}
+	if cfg.Database.MaxIdleConns < 0 {
+		errs.addf("database.max_idle_conns: must not be negative, got %d", cfg.Database.MaxIdleConns)
 	}
+	validateDuration(&errs, "database.conn_max_lifetime", cfg.Database.ConnMaxLifetime)
+	validateDuration(&errs, "database.conn_max_idle_time", cfg.Database.ConnMaxIdleTime)
+	validateDuration(&errs, "database.connect_timeout", cfg.Database.ConnectTimeout)
+	validateDuration(&errs, "database.query_timeout", cfg.Database.QueryTimeout)
+	if cfg.JWT.Key == "" {
+		errs.addf("jwt.key: is required, set it or jwt.key_file")
+	}
+	if cfg.Limits.MaxMessageLength < 0 {
+		errs.addf("limits.max_message_length: must not be negative, got %d", cfg.Limits.MaxMessageLength)
+	}
+	if cfg.Limits.MessagesPerSecond < 0 {
+		errs.addf("limits.messages_per_second: must not be negative, got %v", cfg.Limits.MessagesPerSecond)
+	}
+	if cfg.Limits.MessagesPerSecond > 0 && cfg.Limits.MessageBurst < 1 {
+		errs.addf("limits.message_burst: must be at least 1 when messages are rate limited, got %d", cfg.Limits.MessageBurst)
+	}
+	for _, word := range cfg.ContentFilter.BlockedWords {
+		if strings.TrimSpace(word) == "" {
+			errs.addf("content_filter.blocked_words: must not contain empty words")
+			break
+		}
+	}
+	if cfg.ContentFilter.Action != FilterActionMask && cfg.ContentFilter.Action != FilterActionReject {
+		errs.addf("content_filter.action: must be %q or %q, got %q", FilterActionMask, FilterActionReject, cfg.ContentFilter.Action)
+	}
+	validateRetention(&errs, cfg.Retention)
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Log.Level)); err != nil {
+		errs.addf("log.level: must be debug, info, warn or error, got %q", cfg.Log.Level)
+	}
+	if cfg.Log.Format != "text" && cfg.Log.Format != "json" {
+		errs.addf("log.format: must be text or json, got %q", cfg.Log.Format)
+	}
+	validateCertPair(&errs, "tls", cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	switch cfg.TLS.ClientAuth {
+	case ClientAuthNone:
+	case ClientAuthOptional, ClientAuthRequire:
+		if !cfg.TLS.Enabled() {
+			errs.addf("tls.client_auth: requires tls.cert_file")
+		}
+		if cfg.TLS.ClientCAFile == "" {
+			errs.addf("tls.client_ca_file: is required when tls.client_auth is %q", cfg.TLS.ClientAuth)
+		}
+	default:
+		errs.addf("tls.client_auth: must be %q, %q or %q, got %q", ClientAuthNone, ClientAuthOptional, ClientAuthRequire, cfg.TLS.ClientAuth)
+	}
+	switch cfg.Tracing.Exporter {
+	case TracingExporterNone, TracingExporterStdout:
+	case TracingExporterOTLP:
+		if cfg.Tracing.Endpoint == "" {
+			errs.addf("tracing.endpoint: is required when tracing.exporter is %q", TracingExporterOTLP)
+		}
+	default:
+		errs.addf("tracing.exporter: must be %q, %q or %q, got %q", TracingExporterNone, TracingExporterOTLP, TracingExporterStdout, cfg.Tracing.Exporter)
+	}
+	if cfg.Tracing.SampleRatio < 0 || cfg.Tracing.SampleRatio > 1 {
+		errs.addf("tracing.sample_ratio: must be between 0 and 1, got %v", cfg.Tracing.SampleRatio)
+	}
+	if cfg.Tracing.ServiceName == "" {
+		errs.addf("tracing.service_name: is required")
+	}
+	return errs.err()
+}
+
+func validateRetention(errs *validationErrors, c RetentionConfig) {
+	validateDuration(errs, "retention.max_age", c.MaxAge)
+	if c.MaxMessages < 0 {
+		errs.addf("retention.max_messages: must not be negative, got %d", c.MaxMessages)
+	}
+	seen := make(map[string]bool, len(c.Rooms))
+	for i, r := range c.Rooms {
+		if r.Room == "" {
+			errs.addf("retention.rooms[%d].room: is required", i)
+		} else if seen[r.Room] {
+			errs.addf("retention.rooms[%d].room: %q is listed twice", i, r.Room)
+		}
+		seen[r.Room] = true
+		validateDuration(errs, fmt.Sprintf("retention.rooms[%d].max_age", i), r.MaxAge)
+		if r.MaxMessages < 0 {
+			errs.addf("retention.rooms[%d].max_messages: must not be negative, got %d", i, r.MaxMessages)
+		}
+	}
+	validateDuration(errs, "retention.interval", c.Interval)
+	if c.BatchSize < 1 {
+		errs.addf("retention.batch_size: must be at least 1, got %d", c.BatchSize)
+	}
+	validateDuration(errs, "retention.batch_pause", c.BatchPause)
+}
+
+// ClientConfig is the configuration of the command line client.
+type ClientConfig struct {
+	Server       ClientServerSettings `mapstructure:"server"`
+	Username     string               `mapstructure:"username"`
+	PasswordFile string               `mapstructure:"password_file"` // file holding the password, prompted for if empty
+	TokenCache   string               `mapstructure:"token_cache"`   // file caching the issued tokens, no caching if empty
+	DeviceKey    string               `mapstructure:"device_key"`    // file holding the key of this device for encrypted messages
+	TLS          ClientTLSConfig      `mapstructure:"tls"`
+}
+
+type ClientServerSettings struct {
+	// Address is the host:port of the server, or a comma separated list of them
+	// tried in order, or a gRPC target such as dns:///chat.example.com:8082. It
+	// overrides Host and Port if set.
+	Address string `mapstructure:"address"`
+	Host    string `mapstructure:"host"`
+	Port    int    `mapstructure:"port"`
+}
 
-	// JWT
-	if t := os.Getenv("GRPC_GO_CHATROOM_JWT_KEY"); t != "" {
-		JWT = &jwtConfig{
-			JWTKey: t,
+// Addresses returns the addresses of the server.
+func (s ClientServerSettings) Addresses() []string {
+	if s.Address == "" {
+		return []string{net.JoinHostPort(s.Host, strconv.Itoa(s.Port))}
+	}
+	var addrs []string
+	for _, addr := range strings.Split(s.Address, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
 		}
+	}
+	return addrs
+}
+
+// String returns the addresses of the server as one string, e.g. to key the tokens it issued.
+func (s ClientServerSettings) String() string {
+	return strings.Join(s.Addresses(), ",")
+}
+
+// ClientTLSConfig is how the client connects to a TLS server.
+type ClientTLSConfig struct {
+	Enabled  bool   `mapstructure:"enabled"`
+	CAFile   string `mapstructure:"ca_file"`   // CA certificates verifying the server, the system ones if empty
+	CertFile string `mapstructure:"cert_file"` // client certificate, for servers requiring one
+	KeyFile  string `mapstructure:"key_file"`
+}
+
+// IsEnabled reports whether the client connects with TLS, which setting any file implies.
+func (c ClientTLSConfig) IsEnabled() bool {
+	return c.Enabled || c.CAFile != "" || c.CertFile != ""
+}
+
+var clientSchema = schema{
+	defaults: map[string]any{
+		"server.address": "",
+		"server.host":    "localhost",
+		"server.port":    8082,
+		"username":       "",
+		"password_file":  "",
+		"token_cache":    defaultClientPath("tokens.json"),
+		"device_key":     defaultClientPath("device_key.json"),
+		"tls.enabled":    false,
+		"tls.ca_file":    "",
+		"tls.cert_file":  "",
+		"tls.key_file":   "",
+	},
+	defaultFile: defaultClientPath("client.yaml"),
+	profiles:    true,
+}
+
+// defaultClientPath returns the path of file in the client's directory of the
+// user's config directory.
+func defaultClientPath(file string) string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "grpc-go-chatroom", file)
+}
+
+// LoadClient loads and validates the configuration of the client.
+func LoadClient(opts Options) (*ClientConfig, error) {
+	cfg := &ClientConfig{}
+	if err := load(clientSchema, opts, cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate reports all the invalid settings of cfg.
+func (cfg *ClientConfig) Validate() error {
+	var errs validationErrors
+	if cfg.Server.Address != "" {
+		validateAddresses(&errs, cfg.Server.Addresses())
 	} else {
-		f, err := os.Open("/run/secrets/jwy-key")
-		if err != nil {
-			log.Fatalf("failed to open jwt-key secret file: %v", err)
+		if cfg.Server.Host == "" {
+			errs.addf("server.host: is required")
+		}
+		validatePort(&errs, "server.port", cfg.Server.Port)
+	}
+	if len(cfg.Username) < 2 || len(cfg.Username) > 24 {
+		errs.addf("username: must be 2 to 24 characters, got %q", cfg.Username)
+	}
+	validateCertPair(&errs, "tls", cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	return errs.err()
+}
+
+// validateAddresses checks that the server addresses are host:port pairs or gRPC targets.
+func validateAddresses(errs *validationErrors, addrs []string) {
+	if len(addrs) == 0 {
+		errs.addf("server.address: has no address")
+	}
+	for _, addr := range addrs {
+		if strings.Contains(addr, "://") || strings.HasPrefix(addr, "dns:") || strings.HasPrefix(addr, "unix:") {
+			if len(addrs) > 1 {
+				errs.addf("server.address: the gRPC target %q can not be listed with other addresses", addr)
+			}
+			continue
 		}
-		jwtKeyRaw, err := io.ReadAll(f)
-		jwtKey := strings.TrimSpace(string(jwtKeyRaw))
-		if err != nil || jwtKey == "" {
-			log.Fatalf("failed to read jwt-key secret file: %v", err)
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || host == "" {
+			errs.addf("server.address: must be host:port, got %q", addr)
+			continue
 		}
-		JWT = &jwtConfig{
-			JWTKey: string(jwtKey),
+		if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+			errs.addf("server.address: the port of %q must be between 1 and 65535", addr)
 		}
 	}
 }
@@ -0,0 +1,540 @@
+//go:build unit_test
+
+package config_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/config"
+)
+
+// lookupEnv looks up environment variables in env only, so that tests do not depend on the host.
+func lookupEnv(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+	return file
+}
+
+// requiredEnv holds the settings without defaults.
+var requiredEnv = map[string]string{
+	"GRPC_GO_CHATROOM_DATABASE_USER":     "user",
+	"GRPC_GO_CHATROOM_DATABASE_PASSWORD": "pwd",
+	"GRPC_GO_CHATROOM_DATABASE_DBNAME":   "chat",
+	"GRPC_GO_CHATROOM_JWT_KEY":           "key",
+}
+
+func withEnv(env map[string]string) map[string]string {
+	merged := map[string]string{}
+	for k, v := range requiredEnv {
+		merged[k] = v
+	}
+	for k, v := range env {
+		merged[k] = v
+	}
+	return merged
+}
+
+func TestLoadServerLayers(t *testing.T) {
+	file := writeFile(t, "config.yaml", `
+server:
+  port: 9000
+  admins: [alice]
+database:
+  host: db.example.com
+  port: 3307
+`)
+	// Files written before the database section was renamed
+	oldFile := writeFile(t, "old.yaml", `
+mysql:
+  host: old.example.com
+  port: 3309
+`)
+	bothFile := writeFile(t, "both.yaml", `
+mysql:
+  host: old.example.com
+database:
+  host: db.example.com
+`)
+
+	tests := []struct {
+		name     string
+		file     string
+		env      map[string]string
+		flags    map[string]any
+		wantPort int
+		wantHost string
+		wantDB   int
+		admins   []string
+	}{
+		{
+			name:     "defaults",
+			wantPort: 8082,
+			wantHost: "127.0.0.1",
+			wantDB:   3306,
+			admins:   []string{},
+		},
+		{
+			name:     "file overrides defaults",
+			file:     file,
+			wantPort: 9000,
+			wantHost: "db.example.com",
+			wantDB:   3307,
+			admins:   []string{"alice"},
+		},
+		{
+			name:     "config file from env",
+			env:      map[string]string{config.ConfigFileEnv: file},
+			wantPort: 9000,
+			wantHost: "db.example.com",
+			wantDB:   3307,
+			admins:   []string{"alice"},
+		},
+		{
+			name: "env overrides file",
+			file: file,
+			env: map[string]string{
+				"GRPC_GO_CHATROOM_SERVER_PORT":   "9001",
+				"GRPC_GO_CHATROOM_SERVER_ADMINS": "bob,carol",
+			},
+			wantPort: 9001,
+			wantHost: "db.example.com",
+			wantDB:   3307,
+			admins:   []string{"bob", "carol"},
+		},
+		{
+			name: "legacy env",
+			file: file,
+			env: map[string]string{
+				"GRPC_GO_CHATROOM_DBHOST": "legacy.example.com",
+				"GRPC_GO_CHATROOM_DBPORT": "3308",
+				"GRPC_GO_CHATROOM_ADMINS": "dave",
+			},
+			wantPort: 9000,
+			wantHost: "legacy.example.com",
+			wantDB:   3308,
+			admins:   []string{"dave"},
+		},
+		{
+			name: "generic env wins over legacy env",
+			env: map[string]string{
+				"GRPC_GO_CHATROOM_DATABASE_HOST": "new.example.com",
+				"GRPC_GO_CHATROOM_MYSQL_HOST":    "old.example.com",
+				"GRPC_GO_CHATROOM_DBHOST":        "legacy.example.com",
+			},
+			wantPort: 8082,
+			wantHost: "new.example.com",
+			wantDB:   3306,
+			admins:   []string{},
+		},
+		{
+			name:     "old section name",
+			file:     oldFile,
+			wantPort: 8082,
+			wantHost: "old.example.com",
+			wantDB:   3309,
+			admins:   []string{},
+		},
+		{
+			name:     "new section name wins over old one",
+			file:     bothFile,
+			wantPort: 8082,
+			wantHost: "db.example.com",
+			wantDB:   3306,
+			admins:   []string{},
+		},
+		{
+			name: "env of old section name",
+			file: file,
+			env: map[string]string{
+				"GRPC_GO_CHATROOM_MYSQL_HOST": "old.example.com",
+				"GRPC_GO_CHATROOM_DBHOST":     "legacy.example.com",
+			},
+			wantPort: 9000,
+			wantHost: "old.example.com",
+			wantDB:   3307,
+			admins:   []string{"alice"},
+		},
+		{
+			name: "postgres default port",
+			env: map[string]string{
+				"GRPC_GO_CHATROOM_DATABASE_DRIVER": "postgres",
+			},
+			wantPort: 8082,
+			wantHost: "127.0.0.1",
+			wantDB:   5432,
+			admins:   []string{},
+		},
+		{
+			name:     "flags override env",
+			file:     file,
+			env:      map[string]string{"GRPC_GO_CHATROOM_SERVER_PORT": "9001"},
+			flags:    map[string]any{"server.port": 9002},
+			wantPort: 9002,
+			wantHost: "db.example.com",
+			wantDB:   3307,
+			admins:   []string{"alice"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			cfg, err := config.LoadServer(config.Options{File: tt.file, Flags: tt.flags, LookupEnv: lookupEnv(withEnv(tt.env))})
+			require.NoError(err)
+			require.Equal(tt.wantPort, cfg.Server.Port)
+			require.Equal(tt.wantHost, cfg.Database.Host)
+			require.Equal(tt.wantDB, cfg.Database.Port)
+			require.Equal(tt.admins, cfg.Server.Admins)
+			require.Equal("key", cfg.JWT.Key)
+		})
+	}
+}
+
+func TestLoadServerTOML(t *testing.T) {
+	require := require.New(t)
+	file := writeFile(t, "config.toml", `
+[server]
+port = 9100
+allowed_origins = ["https://chat.example.com"]
+
+[database]
+query_timeout = "2s"
+`)
+	cfg, err := config.LoadServer(config.Options{File: file, LookupEnv: lookupEnv(requiredEnv)})
+	require.NoError(err)
+	require.Equal(9100, cfg.Server.Port)
+	require.Equal([]string{"https://chat.example.com"}, cfg.Server.AllowedOrigins)
+	require.Equal(2*time.Second, cfg.Database.QueryTimeout)
+	require.Equal(30*time.Minute, cfg.Database.ConnMaxLifetime)
+}
+
+func TestLoadServerRetention(t *testing.T) {
+	require := require.New(t)
+	file := writeFile(t, "config.yaml", `
+retention:
+  max_age: 720h
+  rooms:
+    - room: Random
+      max_messages: 100
+  legal_hold:
+    users: [mallory]
+`)
+	cfg, err := config.LoadServer(config.Options{File: file, LookupEnv: lookupEnv(withEnv(map[string]string{
+		"GRPC_GO_CHATROOM_RETENTION_LEGAL_HOLD_ROOMS": "incidents,audit",
+	}))})
+	require.NoError(err)
+	require.True(cfg.Retention.Enabled())
+	require.Equal([]string{"incidents", "audit"}, cfg.Retention.LegalHold.Rooms)
+	require.Equal([]string{"mallory"}, cfg.Retention.LegalHold.Users)
+	require.Equal(1000, cfg.Retention.BatchSize)
+
+	// Room names keep their case, and listed rooms don't inherit the global policy
+	maxAge, maxMessages := cfg.Retention.Policy("Random")
+	require.Zero(maxAge)
+	require.Equal(100, maxMessages)
+	maxAge, maxMessages = cfg.Retention.Policy("general")
+	require.Equal(720*time.Hour, maxAge)
+	require.Zero(maxMessages)
+
+	// Nothing is purged by default
+	cfg, err = config.LoadServer(config.Options{LookupEnv: lookupEnv(requiredEnv)})
+	require.NoError(err)
+	require.False(cfg.Retention.Enabled())
+}
+
+func TestLoadServerSecretFiles(t *testing.T) {
+	require := require.New(t)
+	env := map[string]string{
+		"GRPC_GO_CHATROOM_DATABASE_USER":          "user",
+		"GRPC_GO_CHATROOM_DATABASE_DBNAME":        "chat",
+		"GRPC_GO_CHATROOM_DATABASE_PASSWORD_FILE": writeFile(t, "db-password", "secret-pwd\n"),
+		"GRPC_GO_CHATROOM_JWT_KEY_FILE":           writeFile(t, "jwt-key", "secret-key\n"),
+	}
+	cfg, err := config.LoadServer(config.Options{LookupEnv: lookupEnv(env)})
+	require.NoError(err)
+	require.Equal("secret-pwd", cfg.Database.Password)
+	require.Equal("secret-key", cfg.JWT.Key)
+
+	// Values set directly win over the files
+	env["GRPC_GO_CHATROOM_JWT_KEY"] = "direct-key"
+	cfg, err = config.LoadServer(config.Options{LookupEnv: lookupEnv(env)})
+	require.NoError(err)
+	require.Equal("direct-key", cfg.JWT.Key)
+}
+
+func TestLoadServerErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		env     map[string]string
+		flags   map[string]any
+		wantErr string
+	}{
+		{
+			name: "all invalid settings are reported",
+			env: map[string]string{
+				"GRPC_GO_CHATROOM_SERVER_PORT":     "0",
+				"GRPC_GO_CHATROOM_DATABASE_DRIVER": "sqlite",
+				"GRPC_GO_CHATROOM_DATABASE_PORT":   "70000",
+			},
+			wantErr: "invalid config: server.port: must be between 1 and 65535, got 0\n" +
+				"database.driver: must be \"mysql\" or \"postgres\", got \"sqlite\"\n" +
+				"database.port: must be between 1 and 65535, got 70000\n" +
+				"database.user: is required\n" +
+				"database.password: is required, set it or database.password_file\n" +
+				"database.dbname: is required\n" +
+				"jwt.key: is required, set it or jwt.key_file",
+		},
+		{
+			name: "invalid runtime settings",
+			env: withEnv(map[string]string{
+				"GRPC_GO_CHATROOM_LIMITS_MESSAGE_BURST":         "0",
+				"GRPC_GO_CHATROOM_CONTENT_FILTER_BLOCKED_WORDS": "spam,,",
+				"GRPC_GO_CHATROOM_CONTENT_FILTER_ACTION":        "ban",
+			}),
+			wantErr: "invalid config: limits.message_burst: must be at least 1 when messages are rate limited, got 0\n" +
+				"content_filter.blocked_words: must not contain empty words\n" +
+				`content_filter.action: must be "mask" or "reject", got "ban"`,
+		},
+		{
+			name: "invalid tls settings",
+			env: withEnv(map[string]string{
+				"GRPC_GO_CHATROOM_TLS_KEY_FILE":    "key.pem",
+				"GRPC_GO_CHATROOM_TLS_CLIENT_AUTH": "require",
+			}),
+			wantErr: "invalid config: tls.cert_file: is required with tls.key_file\n" +
+				"tls.client_auth: requires tls.cert_file\n" +
+				`tls.client_ca_file: is required when tls.client_auth is "require"`,
+		},
+		{
+			name: "invalid database pool settings",
+			env: withEnv(map[string]string{
+				"GRPC_GO_CHATROOM_DATABASE_MAX_OPEN_CONNS": "-1",
+				"GRPC_GO_CHATROOM_DATABASE_QUERY_TIMEOUT":  "-5s",
+			}),
+			wantErr: "invalid config: database.max_open_conns: must not be negative, got -1\n" +
+				"database.query_timeout: must not be negative, got -5s",
+		},
+		{
+			name: "invalid retention settings",
+			file: writeFile(t, "retention.yaml", `
+retention:
+  rooms:
+    - max_age: -1h
+    - room: random
+    - room: random
+      max_messages: -1
+`),
+			env: withEnv(map[string]string{
+				"GRPC_GO_CHATROOM_RETENTION_MAX_MESSAGES": "-1",
+				"GRPC_GO_CHATROOM_RETENTION_BATCH_SIZE":   "0",
+			}),
+			wantErr: "invalid config: retention.max_messages: must not be negative, got -1\n" +
+				"retention.rooms[0].room: is required\n" +
+				"retention.rooms[0].max_age: must not be negative, got -1h0m0s\n" +
+				"retention.rooms[2].room: \"random\" is listed twice\n" +
+				"retention.rooms[2].max_messages: must not be negative, got -1\n" +
+				"retention.batch_size: must be at least 1, got 0",
+		},
+		{
+			name:    "query timeout is not a duration",
+			env:     withEnv(map[string]string{"GRPC_GO_CHATROOM_DATABASE_QUERY_TIMEOUT": "5"}),
+			wantErr: "failed to decode config",
+		},
+		{
+			name:    "invalid client auth",
+			env:     withEnv(map[string]string{"GRPC_GO_CHATROOM_TLS_CLIENT_AUTH": "always"}),
+			wantErr: `tls.client_auth: must be "none", "optional" or "require", got "always"`,
+		},
+		{
+			name:    "invalid log format",
+			env:     withEnv(map[string]string{"GRPC_GO_CHATROOM_LOG_FORMAT": "logfmt"}),
+			wantErr: `log.format: must be text or json, got "logfmt"`,
+		},
+		{
+			name: "invalid tracing settings",
+			env: withEnv(map[string]string{
+				"GRPC_GO_CHATROOM_TRACING_EXPORTER":     "otlp",
+				"GRPC_GO_CHATROOM_TRACING_ENDPOINT":     "",
+				"GRPC_GO_CHATROOM_TRACING_SAMPLE_RATIO": "2",
+			}),
+			wantErr: "tracing.endpoint: is required when tracing.exporter is \"otlp\"\n" +
+				"tracing.sample_ratio: must be between 0 and 1, got 2",
+		},
+		{
+			name:    "unknown trace exporter",
+			env:     withEnv(map[string]string{"GRPC_GO_CHATROOM_TRACING_EXPORTER": "zipkin"}),
+			wantErr: `tracing.exporter: must be "none", "otlp" or "stdout", got "zipkin"`,
+		},
+		{
+			name:    "port is not a number",
+			env:     withEnv(map[string]string{"GRPC_GO_CHATROOM_SERVER_PORT": "http"}),
+			wantErr: "failed to decode config",
+		},
+		{
+			name:    "missing file",
+			file:    filepath.Join(t.TempDir(), "missing.yaml"),
+			env:     requiredEnv,
+			wantErr: "failed to read config file",
+		},
+		{
+			name:    "unknown flag",
+			env:     requiredEnv,
+			flags:   map[string]any{"server.host": "localhost"},
+			wantErr: "unknown config key of flag: server.host",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := config.LoadServer(config.Options{File: tt.file, Flags: tt.flags, LookupEnv: lookupEnv(tt.env)})
+			require.ErrorContains(t, err, tt.wantErr)
+		})
+	}
+}
+
+func TestLoadClient(t *testing.T) {
+	file := writeFile(t, "client.yaml", `
+server:
+  host: chat.example.com
+username: alice
+profiles:
+  staging:
+    server:
+      address: staging-1.example.com:8082, staging-2.example.com:8082
+    tls:
+      enabled: true
+  local:
+    server:
+      host: localhost
+`)
+	defaultProfile := writeFile(t, "client.yaml", `
+username: alice
+profile: local
+profiles:
+  local:
+    server:
+      port: 9090
+`)
+
+	tests := []struct {
+		name     string
+		file     string
+		profile  string
+		env      map[string]string
+		flags    map[string]any
+		wantAddr string
+		wantUser string
+		wantTLS  bool
+		wantErr  string
+	}{
+		{
+			name:     "defaults",
+			flags:    map[string]any{"username": "alice"},
+			wantAddr: "localhost:8082",
+			wantUser: "alice",
+		},
+		{
+			name:     "file, env and flags",
+			file:     file,
+			env:      map[string]string{"GRPC_GO_CHATROOM_SERVER_PORT": "9000"},
+			flags:    map[string]any{"username": "bob"},
+			wantAddr: "chat.example.com:9000",
+			wantUser: "bob",
+		},
+		{
+			name:     "ca file implies tls",
+			flags:    map[string]any{"username": "alice", "tls.ca_file": "ca.pem"},
+			wantAddr: "localhost:8082",
+			wantUser: "alice",
+			wantTLS:  true,
+		},
+		{
+			name:    "client certificate without key",
+			flags:   map[string]any{"username": "alice", "tls.cert_file": "cert.pem"},
+			wantErr: "invalid config: tls.key_file: is required with tls.cert_file",
+		},
+		{
+			name:    "username is required",
+			wantErr: `invalid config: username: must be 2 to 24 characters, got ""`,
+		},
+		{
+			name:     "server address overrides host and port",
+			flags:    map[string]any{"username": "alice", "server.address": "chat.example.com:443", "server.port": 9000},
+			wantAddr: "chat.example.com:443",
+			wantUser: "alice",
+		},
+		{
+			name:     "gRPC target",
+			env:      map[string]string{"GRPC_GO_CHATROOM_SERVER_ADDRESS": "dns:///chat.example.com:8082"},
+			flags:    map[string]any{"username": "alice"},
+			wantAddr: "dns:///chat.example.com:8082",
+			wantUser: "alice",
+		},
+		{
+			name:    "invalid server addresses",
+			flags:   map[string]any{"username": "alice", "server.address": "chat.example.com,localhost:0,dns:///a:1"},
+			wantErr: "invalid config: server.address: must be host:port, got \"chat.example.com\"\nserver.address: the port of \"localhost:0\" must be between 1 and 65535\nserver.address: the gRPC target \"dns:///a:1\" can not be listed with other addresses",
+		},
+		{
+			name:     "profile",
+			file:     file,
+			profile:  "staging",
+			wantAddr: "staging-1.example.com:8082,staging-2.example.com:8082",
+			wantUser: "alice",
+			wantTLS:  true,
+		},
+		{
+			name:     "profile by env, overridden by flags",
+			file:     file,
+			env:      map[string]string{"GRPC_GO_CHATROOM_PROFILE": "local"},
+			flags:    map[string]any{"server.port": 9000},
+			wantAddr: "localhost:9000",
+			wantUser: "alice",
+		},
+		{
+			name:     "default profile of the file",
+			file:     defaultProfile,
+			wantAddr: "localhost:9090",
+			wantUser: "alice",
+		},
+		{
+			name:    "unknown profile",
+			file:    file,
+			profile: "prod",
+			wantErr: `unknown profile "prod", the config file has: local, staging`,
+		},
+		{
+			name:    "no profiles",
+			profile: "prod",
+			wantErr: `unknown profile "prod", the config file has no profiles`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			cfg, err := config.LoadClient(config.Options{File: tt.file, Flags: tt.flags, Profile: tt.profile, LookupEnv: lookupEnv(tt.env)})
+			if tt.wantErr != "" {
+				require.EqualError(err, tt.wantErr)
+				return
+			}
+			require.NoError(err)
+			require.Equal(tt.wantAddr, cfg.Server.String())
+			require.Equal(tt.wantUser, cfg.Username)
+			require.Equal(tt.wantTLS, cfg.TLS.IsEnabled())
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadableKeys lists the settings that can change without a restart, a key
+// ending with "." covers its whole section.
+var reloadableKeys = []string{"server.allowed_origins", "limits.", "content_filter.", "retention.", "log.level"}
+
+func isReloadable(key string) bool {
+	for _, reloadable := range reloadableKeys {
+		if key == reloadable || (strings.HasSuffix(reloadable, ".") && strings.HasPrefix(key, reloadable)) {
+			return true
+		}
+	}
+	return false
+}
+
+// watchDebounce groups the bursts of events editors produce when saving a file.
+const watchDebounce = 200 * time.Millisecond
+
+// Reloader reloads the server configuration at runtime, and hands the new one
+// to the running components.
+type Reloader struct {
+	opts     Options
+	mu       sync.Mutex // serializes reloads and guards onChange
+	current  atomic.Pointer[ServerConfig]
+	onChange []func(cfg *ServerConfig)
+}
+
+// NewReloader creates a Reloader of cfg, which was loaded by LoadServer(opts).
+func NewReloader(opts Options, cfg *ServerConfig) *Reloader {
+	r := &Reloader{opts: opts}
+	r.current.Store(cfg)
+	return r
+}
+
+// Current returns the configuration in use, which must not be modified.
+func (r *Reloader) Current() *ServerConfig {
+	return r.current.Load()
+}
+
+// OnChange registers fn to be called with the new configuration after every
+// successful reload that changed something.
+func (r *Reloader) OnChange(fn func(cfg *ServerConfig)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onChange = append(r.onChange, fn)
+}
+
+// Reload loads the configuration again from all the layers, and swaps it in if
+// it is valid and only reloadable settings changed. It returns the keys of the
+// changed settings, or why the new configuration was rejected, in which case
+// the current one stays in use.
+func (r *Reloader) Reload() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := LoadServer(r.opts)
+	if err != nil {
+		return nil, err
+	}
+	changed := diff(r.current.Load(), cfg)
+	var errs validationErrors
+	for _, key := range changed {
+		if !isReloadable(key) {
+			errs.addf("%s: can not be changed without a restart", key)
+		}
+	}
+	if err := errs.err(); err != nil {
+		return nil, err
+	}
+	if len(changed) == 0 {
+		return nil, nil
+	}
+
+	r.current.Store(cfg)
+	for _, fn := range r.onChange {
+		fn(cfg)
+	}
+	return changed, nil
+}
+
+// Watch reloads the configuration whenever the config file changes, until ctx is done.
+// It returns nil right away if there is no config file.
+func (r *Reloader) Watch(ctx context.Context) error {
+	file := serverSchema.file(r.opts)
+	if file == "" {
+		return nil
+	}
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return fmt.Errorf("failed to resolve config file: %w", err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to watch config file: %w", err)
+	}
+	defer watcher.Close()
+	// Watch the directory, since editors and kubernetes replace files instead of writing them.
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		return fmt.Errorf("failed to watch config file: %w", err)
+	}
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case evt, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(evt.Name) == file && !evt.Has(fsnotify.Chmod) {
+				debounce = time.After(watchDebounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			slog.Error("error watching config file", "error", err)
+		case <-debounce:
+			debounce = nil
+			r.ReloadAndLog("config file changed")
+		}
+	}
+}
+
+// ReloadAndLog reloads the configuration and logs the result, prefixed by reason.
+func (r *Reloader) ReloadAndLog(reason string) {
+	changed, err := r.Reload()
+	switch {
+	case err != nil:
+		slog.Warn("config reload rejected", "reason", reason, "error", err)
+	case len(changed) == 0:
+		slog.Info("config reloaded, nothing changed", "reason", reason)
+	default:
+		slog.Info("config reloaded", "reason", reason, "changed", changed)
+	}
+}
+
+// diff returns the keys of the settings that differ between a and b.
+func diff(a, b *ServerConfig) []string {
+	settingsA, settingsB := map[string]any{}, map[string]any{}
+	flatten("", reflect.ValueOf(*a), settingsA)
+	flatten("", reflect.ValueOf(*b), settingsB)
+	var changed []string
+	for key, value := range settingsA {
+		if !reflect.DeepEqual(value, settingsB[key]) {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// flatten adds the settings of the struct v to out, keyed like "server.port".
+func flatten(prefix string, v reflect.Value, out map[string]any) {
+	for i := 0; i < v.NumField(); i++ {
+		key := v.Type().Field(i).Tag.Get("mapstructure")
+		if prefix != "" {
+			key = prefix + "." + key
+		}
+		if v.Field(i).Kind() == reflect.Struct {
+			flatten(key, v.Field(i), out)
+		} else {
+			out[key] = v.Field(i).Interface()
+		}
+	}
+}
@@ -0,0 +1,110 @@
+//go:build unit_test
+
+package config_test
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/config"
+)
+
+func newTestReloader(t *testing.T, content string) (*config.Reloader, string) {
+	t.Helper()
+	file := writeFile(t, "config.yaml", content)
+	opts := config.Options{File: file, LookupEnv: lookupEnv(requiredEnv)}
+	cfg, err := config.LoadServer(opts)
+	require.NoError(t, err)
+	return config.NewReloader(opts, cfg), file
+}
+
+func TestReload(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		wantChanged []string
+		wantErr     string
+	}{
+		{
+			name:    "nothing changed",
+			content: "limits:\n  max_message_length: 100\n",
+		},
+		{
+			name:        "reloadable settings changed",
+			content:     "limits:\n  max_message_length: 200\ncontent_filter:\n  blocked_words: [spam]\nlog:\n  level: debug\nserver:\n  allowed_origins: ['*']\nretention:\n  rooms: [{room: random, max_age: 24h}]\n",
+			wantChanged: []string{"content_filter.blocked_words", "limits.max_message_length", "log.level", "retention.rooms", "server.allowed_origins"},
+		},
+		{
+			name:    "settings needing a restart changed",
+			content: "limits:\n  max_message_length: 200\nserver:\n  port: 9000\nmysql:\n  host: db.example.com\n",
+			wantErr: "invalid config: database.host: can not be changed without a restart\nserver.port: can not be changed without a restart",
+		},
+		{
+			name:    "invalid config",
+			content: "limits:\n  max_message_length: -1\nlog:\n  level: loud\n",
+			wantErr: "invalid config: limits.max_message_length: must not be negative, got -1\n" +
+				"log.level: must be debug, info, warn or error, got \"loud\"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			reloader, file := newTestReloader(t, "limits:\n  max_message_length: 100\n")
+			old := reloader.Current()
+			var applied *config.ServerConfig
+			reloader.OnChange(func(cfg *config.ServerConfig) { applied = cfg })
+
+			require.NoError(os.WriteFile(file, []byte(tt.content), 0o600))
+			changed, err := reloader.Reload()
+			if tt.wantErr != "" {
+				require.EqualError(err, tt.wantErr)
+				require.Same(old, reloader.Current())
+				require.Nil(applied)
+				return
+			}
+			require.NoError(err)
+			require.Equal(tt.wantChanged, changed)
+			if len(tt.wantChanged) == 0 {
+				require.Same(old, reloader.Current())
+				require.Nil(applied)
+				return
+			}
+			require.Same(applied, reloader.Current())
+			require.Equal(200, applied.Limits.MaxMessageLength)
+			require.Equal([]string{"spam"}, applied.ContentFilter.BlockedWords)
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	require := require.New(t)
+	reloader, file := newTestReloader(t, "log:\n  level: info\n")
+	applied := make(chan *config.ServerConfig, 1)
+	reloader.OnChange(func(cfg *config.ServerConfig) { applied <- cfg })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- reloader.Watch(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(<-done)
+	})
+
+	// Give the watcher some time to start, then rewrite the file until it notices.
+	deadline := time.After(5 * time.Second)
+	for {
+		require.NoError(os.WriteFile(file, []byte("log:\n  level: warn\n"), 0o600))
+		select {
+		case cfg := <-applied:
+			require.Equal("warn", cfg.Log.Level)
+			return
+		case <-time.After(500 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("config file change was not reloaded")
+		}
+	}
+}
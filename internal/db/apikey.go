@@ -0,0 +1,93 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// APIKey is an API key of a bot, the key itself is never stored, only its hash.
+type APIKey struct {
+	ID        int64
+	UserID    int64
+	BotName   string
+	Prefix    string
+	Scopes    string // comma separated
+	CreatedAt int64  // unix timestamp
+	RevokedAt int64  // unix timestamp, 0 if the key is active
+}
+
+// InsertAPIKey inserts a new API key of the bot with userID, and returns the new key's ID.
+func InsertAPIKey(ctx context.Context, db Querier, userID int64, prefix, keyHash, scopes string) (_ int64, err error) {
+	ctx, done := startQuery(ctx, db, "insert_api_key")
+	defer done(&err)
+	id, err := insertReturningID(ctx, db, "INSERT INTO api_keys (user_id, prefix, key_hash, scopes) VALUES (?, ?, ?, ?);",
+		userID, prefix, keyHash, scopes)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert api key to database: %w", err)
+	}
+	return id, nil
+}
+
+// GetActiveAPIKeyByHash returns the not revoked API key with keyHash, or nil if there is none.
+func GetActiveAPIKeyByHash(ctx context.Context, db Querier, keyHash string) (_ *APIKey, err error) {
+	ctx, done := startQuery(ctx, db, "get_active_api_key_by_hash")
+	defer done(&err)
+	d := DialectOf(db)
+	query := "SELECT k.id, k.user_id, u.username, k.prefix, k.scopes, " + d.unixTime("k.created_at") + " " +
+		"FROM api_keys k JOIN users u ON u.id = k.user_id WHERE k.key_hash = ? AND k.revoked_at IS NULL;"
+
+	key := &APIKey{}
+	err = db.QueryRowContext(ctx, d.rebind(query), keyHash).Scan(&key.ID, &key.UserID, &key.BotName, &key.Prefix, &key.Scopes, &key.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get api key: %w", err)
+	}
+	return key, nil
+}
+
+// ListAPIKeys returns all the API keys including the revoked ones.
+func ListAPIKeys(ctx context.Context, db Querier) (_ []*APIKey, err error) {
+	ctx, done := startQuery(ctx, db, "list_api_keys")
+	defer done(&err)
+	d := DialectOf(db)
+	query := "SELECT k.id, k.user_id, u.username, k.prefix, k.scopes, " + d.unixTime("k.created_at") + ", " +
+		"COALESCE(" + d.unixTime("k.revoked_at") + ", 0) FROM api_keys k JOIN users u ON u.id = k.user_id ORDER BY k.id;"
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list api keys: %w", err)
+	}
+	defer rows.Close()
+
+	res := make([]*APIKey, 0, 8)
+	for rows.Next() {
+		key := &APIKey{}
+		err = rows.Scan(&key.ID, &key.UserID, &key.BotName, &key.Prefix, &key.Scopes, &key.CreatedAt, &key.RevokedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		res = append(res, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// RevokeAPIKey revokes the API key with id, and reports whether an active key was revoked.
+func RevokeAPIKey(ctx context.Context, db Querier, id int64) (_ bool, err error) {
+	ctx, done := startQuery(ctx, db, "revoke_api_key")
+	defer done(&err)
+	ret, err := db.ExecContext(ctx, DialectOf(db).rebind("UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE id = ? AND revoked_at IS NULL;"), id)
+	if err != nil {
+		return false, fmt.Errorf("failed to revoke api key: %w", err)
+	}
+	n, err := ret.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get revoked api keys number: %w", err)
+	}
+	return n > 0, nil
+}
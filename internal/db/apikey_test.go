@@ -0,0 +1,149 @@
+//go:build unit_test
+
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInsertAPIKey(t *testing.T) {
+	require := require.New(t)
+
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+
+	mock.ExpectExec("INSERT INTO api_keys \\(user_id, prefix, key_hash, scopes\\) VALUES \\(\\?, \\?, \\?, \\?\\);").
+		WithArgs(7, "gcb_abcdefgh", "hash", "messages:write").
+		WillReturnResult(sqlmock.NewResult(3, 1))
+
+	id, err := InsertAPIKey(context.Background(), db, 7, "gcb_abcdefgh", "hash", "messages:write")
+	require.NoError(err)
+	require.Equal(int64(3), id)
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestGetActiveAPIKeyByHash(t *testing.T) {
+	require := require.New(t)
+
+	tests := []struct {
+		name        string
+		mockSetup   func(sqlmock.Sqlmock)
+		expected    *APIKey
+		expectedErr error
+	}{
+		{
+			name: "Key Found",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				rows := sqlmock.NewRows([]string{"id", "user_id", "username", "prefix", "scopes", "created_at"}).
+					AddRow(3, 7, "ci-bot", "gcb_abcdefgh", "messages:write", 1723680000)
+				mock.ExpectQuery("SELECT .* FROM api_keys k JOIN users u ON u.id = k.user_id WHERE k.key_hash = \\? AND k.revoked_at IS NULL;").
+					WithArgs("hash").
+					WillReturnRows(rows)
+			},
+			expected: &APIKey{
+				ID:        3,
+				UserID:    7,
+				BotName:   "ci-bot",
+				Prefix:    "gcb_abcdefgh",
+				Scopes:    "messages:write",
+				CreatedAt: 1723680000,
+			},
+		},
+		{
+			name: "Key Not Found",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT .* FROM api_keys").
+					WithArgs("hash").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			},
+			expected: nil,
+		},
+		{
+			name: "Query Error",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT .* FROM api_keys").
+					WithArgs("hash").
+					WillReturnError(errors.New("query failed"))
+			},
+			expected:    nil,
+			expectedErr: errors.New("failed to get api key: query failed"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			require.NoError(err)
+			defer db.Close()
+
+			tt.mockSetup(mock)
+
+			key, err := GetActiveAPIKeyByHash(context.Background(), db, "hash")
+			require.Equal(tt.expected, key)
+			if tt.expectedErr != nil {
+				require.EqualError(err, tt.expectedErr.Error())
+			} else {
+				require.NoError(err)
+			}
+			require.NoError(mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestListAPIKeys(t *testing.T) {
+	require := require.New(t)
+
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{"id", "user_id", "username", "prefix", "scopes", "created_at", "revoked_at"}).
+		AddRow(1, 7, "ci-bot", "gcb_aaaaaaaa", "messages:write", 1723680000, 1723690000).
+		AddRow(2, 7, "ci-bot", "gcb_bbbbbbbb", "messages:write", 1723700000, 0)
+	mock.ExpectQuery("SELECT .* FROM api_keys k JOIN users u ON u.id = k.user_id ORDER BY k.id;").
+		WillReturnRows(rows)
+
+	keys, err := ListAPIKeys(context.Background(), db)
+	require.NoError(err)
+	require.Len(keys, 2)
+	require.Equal(int64(1723690000), keys[0].RevokedAt)
+	require.Equal(int64(0), keys[1].RevokedAt)
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestRevokeAPIKey(t *testing.T) {
+	require := require.New(t)
+
+	tests := []struct {
+		name        string
+		result      int64
+		expected    bool
+		expectedErr error
+	}{
+		{name: "Revoked", result: 1, expected: true},
+		{name: "Not Found Or Already Revoked", result: 0, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			require.NoError(err)
+			defer db.Close()
+
+			mock.ExpectExec("UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE id = \\? AND revoked_at IS NULL;").
+				WithArgs(3).
+				WillReturnResult(sqlmock.NewResult(0, tt.result))
+
+			revoked, err := RevokeAPIKey(context.Background(), db, 3)
+			require.Equal(tt.expected, revoked)
+			require.Equal(tt.expectedErr, err)
+			require.NoError(mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+)
+
+// ExportFilter selects the messages of an export.
+type ExportFilter struct {
+	Rooms          []string // all rooms if empty
+	Since          int64    // Unix time in seconds of the oldest messages, 0 for any
+	Until          int64    // Unix time in seconds the messages were sent before, 0 for any
+	IncludePrivate bool     // include private and encrypted messages
+}
+
+// where returns the WHERE clause of the messages selected by f, and its arguments.
+func (f ExportFilter) where(d Dialect) (string, []any) {
+	var conds []string
+	var args []any
+	if len(f.Rooms) > 0 {
+		conds = append(conds, "room IN ("+placeholders(len(f.Rooms))+")")
+		for _, room := range f.Rooms {
+			args = append(args, room)
+		}
+	}
+	if f.Since > 0 {
+		conds = append(conds, d.unixTime("created_at")+" >= ?")
+		args = append(args, f.Since)
+	}
+	if f.Until > 0 {
+		conds = append(conds, d.unixTime("created_at")+" < ?")
+		args = append(args, f.Until)
+	}
+	if !f.IncludePrivate {
+		conds = append(conds, "type NOT IN (?, ?)")
+		args = append(args, int32(pb.MessageType_MESSAGE_TYPE_PRIVATE), int32(pb.MessageType_MESSAGE_TYPE_ENCRYPTED))
+	}
+	if len(conds) == 0 {
+		return "TRUE", nil
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// ExportRooms returns the rooms of the messages selected by f with their number of
+// messages, sorted by name.
+func ExportRooms(ctx context.Context, db Querier, f ExportFilter) (_ []*pb.ExportedRoom, err error) {
+	ctx, done := startQuery(ctx, db, "export_rooms")
+	defer done(&err)
+	d := DialectOf(db)
+	where, args := f.where(d)
+	rows, err := db.QueryContext(ctx, d.rebind("SELECT room, COUNT(*) FROM messages WHERE "+where+" GROUP BY room ORDER BY room;"), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export rooms: %w", err)
+	}
+	defer rows.Close()
+
+	var rooms []*pb.ExportedRoom
+	for rows.Next() {
+		room := &pb.ExportedRoom{}
+		if err := rows.Scan(&room.Name, &room.MessageCount); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		rooms = append(rooms, room)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return rooms, nil
+}
+
+// ExportUsers returns the users who sent or received the messages selected by f,
+// without their password hashes, sorted by ID.
+func ExportUsers(ctx context.Context, db Querier, f ExportFilter) (_ []*pb.ExportedUser, err error) {
+	ctx, done := startQuery(ctx, db, "export_users")
+	defer done(&err)
+	d := DialectOf(db)
+	where, args := f.where(d)
+	query := "SELECT username, display_name, avatar_url, status_text, bio, is_bot, COALESCE(" + d.unixTime("created_at") + ", 0) FROM users " +
+		"WHERE username IN (SELECT username FROM messages WHERE " + where + ") " +
+		"OR username IN (SELECT recipient FROM messages WHERE " + where + ") ORDER BY id;"
+	rows, err := db.QueryContext(ctx, d.rebind(query), append(args, args...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []*pb.ExportedUser
+	for rows.Next() {
+		user := &pb.ExportedUser{Profile: &pb.UserProfile{}}
+		p := user.Profile
+		if err := rows.Scan(&p.Username, &p.DisplayName, &p.AvatarUrl, &p.StatusText, &p.Bio, &user.Bot, &user.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		users = append(users, user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// ExportMessages returns the first limit messages selected by f with a message
+// number above after, oldest first. Encrypted messages are exported with their
+// ciphertext and wrapped keys as they are.
+func ExportMessages(ctx context.Context, db Querier, f ExportFilter, after uint64, limit int) (_ []*pb.Message, err error) {
+	ctx, done := startQuery(ctx, db, "export_messages")
+	defer done(&err)
+	d := DialectOf(db)
+	where, args := f.where(d)
+	query := "SELECT id, username, room, message, type, recipient, binary_content, wrapped_keys, COALESCE(" + d.unixTime("created_at") + ", 0) FROM messages " +
+		"WHERE id > ? AND " + where + " ORDER BY id LIMIT ?;"
+	args = append(append([]any{after}, args...), limit)
+	rows, err := db.QueryContext(ctx, d.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export messages: %w", err)
+	}
+	defer rows.Close()
+
+	res := make([]*pb.Message, 0, limit)
+	for rows.Next() {
+		var msgType int32
+		var keys []byte
+		msg := &pb.Message{}
+		if err := rows.Scan(&msg.MessageNumber, &msg.Username, &msg.Room, &msg.TextContent, &msgType, &msg.Recipient,
+			&msg.BinaryContent, &keys, &msg.Timestamp); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		msg.Type = pb.MessageType(msgType)
+		if msg.WrappedKeys, err = decodeWrappedKeys(keys); err != nil {
+			return nil, fmt.Errorf("message %d: %w", msg.MessageNumber, err)
+		}
+		res = append(res, msg)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// InsertImportedUser inserts a user of an archive, and returns the new user's ID.
+// Imported users have no password, like bots, so they can only log in with a
+// client certificate.
+func InsertImportedUser(ctx context.Context, db Querier, user *pb.ExportedUser) (_ int64, err error) {
+	ctx, done := startQuery(ctx, db, "insert_imported_user")
+	defer done(&err)
+	p := user.GetProfile()
+	query := "INSERT INTO users (username, password_hash, is_bot, display_name, avatar_url, status_text, bio, created_at) " +
+		"VALUES (?, '', ?, ?, ?, ?, ?, " + DialectOf(db).fromUnixTime("NULLIF(?, 0)") + ");"
+	id, err := insertReturningID(ctx, db, query,
+		p.GetUsername(), user.GetBot(), p.GetDisplayName(), p.GetAvatarUrl(), p.GetStatusText(), p.GetBio(), user.GetCreatedAt())
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert imported user to database: %w", err)
+	}
+	return id, nil
+}
+
+// ImportMessage inserts a message of an archive exported from the deployment of
+// source, written by the user of userID, with a new message number. It reports
+// false without an error if the message was imported from source before, so that
+// importing an archive twice does not duplicate its messages.
+func ImportMessage(ctx context.Context, db Querier, userID int64, source string, msg *pb.Message) (_ bool, err error) {
+	ctx, done := startQuery(ctx, db, "import_message")
+	defer done(&err)
+	d := DialectOf(db)
+	keys, err := encodeWrappedKeys(msg.GetWrappedKeys())
+	if err != nil {
+		return false, err
+	}
+	query := "INSERT INTO messages (user_id, username, room, message, type, recipient, binary_content, wrapped_keys, created_at, import_source, import_id) " +
+		"VALUES (?, ?, ?, ?, ?, ?, ?, ?, " + d.fromUnixTime("?") + ", ?, ?)"
+	if d == Postgres {
+		query += " ON CONFLICT (import_source, import_id) DO NOTHING;"
+	} else {
+		query += " ON DUPLICATE KEY UPDATE id = id;"
+	}
+	ret, err := db.ExecContext(ctx, d.rebind(query), userID, msg.GetUsername(), msg.GetRoom(), msg.GetTextContent(), int32(msg.GetType()),
+		msg.GetRecipient(), nullBytes(msg.GetBinaryContent()), nullBytes(keys), msg.GetTimestamp(), source, msg.GetMessageNumber())
+	if err != nil {
+		return false, fmt.Errorf("failed to import message: %w", err)
+	}
+	n, err := ret.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get imported messages number: %w", err)
+	}
+	return n > 0, nil
+}
+
+// GetInstanceID returns the ID of the deployment, the source of its archives.
+func GetInstanceID(ctx context.Context, db Querier) (id string, err error) {
+	ctx, done := startQuery(ctx, db, "get_instance_id")
+	defer done(&err)
+	if err := db.QueryRowContext(ctx, "SELECT id FROM instance;").Scan(&id); err != nil {
+		return "", fmt.Errorf("failed to get instance id: %w", err)
+	}
+	return id, nil
+}
+
+// MessageExists reports whether the message of number id exists.
+func MessageExists(ctx context.Context, db Querier, id uint64) (exists bool, err error) {
+	ctx, done := startQuery(ctx, db, "message_exists")
+	defer done(&err)
+	d := DialectOf(db)
+	if err := db.QueryRowContext(ctx, d.rebind("SELECT EXISTS (SELECT 1 FROM messages WHERE id = ?);"), id).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to check message: %w", err)
+	}
+	return exists, nil
+}
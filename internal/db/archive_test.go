@@ -0,0 +1,239 @@
+//go:build unit_test
+
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestExportFilterWhere(t *testing.T) {
+	tests := []struct {
+		name         string
+		filter       ExportFilter
+		dialect      Dialect
+		expected     string
+		expectedArgs []any
+	}{
+		{
+			name:         "everything",
+			filter:       ExportFilter{IncludePrivate: true},
+			dialect:      MySQL,
+			expected:     "TRUE",
+			expectedArgs: nil,
+		},
+		{
+			name:         "public messages",
+			filter:       ExportFilter{},
+			dialect:      MySQL,
+			expected:     "type NOT IN (?, ?)",
+			expectedArgs: []any{int32(pb.MessageType_MESSAGE_TYPE_PRIVATE), int32(pb.MessageType_MESSAGE_TYPE_ENCRYPTED)},
+		},
+		{
+			name:         "rooms and time range",
+			filter:       ExportFilter{Rooms: []string{"general", "random"}, Since: 1723680000, Until: 1723766400, IncludePrivate: true},
+			dialect:      Postgres,
+			expected:     "room IN (?, ?) AND CAST(EXTRACT(EPOCH FROM created_at) AS BIGINT) >= ? AND CAST(EXTRACT(EPOCH FROM created_at) AS BIGINT) < ?",
+			expectedArgs: []any{"general", "random", int64(1723680000), int64(1723766400)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			where, args := tt.filter.where(tt.dialect)
+			require.Equal(t, tt.expected, where)
+			require.Equal(t, tt.expectedArgs, args)
+		})
+	}
+}
+
+func TestExportRooms(t *testing.T) {
+	require := require.New(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT room, COUNT(*) FROM messages WHERE room IN (?) GROUP BY room ORDER BY room;")).
+		WithArgs("general").
+		WillReturnRows(sqlmock.NewRows([]string{"room", "count"}).AddRow("general", 42))
+	rooms, err := ExportRooms(context.Background(), db, ExportFilter{Rooms: []string{"general"}, IncludePrivate: true})
+	require.NoError(err)
+	require.Len(rooms, 1)
+	require.True(proto.Equal(&pb.ExportedRoom{Name: "general", MessageCount: 42}, rooms[0]))
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestExportUsers(t *testing.T) {
+	require := require.New(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT username, display_name, avatar_url, status_text, bio, is_bot, COALESCE(UNIX_TIMESTAMP(created_at), 0) FROM users "+
+		"WHERE username IN (SELECT username FROM messages WHERE type NOT IN (?, ?)) OR username IN (SELECT recipient FROM messages WHERE type NOT IN (?, ?)) ORDER BY id;")).
+		WithArgs(6, 7, 6, 7).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "display_name", "avatar_url", "status_text", "bio", "is_bot", "created_at"}).
+			AddRow("alice", "Alice", "", "busy", "", false, 1723680000).
+			AddRow("echo", "", "", "", "", true, 0))
+	users, err := ExportUsers(context.Background(), db, ExportFilter{})
+	require.NoError(err)
+	require.Len(users, 2)
+	require.True(proto.Equal(&pb.ExportedUser{
+		Profile:   &pb.UserProfile{Username: "alice", DisplayName: "Alice", StatusText: "busy"},
+		CreatedAt: 1723680000,
+	}, users[0]))
+	require.True(users[1].GetBot())
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestExportMessages(t *testing.T) {
+	require := require.New(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+
+	keys := []*pb.WrappedKey{{Username: "bob", DeviceId: "laptop", EphemeralPublicKey: []byte("ephemeral"), WrappedKey: []byte("wrapped")}}
+	encodedKeys, err := encodeWrappedKeys(keys)
+	require.NoError(err)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, username, room, message, type, recipient, binary_content, wrapped_keys, COALESCE(UNIX_TIMESTAMP(created_at), 0) FROM messages "+
+		"WHERE id > ? AND TRUE ORDER BY id LIMIT ?;")).
+		WithArgs(10, 3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "room", "message", "type", "recipient", "binary_content", "wrapped_keys", "created_at"}).
+			AddRow(11, "alice", "general", "Hello", 3, "", nil, nil, 1723680000).
+			AddRow(12, "alice", "general", "psst", 6, "bob", nil, nil, 1723680001).
+			AddRow(13, "alice", "general", "", 7, "bob", []byte("ciphertext"), encodedKeys, 1723680002))
+	msgs, err := ExportMessages(context.Background(), db, ExportFilter{IncludePrivate: true}, 10, 3)
+	require.NoError(err)
+	require.Len(msgs, 3)
+	require.True(proto.Equal(&pb.Message{
+		MessageNumber: 12, Username: "alice", Room: "general", TextContent: "psst",
+		Type: pb.MessageType_MESSAGE_TYPE_PRIVATE, Recipient: "bob", Timestamp: 1723680001,
+	}, msgs[1]))
+	require.True(proto.Equal(&pb.Message{
+		MessageNumber: 13, Username: "alice", Room: "general", Type: pb.MessageType_MESSAGE_TYPE_ENCRYPTED, Recipient: "bob",
+		BinaryContent: []byte("ciphertext"), WrappedKeys: keys, Timestamp: 1723680002,
+	}, msgs[2]))
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestInsertImportedUser(t *testing.T) {
+	require := require.New(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO users (username, password_hash, is_bot, display_name, avatar_url, status_text, bio, created_at) "+
+		"VALUES (?, '', ?, ?, ?, ?, ?, FROM_UNIXTIME(NULLIF(?, 0)));")).
+		WithArgs("alice", false, "Alice", "", "", "", 1723680000).
+		WillReturnResult(sqlmock.NewResult(7, 1))
+	id, err := InsertImportedUser(context.Background(), db, &pb.ExportedUser{
+		Profile:   &pb.UserProfile{Username: "alice", DisplayName: "Alice"},
+		CreatedAt: 1723680000,
+	})
+	require.NoError(err)
+	require.EqualValues(7, id)
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestImportMessage(t *testing.T) {
+	msg := &pb.Message{MessageNumber: 11, Username: "alice", Room: "general", TextContent: "Hello", Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Timestamp: 1723680000}
+	args := []driver.Value{3, "alice", "general", "Hello", 3, "", nil, nil, 1723680000, "0f1e2d3c", 11}
+	tests := []struct {
+		name          string
+		dialect       Dialect
+		mockSetup     func(mock sqlmock.Sqlmock)
+		expected      bool
+		expectedError string
+	}{
+		{
+			name:    "imported",
+			dialect: MySQL,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO messages (user_id, username, room, message, type, recipient, binary_content, wrapped_keys, created_at, import_source, import_id) " +
+					"VALUES (?, ?, ?, ?, ?, ?, ?, ?, FROM_UNIXTIME(?), ?, ?) ON DUPLICATE KEY UPDATE id = id;")).
+					WithArgs(args...).
+					WillReturnResult(sqlmock.NewResult(42, 1))
+			},
+			expected: true,
+		},
+		{
+			name:    "already imported",
+			dialect: Postgres,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO messages (user_id, username, room, message, type, recipient, binary_content, wrapped_keys, created_at, import_source, import_id) " +
+					"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, TO_TIMESTAMP($9), $10, $11) ON CONFLICT (import_source, import_id) DO NOTHING;")).
+					WithArgs(args...).
+					WillReturnResult(sqlmock.NewResult(0, 0))
+			},
+		},
+		{
+			name:    "insert failure",
+			dialect: MySQL,
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("INSERT INTO messages").WillReturnError(errors.New("insert failed"))
+			},
+			expectedError: "failed to import message: insert failed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			db, mock, err := sqlmock.New()
+			require.NoError(err)
+			defer db.Close()
+			registerDialect(db, tt.dialect)
+			tt.mockSetup(mock)
+
+			inserted, err := ImportMessage(context.Background(), db, 3, "0f1e2d3c", msg)
+			if tt.expectedError == "" {
+				require.NoError(err)
+			} else {
+				require.EqualError(err, tt.expectedError)
+			}
+			require.Equal(tt.expected, inserted)
+			require.NoError(mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestGetInstanceID(t *testing.T) {
+	require := require.New(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM instance;")).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("0f1e2d3c"))
+	id, err := GetInstanceID(context.Background(), db)
+	require.NoError(err)
+	require.Equal("0f1e2d3c", id)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM instance;")).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	_, err = GetInstanceID(context.Background(), db)
+	require.ErrorContains(err, "failed to get instance id")
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestMessageExists(t *testing.T) {
+	require := require.New(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+	registerDialect(db, Postgres)
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT EXISTS (SELECT 1 FROM messages WHERE id = $1);")).WithArgs(11).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	exists, err := MessageExists(context.Background(), db, 11)
+	require.NoError(err)
+	require.True(exists)
+	require.NoError(mock.ExpectationsWereMet())
+}
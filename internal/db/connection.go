@@ -1,35 +1,170 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	_ "github.com/jackc/pgx/v5/stdlib" // registers the pgx driver
+	"github.com/zjy-dev/grpc-go-chatroom/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
-// MustConnect initialize and return a new database connection
-func MustConnect(dbUser, dbPass, host string, port uint64, dbName string) *sql.DB {
-	// Capture connection properties.
-	cfg := mysql.NewConfig()
-	cfg.Net = "tcp"
-	cfg.User = dbUser
-	cfg.Passwd = dbPass
-	cfg.DBName = dbName
-	cfg.Addr = fmt.Sprintf("%s:%d", host, port)
+var tracer = tracing.Tracer()
+
+const (
+	// pingTimeout bounds every attempt of Connect to reach the database.
+	pingTimeout = 5 * time.Second
+	// initialConnectBackoff is the delay after the first failed attempt of Connect, doubled per attempt.
+	initialConnectBackoff = 500 * time.Millisecond
+	// maxConnectBackoff is the upper bound of the delay between the attempts of Connect.
+	maxConnectBackoff = 10 * time.Second
+)
 
-	// Get a database handle.
-	dsnStr := cfg.FormatDSN()
-	db, err := sql.Open("mysql", dsnStr)
+// ConnectOptions tells Connect where the database is and how to pool its connections.
+type ConnectOptions struct {
+	Dialect  Dialect
+	Host     string
+	Port     uint64
+	User     string
+	Password string
+	DBName   string
+
+	MaxOpenConns    int           // 0 for no limit
+	MaxIdleConns    int           // 0 for the default of database/sql
+	ConnMaxLifetime time.Duration // 0 to reuse connections forever
+	ConnMaxIdleTime time.Duration // 0 to keep idle connections forever
+	// QueryTimeout bounds every query of the package on the connection, besides
+	// the deadline of the context of the query. 0 for no bound.
+	QueryTimeout time.Duration
+}
 
+// queryTimeouts holds the query timeout of every database connected by Connect.
+var queryTimeouts sync.Map
+
+// Connect opens a pool of connections to the database of opts, and waits until the
+// database answers. The database is pinged again with exponential backoff until ctx
+// is done, so that the server can start before the database does.
+func Connect(ctx context.Context, opts ConnectOptions) (*sql.DB, error) {
+	db, err := sql.Open(opts.Dialect.driverName(), dsn(opts.Dialect, opts.User, opts.Password, opts.Host, opts.Port, opts.DBName))
 	if err != nil {
-		log.Panic(err)
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	db.SetMaxOpenConns(opts.MaxOpenConns)
+	if opts.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(opts.MaxIdleConns)
 	}
+	db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(opts.ConnMaxIdleTime)
+	registerDialect(db, opts.Dialect)
+	queryTimeouts.Store(db, opts.QueryTimeout)
 
-	err = db.Ping()
-	if err != nil {
-		log.Panic(err)
+	for attempt := 1; ; attempt++ {
+		pingCtx, cancel := context.WithTimeout(ctx, pingTimeout)
+		err = db.PingContext(pingCtx)
+		cancel()
+		if err == nil {
+			return db, nil
+		}
+
+		delay := connectBackoff(attempt)
+		slog.WarnContext(ctx, "failed to connect to database, retrying", "attempt", attempt, "retry_in", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			db.Close()
+			dialects.Delete(db)
+			queryTimeouts.Delete(db)
+			return nil, fmt.Errorf("failed to connect to database after %d attempts: %w", attempt, err)
+		case <-time.After(delay):
+		}
 	}
+}
 
-	return db
+// connectBackoff returns the delay before the attempt of Connect following attempt,
+// with jitter so that replicas started together don't retry together.
+func connectBackoff(attempt int) time.Duration {
+	delay := initialConnectBackoff << (attempt - 1)
+	if delay <= 0 || delay > maxConnectBackoff {
+		delay = maxConnectBackoff
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// Ping checks that db is reachable, within its query timeout.
+func Ping(ctx context.Context, db *sql.DB) error {
+	ctx, cancel := queryContext(ctx, db)
+	defer cancel()
+	return db.PingContext(ctx)
+}
+
+// queryContext bounds ctx by the query timeout of db, see ConnectOptions.QueryTimeout.
+func queryContext(ctx context.Context, db Querier) (context.Context, context.CancelFunc) {
+	if timeout, ok := queryTimeouts.Load(db); ok && timeout.(time.Duration) > 0 {
+		return context.WithTimeout(ctx, timeout.(time.Duration))
+	}
+	return context.WithCancel(ctx)
+}
+
+// startQuery starts the query of the package named query on db, in a span of ctx.
+// The returned context is bounded by the query timeout of db, and done must be
+// called with the error of the query once it and the scan of its rows are over.
+func startQuery(ctx context.Context, db Querier, query string) (_ context.Context, done func(err *error)) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "db."+query,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", DialectOf(db).system())))
+	ctx, cancel := queryContext(ctx, db)
+	return ctx, func(err *error) {
+		cancel()
+		observeQuery(query, start)
+		if *err != nil {
+			span.RecordError(*err)
+			span.SetStatus(otelcodes.Error, "query failed")
+		}
+		span.End()
+	}
+}
+
+// IsUnavailable reports whether err is caused by the database being unreachable
+// or too slow rather than by the query, so that the call may succeed later.
+func IsUnavailable(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, sql.ErrConnDone) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	var connectErr *pgconn.ConnectError
+	return errors.As(err, &netErr) || errors.As(err, &connectErr)
+}
+
+// dsn returns the data source name of the database for the driver of d.
+func dsn(d Dialect, dbUser, dbPass, host string, port uint64, dbName string) string {
+	addr := net.JoinHostPort(host, strconv.FormatUint(port, 10))
+	if d == Postgres {
+		// The other settings, e.g. sslmode, are read from the PG* env vars.
+		u := url.URL{Scheme: "postgres", User: url.UserPassword(dbUser, dbPass), Host: addr, Path: "/" + dbName}
+		return u.String()
+	}
+
+	// Capture connection properties.
+	cfg := mysql.NewConfig()
+	cfg.Net = "tcp"
+	cfg.User = dbUser
+	cfg.Passwd = dbPass
+	cfg.DBName = dbName
+	cfg.Addr = addr
+	return cfg.FormatDSN()
 }
@@ -3,20 +3,56 @@
 package db
 
 import (
-	"log"
+	"context"
+	"database/sql"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
-	"github.com/zjy-dev/grpc-go-chatroom/internal/config"
 )
 
-func TestMustConnect(t *testing.T) {
+// connectTestDB connects to the database dbName of testDB, and closes it when the test ends.
+func connectTestDB(t *testing.T, dbName string) *sql.DB {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	dbConn, err := Connect(ctx, ConnectOptions{
+		Dialect:  Dialect(testDB.Driver),
+		Host:     testDB.Host,
+		Port:     uint64(testDB.Port),
+		User:     testDB.User,
+		Password: testDB.Password,
+		DBName:   dbName,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { dbConn.Close() })
+	return dbConn
+}
+
+func TestConnect(t *testing.T) {
 	require := require.New(t)
-	require.NotPanics(func() {
-		dbConn := MustConnect(config.Mysql.User, config.Mysql.Password, config.Mysql.Host, config.Mysql.Port, config.Mysql.DBName)
-		if dbConn == nil {
-			log.Panic("MustConnect should not return nil")
-		}
-		dbConn.Close()
+	dbConn, err := Connect(context.Background(), ConnectOptions{
+		Dialect:      Dialect(testDB.Driver),
+		Host:         testDB.Host,
+		Port:         uint64(testDB.Port),
+		User:         testDB.User,
+		Password:     testDB.Password,
+		DBName:       testDB.DBName,
+		MaxOpenConns: 2,
+		QueryTimeout: time.Second,
 	})
+	require.NoError(err)
+	defer dbConn.Close()
+	require.Equal(2, dbConn.Stats().MaxOpenConnections)
+	require.NoError(Ping(context.Background(), dbConn))
+
+	// The query timeout cuts the queries running longer
+	sleep := "SELECT SLEEP(2);"
+	if DialectOf(dbConn) == Postgres {
+		sleep = "SELECT pg_sleep(2);"
+	}
+	ctx, cancel := queryContext(context.Background(), dbConn)
+	defer cancel()
+	_, err = dbConn.ExecContext(ctx, sleep)
+	require.Error(err)
+	require.True(IsUnavailable(err))
 }
@@ -0,0 +1,103 @@
+//go:build unit_test
+
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectRetriesUntilDone(t *testing.T) {
+	require := require.New(t)
+	// Nothing listens on the port, so every attempt fails at once.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	port := uint64(lis.Addr().(*net.TCPAddr).Port)
+	lis.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*initialConnectBackoff)
+	defer cancel()
+	start := time.Now()
+	dbConn, err := Connect(ctx, ConnectOptions{Dialect: MySQL, Host: "127.0.0.1", Port: port, User: "user", Password: "pwd", DBName: "chat"})
+	require.Nil(dbConn)
+	require.ErrorContains(err, "failed to connect to database after")
+	require.True(IsUnavailable(err))
+	require.Less(time.Since(start), 2*time.Second)
+}
+
+func TestConnectBackoff(t *testing.T) {
+	for attempt := 1; attempt <= 64; attempt++ {
+		want := initialConnectBackoff << (attempt - 1)
+		if want <= 0 || want > maxConnectBackoff {
+			want = maxConnectBackoff
+		}
+		delay := connectBackoff(attempt)
+		require.GreaterOrEqual(t, delay, want/2, "attempt %d", attempt)
+		require.LessOrEqual(t, delay, want, "attempt %d", attempt)
+	}
+}
+
+func TestQueryContext(t *testing.T) {
+	require := require.New(t)
+	db, _, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+
+	// No timeout, the deadline of the parent is kept
+	ctx, cancel := queryContext(context.Background(), db)
+	_, ok := ctx.Deadline()
+	require.False(ok)
+	cancel()
+	require.Error(ctx.Err())
+
+	queryTimeouts.Store(db, time.Minute)
+	defer queryTimeouts.Delete(db)
+	ctx, cancel = queryContext(context.Background(), db)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	require.True(ok)
+	require.WithinDuration(time.Now().Add(time.Minute), deadline, time.Second)
+
+	// The earlier deadline of the parent, e.g. of an RPC, wins
+	parent, cancelParent := context.WithTimeout(context.Background(), time.Second)
+	defer cancelParent()
+	ctx, cancel = queryContext(parent, db)
+	defer cancel()
+	deadline, _ = ctx.Deadline()
+	parentDeadline, _ := parent.Deadline()
+	require.Equal(parentDeadline, deadline)
+}
+
+func TestIsUnavailable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "bad connection", err: fmt.Errorf("query: %w", driver.ErrBadConn), want: true},
+		{name: "mysql invalid connection", err: mysql.ErrInvalidConn, want: true},
+		{name: "timeout", err: fmt.Errorf("query: %w", context.DeadlineExceeded), want: true},
+		{name: "network", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, want: true},
+		{name: "postgres connect", err: &pgconn.ConnectError{}, want: true},
+		{name: "mysql query", err: &mysql.MySQLError{Number: 1062}},
+		{name: "postgres query", err: &pgconn.PgError{Code: "23505"}},
+		{name: "canceled", err: context.Canceled},
+		{name: "nil"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, IsUnavailable(tt.err))
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"context"
+	"fmt"
+)
+
+// DeviceKey is the public key of a device of a user, for end-to-end encrypted messages.
+type DeviceKey struct {
+	DeviceID  string
+	PublicKey []byte
+	CreatedAt int64 // unix timestamp
+}
+
+// UpsertDeviceKey registers the public key of the device deviceID of the user of
+// userID, replacing the key the device had.
+func UpsertDeviceKey(ctx context.Context, db Querier, userID int64, deviceID string, publicKey []byte) (err error) {
+	ctx, done := startQuery(ctx, db, "upsert_device_key")
+	defer done(&err)
+	d := DialectOf(db)
+	query := "INSERT INTO device_keys (user_id, device_id, public_key) VALUES (?, ?, ?)"
+	if d == Postgres {
+		query += " ON CONFLICT (user_id, device_id) DO UPDATE SET public_key = EXCLUDED.public_key, created_at = CURRENT_TIMESTAMP;"
+	} else {
+		query += " ON DUPLICATE KEY UPDATE public_key = VALUES(public_key), created_at = CURRENT_TIMESTAMP;"
+	}
+	if _, err = db.ExecContext(ctx, d.rebind(query), userID, deviceID, publicKey); err != nil {
+		return fmt.Errorf("failed to upsert device key: %w", err)
+	}
+	return nil
+}
+
+// ListDeviceKeys returns the device keys of username, oldest first.
+func ListDeviceKeys(ctx context.Context, db Querier, username string) (_ []*DeviceKey, err error) {
+	ctx, done := startQuery(ctx, db, "list_device_keys")
+	defer done(&err)
+	d := DialectOf(db)
+	query := "SELECT k.device_id, k.public_key, COALESCE(" + d.unixTime("k.created_at") + ", 0) " +
+		"FROM device_keys k JOIN users u ON u.id = k.user_id WHERE u.username = ? ORDER BY k.id;"
+	rows, err := db.QueryContext(ctx, d.rebind(query), username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list device keys: %w", err)
+	}
+	defer rows.Close()
+
+	var keys []*DeviceKey
+	for rows.Next() {
+		key := &DeviceKey{}
+		if err := rows.Scan(&key.DeviceID, &key.PublicKey, &key.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
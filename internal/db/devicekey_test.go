@@ -0,0 +1,89 @@
+//go:build unit_test
+
+package db
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpsertDeviceKey(t *testing.T) {
+	tests := []struct {
+		name          string
+		dialect       Dialect
+		query         string
+		err           error
+		expectedError string
+	}{
+		{
+			name:    "MySQL",
+			dialect: MySQL,
+			query: "INSERT INTO device_keys (user_id, device_id, public_key) VALUES (?, ?, ?) " +
+				"ON DUPLICATE KEY UPDATE public_key = VALUES(public_key), created_at = CURRENT_TIMESTAMP;",
+		},
+		{
+			name:    "Postgres",
+			dialect: Postgres,
+			query: "INSERT INTO device_keys (user_id, device_id, public_key) VALUES ($1, $2, $3) " +
+				"ON CONFLICT (user_id, device_id) DO UPDATE SET public_key = EXCLUDED.public_key, created_at = CURRENT_TIMESTAMP;",
+		},
+		{
+			name:          "Insert Failure",
+			dialect:       MySQL,
+			query:         "INSERT INTO device_keys",
+			err:           errors.New("insert failed"),
+			expectedError: "failed to upsert device key: insert failed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			db, mock, err := sqlmock.New()
+			require.NoError(err)
+			defer db.Close()
+			registerDialect(db, tt.dialect)
+
+			exec := mock.ExpectExec(regexp.QuoteMeta(tt.query)).WithArgs(7, "laptop", []byte("public key"))
+			if tt.err != nil {
+				exec.WillReturnError(tt.err)
+			} else {
+				exec.WillReturnResult(sqlmock.NewResult(3, 1))
+			}
+
+			err = UpsertDeviceKey(context.Background(), db, 7, "laptop", []byte("public key"))
+			if tt.expectedError == "" {
+				require.NoError(err)
+			} else {
+				require.EqualError(err, tt.expectedError)
+			}
+			require.NoError(mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestListDeviceKeys(t *testing.T) {
+	require := require.New(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT k.device_id, k.public_key, COALESCE(UNIX_TIMESTAMP(k.created_at), 0) " +
+		"FROM device_keys k JOIN users u ON u.id = k.user_id WHERE u.username = ? ORDER BY k.id;")).
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"device_id", "public_key", "created_at"}).
+			AddRow("laptop", []byte("laptop key"), 1723680000).
+			AddRow("phone", []byte("phone key"), 1723680001))
+	keys, err := ListDeviceKeys(context.Background(), db, "alice")
+	require.NoError(err)
+	require.Equal([]*DeviceKey{
+		{DeviceID: "laptop", PublicKey: []byte("laptop key"), CreatedAt: 1723680000},
+		{DeviceID: "phone", PublicKey: []byte("phone key"), CreatedAt: 1723680001},
+	}, keys)
+	require.NoError(mock.ExpectationsWereMet())
+}
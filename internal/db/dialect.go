@@ -0,0 +1,146 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Dialect is the SQL dialect of a database. The queries of the package are
+// written with ? placeholders and unquoted identifiers, which both dialects
+// accept once the placeholders are rebound, see Dialect.rebind.
+type Dialect string
+
+const (
+	MySQL    Dialect = "mysql"
+	Postgres Dialect = "postgres"
+)
+
+// Querier runs the queries of the package, it is a *sql.DB or a *sql.Tx of WithTx.
+type Querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// dialects holds the dialect of every database connected by Connect and of its
+// transactions, MySQL if unknown.
+var dialects sync.Map
+
+// registerDialect records the dialect of db.
+func registerDialect(db Querier, d Dialect) {
+	dialects.Store(db, d)
+}
+
+// DialectOf returns the dialect of db, MySQL unless it was connected to PostgreSQL.
+func DialectOf(db Querier) Dialect {
+	if d, ok := dialects.Load(db); ok {
+		return d.(Dialect)
+	}
+	return MySQL
+}
+
+// system returns the name of d in the db.system attribute of the spans.
+func (d Dialect) system() string {
+	if d == Postgres {
+		return "postgresql"
+	}
+	return "mysql"
+}
+
+// driverName returns the name of the database/sql driver of d.
+func (d Dialect) driverName() string {
+	if d == Postgres {
+		return "pgx"
+	}
+	return "mysql"
+}
+
+// rebind replaces the ? placeholders of query by $1, $2... for PostgreSQL.
+// Queries must not contain ? elsewhere, e.g. in string literals.
+func (d Dialect) rebind(query string) string {
+	if d != Postgres || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// unixTime returns the SQL expression of the Unix time in seconds of the timestamp column.
+func (d Dialect) unixTime(column string) string {
+	if d == Postgres {
+		return fmt.Sprintf("CAST(EXTRACT(EPOCH FROM %s) AS BIGINT)", column)
+	}
+	return fmt.Sprintf("UNIX_TIMESTAMP(%s)", column)
+}
+
+// fromUnixTime returns the SQL expression of the timestamp of the Unix time in seconds
+// bound to placeholder.
+func (d Dialect) fromUnixTime(placeholder string) string {
+	if d == Postgres {
+		return fmt.Sprintf("TO_TIMESTAMP(%s)", placeholder)
+	}
+	return fmt.Sprintf("FROM_UNIXTIME(%s)", placeholder)
+}
+
+// isNoSuchTable reports whether err is caused by a missing table.
+func (d Dialect) isNoSuchTable(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1146
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "42P01" // undefined_table
+	}
+	return false
+}
+
+// IsDuplicateKey reports whether err is caused by a row whose unique key is taken.
+func IsDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1062
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "23505" // unique_violation
+	}
+	return false
+}
+
+// insertReturningID runs query, an INSERT into a table with an id column, and
+// returns the id of the new row. PostgreSQL has no LastInsertId, so the id is
+// returned by the statement.
+func insertReturningID(ctx context.Context, db Querier, query string, args ...any) (int64, error) {
+	d := DialectOf(db)
+	if d == Postgres {
+		var id int64
+		query = strings.TrimSuffix(strings.TrimSpace(query), ";") + " RETURNING id;"
+		if err := db.QueryRowContext(ctx, d.rebind(query), args...).Scan(&id); err != nil {
+			return 0, err
+		}
+		return id, nil
+	}
+	ret, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return ret.LastInsertId()
+}
@@ -1,46 +1,101 @@
 package db
 
 import (
-	"database/sql"
+	"context"
 	"fmt"
+	"math"
+	"slices"
 
 	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"google.golang.org/protobuf/proto"
 )
 
-func InsertMessage(db *sql.DB, userID int, username, message string) (id int64, err error) {
-	ret, err := db.Exec("INSERT INTO `messages` (user_id, username, message) VALUES (?, ?, ?);",
-		userID, username, message)
+// InsertMessage stores msg written by the user of userID, and returns its message number.
+func InsertMessage(ctx context.Context, db Querier, userID int64, msg *pb.Message) (id int64, err error) {
+	ctx, done := startQuery(ctx, db, "insert_message")
+	defer done(&err)
+	id, err = insertReturningID(ctx, db, "INSERT INTO messages (user_id, username, room, message, type, recipient) VALUES (?, ?, ?, ?, ?, ?);",
+		userID, msg.GetUsername(), msg.GetRoom(), msg.GetTextContent(), int32(msg.GetType()), msg.GetRecipient())
 	if err != nil {
-		return 0, fmt.Errorf("failed to insert to database: %v", err)
+		return 0, fmt.Errorf("failed to insert to database: %w", err)
 	}
+	return id, nil
+}
 
-	id, err = ret.LastInsertId()
+// InsertEncryptedMessage stores the encrypted msg written by the user of userID with
+// its ciphertext and wrapped keys as they are, and returns its message number.
+func InsertEncryptedMessage(ctx context.Context, db Querier, userID int64, msg *pb.Message) (id int64, err error) {
+	ctx, done := startQuery(ctx, db, "insert_encrypted_message")
+	defer done(&err)
+	keys, err := encodeWrappedKeys(msg.GetWrappedKeys())
+	if err != nil {
+		return 0, err
+	}
+	id, err = insertReturningID(ctx, db, "INSERT INTO messages (user_id, username, room, message, type, recipient, binary_content, wrapped_keys) "+
+		"VALUES (?, ?, ?, '', ?, ?, ?, ?);",
+		userID, msg.GetUsername(), msg.GetRoom(), int32(msg.GetType()), msg.GetRecipient(), nullBytes(msg.GetBinaryContent()), nullBytes(keys))
 	if err != nil {
-		return 0, fmt.Errorf("failed to get last inserted message ID: %v", err)
+		return 0, fmt.Errorf("failed to insert to database: %w", err)
 	}
 	return id, nil
 }
 
-func GetMessages(db *sql.DB) ([]*pb.Message, error) {
-	query := "SELECT id, user_id, username, message, created_at FROM `messages`;"
-	rows, err := db.Query(query)
+// encodeWrappedKeys encodes keys for the wrapped_keys column, nil if there are none.
+// They are encoded as the wrapped_keys field of a Message, which the column is.
+func encodeWrappedKeys(keys []*pb.WrappedKey) ([]byte, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	data, err := proto.Marshal(&pb.Message{WrappedKeys: keys})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode wrapped keys: %w", err)
+	}
+	return data, nil
+}
+
+// nullBytes returns b as an argument of a nullable column, NULL if b is empty.
+func nullBytes(b []byte) any {
+	if len(b) == 0 {
+		return nil
+	}
+	return b
+}
+
+// decodeWrappedKeys decodes the wrapped_keys column encoded by encodeWrappedKeys.
+func decodeWrappedKeys(data []byte) ([]*pb.WrappedKey, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	msg := &pb.Message{}
+	if err := proto.Unmarshal(data, msg); err != nil {
+		return nil, fmt.Errorf("failed to decode wrapped keys: %w", err)
+	}
+	return msg.GetWrappedKeys(), nil
+}
+
+func GetMessages(ctx context.Context, db Querier) (_ []*pb.Message, err error) {
+	ctx, done := startQuery(ctx, db, "get_messages")
+	defer done(&err)
+	query := "SELECT id, user_id, username, room, message, created_at FROM messages;"
+	rows, err := db.QueryContext(ctx, query)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get messages: %v", err)
+		return nil, fmt.Errorf("failed to get messages: %w", err)
 	}
 	defer rows.Close()
 
 	res := make([]*pb.Message, 0, 32)
 	for rows.Next() {
 		var id, userID int
-		var username, message string
+		var username, room, message string
 		var createdAt string
-		err = rows.Scan(&id, &userID, &username, &message, &createdAt)
+		err = rows.Scan(&id, &userID, &username, &room, &message, &createdAt)
 		if err != nil {
-			return nil, fmt.Errorf("failed to scan row: %v", err)
+			return nil, fmt.Errorf("failed to scan row: %w", err)
 		}
 		res = append(res, &pb.Message{
 			TextContent:   message,
 			Username:      username,
+			Room:          room,
 			MessageNumber: uint64(id),
 		})
 
@@ -52,3 +107,42 @@ func GetMessages(db *sql.DB) ([]*pb.Message, error) {
 
 	return res, nil
 }
+
+// GetRoomMessages returns the last limit messages of room before the message number
+// before, or the last ones if before is 0, oldest first. Private and encrypted
+// messages are left out.
+func GetRoomMessages(ctx context.Context, db Querier, room string, before uint64, limit int) (_ []*pb.Message, err error) {
+	ctx, done := startQuery(ctx, db, "get_room_messages")
+	defer done(&err)
+	if before == 0 {
+		before = math.MaxInt64
+	}
+	d := DialectOf(db)
+	rows, err := db.QueryContext(ctx, d.rebind("SELECT id, username, room, message, type, "+d.unixTime("created_at")+" FROM messages "+
+		"WHERE room = ? AND type NOT IN (?, ?) AND id < ? ORDER BY id DESC LIMIT ?;"),
+		room, int32(pb.MessageType_MESSAGE_TYPE_PRIVATE), int32(pb.MessageType_MESSAGE_TYPE_ENCRYPTED), before, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get messages: %w", err)
+	}
+	defer rows.Close()
+
+	res := make([]*pb.Message, 0, limit)
+	for rows.Next() {
+		var id uint64
+		var msgType int32
+		var createdAt int64
+		msg := &pb.Message{}
+		if err := rows.Scan(&id, &msg.Username, &msg.Room, &msg.TextContent, &msgType, &createdAt); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		msg.MessageNumber, msg.Type, msg.Timestamp = id, pb.MessageType(msgType), createdAt
+		res = append(res, msg)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// The newest messages were selected first.
+	slices.Reverse(res)
+	return res, nil
+}
@@ -3,44 +3,134 @@
 package db
 
 import (
+	"context"
+	"fmt"
+	"log"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
 	"github.com/zjy-dev/grpc-go-chatroom/internal/config"
+	"google.golang.org/protobuf/proto"
 )
 
-func TestMain(m *testing.M) {
-	os.Setenv("DBUSER", "root")
-	os.Setenv("DBPASS", "123456")
-
-	code := m.Run()
+// testDB is the database of the integration tests, configured by the env vars, see test.env.
+var testDB config.DatabaseConfig
 
-	os.Unsetenv("DBUSER")
-	os.Unsetenv("DBPASS")
+func TestMain(m *testing.M) {
+	cfg, err := config.LoadServer(config.Options{})
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	testDB = cfg.Database
 
-	os.Exit(code)
+	os.Exit(m.Run())
 }
 
 func TestGetMessagesIntegration(t *testing.T) {
 	require := require.New(t)
 
-	dbConn := MustConnect(config.Mysql.User, config.Mysql.Password, config.Mysql.Host, config.Mysql.Port, config.Mysql.DBName)
+	dbConn := connectTestDB(t, testDB.DBName)
 
-	res, err := GetMessages(dbConn)
+	res, err := GetMessages(context.Background(), dbConn)
 	require.NotEmpty(res)
 	require.Nil(err)
 }
 
 func TestInsertMessageIntegration(t *testing.T) {
 	require := require.New(t)
-	dbConn := MustConnect(config.Mysql.User, config.Mysql.Password, config.Mysql.Host, config.Mysql.Port, config.Mysql.DBName)
+	dbConn := connectTestDB(t, testDB.DBName)
 
-	t.Cleanup(func() {
-		dbConn.Close()
-	})
-
-	id, err := InsertMessage(dbConn, 1, "zjy-dev", "hello")
+	id, err := InsertMessage(context.Background(), dbConn, 1, &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Username: "zjy-dev", Room: "general", TextContent: "hello"})
 	require.NotZero(id)
 	require.Nil(err)
 }
+
+func TestGetRoomMessagesIntegration(t *testing.T) {
+	require := require.New(t)
+	dbConn := connectTestDB(t, testDB.DBName)
+
+	id, err := InsertMessage(context.Background(), dbConn, 1, &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_PRIVATE, Username: "zjy-dev", Room: "general", TextContent: "secret", Recipient: "alice"})
+	require.NoError(err)
+
+	res, err := GetRoomMessages(context.Background(), dbConn, "general", uint64(id)+1, 10)
+	require.NoError(err)
+	for _, msg := range res {
+		require.NotEqual(pb.MessageType_MESSAGE_TYPE_PRIVATE, msg.GetType())
+	}
+}
+
+func TestPurgeMessagesIntegration(t *testing.T) {
+	require := require.New(t)
+	dbConn := connectTestDB(t, testDB.DBName)
+
+	// A room of its own, so that the purge leaves the other tests' messages alone
+	room := fmt.Sprintf("purge-%d", time.Now().UnixNano())
+	for _, username := range []string{"alice", "mallory", "alice", "alice"} {
+		_, err := InsertMessage(context.Background(), dbConn, 1, &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Username: username, Room: room, TextContent: "hello"})
+		require.NoError(err)
+	}
+
+	// Keep the newest message, and every message of mallory
+	belowID, err := NthNewestMessageID(context.Background(), dbConn, room, 1)
+	require.NoError(err)
+	filter := PurgeFilter{Room: room, BelowID: belowID, HeldUsers: []string{"mallory"}}
+	n, err := CountPurgeableMessages(context.Background(), dbConn, filter)
+	require.NoError(err)
+	require.EqualValues(2, n)
+
+	n, err = PurgeMessages(context.Background(), dbConn, filter, 1)
+	require.NoError(err)
+	require.EqualValues(1, n)
+	n, err = PurgeMessages(context.Background(), dbConn, filter, 10)
+	require.NoError(err)
+	require.EqualValues(1, n)
+
+	res, err := GetRoomMessages(context.Background(), dbConn, room, 0, 10)
+	require.NoError(err)
+	require.Len(res, 2)
+	require.Equal("mallory", res[0].GetUsername())
+}
+
+func TestExportImportMessagesIntegration(t *testing.T) {
+	require := require.New(t)
+	dbConn := connectTestDB(t, testDB.DBName)
+
+	room := fmt.Sprintf("export-%d", time.Now().UnixNano())
+	_, err := InsertMessage(context.Background(), dbConn, 1, &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Username: "zjy-dev", Room: room, TextContent: "hello"})
+	require.NoError(err)
+	filter := ExportFilter{Rooms: []string{room}}
+	msgs, err := ExportMessages(context.Background(), dbConn, filter, 0, 10)
+	require.NoError(err)
+	require.Len(msgs, 1)
+
+	source, err := GetInstanceID(context.Background(), dbConn)
+	require.NoError(err)
+	require.NotEmpty(source)
+	local, err := MessageExists(context.Background(), dbConn, msgs[0].GetMessageNumber())
+	require.NoError(err)
+	require.True(local)
+
+	// An archive of another deployment whose message number is taken here is
+	// imported twice, its message is inserted once with a new number.
+	imported := proto.Clone(msgs[0]).(*pb.Message)
+	imported.TextContent = "hello from elsewhere"
+	for i, want := range []bool{true, false} {
+		inserted, err := ImportMessage(context.Background(), dbConn, 1, "elsewhere-"+room, imported)
+		require.NoError(err)
+		require.Equal(want, inserted, "import %d", i+1)
+	}
+
+	msgs, err = ExportMessages(context.Background(), dbConn, filter, 0, 10)
+	require.NoError(err)
+	require.Len(msgs, 2)
+	require.Equal(msgs[0].GetTimestamp(), msgs[1].GetTimestamp())
+	require.Equal("hello", msgs[0].GetTextContent())
+	require.Equal("hello from elsewhere", msgs[1].GetTextContent())
+	require.Greater(msgs[1].GetMessageNumber(), msgs[0].GetMessageNumber())
+	rooms, err := ExportRooms(context.Background(), dbConn, filter)
+	require.NoError(err)
+	require.EqualValues(2, rooms[0].GetMessageCount())
+}
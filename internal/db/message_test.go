@@ -3,12 +3,16 @@
 package db
 
 import (
+	"context"
 	"errors"
+	"math"
+	"regexp"
 	"testing"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/stretchr/testify/require"
 	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestInsertMessage(t *testing.T) {
@@ -16,47 +20,43 @@ func TestInsertMessage(t *testing.T) {
 
 	tests := []struct {
 		name         string
-		userID       int
-		username     string
-		message      string
+		userID       int64
+		msg          *pb.Message
 		mockBehavior func(mock sqlmock.Sqlmock)
 		expectedID   int64
 		expectErr    bool
 	}{
 		{
-			name:     "Successful Insert",
-			userID:   1,
-			username: "testuser",
-			message:  "Hello, World!",
+			name:   "Successful Insert",
+			userID: 1,
+			msg:    &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Username: "testuser", Room: "general", TextContent: "Hello, World!"},
 			mockBehavior: func(mock sqlmock.Sqlmock) {
-				mock.ExpectExec("INSERT INTO `messages` \\(user_id, username, message\\) VALUES \\(\\?, \\?, \\?\\);").
-					WithArgs(1, "testuser", "Hello, World!").
+				mock.ExpectExec("INSERT INTO messages \\(user_id, username, room, message, type, recipient\\) VALUES \\(\\?, \\?, \\?, \\?, \\?, \\?\\);").
+					WithArgs(1, "testuser", "general", "Hello, World!", 3, "").
 					WillReturnResult(sqlmock.NewResult(1, 1))
 			},
 			expectedID: 1,
 			expectErr:  false,
 		},
 		{
-			name:     "Insert Failure",
-			userID:   1,
-			username: "testuser",
-			message:  "Hello, World!",
+			name:   "Insert Failure",
+			userID: 1,
+			msg:    &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Username: "testuser", Room: "general", TextContent: "Hello, World!"},
 			mockBehavior: func(mock sqlmock.Sqlmock) {
-				mock.ExpectExec("INSERT INTO `messages` \\(user_id, username, message\\) VALUES \\(\\?, \\?, \\?\\);").
-					WithArgs(1, "testuser", "Hello, World!").
+				mock.ExpectExec("INSERT INTO messages \\(user_id, username, room, message, type, recipient\\) VALUES \\(\\?, \\?, \\?, \\?, \\?, \\?\\);").
+					WithArgs(1, "testuser", "general", "Hello, World!", 3, "").
 					WillReturnError(errors.New("insert failed"))
 			},
 			expectedID: 0,
 			expectErr:  true,
 		},
 		{
-			name:     "Get Last Insert ID Failure",
-			userID:   1,
-			username: "testuser",
-			message:  "Hello, World!",
+			name:   "Get Last Insert ID Failure",
+			userID: 1,
+			msg:    &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Username: "testuser", Room: "general", TextContent: "Hello, World!"},
 			mockBehavior: func(mock sqlmock.Sqlmock) {
-				mock.ExpectExec("INSERT INTO `messages` \\(user_id, username, message\\) VALUES \\(\\?, \\?, \\?\\);").
-					WithArgs(1, "testuser", "Hello, World!").
+				mock.ExpectExec("INSERT INTO messages \\(user_id, username, room, message, type, recipient\\) VALUES \\(\\?, \\?, \\?, \\?, \\?, \\?\\);").
+					WithArgs(1, "testuser", "general", "Hello, World!", 3, "").
 					WillReturnResult(sqlmock.NewResult(1, 1)).
 					WillReturnError(errors.New("failed to get last inserted message ID"))
 			},
@@ -76,7 +76,7 @@ func TestInsertMessage(t *testing.T) {
 			tt.mockBehavior(mock)
 
 			// Call the function
-			id, err := InsertMessage(db, tt.userID, tt.username, tt.message)
+			id, err := InsertMessage(context.Background(), db, tt.userID, tt.msg)
 
 			// Assertions
 			if tt.expectErr {
@@ -105,15 +105,16 @@ func TestGetMessages(t *testing.T) {
 		{
 			name: "Successful Query",
 			mockBehavior: func(mock sqlmock.Sqlmock) {
-				rows := sqlmock.NewRows([]string{"id", "user_id", "username", "message", "created_at"}).
-					AddRow(1, 1, "testuser", "Hello, World!", "2024-08-15 00:00:00")
-				mock.ExpectQuery("SELECT id, user_id, username, message, created_at FROM `messages`;").
+				rows := sqlmock.NewRows([]string{"id", "user_id", "username", "room", "message", "created_at"}).
+					AddRow(1, 1, "testuser", "general", "Hello, World!", "2024-08-15 00:00:00")
+				mock.ExpectQuery("SELECT id, user_id, username, room, message, created_at FROM messages;").
 					WillReturnRows(rows)
 			},
 			expected: []*pb.Message{
 				{
 					TextContent:   "Hello, World!",
 					Username:      "testuser",
+					Room:          "general",
 					MessageNumber: 1,
 				},
 			},
@@ -122,7 +123,7 @@ func TestGetMessages(t *testing.T) {
 		{
 			name: "Query Failure",
 			mockBehavior: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery("SELECT id, user_id, username, message, created_at FROM `messages`;").
+				mock.ExpectQuery("SELECT id, user_id, username, room, message, created_at FROM messages;").
 					WillReturnError(errors.New("query failed"))
 			},
 			expected:  nil,
@@ -131,9 +132,9 @@ func TestGetMessages(t *testing.T) {
 		{
 			name: "Row Scan Failure",
 			mockBehavior: func(mock sqlmock.Sqlmock) {
-				rows := sqlmock.NewRows([]string{"id", "user_id", "username", "message", "created_at"}).
-					AddRow(1, 1, "testuser", "Hello, World!", "2024-08-15 00:00:00")
-				mock.ExpectQuery("SELECT id, user_id, username, message FROM `messages`;").
+				rows := sqlmock.NewRows([]string{"id", "user_id", "username", "room", "message", "created_at"}).
+					AddRow(1, 1, "testuser", "general", "Hello, World!", "2024-08-15 00:00:00")
+				mock.ExpectQuery("SELECT id, user_id, username, message FROM messages;").
 					WillReturnRows(rows)
 			},
 			expected:  nil,
@@ -152,7 +153,7 @@ func TestGetMessages(t *testing.T) {
 			tt.mockBehavior(mock)
 
 			// Call the function
-			messages, err := GetMessages(db)
+			messages, err := GetMessages(context.Background(), db)
 
 			// Assertions
 			if tt.expectErr {
@@ -169,3 +170,94 @@ func TestGetMessages(t *testing.T) {
 		})
 	}
 }
+
+func TestInsertEncryptedMessage(t *testing.T) {
+	require := require.New(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+
+	keys := []*pb.WrappedKey{{Username: "bob", DeviceId: "laptop", EphemeralPublicKey: []byte("ephemeral"), WrappedKey: []byte("wrapped")}}
+	encodedKeys, err := encodeWrappedKeys(keys)
+	require.NoError(err)
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO messages (user_id, username, room, message, type, recipient, binary_content, wrapped_keys) "+
+		"VALUES (?, ?, ?, '', ?, ?, ?, ?);")).
+		WithArgs(1, "alice", "general", 7, "bob", []byte("ciphertext"), encodedKeys).
+		WillReturnResult(sqlmock.NewResult(9, 1))
+
+	id, err := InsertEncryptedMessage(context.Background(), db, 1, &pb.Message{
+		Type: pb.MessageType_MESSAGE_TYPE_ENCRYPTED, Username: "alice", Room: "general", Recipient: "bob",
+		BinaryContent: []byte("ciphertext"), WrappedKeys: keys,
+	})
+	require.NoError(err)
+	require.Equal(int64(9), id)
+	require.NoError(mock.ExpectationsWereMet())
+
+	decoded, err := decodeWrappedKeys(encodedKeys)
+	require.NoError(err)
+	require.Len(decoded, 1)
+	require.True(proto.Equal(keys[0], decoded[0]))
+}
+
+func TestGetRoomMessages(t *testing.T) {
+	require := require.New(t)
+	query := "SELECT id, username, room, message, type, UNIX_TIMESTAMP\\(created_at\\) FROM messages WHERE room = \\? AND type NOT IN \\(\\?, \\?\\) AND id < \\? ORDER BY id DESC LIMIT \\?;"
+
+	tests := []struct {
+		name         string
+		before       uint64
+		mockBehavior func(mock sqlmock.Sqlmock)
+		expected     []*pb.Message
+		expectErr    bool
+	}{
+		{
+			name:   "Latest Messages",
+			before: 0,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				rows := sqlmock.NewRows([]string{"id", "username", "room", "message", "type", "created_at"}).
+					AddRow(7, "bob", "general", "hi alice", 3, 1723680001).
+					AddRow(5, "alice", "general", "waves", 5, 1723680000)
+				mock.ExpectQuery(query).WithArgs("general", 6, 7, uint64(math.MaxInt64), 2).WillReturnRows(rows)
+			},
+			expected: []*pb.Message{
+				{MessageNumber: 5, Username: "alice", Room: "general", TextContent: "waves", Type: pb.MessageType_MESSAGE_TYPE_ACTION, Timestamp: 1723680000},
+				{MessageNumber: 7, Username: "bob", Room: "general", TextContent: "hi alice", Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Timestamp: 1723680001},
+			},
+		},
+		{
+			name:   "Before A Message",
+			before: 5,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(query).WithArgs("general", 6, 7, uint64(5), 2).
+					WillReturnRows(sqlmock.NewRows([]string{"id", "username", "room", "message", "type", "created_at"}))
+			},
+			expected: []*pb.Message{},
+		},
+		{
+			name:   "Query Failure",
+			before: 0,
+			mockBehavior: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(query).WillReturnError(errors.New("query failed"))
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			require.NoError(err)
+			defer db.Close()
+			tt.mockBehavior(mock)
+
+			messages, err := GetRoomMessages(context.Background(), db, "general", tt.before, 2)
+			if tt.expectErr {
+				require.Error(err)
+				return
+			}
+			require.NoError(err)
+			require.Equal(tt.expected, messages)
+			require.NoError(mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,16 @@
+package db
+
+import (
+	"time"
+
+	"github.com/zjy-dev/grpc-go-chatroom/internal/metrics"
+)
+
+// QueryDuration is the latency of the queries of the package, by function.
+var QueryDuration = metrics.NewHistogramVec("chatroom_db_query_seconds",
+	"Duration of the database queries, by query.", metrics.DefaultBuckets, "query")
+
+// observeQuery records the duration of query, which started at start.
+func observeQuery(query string, start time.Time) {
+	QueryDuration.With(query).Observe(time.Since(start).Seconds())
+}
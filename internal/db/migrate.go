@@ -0,0 +1,409 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrationFiles holds the migrations of the schema of every dialect under
+// migrations/<dialect>, a <version>_<name>.up.sql and a <version>_<name>.down.sql
+// file for every version. Both dialects have the same versions.
+//
+//go:embed migrations/*/*.sql
+var migrationFiles embed.FS
+
+// migrationLock names the lock held while migrating, so that servers migrating
+// on startup at the same time apply every migration once. PostgreSQL advisory
+// locks are named by numbers.
+const (
+	migrationLock         = "grpc_go_chatroom.migrations"
+	migrationAdvisoryLock = 0x63686174726f6f6d // "chatroom"
+)
+
+// migrationLockTimeout is how long to wait for the migrations of another process.
+const migrationLockTimeout = 60 * time.Second
+
+// adoptedTables are the tables the first migrations create unless they exist, with
+// their columns. Databases created by the SQL files of the releases before
+// migrations have them, but the tables of the first releases lack some columns,
+// e.g. their messages had a messages column instead of message, and are refused
+// rather than recorded as migrated with the wrong schema.
+var adoptedTables = []struct {
+	name    string
+	columns []string
+}{
+	{name: "users", columns: []string{"id", "username", "password_hash", "created_at", "last_login_at", "is_bot"}},
+	{name: "messages", columns: []string{"id", "user_id", "username", "room", "message", "type", "recipient", "created_at"}},
+}
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is a versioned change of the schema.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string // SQL applying the change
+	Down    string // SQL reverting the change
+}
+
+// MigrationStatus is a migration and whether it was applied.
+type MigrationStatus struct {
+	Migration
+	AppliedAt time.Time // zero if not applied
+	Unknown   bool      // applied by a newer binary, whose migrations this one does not have
+}
+
+// Migrations returns the migrations of d embedded in the binary, by version.
+func Migrations(d Dialect) ([]Migration, error) {
+	return loadMigrations(migrationFiles, path.Join("migrations", string(d)))
+}
+
+// loadMigrations reads the migrations in dir of fsys.
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %v", err)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration %s: the name is not <version>_<name>.up.sql or <version>_<name>.down.sql", entry.Name())
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s: the version must be a positive number", entry.Name())
+		}
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %v", entry.Name(), err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %s: version %d is also named %s", entry.Name(), version, m.Name)
+		}
+		if match[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if strings.TrimSpace(m.Up) == "" || strings.TrimSpace(m.Down) == "" {
+			return nil, fmt.Errorf("migration %d_%s: both the up and the down file are required", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// splitStatements splits the SQL of a migration into statements, which end with
+// a semicolon at the end of a line, since the driver runs one statement at a time.
+func splitStatements(script string) []string {
+	var statements []string
+	var statement strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if statement.Len() == 0 && (trimmed == "" || strings.HasPrefix(trimmed, "--")) {
+			continue
+		}
+		statement.WriteString(line)
+		statement.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			statements = append(statements, strings.TrimSpace(statement.String()))
+			statement.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(statement.String()); rest != "" {
+		statements = append(statements, rest)
+	}
+	return statements
+}
+
+// MigrateUp applies the migrations not applied yet in order, and returns them.
+// The migrations applied before a failure stay applied.
+func MigrateUp(ctx context.Context, db *sql.DB) ([]Migration, error) {
+	d := DialectOf(db)
+	migrations, err := Migrations(d)
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []Migration
+	err = withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+		if err := createMigrationTable(ctx, conn, d); err != nil {
+			return err
+		}
+		done, err := appliedMigrations(ctx, conn, d)
+		if err != nil {
+			return err
+		}
+		if len(done) == 0 {
+			if err := checkAdoptedTables(ctx, conn, d); err != nil {
+				return err
+			}
+		}
+		for _, m := range migrations {
+			if _, ok := done[m.Version]; ok {
+				continue
+			}
+			err := runMigration(ctx, conn, d, m, m.Up, "INSERT INTO schema_migrations (version, name) VALUES (?, ?);", m.Version, m.Name)
+			if err != nil {
+				return err
+			}
+			applied = append(applied, m)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// MigrateDown reverts the last steps applied migrations, latest first, and
+// returns them.
+func MigrateDown(ctx context.Context, db *sql.DB, steps int) ([]Migration, error) {
+	d := DialectOf(db)
+	migrations, err := Migrations(d)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := make(map[int]Migration, len(migrations))
+	for _, m := range migrations {
+		byVersion[m.Version] = m
+	}
+
+	var reverted []Migration
+	err = withMigrationLock(ctx, db, func(conn *sql.Conn) error {
+		done, err := appliedMigrations(ctx, conn, d)
+		if err != nil {
+			return err
+		}
+		versions := make([]int, 0, len(done))
+		for version := range done {
+			versions = append(versions, version)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+		if steps < len(versions) {
+			versions = versions[:steps]
+		}
+
+		for _, version := range versions {
+			m, ok := byVersion[version]
+			if !ok {
+				return fmt.Errorf("migration %d was applied by a newer version of the server, revert it with that version", version)
+			}
+			err := runMigration(ctx, conn, d, m, m.Down, "DELETE FROM schema_migrations WHERE version = ?;", m.Version)
+			if err != nil {
+				return err
+			}
+			reverted = append(reverted, m)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// GetMigrationStatus returns the embedded migrations and the migrations applied
+// to the database, by version.
+func GetMigrationStatus(ctx context.Context, db *sql.DB) ([]MigrationStatus, error) {
+	d := DialectOf(db)
+	migrations, err := Migrations(d)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to database: %v", err)
+	}
+	defer conn.Close()
+	done, err := appliedMigrations(ctx, conn, d)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		statuses = append(statuses, MigrationStatus{Migration: m, AppliedAt: done[m.Version].AppliedAt})
+		delete(done, m.Version)
+	}
+	for _, unknown := range done {
+		statuses = append(statuses, unknown)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+// withMigrationLock runs f on a connection holding the migration lock.
+func withMigrationLock(ctx context.Context, db *sql.DB, f func(conn *sql.Conn) error) error {
+	// The lock belongs to the session, so it is taken and released on the same connection.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %v", err)
+	}
+	defer conn.Close()
+
+	if DialectOf(db) == Postgres {
+		lockCtx, cancel := context.WithTimeout(ctx, migrationLockTimeout)
+		defer cancel()
+		if _, err := conn.ExecContext(lockCtx, "SELECT pg_advisory_lock($1);", int64(migrationAdvisoryLock)); err != nil {
+			if lockCtx.Err() != nil && ctx.Err() == nil {
+				return fmt.Errorf("failed to lock migrations: another process has been migrating the database for %s", migrationLockTimeout)
+			}
+			return fmt.Errorf("failed to lock migrations: %v", err)
+		}
+		defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1);", int64(migrationAdvisoryLock))
+		return f(conn)
+	}
+
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?);", migrationLock, int(migrationLockTimeout.Seconds())).Scan(&locked); err != nil {
+		return fmt.Errorf("failed to lock migrations: %v", err)
+	}
+	if locked.Int64 != 1 {
+		return fmt.Errorf("failed to lock migrations: another process has been migrating the database for %s", migrationLockTimeout)
+	}
+	defer conn.ExecContext(context.Background(), "DO RELEASE_LOCK(?);", migrationLock)
+	return f(conn)
+}
+
+// createMigrationTable creates the table of the applied migrations if it does not exist.
+func createMigrationTable(ctx context.Context, conn *sql.Conn, d Dialect) error {
+	query := "CREATE TABLE IF NOT EXISTS schema_migrations (" +
+		"version integer NOT NULL PRIMARY KEY, " +
+		"name varchar(255) NOT NULL, " +
+		"applied_at timestamp NULL DEFAULT CURRENT_TIMESTAMP" +
+		") ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_0900_ai_ci;"
+	if d == Postgres {
+		query = "CREATE TABLE IF NOT EXISTS schema_migrations (" +
+			"version integer NOT NULL PRIMARY KEY, " +
+			"name varchar(255) NOT NULL, " +
+			"applied_at timestamptz DEFAULT CURRENT_TIMESTAMP" +
+			");"
+	}
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create the schema_migrations table: %v", err)
+	}
+	return nil
+}
+
+// checkAdoptedTables returns an error if a table the first migrations would adopt
+// exists without some of the columns they create.
+func checkAdoptedTables(ctx context.Context, conn *sql.Conn, d Dialect) error {
+	query := "SELECT column_name FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ?;"
+	if d == Postgres {
+		query = "SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1;"
+	}
+	for _, table := range adoptedTables {
+		rows, err := conn.QueryContext(ctx, query, table.name)
+		if err != nil {
+			return fmt.Errorf("failed to query the columns of %s: %v", table.name, err)
+		}
+		columns := map[string]bool{}
+		for rows.Next() {
+			var column string
+			if err := rows.Scan(&column); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan the columns of %s: %v", table.name, err)
+			}
+			columns[column] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to query the columns of %s: %v", table.name, err)
+		}
+		if len(columns) == 0 {
+			continue // created by the migrations
+		}
+		var missing []string
+		for _, column := range table.columns {
+			if !columns[column] {
+				missing = append(missing, column)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("the %s table was created by an older release and has no %s column(s), "+
+				"upgrade it as described in the README before migrating", table.name, strings.Join(missing, ", "))
+		}
+	}
+	return nil
+}
+
+// appliedMigrations returns the applied migrations by version, without their SQL.
+// None are applied if the schema_migrations table does not exist yet.
+func appliedMigrations(ctx context.Context, conn *sql.Conn, d Dialect) (map[int]MigrationStatus, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, name, "+d.unixTime("applied_at")+" FROM schema_migrations ORDER BY version;")
+	if d.isNoSuchTable(err) {
+		return map[int]MigrationStatus{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query applied migrations: %v", err)
+	}
+	defer rows.Close()
+
+	applied := map[int]MigrationStatus{}
+	for rows.Next() {
+		var status MigrationStatus
+		var appliedAt int64
+		if err := rows.Scan(&status.Version, &status.Name, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan applied migration: %v", err)
+		}
+		status.AppliedAt = time.Unix(appliedAt, 0)
+		status.Unknown = true // until matched with an embedded migration
+		applied[status.Version] = status
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query applied migrations: %v", err)
+	}
+	return applied, nil
+}
+
+// runMigration runs the statements of script, the up or down SQL of m, then
+// record with args to update schema_migrations. On PostgreSQL they run in a
+// transaction. MySQL commits schema changes implicitly, so there the statements
+// run before a failing one are not rolled back.
+func runMigration(ctx context.Context, conn *sql.Conn, d Dialect, m Migration, script, record string, args ...any) error {
+	type execer interface {
+		ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	}
+	var exec execer = conn
+	var tx *sql.Tx
+	if d == Postgres {
+		var err error
+		if tx, err = conn.BeginTx(ctx, nil); err != nil {
+			return fmt.Errorf("migration %d_%s failed: %v", m.Version, m.Name, err)
+		}
+		defer tx.Rollback()
+		exec = tx
+	}
+
+	for _, statement := range splitStatements(script) {
+		if _, err := exec.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("migration %d_%s failed: %v", m.Version, m.Name, err)
+		}
+	}
+	if _, err := exec.ExecContext(ctx, d.rebind(record), args...); err != nil {
+		return fmt.Errorf("failed to record migration %d_%s: %v", m.Version, m.Name, err)
+	}
+	if tx != nil {
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d_%s failed: %v", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+//go:build integration_test
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// createTestDatabase creates an empty database dropped after the test, and connects to it.
+func createTestDatabase(t *testing.T, name string) *sql.DB {
+	admin := connectTestDB(t, testDB.DBName)
+	dbName := fmt.Sprintf("%s_%s_%d", testDB.DBName, name, time.Now().UnixNano())
+	_, err := admin.Exec("CREATE DATABASE " + dbName + ";")
+	require.NoError(t, err)
+	t.Cleanup(func() { admin.Exec("DROP DATABASE " + dbName + ";") })
+	return connectTestDB(t, dbName)
+}
+
+// TestMigrationsIntegration applies all migrations to a fresh database, reverts
+// them and applies them again.
+func TestMigrationsIntegration(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	migrations, err := Migrations(Dialect(testDB.Driver))
+	require.NoError(err)
+
+	dbConn := createTestDatabase(t, "migrations")
+
+	applied, err := MigrateUp(ctx, dbConn)
+	require.NoError(err)
+	require.Equal(migrations, applied)
+
+	// The queries of the package run on the migrated schema
+	userID, err := InsertUser(context.Background(), dbConn, "alice", "hash")
+	require.NoError(err)
+	_, err = InsertAPIKey(context.Background(), dbConn, userID, "prefix", "hash", "chat")
+	require.NoError(err)
+	_, err = InsertWebhook(context.Background(), dbConn, "https://example.com/hook", "", "", "secret", "admin")
+	require.NoError(err)
+	_, err = GetMessages(context.Background(), dbConn)
+	require.NoError(err)
+
+	applied, err = MigrateUp(ctx, dbConn)
+	require.NoError(err)
+	require.Empty(applied)
+	statuses, err := GetMigrationStatus(ctx, dbConn)
+	require.NoError(err)
+	for _, status := range statuses {
+		require.False(status.AppliedAt.IsZero(), "migration %d is not applied", status.Version)
+	}
+
+	reverted, err := MigrateDown(ctx, dbConn, len(migrations))
+	require.NoError(err)
+	require.Len(reverted, len(migrations))
+	_, err = dbConn.Exec("SELECT 1 FROM users;")
+	require.True(DialectOf(dbConn).isNoSuchTable(err), "the users table was not dropped: %v", err)
+
+	applied, err = MigrateUp(ctx, dbConn)
+	require.NoError(err)
+	require.Equal(migrations, applied)
+}
+
+// TestUserProfilesMigrationIntegration checks that the migration 0005 replaces the
+// placeholder user IDs of the messages stored before it with their authors'.
+func TestUserProfilesMigrationIntegration(t *testing.T) {
+	require := require.New(t)
+	ctx := context.Background()
+	migrations, err := Migrations(Dialect(testDB.Driver))
+	require.NoError(err)
+	dbConn := createTestDatabase(t, "backfill")
+
+	_, err = MigrateUp(ctx, dbConn)
+	require.NoError(err)
+	_, err = MigrateDown(ctx, dbConn, len(migrations)-4)
+	require.NoError(err)
+	statuses, err := GetMigrationStatus(ctx, dbConn)
+	require.NoError(err)
+	require.False(statuses[3].AppliedAt.IsZero())
+	require.True(statuses[4].AppliedAt.IsZero(), "migration %d is applied", statuses[4].Version)
+
+	aliceID, err := InsertUser(ctx, dbConn, "alice", "hash")
+	require.NoError(err)
+	bobID, err := InsertUser(ctx, dbConn, "bob", "hash")
+	require.NoError(err)
+	var messageIDs []int64
+	// mallory was deleted
+	for _, username := range []string{"alice", "bob", "mallory", "alice"} {
+		id, err := insertReturningID(ctx, dbConn, "INSERT INTO messages (user_id, username, room, message) VALUES (?, ?, ?, ?);",
+			42, username, "general", "hello")
+		require.NoError(err)
+		messageIDs = append(messageIDs, id)
+	}
+
+	_, err = MigrateUp(ctx, dbConn)
+	require.NoError(err)
+
+	for i, want := range []int64{aliceID, bobID, 42, aliceID} {
+		var userID int64
+		require.NoError(dbConn.QueryRow(DialectOf(dbConn).rebind("SELECT user_id FROM messages WHERE id = ?;"), messageIDs[i]).Scan(&userID))
+		require.Equal(want, userID, "message %d", i)
+	}
+}
@@ -0,0 +1,399 @@
+//go:build unit_test
+
+package db
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrations(t *testing.T) {
+	require := require.New(t)
+
+	mysqlMigrations, err := Migrations(MySQL)
+	require.NoError(err)
+	require.NotEmpty(mysqlMigrations)
+	postgresMigrations, err := Migrations(Postgres)
+	require.NoError(err)
+	require.Len(postgresMigrations, len(mysqlMigrations))
+
+	for i, m := range mysqlMigrations {
+		// Versions are consecutive, so that a missing file is noticed
+		require.Equal(i+1, m.Version)
+		require.NotEmpty(splitStatements(m.Up))
+		require.NotEmpty(splitStatements(m.Down))
+		// The dialects have the same migrations
+		require.Equal(m.Version, postgresMigrations[i].Version)
+		require.Equal(m.Name, postgresMigrations[i].Name)
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	tests := []struct {
+		name          string
+		files         fstest.MapFS
+		expected      []Migration
+		expectedError string
+	}{
+		{
+			name: "sorted by version",
+			files: fstest.MapFS{
+				"m/10_b.up.sql":   {Data: []byte("CREATE TABLE b;")},
+				"m/10_b.down.sql": {Data: []byte("DROP TABLE b;")},
+				"m/2_a.up.sql":    {Data: []byte("CREATE TABLE a;")},
+				"m/2_a.down.sql":  {Data: []byte("DROP TABLE a;")},
+			},
+			expected: []Migration{
+				{Version: 2, Name: "a", Up: "CREATE TABLE a;", Down: "DROP TABLE a;"},
+				{Version: 10, Name: "b", Up: "CREATE TABLE b;", Down: "DROP TABLE b;"},
+			},
+		},
+		{
+			name: "missing down",
+			files: fstest.MapFS{
+				"m/1_a.up.sql": {Data: []byte("CREATE TABLE a;")},
+			},
+			expectedError: "migration 1_a: both the up and the down file are required",
+		},
+		{
+			name: "names differ",
+			files: fstest.MapFS{
+				"m/1_a.up.sql":   {Data: []byte("CREATE TABLE a;")},
+				"m/1_b.down.sql": {Data: []byte("DROP TABLE a;")},
+			},
+			expectedError: "migration 1_b.down.sql: version 1 is also named a",
+		},
+		{
+			name: "invalid name",
+			files: fstest.MapFS{
+				"m/create_a.sql": {Data: []byte("CREATE TABLE a;")},
+			},
+			expectedError: "migration create_a.sql: the name is not <version>_<name>.up.sql or <version>_<name>.down.sql",
+		},
+		{
+			name: "zero version",
+			files: fstest.MapFS{
+				"m/0_a.up.sql": {Data: []byte("CREATE TABLE a;")},
+			},
+			expectedError: "migration 0_a.up.sql: the version must be a positive number",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := loadMigrations(tt.files, "m")
+			if tt.expectedError != "" {
+				require.EqualError(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, migrations)
+		})
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	script := "-- Comment\n\nCREATE TABLE `a` (\n    `id` int\n);\n\nDROP TABLE `b`;\nDROP TABLE `c`"
+	require.Equal(t, []string{
+		"CREATE TABLE `a` (\n    `id` int\n);",
+		"DROP TABLE `b`;",
+		"DROP TABLE `c`",
+	}, splitStatements(script))
+}
+
+// expectMigrationLock expects the migration lock to be taken.
+func expectMigrationLock(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT GET_LOCK(?, ?);")).
+		WithArgs(migrationLock, 60).
+		WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(1))
+}
+
+// expectMigrationUnlock expects the migration lock to be released.
+func expectMigrationUnlock(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(regexp.QuoteMeta("DO RELEASE_LOCK(?);")).WithArgs(migrationLock).WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+// expectNoAdoptedTables expects the columns of the tables the first migrations adopt
+// to be queried, and none to exist.
+func expectNoAdoptedTables(mock sqlmock.Sqlmock, query string) {
+	for _, table := range adoptedTables {
+		mock.ExpectQuery(regexp.QuoteMeta(query)).WithArgs(table.name).WillReturnRows(sqlmock.NewRows([]string{"column_name"}))
+	}
+}
+
+const selectColumns = "SELECT column_name FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ?;"
+
+const selectAppliedMigrations = "SELECT version, name, UNIX_TIMESTAMP(applied_at) FROM schema_migrations ORDER BY version;"
+
+func TestMigrateUp(t *testing.T) {
+	require := require.New(t)
+	migrations, err := Migrations(MySQL)
+	require.NoError(err)
+
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+
+	expectMigrationLock(mock)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(selectAppliedMigrations)).
+		WillReturnRows(sqlmock.NewRows([]string{"version", "name", "applied_at"}).AddRow(1, "create_users", 1723680000))
+	for _, m := range migrations[1:] {
+		for _, statement := range splitStatements(m.Up) {
+			mock.ExpectExec(regexp.QuoteMeta(statement)).WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations (version, name) VALUES (?, ?);")).
+			WithArgs(m.Version, m.Name).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	expectMigrationUnlock(mock)
+
+	applied, err := MigrateUp(context.Background(), db)
+	require.NoError(err)
+	require.Equal(migrations[1:], applied)
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestMigrateUpFailure(t *testing.T) {
+	require := require.New(t)
+
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+
+	expectMigrationLock(mock)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(selectAppliedMigrations)).
+		WillReturnError(&mysql.MySQLError{Number: 1146, Message: "Table 'schema_migrations' doesn't exist"})
+	expectNoAdoptedTables(mock, selectColumns)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS `users`").WillReturnError(errors.New("access denied"))
+	expectMigrationUnlock(mock)
+
+	applied, err := MigrateUp(context.Background(), db)
+	require.EqualError(err, "migration 1_create_users failed: access denied")
+	require.Empty(applied)
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestMigrateUpAdoptedTables(t *testing.T) {
+	tests := []struct {
+		name          string
+		messages      []string
+		expectedError string
+	}{
+		{
+			name:     "created by the last release before migrations",
+			messages: []string{"id", "user_id", "username", "room", "message", "type", "recipient", "created_at"},
+		},
+		{
+			name:          "created by the first release",
+			messages:      []string{"id", "user_id", "username", "messages", "created_at"},
+			expectedError: "the messages table was created by an older release and has no room, message, type, recipient column(s), upgrade it as described in the README before migrating",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			migrations, err := Migrations(MySQL)
+			require.NoError(err)
+			db, mock, err := sqlmock.New()
+			require.NoError(err)
+			defer db.Close()
+
+			expectMigrationLock(mock)
+			mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(regexp.QuoteMeta(selectAppliedMigrations)).
+				WillReturnRows(sqlmock.NewRows([]string{"version", "name", "applied_at"}))
+			users := sqlmock.NewRows([]string{"column_name"})
+			for _, column := range adoptedTables[0].columns {
+				users.AddRow(column)
+			}
+			messages := sqlmock.NewRows([]string{"column_name"})
+			for _, column := range tt.messages {
+				messages.AddRow(column)
+			}
+			mock.ExpectQuery(regexp.QuoteMeta(selectColumns)).WithArgs("users").WillReturnRows(users)
+			mock.ExpectQuery(regexp.QuoteMeta(selectColumns)).WithArgs("messages").WillReturnRows(messages)
+			if tt.expectedError == "" {
+				for _, m := range migrations {
+					for _, statement := range splitStatements(m.Up) {
+						mock.ExpectExec(regexp.QuoteMeta(statement)).WillReturnResult(sqlmock.NewResult(0, 0))
+					}
+					mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations (version, name) VALUES (?, ?);")).
+						WithArgs(m.Version, m.Name).
+						WillReturnResult(sqlmock.NewResult(0, 1))
+				}
+			}
+			expectMigrationUnlock(mock)
+
+			applied, err := MigrateUp(context.Background(), db)
+			if tt.expectedError == "" {
+				require.NoError(err)
+				require.Equal(migrations, applied)
+			} else {
+				require.EqualError(err, tt.expectedError)
+				require.Empty(applied)
+			}
+			require.NoError(mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestMigrateUpLocked(t *testing.T) {
+	require := require.New(t)
+
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT GET_LOCK(?, ?);")).
+		WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(0))
+
+	_, err = MigrateUp(context.Background(), db)
+	require.EqualError(err, "failed to lock migrations: another process has been migrating the database for 1m0s")
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestMigrateDown(t *testing.T) {
+	migrations, err := Migrations(MySQL)
+	require.NoError(t, err)
+	last := migrations[len(migrations)-1]
+
+	tests := []struct {
+		name          string
+		applied       []int
+		steps         int
+		expected      []Migration
+		expectedError string
+	}{
+		{
+			name:     "last",
+			applied:  []int{1, last.Version},
+			steps:    1,
+			expected: []Migration{last},
+		},
+		{
+			name:     "more steps than applied",
+			applied:  []int{1},
+			steps:    5,
+			expected: []Migration{migrations[0]},
+		},
+		{
+			name:          "unknown version",
+			applied:       []int{1, 1000},
+			steps:         1,
+			expectedError: "migration 1000 was applied by a newer version of the server, revert it with that version",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			db, mock, err := sqlmock.New()
+			require.NoError(err)
+			defer db.Close()
+
+			expectMigrationLock(mock)
+			rows := sqlmock.NewRows([]string{"version", "name", "applied_at"})
+			for _, version := range tt.applied {
+				rows.AddRow(version, "migration", 1723680000)
+			}
+			mock.ExpectQuery(regexp.QuoteMeta(selectAppliedMigrations)).WillReturnRows(rows)
+			for _, m := range tt.expected {
+				for _, statement := range splitStatements(m.Down) {
+					mock.ExpectExec(regexp.QuoteMeta(statement)).WillReturnResult(sqlmock.NewResult(0, 0))
+				}
+				mock.ExpectExec(regexp.QuoteMeta("DELETE FROM schema_migrations WHERE version = ?;")).
+					WithArgs(m.Version).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			expectMigrationUnlock(mock)
+
+			reverted, err := MigrateDown(context.Background(), db, tt.steps)
+			if tt.expectedError != "" {
+				require.EqualError(err, tt.expectedError)
+			} else {
+				require.NoError(err)
+				require.Equal(tt.expected, reverted)
+			}
+			require.NoError(mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestGetMigrationStatus(t *testing.T) {
+	require := require.New(t)
+	migrations, err := Migrations(MySQL)
+	require.NoError(err)
+
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta(selectAppliedMigrations)).
+		WillReturnRows(sqlmock.NewRows([]string{"version", "name", "applied_at"}).
+			AddRow(1, "create_users", 1723680000).
+			AddRow(1000, "from_the_future", 1723680001))
+
+	statuses, err := GetMigrationStatus(context.Background(), db)
+	require.NoError(err)
+	require.Len(statuses, len(migrations)+1)
+	require.Equal(MigrationStatus{Migration: migrations[0], AppliedAt: time.Unix(1723680000, 0)}, statuses[0])
+	for i, m := range migrations[1:] {
+		require.Equal(MigrationStatus{Migration: m}, statuses[i+1])
+	}
+	require.Equal(MigrationStatus{
+		Migration: Migration{Version: 1000, Name: "from_the_future"},
+		AppliedAt: time.Unix(1723680001, 0),
+		Unknown:   true,
+	}, statuses[len(statuses)-1])
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestMigrateUpPostgres(t *testing.T) {
+	require := require.New(t)
+	migrations, err := Migrations(Postgres)
+	require.NoError(err)
+
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+	registerDialect(db, Postgres)
+
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_lock($1);")).
+		WithArgs(int64(migrationAdvisoryLock)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT version, name, CAST(EXTRACT(EPOCH FROM applied_at) AS BIGINT) FROM schema_migrations ORDER BY version;")).
+		WillReturnError(&pgconn.PgError{Code: "42P01"})
+	expectNoAdoptedTables(mock, "SELECT column_name FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1;")
+	// Every migration runs in a transaction with its record
+	for _, m := range migrations {
+		mock.ExpectBegin()
+		for _, statement := range splitStatements(m.Up) {
+			mock.ExpectExec(regexp.QuoteMeta(statement)).WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO schema_migrations (version, name) VALUES ($1, $2);")).
+			WithArgs(m.Version, m.Name).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+	mock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_unlock($1);")).
+		WithArgs(int64(migrationAdvisoryLock)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	applied, err := MigrateUp(context.Background(), db)
+	require.NoError(err)
+	require.Equal(migrations, applied)
+	require.NoError(mock.ExpectationsWereMet())
+}
@@ -1,12 +1,9 @@
-USE `grpc_go_chatroom`;
-
-CREATE TABLE `users` (
+CREATE TABLE IF NOT EXISTS `users` (
     `id` int NOT NULL AUTO_INCREMENT COMMENT '用户唯一标识符',
     `username` varchar(255) NOT NULL UNIQUE COMMENT '用户名，必须唯一',
     `password_hash` varchar(255) NOT NULL COMMENT '用户密码的哈希值',
     `created_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP COMMENT '用户创建时间',
     `last_login_at` timestamp NULL DEFAULT NULL COMMENT '用户最后登录时间',
+    `is_bot` boolean NOT NULL DEFAULT FALSE COMMENT '是否为机器人账号，机器人只能使用 API key 认证',
     PRIMARY KEY (`id`)
 ) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_0900_ai_ci;
-
-INSERT INTO `users` (`username`, `password_hash`) VALUES (?, ?);
\ No newline at end of file
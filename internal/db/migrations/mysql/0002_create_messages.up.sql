@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS `messages` (
+    `id` int NOT NULL AUTO_INCREMENT,
+    `user_id` int NOT NULL,
+    `username` varchar(255) NOT NULL,
+    `room` varchar(64) NOT NULL DEFAULT 'general',
+    `message` text NOT NULL,
+    `type` tinyint NOT NULL DEFAULT 3 COMMENT 'MessageType, 3 is normal',
+    `recipient` varchar(255) NOT NULL DEFAULT '' COMMENT 'the recipient of a private message',
+    `created_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (`id`),
+    KEY `idx_messages_room_id` (`room`, `id`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_0900_ai_ci;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS `api_keys` (
+    `id` int NOT NULL AUTO_INCREMENT,
+    `user_id` int NOT NULL COMMENT '所属机器人的用户 ID',
+    `prefix` varchar(16) NOT NULL COMMENT 'API key 的前缀，用于展示',
+    `key_hash` char(64) NOT NULL UNIQUE COMMENT 'API key 的 SHA-256 哈希值',
+    `scopes` varchar(255) NOT NULL COMMENT '逗号分隔的权限范围',
+    `created_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP,
+    `revoked_at` timestamp NULL DEFAULT NULL COMMENT '吊销时间，NULL 表示有效',
+    PRIMARY KEY (`id`),
+    FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_0900_ai_ci;
@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS `webhooks` (
+    `id` int NOT NULL AUTO_INCREMENT,
+    `url` varchar(2048) NOT NULL COMMENT '接收事件的 URL',
+    `event_types` varchar(255) NOT NULL DEFAULT '' COMMENT '逗号分隔的事件类型，空表示全部',
+    `rooms` varchar(1024) NOT NULL DEFAULT '' COMMENT '逗号分隔的房间，空表示全部',
+    `secret` varchar(128) NOT NULL COMMENT 'HMAC 签名密钥',
+    `created_by` varchar(255) NOT NULL COMMENT '创建该订阅的管理员',
+    `created_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (`id`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_0900_ai_ci;
+
+CREATE TABLE IF NOT EXISTS `webhook_dead_letters` (
+    `id` int NOT NULL AUTO_INCREMENT,
+    `webhook_id` int NOT NULL,
+    `event_id` varchar(64) NOT NULL,
+    `event_type` varchar(64) NOT NULL,
+    `payload` mediumblob NOT NULL COMMENT '投递失败的 JSON 事件',
+    `attempts` int NOT NULL COMMENT '已尝试投递的次数',
+    `last_error` text NOT NULL,
+    `created_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (`id`),
+    KEY `idx_webhook_id` (`webhook_id`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_0900_ai_ci;
@@ -0,0 +1,11 @@
+ALTER TABLE `users`
+    ADD COLUMN `display_name` varchar(64) NOT NULL DEFAULT '' COMMENT '显示名称，空表示用户名',
+    ADD COLUMN `avatar_url` varchar(2048) NOT NULL DEFAULT '' COMMENT '头像 URL',
+    ADD COLUMN `status_text` varchar(128) NOT NULL DEFAULT '' COMMENT '状态文本',
+    ADD COLUMN `bio` varchar(1024) NOT NULL DEFAULT '' COMMENT '个人简介';
+
+-- Messages used to be stored with a placeholder user ID, store their authors'
+-- instead. The messages of deleted users are kept as they are.
+UPDATE `messages` JOIN `users` ON `users`.`username` = `messages`.`username`
+    SET `messages`.`user_id` = `users`.`id`
+    WHERE `messages`.`user_id` <> `users`.`id`;
@@ -0,0 +1,5 @@
+ALTER TABLE `messages`
+    DROP COLUMN `binary_content`,
+    DROP COLUMN `wrapped_keys`;
+
+DROP TABLE IF EXISTS `device_keys`;
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS `device_keys` (
+    `id` int NOT NULL AUTO_INCREMENT,
+    `user_id` int NOT NULL,
+    `device_id` varchar(64) NOT NULL COMMENT '设备标识，由设备自行选择',
+    `public_key` varbinary(32) NOT NULL COMMENT 'X25519 公钥',
+    `created_at` timestamp NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (`id`),
+    UNIQUE KEY `uniq_user_device` (`user_id`, `device_id`),
+    FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_0900_ai_ci;
+
+ALTER TABLE `messages`
+    ADD COLUMN `binary_content` mediumblob NULL COMMENT '加密消息的密文，服务器无法解密',
+    ADD COLUMN `wrapped_keys` blob NULL COMMENT '为每个设备加密的消息密钥';
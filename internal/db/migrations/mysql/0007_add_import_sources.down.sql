@@ -0,0 +1,6 @@
+ALTER TABLE `messages`
+    DROP INDEX `uniq_import`,
+    DROP COLUMN `import_source`,
+    DROP COLUMN `import_id`;
+
+DROP TABLE IF EXISTS `instance`;
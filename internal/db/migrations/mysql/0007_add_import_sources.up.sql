@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS `instance` (
+    `id` char(32) NOT NULL COMMENT '部署标识，导出的存档以它标识消息来源',
+    PRIMARY KEY (`id`)
+) ENGINE = InnoDB DEFAULT CHARSET = utf8mb4 COLLATE = utf8mb4_0900_ai_ci;
+
+INSERT INTO `instance` (`id`) VALUES (REPLACE(UUID(), '-', ''));
+
+ALTER TABLE `messages`
+    ADD COLUMN `import_source` varchar(64) NULL COMMENT '导入消息的来源部署标识',
+    ADD COLUMN `import_id` bigint NULL COMMENT '导入消息在来源部署的消息编号',
+    ADD UNIQUE KEY `uniq_import` (`import_source`, `import_id`);
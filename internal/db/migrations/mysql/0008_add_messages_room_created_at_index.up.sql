@@ -0,0 +1,2 @@
+-- Lets the retention purge find the old messages of a room without scanning it.
+ALTER TABLE `messages` ADD INDEX `idx_messages_room_created_at` (`room`, `created_at`);
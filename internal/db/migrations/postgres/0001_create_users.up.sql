@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS users (
+    id integer GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    username varchar(255) NOT NULL UNIQUE,
+    password_hash varchar(255) NOT NULL,
+    created_at timestamptz DEFAULT CURRENT_TIMESTAMP,
+    last_login_at timestamptz DEFAULT NULL,
+    -- Bots can only authenticate with API keys.
+    is_bot boolean NOT NULL DEFAULT FALSE
+);
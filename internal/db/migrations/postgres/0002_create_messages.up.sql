@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS messages (
+    id integer GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    user_id integer NOT NULL,
+    username varchar(255) NOT NULL,
+    room varchar(64) NOT NULL DEFAULT 'general',
+    message text NOT NULL,
+    -- MessageType, 3 is normal.
+    type smallint NOT NULL DEFAULT 3,
+    -- The recipient of a private message.
+    recipient varchar(255) NOT NULL DEFAULT '',
+    created_at timestamptz DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_messages_room_id ON messages (room, id);
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS api_keys (
+    id integer GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    -- Shown to tell the keys apart.
+    prefix varchar(16) NOT NULL,
+    -- SHA-256 of the key, which is never stored.
+    key_hash char(64) NOT NULL UNIQUE,
+    -- Comma separated.
+    scopes varchar(255) NOT NULL,
+    created_at timestamptz DEFAULT CURRENT_TIMESTAMP,
+    -- NULL while the key is active.
+    revoked_at timestamptz DEFAULT NULL
+);
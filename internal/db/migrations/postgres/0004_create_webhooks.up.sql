@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS webhooks (
+    id integer GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    url varchar(2048) NOT NULL,
+    -- Comma separated, all event types if empty.
+    event_types varchar(255) NOT NULL DEFAULT '',
+    -- Comma separated, all rooms if empty.
+    rooms varchar(1024) NOT NULL DEFAULT '',
+    -- Key of the HMAC signatures.
+    secret varchar(128) NOT NULL,
+    -- The admin who subscribed.
+    created_by varchar(255) NOT NULL,
+    created_at timestamptz DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+    id integer GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    webhook_id integer NOT NULL,
+    event_id varchar(64) NOT NULL,
+    event_type varchar(64) NOT NULL,
+    -- The JSON event that could not be delivered.
+    payload bytea NOT NULL,
+    attempts integer NOT NULL,
+    last_error text NOT NULL,
+    created_at timestamptz DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_id ON webhook_dead_letters (webhook_id);
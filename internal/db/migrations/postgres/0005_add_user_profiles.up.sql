@@ -0,0 +1,12 @@
+ALTER TABLE users
+    -- Empty means username.
+    ADD COLUMN IF NOT EXISTS display_name varchar(64) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS avatar_url varchar(2048) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS status_text varchar(128) NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS bio varchar(1024) NOT NULL DEFAULT '';
+
+-- Messages used to be stored with a placeholder user ID, store their authors'
+-- instead. The messages of deleted users are kept as they are.
+UPDATE messages SET user_id = users.id
+    FROM users
+    WHERE users.username = messages.username AND messages.user_id <> users.id;
@@ -0,0 +1,5 @@
+ALTER TABLE messages
+    DROP COLUMN IF EXISTS binary_content,
+    DROP COLUMN IF EXISTS wrapped_keys;
+
+DROP TABLE IF EXISTS device_keys;
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS device_keys (
+    id integer GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    -- Chosen by the device.
+    device_id varchar(64) NOT NULL,
+    -- X25519 public key.
+    public_key bytea NOT NULL,
+    created_at timestamptz DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, device_id)
+);
+
+ALTER TABLE messages
+    -- The ciphertext of an encrypted message, which the server cannot decrypt.
+    ADD COLUMN IF NOT EXISTS binary_content bytea NULL,
+    -- The message key encrypted for every device.
+    ADD COLUMN IF NOT EXISTS wrapped_keys bytea NULL;
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS uniq_import;
+
+ALTER TABLE messages
+    DROP COLUMN IF EXISTS import_source,
+    DROP COLUMN IF EXISTS import_id;
+
+DROP TABLE IF EXISTS instance;
@@ -0,0 +1,14 @@
+-- The ID of the deployment, which identifies the messages of its archives.
+CREATE TABLE IF NOT EXISTS instance (
+    id char(32) PRIMARY KEY
+);
+
+INSERT INTO instance (id) VALUES (md5(random()::text || clock_timestamp()::text));
+
+ALTER TABLE messages
+    -- The ID of the deployment an imported message comes from.
+    ADD COLUMN IF NOT EXISTS import_source varchar(64) NULL,
+    -- The message number of an imported message in its source.
+    ADD COLUMN IF NOT EXISTS import_id bigint NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS uniq_import ON messages (import_source, import_id);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS idx_messages_room_created_at;
@@ -0,0 +1,2 @@
+-- Lets the retention purge find the old messages of a room without scanning it.
+CREATE INDEX IF NOT EXISTS idx_messages_room_created_at ON messages (room, created_at);
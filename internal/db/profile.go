@@ -0,0 +1,59 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Profile is the public profile of a user.
+type Profile struct {
+	UserID      int64
+	Username    string
+	DisplayName string // empty means username
+	AvatarURL   string
+	StatusText  string
+	Bio         string
+}
+
+// ProfileUpdate holds the fields of a profile to update, nil fields are left unchanged.
+type ProfileUpdate struct {
+	DisplayName *string
+	AvatarURL   *string
+	StatusText  *string
+	Bio         *string
+}
+
+// GetProfile returns the profile of username, or nil if the user does not exist.
+func GetProfile(ctx context.Context, db Querier, username string) (_ *Profile, err error) {
+	ctx, done := startQuery(ctx, db, "get_profile")
+	defer done(&err)
+	query := "SELECT id, username, display_name, avatar_url, status_text, bio FROM users WHERE username = ?;"
+
+	var p Profile
+	err = db.QueryRowContext(ctx, DialectOf(db).rebind(query), username).
+		Scan(&p.UserID, &p.Username, &p.DisplayName, &p.AvatarURL, &p.StatusText, &p.Bio)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get profile: %w", err)
+	}
+	return &p, nil
+}
+
+// UpdateProfile updates the set fields of update in the profile of username.
+// Updating a user that does not exist is not an error, see GetProfile.
+func UpdateProfile(ctx context.Context, db Querier, username string, update ProfileUpdate) (err error) {
+	ctx, done := startQuery(ctx, db, "update_profile")
+	defer done(&err)
+	// NULL arguments keep the current values.
+	query := "UPDATE users SET display_name = COALESCE(?, display_name), avatar_url = COALESCE(?, avatar_url), " +
+		"status_text = COALESCE(?, status_text), bio = COALESCE(?, bio) WHERE username = ?;"
+	_, err = db.ExecContext(ctx, DialectOf(db).rebind(query),
+		update.DisplayName, update.AvatarURL, update.StatusText, update.Bio, username)
+	if err != nil {
+		return fmt.Errorf("failed to update profile: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+//go:build unit_test
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	selectProfile = "SELECT id, username, display_name, avatar_url, status_text, bio FROM users WHERE username = ?;"
+	updateProfile = "UPDATE users SET display_name = COALESCE(?, display_name), avatar_url = COALESCE(?, avatar_url), " +
+		"status_text = COALESCE(?, status_text), bio = COALESCE(?, bio) WHERE username = ?;"
+)
+
+func TestGetProfile(t *testing.T) {
+	tests := []struct {
+		name          string
+		username      string
+		mockSetup     func(sqlmock.Sqlmock)
+		expected      *Profile
+		expectedError string
+	}{
+		{
+			name:     "found",
+			username: "alice",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(regexp.QuoteMeta(selectProfile)).
+					WithArgs("alice").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "username", "display_name", "avatar_url", "status_text", "bio"}).
+						AddRow(3, "alice", "Alice", "https://example.com/alice.png", "busy", "Hi"))
+			},
+			expected: &Profile{UserID: 3, Username: "alice", DisplayName: "Alice", AvatarURL: "https://example.com/alice.png", StatusText: "busy", Bio: "Hi"},
+		},
+		{
+			name:     "not found",
+			username: "bob",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(regexp.QuoteMeta(selectProfile)).WithArgs("bob").WillReturnError(sql.ErrNoRows)
+			},
+		},
+		{
+			name:     "query error",
+			username: "alice",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(regexp.QuoteMeta(selectProfile)).WithArgs("alice").WillReturnError(errors.New("query failed"))
+			},
+			expectedError: "failed to get profile: query failed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			db, mock, err := sqlmock.New()
+			require.NoError(err)
+			defer db.Close()
+			tt.mockSetup(mock)
+
+			profile, err := GetProfile(context.Background(), db, tt.username)
+			if tt.expectedError == "" {
+				require.NoError(err)
+			} else {
+				require.EqualError(err, tt.expectedError)
+			}
+			require.Equal(tt.expected, profile)
+			require.NoError(mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestUpdateProfile(t *testing.T) {
+	require := require.New(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+
+	// The fields left nil are passed as NULL to keep their values
+	displayName, bio := "Alice", ""
+	mock.ExpectExec(regexp.QuoteMeta(updateProfile)).
+		WithArgs("Alice", nil, nil, "", "alice").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	require.NoError(UpdateProfile(context.Background(), db, "alice", ProfileUpdate{DisplayName: &displayName, Bio: &bio}))
+
+	mock.ExpectExec(regexp.QuoteMeta(updateProfile)).
+		WithArgs(nil, nil, nil, nil, "alice").
+		WillReturnError(errors.New("connection lost"))
+	require.EqualError(UpdateProfile(context.Background(), db, "alice", ProfileUpdate{}), "failed to update profile: connection lost")
+	require.NoError(mock.ExpectationsWereMet())
+}
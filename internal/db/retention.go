@@ -0,0 +1,150 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// PurgeFilter selects the messages of a room to purge: the ones created before
+// Before or with an ID below BelowID, except the messages of HeldUsers.
+type PurgeFilter struct {
+	Room      string
+	Before    time.Time // zero to purge by ID only
+	BelowID   int64     // 0 to purge by age only
+	HeldUsers []string
+}
+
+// where returns the WHERE clause of the messages selected by f, and its arguments.
+// A filter without age and ID selects nothing.
+func (f PurgeFilter) where(d Dialect) (string, []any) {
+	var rules []string
+	args := []any{f.Room}
+	if !f.Before.IsZero() {
+		// The bare column lets the purge use the (room, created_at) index.
+		rules = append(rules, "created_at < "+d.fromUnixTime("?"))
+		args = append(args, f.Before.Unix())
+	}
+	if f.BelowID > 0 {
+		rules = append(rules, "id < ?")
+		args = append(args, f.BelowID)
+	}
+	if len(rules) == 0 {
+		rules = append(rules, "FALSE")
+	}
+	where := "room = ? AND (" + strings.Join(rules, " OR ") + ")"
+	if len(f.HeldUsers) > 0 {
+		where += " AND username NOT IN (" + placeholders(len(f.HeldUsers)) + ")"
+		for _, user := range f.HeldUsers {
+			args = append(args, user)
+		}
+	}
+	return where, args
+}
+
+// placeholders returns n comma separated ? placeholders.
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// ListMessageRooms returns the rooms having messages, sorted.
+func ListMessageRooms(ctx context.Context, db Querier) (_ []string, err error) {
+	ctx, done := startQuery(ctx, db, "list_message_rooms")
+	defer done(&err)
+	rows, err := db.QueryContext(ctx, "SELECT DISTINCT room FROM messages ORDER BY room;")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rooms: %w", err)
+	}
+	defer rows.Close()
+
+	var rooms []string
+	for rows.Next() {
+		var room string
+		if err := rows.Scan(&room); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		rooms = append(rooms, room)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return rooms, nil
+}
+
+// NthNewestMessageID returns the ID of the nth newest message of room, or 0 if
+// the room has fewer messages. The messages with smaller IDs are older.
+func NthNewestMessageID(ctx context.Context, db Querier, room string, n int) (_ int64, err error) {
+	ctx, done := startQuery(ctx, db, "nth_newest_message_id")
+	defer done(&err)
+	rows, err := db.QueryContext(ctx, DialectOf(db).rebind("SELECT id FROM messages WHERE room = ? ORDER BY id DESC LIMIT 1 OFFSET ?;"), room, n-1)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get nth newest message: %w", err)
+	}
+	defer rows.Close()
+
+	var id int64
+	if rows.Next() {
+		if err := rows.Scan(&id); err != nil {
+			return 0, fmt.Errorf("failed to scan row: %w", err)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// CountPurgeableMessages returns the number of messages selected by f.
+func CountPurgeableMessages(ctx context.Context, db Querier, f PurgeFilter) (_ int64, err error) {
+	ctx, done := startQuery(ctx, db, "count_purgeable_messages")
+	defer done(&err)
+	d := DialectOf(db)
+	where, args := f.where(d)
+	var n int64
+	if err := db.QueryRowContext(ctx, d.rebind("SELECT COUNT(*) FROM messages WHERE "+where+";"), args...).Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count purgeable messages: %w", err)
+	}
+	return n, nil
+}
+
+// PurgeMessages deletes the oldest limit messages selected by f, and returns how
+// many it deleted. The messages are deleted by primary key, so that only their
+// rows are locked rather than ranges of the table.
+func PurgeMessages(ctx context.Context, db Querier, f PurgeFilter, limit int) (_ int64, err error) {
+	ctx, done := startQuery(ctx, db, "purge_messages")
+	defer done(&err)
+	d := DialectOf(db)
+	where, args := f.where(d)
+	rows, err := db.QueryContext(ctx, d.rebind("SELECT id FROM messages WHERE "+where+" ORDER BY id LIMIT ?;"), append(args, limit)...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to select messages to purge: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []any
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return 0, fmt.Errorf("failed to scan row: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	ret, err := db.ExecContext(ctx, d.rebind("DELETE FROM messages WHERE id IN ("+placeholders(len(ids))+");"), ids...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge messages: %w", err)
+	}
+	n, err := ret.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get purged messages number: %w", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,160 @@
+//go:build unit_test
+
+package db
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPurgeFilterWhere(t *testing.T) {
+	before := time.Unix(1723680000, 0)
+	tests := []struct {
+		name         string
+		filter       PurgeFilter
+		dialect      Dialect
+		expected     string
+		expectedArgs []any
+	}{
+		{
+			name:         "by age",
+			filter:       PurgeFilter{Room: "general", Before: before},
+			dialect:      MySQL,
+			expected:     "room = ? AND (created_at < FROM_UNIXTIME(?))",
+			expectedArgs: []any{"general", int64(1723680000)},
+		},
+		{
+			name:         "by age and count with held users",
+			filter:       PurgeFilter{Room: "general", Before: before, BelowID: 42, HeldUsers: []string{"alice", "bob"}},
+			dialect:      Postgres,
+			expected:     "room = ? AND (created_at < TO_TIMESTAMP(?) OR id < ?) AND username NOT IN (?, ?)",
+			expectedArgs: []any{"general", int64(1723680000), int64(42), "alice", "bob"},
+		},
+		{
+			name:         "nothing",
+			filter:       PurgeFilter{Room: "general"},
+			dialect:      MySQL,
+			expected:     "room = ? AND (FALSE)",
+			expectedArgs: []any{"general"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			where, args := tt.filter.where(tt.dialect)
+			require.Equal(t, tt.expected, where)
+			require.Equal(t, tt.expectedArgs, args)
+		})
+	}
+}
+
+func TestListMessageRooms(t *testing.T) {
+	require := require.New(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT DISTINCT room FROM messages ORDER BY room;")).
+		WillReturnRows(sqlmock.NewRows([]string{"room"}).AddRow("general").AddRow("random"))
+	rooms, err := ListMessageRooms(context.Background(), db)
+	require.NoError(err)
+	require.Equal([]string{"general", "random"}, rooms)
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestNthNewestMessageID(t *testing.T) {
+	require := require.New(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+
+	query := regexp.QuoteMeta("SELECT id FROM messages WHERE room = ? ORDER BY id DESC LIMIT 1 OFFSET ?;")
+	mock.ExpectQuery(query).WithArgs("general", 99).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1234))
+	id, err := NthNewestMessageID(context.Background(), db, "general", 100)
+	require.NoError(err)
+	require.EqualValues(1234, id)
+
+	// The room has fewer messages
+	mock.ExpectQuery(query).WithArgs("random", 99).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	id, err = NthNewestMessageID(context.Background(), db, "random", 100)
+	require.NoError(err)
+	require.Zero(id)
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestCountPurgeableMessages(t *testing.T) {
+	require := require.New(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM messages WHERE room = ? AND (id < ?) AND username NOT IN (?);")).
+		WithArgs("general", 42, "alice").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(41))
+	n, err := CountPurgeableMessages(context.Background(), db, PurgeFilter{Room: "general", BelowID: 42, HeldUsers: []string{"alice"}})
+	require.NoError(err)
+	require.EqualValues(41, n)
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestPurgeMessages(t *testing.T) {
+	selectIDs := regexp.QuoteMeta("SELECT id FROM messages WHERE room = ? AND (id < ?) ORDER BY id LIMIT ?;")
+	filter := PurgeFilter{Room: "general", BelowID: 42}
+	tests := []struct {
+		name          string
+		mockSetup     func(mock sqlmock.Sqlmock)
+		expected      int64
+		expectedError string
+	}{
+		{
+			name: "purge a batch",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectIDs).WithArgs("general", 42, 3).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2).AddRow(5))
+				mock.ExpectExec(regexp.QuoteMeta("DELETE FROM messages WHERE id IN (?, ?, ?);")).
+					WithArgs(1, 2, 5).
+					WillReturnResult(sqlmock.NewResult(0, 3))
+			},
+			expected: 3,
+		},
+		{
+			name: "nothing to purge",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectIDs).WithArgs("general", 42, 3).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			},
+		},
+		{
+			name: "delete failure",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(selectIDs).WithArgs("general", 42, 3).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+				mock.ExpectExec(regexp.QuoteMeta("DELETE FROM messages WHERE id IN (?);")).WillReturnError(errors.New("lock wait timeout"))
+			},
+			expectedError: "failed to purge messages: lock wait timeout",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			db, mock, err := sqlmock.New()
+			require.NoError(err)
+			defer db.Close()
+			tt.mockSetup(mock)
+
+			n, err := PurgeMessages(context.Background(), db, filter, 3)
+			if tt.expectedError == "" {
+				require.NoError(err)
+			} else {
+				require.EqualError(err, tt.expectedError)
+			}
+			require.Equal(tt.expected, n)
+			require.NoError(mock.ExpectationsWereMet())
+		})
+	}
+}
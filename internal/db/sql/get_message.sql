@@ -1,2 +0,0 @@
--- Get all messages
-SELECT id, user_id, username, message, created_at FROM messages;
\ No newline at end of file
@@ -1,9 +0,0 @@
-SELECT
-    id,
-    user_id,
-    username,
-    message,
-    created_at
-FROM messages
-WHERE
-    username = ?;
\ No newline at end of file
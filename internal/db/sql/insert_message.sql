@@ -1,4 +0,0 @@
--- Insert new message
-INSERT INTO
-    messages (user_id, username, message)
-VALUES (?, ?, ?);
\ No newline at end of file
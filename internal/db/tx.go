@@ -0,0 +1,44 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// WithTx runs f in a transaction of db, which is committed if f returns nil and
+// rolled back otherwise, including when f panics. The queries of the package run
+// in the transaction when given tx, with the dialect and query timeout of db.
+func WithTx(ctx context.Context, db *sql.DB, f func(tx *sql.Tx) error) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	registerDialect(tx, DialectOf(db))
+	if timeout, ok := queryTimeouts.Load(db); ok {
+		queryTimeouts.Store(tx, timeout)
+	}
+	defer func() {
+		dialects.Delete(tx)
+		queryTimeouts.Delete(tx)
+	}()
+
+	committed := false
+	defer func() {
+		if !committed {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil && !errors.Is(rollbackErr, sql.ErrTxDone) {
+				err = errors.Join(err, fmt.Errorf("failed to roll back transaction: %w", rollbackErr))
+			}
+		}
+	}()
+
+	if err := f(tx); err != nil {
+		return err
+	}
+	committed = true
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+//go:build unit_test
+
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithTx(t *testing.T) {
+	errFailed := errors.New("failed")
+	tests := []struct {
+		name          string
+		f             func(tx *sql.Tx) error
+		mockSetup     func(mock sqlmock.Sqlmock)
+		expectedError string
+	}{
+		{
+			name: "commit",
+			f: func(tx *sql.Tx) error {
+				_, err := InsertBot(context.Background(), tx, "bot")
+				return err
+			},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("INSERT INTO users \\(username, password_hash, is_bot\\) VALUES \\(\\$1, '', TRUE\\) RETURNING id;").
+					WithArgs("bot").
+					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "rollback",
+			f:    func(tx *sql.Tx) error { return errFailed },
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectRollback()
+			},
+			expectedError: "failed",
+		},
+		{
+			name: "rollback failure",
+			f:    func(tx *sql.Tx) error { return errFailed },
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectRollback().WillReturnError(errors.New("connection lost"))
+			},
+			expectedError: "failed\nfailed to roll back transaction: connection lost",
+		},
+		{
+			name: "begin failure",
+			f:    func(tx *sql.Tx) error { return nil },
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin().WillReturnError(errors.New("connection lost"))
+			},
+			expectedError: "failed to begin transaction: connection lost",
+		},
+		{
+			name: "commit failure",
+			f:    func(tx *sql.Tx) error { return nil },
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectCommit().WillReturnError(errors.New("connection lost"))
+			},
+			expectedError: "failed to commit transaction: connection lost",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			db, mock, err := sqlmock.New()
+			require.NoError(err)
+			defer db.Close()
+			// The transactions have the dialect of their database
+			registerDialect(db, Postgres)
+			defer dialects.Delete(db)
+			tt.mockSetup(mock)
+
+			err = WithTx(context.Background(), db, tt.f)
+			if tt.expectedError == "" {
+				require.NoError(err)
+			} else {
+				require.EqualError(err, tt.expectedError)
+			}
+			require.NoError(mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestWithTxPanic(t *testing.T) {
+	require := require.New(t)
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	require.PanicsWithValue("boom", func() {
+		WithTx(context.Background(), db, func(tx *sql.Tx) error { panic("boom") })
+	})
+	require.NoError(mock.ExpectationsWereMet())
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 )
@@ -9,54 +10,75 @@ type User struct {
 	ID           int64
 	Name         string
 	PasswordHash string
+	IsBot        bool
 }
 
 // InsertUser inserts a new user into the database, and returns the new user's ID.
-func InsertUser(db *sql.DB, username, password_hash string) (int64, error) {
-	ret, err := db.Exec("INSERT INTO `users` (`username`, `password_hash`) VALUES (?, ?);",
+func InsertUser(ctx context.Context, db Querier, username, password_hash string) (_ int64, err error) {
+	ctx, done := startQuery(ctx, db, "insert_user")
+	defer done(&err)
+	id, err := insertReturningID(ctx, db, "INSERT INTO users (username, password_hash) VALUES (?, ?);",
 		username, password_hash)
 	if err != nil {
-		return 0, fmt.Errorf("failed to insert user to database: %v", err)
+		return 0, fmt.Errorf("failed to insert user to database: %w", err)
 	}
-	return ret.LastInsertId()
+	return id, nil
+}
+
+// InsertBot inserts a new bot user into the database, and returns the new user's ID.
+// Bots have no password so they can only authenticate with API keys.
+func InsertBot(ctx context.Context, db Querier, username string) (_ int64, err error) {
+	ctx, done := startQuery(ctx, db, "insert_bot")
+	defer done(&err)
+	id, err := insertReturningID(ctx, db, "INSERT INTO users (username, password_hash, is_bot) VALUES (?, '', TRUE);", username)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert bot to database: %w", err)
+	}
+	return id, nil
 }
 
 // UserExistsByName checks if a user exists in the database
-func UserExistsByName(db *sql.DB, username string) (bool, error) {
-	query := "SELECT id FROM `users` WHERE username = ?;"
+func UserExistsByName(ctx context.Context, db Querier, username string) (_ bool, err error) {
+	ctx, done := startQuery(ctx, db, "user_exists_by_name")
+	defer done(&err)
+	query := "SELECT id FROM users WHERE username = ?;"
 
-	row := db.QueryRow(query, username)
+	row := db.QueryRowContext(ctx, DialectOf(db).rebind(query), username)
 
 	var id int64
 	if err := row.Scan(&id); err != nil {
 		if err == sql.ErrNoRows {
 			return false, nil
 		}
-		return false, fmt.Errorf("failed to check if user exists: %v", err)
+		return false, fmt.Errorf("failed to check if user exists: %w", err)
 	}
 
 	return true, nil
 }
 
-func GetUserByUsername(db *sql.DB, username string) (*User, error) {
-	query := "SELECT id, username, password_hash FROM `users` WHERE username = ?;"
+func GetUserByUsername(ctx context.Context, db Querier, username string) (_ *User, err error) {
+	ctx, done := startQuery(ctx, db, "get_user_by_username")
+	defer done(&err)
+	query := "SELECT id, username, password_hash, is_bot FROM users WHERE username = ?;"
 
-	row := db.QueryRow(query, username)
+	row := db.QueryRowContext(ctx, DialectOf(db).rebind(query), username)
 
 	var id int64
 	var uname string
 	var password_hash string
+	var isBot bool
 
-	if err := row.Scan(&id, &uname, &password_hash); err != nil {
+	if err := row.Scan(&id, &uname, &password_hash, &isBot); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
-		return nil, fmt.Errorf("failed to get user by name: %v", err)
+		return nil, fmt.Errorf("failed to get user by name: %w", err)
 	}
 
 	return &User{
 		ID:           id,
 		Name:         uname,
 		PasswordHash: password_hash,
+		IsBot:        isBot,
 	}, nil
 }
@@ -3,6 +3,7 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"testing"
@@ -27,7 +28,7 @@ func TestInsertUser(t *testing.T) {
 			username: "newuser",
 			password: "hashedPassword",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				mock.ExpectExec("INSERT INTO `users` \\(`username`, `password_hash`\\) VALUES \\(\\?, \\?\\);").
+				mock.ExpectExec("INSERT INTO users \\(username, password_hash\\) VALUES \\(\\?, \\?\\);").
 					WithArgs("newuser", "hashedPassword").
 					WillReturnResult(sqlmock.NewResult(1, 1))
 			},
@@ -39,7 +40,7 @@ func TestInsertUser(t *testing.T) {
 			username: "newuser",
 			password: "hashedPassword",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				mock.ExpectExec("INSERT INTO `users` \\(`username`, `password_hash`\\) VALUES \\(\\?, \\?\\);").
+				mock.ExpectExec("INSERT INTO users \\(username, password_hash\\) VALUES \\(\\?, \\?\\);").
 					WithArgs("newuser", "hashedPassword").
 					WillReturnError(errors.New("insert failed"))
 			},
@@ -56,9 +57,13 @@ func TestInsertUser(t *testing.T) {
 
 			tt.mockSetup(mock)
 
-			id, err := InsertUser(db, tt.username, tt.password)
+			id, err := InsertUser(context.Background(), db, tt.username, tt.password)
 			require.Equal(tt.expectedID, id)
-			require.Equal(tt.expectedErr, err)
+			if tt.expectedErr != nil {
+				require.EqualError(err, tt.expectedErr.Error())
+			} else {
+				require.NoError(err)
+			}
 
 			require.NoError(mock.ExpectationsWereMet())
 		})
@@ -80,7 +85,7 @@ func TestUserExistsByName(t *testing.T) {
 			username: "existinguser",
 			mockSetup: func(mock sqlmock.Sqlmock) {
 				rows := sqlmock.NewRows([]string{"id"}).AddRow(1)
-				mock.ExpectQuery("SELECT id FROM `users` WHERE username = \\?;").
+				mock.ExpectQuery("SELECT id FROM users WHERE username = \\?;").
 					WithArgs("existinguser").
 					WillReturnRows(rows)
 			},
@@ -91,7 +96,7 @@ func TestUserExistsByName(t *testing.T) {
 			name:     "User Does Not Exist",
 			username: "nonexistentuser",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery("SELECT id FROM `users` WHERE username = \\?;").
+				mock.ExpectQuery("SELECT id FROM users WHERE username = \\?;").
 					WithArgs("nonexistentuser").
 					WillReturnError(sql.ErrNoRows)
 			},
@@ -102,7 +107,7 @@ func TestUserExistsByName(t *testing.T) {
 			name:     "Query Error",
 			username: "erroruser",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery("SELECT id FROM `users` WHERE username = \\?;").
+				mock.ExpectQuery("SELECT id FROM users WHERE username = \\?;").
 					WithArgs("erroruser").
 					WillReturnError(errors.New("query failed"))
 			},
@@ -119,9 +124,13 @@ func TestUserExistsByName(t *testing.T) {
 
 			tt.mockSetup(mock)
 
-			exists, err := UserExistsByName(db, tt.username)
+			exists, err := UserExistsByName(context.Background(), db, tt.username)
 			require.Equal(tt.expected, exists)
-			require.Equal(tt.expectedErr, err)
+			if tt.expectedErr != nil {
+				require.EqualError(err, tt.expectedErr.Error())
+			} else {
+				require.NoError(err)
+			}
 
 			require.NoError(mock.ExpectationsWereMet())
 		})
@@ -142,9 +151,9 @@ func TestGetUserByUsername(t *testing.T) {
 			name:     "User Found",
 			username: "existinguser",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				rows := sqlmock.NewRows([]string{"id", "username", "password_hash"}).
-					AddRow(1, "existinguser", "hashedPassword")
-				mock.ExpectQuery("SELECT id, username, password_hash FROM `users` WHERE username = \\?;").
+				rows := sqlmock.NewRows([]string{"id", "username", "password_hash", "is_bot"}).
+					AddRow(1, "existinguser", "hashedPassword", false)
+				mock.ExpectQuery("SELECT id, username, password_hash, is_bot FROM users WHERE username = \\?;").
 					WithArgs("existinguser").
 					WillReturnRows(rows)
 			},
@@ -159,7 +168,7 @@ func TestGetUserByUsername(t *testing.T) {
 			name:     "User Not Found",
 			username: "nonexistentuser",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery("SELECT id, username, password_hash FROM `users` WHERE username = \\?;").
+				mock.ExpectQuery("SELECT id, username, password_hash, is_bot FROM users WHERE username = \\?;").
 					WithArgs("nonexistentuser").
 					WillReturnError(sql.ErrNoRows)
 			},
@@ -170,7 +179,7 @@ func TestGetUserByUsername(t *testing.T) {
 			name:     "Query Error",
 			username: "erroruser",
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery("SELECT id, username, password_hash FROM `users` WHERE username = \\?;").
+				mock.ExpectQuery("SELECT id, username, password_hash, is_bot FROM users WHERE username = \\?;").
 					WithArgs("erroruser").
 					WillReturnError(errors.New("query failed"))
 			},
@@ -187,11 +196,32 @@ func TestGetUserByUsername(t *testing.T) {
 
 			tt.mockSetup(mock)
 
-			user, err := GetUserByUsername(db, tt.username)
+			user, err := GetUserByUsername(context.Background(), db, tt.username)
 			require.Equal(tt.expected, user)
-			require.Equal(tt.expectedErr, err)
+			if tt.expectedErr != nil {
+				require.EqualError(err, tt.expectedErr.Error())
+			} else {
+				require.NoError(err)
+			}
 
 			require.NoError(mock.ExpectationsWereMet())
 		})
 	}
 }
+
+func TestInsertBot(t *testing.T) {
+	require := require.New(t)
+
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+
+	mock.ExpectExec("INSERT INTO users \\(username, password_hash, is_bot\\) VALUES \\(\\?, '', TRUE\\);").
+		WithArgs("ci-bot").
+		WillReturnResult(sqlmock.NewResult(7, 1))
+
+	id, err := InsertBot(context.Background(), db, "ci-bot")
+	require.NoError(err)
+	require.Equal(int64(7), id)
+	require.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"context"
+	"fmt"
+)
+
+// Webhook is a webhook subscription to chat events.
+type Webhook struct {
+	ID         int64
+	URL        string
+	EventTypes string // comma separated event type names, all types if empty
+	Rooms      string // comma separated rooms, all rooms if empty
+	Secret     string
+	CreatedBy  string
+	CreatedAt  int64 // unix timestamp
+}
+
+// InsertWebhook inserts a new webhook subscription, and returns its ID.
+func InsertWebhook(ctx context.Context, db Querier, url, eventTypes, rooms, secret, createdBy string) (_ int64, err error) {
+	ctx, done := startQuery(ctx, db, "insert_webhook")
+	defer done(&err)
+	id, err := insertReturningID(ctx, db, "INSERT INTO webhooks (url, event_types, rooms, secret, created_by) VALUES (?, ?, ?, ?, ?);",
+		url, eventTypes, rooms, secret, createdBy)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert webhook to database: %w", err)
+	}
+	return id, nil
+}
+
+// ListWebhooks returns all the webhook subscriptions.
+func ListWebhooks(ctx context.Context, db Querier) (_ []*Webhook, err error) {
+	ctx, done := startQuery(ctx, db, "list_webhooks")
+	defer done(&err)
+	query := "SELECT id, url, event_types, rooms, secret, created_by, " + DialectOf(db).unixTime("created_at") + " FROM webhooks ORDER BY id;"
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	res := make([]*Webhook, 0, 8)
+	for rows.Next() {
+		w := &Webhook{}
+		err = rows.Scan(&w.ID, &w.URL, &w.EventTypes, &w.Rooms, &w.Secret, &w.CreatedBy, &w.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		res = append(res, w)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// DeleteWebhook deletes the webhook subscription with id, and reports whether it existed.
+func DeleteWebhook(ctx context.Context, db Querier, id int64) (_ bool, err error) {
+	ctx, done := startQuery(ctx, db, "delete_webhook")
+	defer done(&err)
+	ret, err := db.ExecContext(ctx, DialectOf(db).rebind("DELETE FROM webhooks WHERE id = ?;"), id)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete webhook: %w", err)
+	}
+	n, err := ret.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get deleted webhooks number: %w", err)
+	}
+	return n > 0, nil
+}
+
+// InsertWebhookDeadLetter stores a delivery that failed after all the attempts.
+func InsertWebhookDeadLetter(ctx context.Context, db Querier, webhookID int64, eventID, eventType string, payload []byte, attempts int, lastError string) (err error) {
+	ctx, done := startQuery(ctx, db, "insert_webhook_dead_letter")
+	defer done(&err)
+	_, err = db.ExecContext(ctx, DialectOf(db).rebind("INSERT INTO webhook_dead_letters (webhook_id, event_id, event_type, payload, attempts, last_error) VALUES (?, ?, ?, ?, ?, ?);"),
+		webhookID, eventID, eventType, payload, attempts, lastError)
+	if err != nil {
+		return fmt.Errorf("failed to insert webhook dead letter to database: %w", err)
+	}
+	return nil
+}
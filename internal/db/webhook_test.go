@@ -0,0 +1,119 @@
+//go:build unit_test
+
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInsertWebhook(t *testing.T) {
+	require := require.New(t)
+
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+
+	mock.ExpectExec("INSERT INTO webhooks \\(url, event_types, rooms, secret, created_by\\) VALUES \\(\\?, \\?, \\?, \\?, \\?\\);").
+		WithArgs("https://example.com/hook", "EVENT_TYPE_MESSAGE", "general", "secret", "admin").
+		WillReturnResult(sqlmock.NewResult(2, 1))
+
+	id, err := InsertWebhook(context.Background(), db, "https://example.com/hook", "EVENT_TYPE_MESSAGE", "general", "secret", "admin")
+	require.NoError(err)
+	require.Equal(int64(2), id)
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestListWebhooks(t *testing.T) {
+	require := require.New(t)
+
+	tests := []struct {
+		name        string
+		mockSetup   func(sqlmock.Sqlmock)
+		expected    []*Webhook
+		expectedErr error
+	}{
+		{
+			name: "Successful Query",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				rows := sqlmock.NewRows([]string{"id", "url", "event_types", "rooms", "secret", "created_by", "created_at"}).
+					AddRow(2, "https://example.com/hook", "EVENT_TYPE_MESSAGE", "", "secret", "admin", 1723680000)
+				mock.ExpectQuery("SELECT id, url, event_types, rooms, secret, created_by, UNIX_TIMESTAMP\\(created_at\\) FROM webhooks ORDER BY id;").
+					WillReturnRows(rows)
+			},
+			expected: []*Webhook{{
+				ID:         2,
+				URL:        "https://example.com/hook",
+				EventTypes: "EVENT_TYPE_MESSAGE",
+				Secret:     "secret",
+				CreatedBy:  "admin",
+				CreatedAt:  1723680000,
+			}},
+		},
+		{
+			name: "Query Failure",
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT .* FROM webhooks").WillReturnError(errors.New("query failed"))
+			},
+			expectedErr: errors.New("failed to list webhooks: query failed"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			require.NoError(err)
+			defer db.Close()
+
+			tt.mockSetup(mock)
+
+			webhooks, err := ListWebhooks(context.Background(), db)
+			require.Equal(tt.expected, webhooks)
+			if tt.expectedErr != nil {
+				require.EqualError(err, tt.expectedErr.Error())
+			} else {
+				require.NoError(err)
+			}
+			require.NoError(mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestDeleteWebhook(t *testing.T) {
+	require := require.New(t)
+
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+
+	mock.ExpectExec("DELETE FROM webhooks WHERE id = \\?;").WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM webhooks WHERE id = \\?;").WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	deleted, err := DeleteWebhook(context.Background(), db, 2)
+	require.NoError(err)
+	require.True(deleted)
+	deleted, err = DeleteWebhook(context.Background(), db, 3)
+	require.NoError(err)
+	require.False(deleted)
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestInsertWebhookDeadLetter(t *testing.T) {
+	require := require.New(t)
+
+	db, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer db.Close()
+
+	mock.ExpectExec("INSERT INTO webhook_dead_letters").
+		WithArgs(2, "event-id", "EVENT_TYPE_MESSAGE", []byte(`{}`), 5, "receiver responded 503 Service Unavailable").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	err = InsertWebhookDeadLetter(context.Background(), db, 2, "event-id", "EVENT_TYPE_MESSAGE", []byte(`{}`), 5, "receiver responded 503 Service Unavailable")
+	require.NoError(err)
+	require.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,175 @@
+// Package health checks the dependencies of the server, and reports the results
+// to orchestrators over HTTP and the standard grpc.health.v1 service.
+//
+// Liveness checks fail when the process is broken and must be restarted, e.g.
+// the broadcast routine is stuck. Readiness checks fail when the server can not
+// serve requests for now, e.g. the database is down, which a restart would not fix.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// CheckTimeout bounds the duration of every check.
+const CheckTimeout = 2 * time.Second
+
+// Check returns an error if a dependency does not work. It must return once ctx is done.
+type Check func(ctx context.Context) error
+
+// Result is the result of a check.
+type Result struct {
+	Name string
+	Err  error
+}
+
+type namedCheck struct {
+	name  string
+	check Check
+	live  bool // whether the check is also a liveness check
+}
+
+// Checker runs the checks of the server.
+type Checker struct {
+	mu     sync.Mutex
+	checks []namedCheck
+	server *health.Server
+}
+
+// NewChecker returns a checker without checks, which reports to the gRPC health
+// server, see Watch.
+func NewChecker(server *health.Server) *Checker {
+	return &Checker{server: server}
+}
+
+// AddLiveness adds a check that fails when the server must be restarted. Liveness
+// checks are readiness checks too.
+func (c *Checker) AddLiveness(name string, check Check) {
+	c.add(namedCheck{name: name, check: check, live: true})
+}
+
+// AddReadiness adds a check that fails when the server can not serve requests.
+func (c *Checker) AddReadiness(name string, check Check) {
+	c.add(namedCheck{name: name, check: check})
+}
+
+func (c *Checker) add(check namedCheck) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks = append(c.checks, check)
+}
+
+// Run runs the readiness checks, or only the liveness checks if liveOnly, in
+// parallel, and returns their results in the order they were added.
+func (c *Checker) Run(ctx context.Context, liveOnly bool) []Result {
+	c.mu.Lock()
+	checks := make([]namedCheck, 0, len(c.checks))
+	for _, check := range c.checks {
+		if check.live || !liveOnly {
+			checks = append(checks, check)
+		}
+	}
+	c.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, CheckTimeout)
+	defer cancel()
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = Result{Name: check.name, Err: check.check(ctx)}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// healthy reports whether all results are successful.
+func healthy(results []Result) bool {
+	for _, result := range results {
+		if result.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Watch runs the readiness checks every interval until ctx is done, and sets
+// the serving status of services and of the server, "", accordingly.
+func (c *Checker) Watch(ctx context.Context, interval time.Duration, services ...string) {
+	services = append(services, "")
+	serving := true
+	for {
+		results := c.Run(ctx, false)
+		status := healthpb.HealthCheckResponse_SERVING
+		if !healthy(results) {
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+		for _, service := range services {
+			c.server.SetServingStatus(service, status)
+		}
+		if healthy(results) != serving {
+			serving = !serving
+			slog.Warn("serving status changed", "serving", serving, "checks", formatResults(results))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// formatResults describes results as a map from check names to "ok" or the error.
+func formatResults(results []Result) map[string]string {
+	checks := make(map[string]string, len(results))
+	for _, result := range results {
+		checks[result.Name] = "ok"
+		if result.Err != nil {
+			checks[result.Name] = result.Err.Error()
+		}
+	}
+	return checks
+}
+
+// LivenessHandler serves the results of the liveness checks as JSON, with the
+// status 200 if they pass and 503 otherwise.
+func (c *Checker) LivenessHandler() http.Handler {
+	return c.handler(true)
+}
+
+// ReadinessHandler is LivenessHandler for the readiness checks.
+func (c *Checker) ReadinessHandler() http.Handler {
+	return c.handler(false)
+}
+
+// handler serves the results of the checks, e.g. {"status": "ok", "checks": {"database": "ok"}}.
+func (c *Checker) handler(liveOnly bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		results := c.Run(r.Context(), liveOnly)
+		resp := struct {
+			Status string            `json:"status"`
+			Checks map[string]string `json:"checks"`
+		}{Status: "ok", Checks: formatResults(results)}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if !healthy(results) {
+			resp.Status = "unavailable"
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			slog.DebugContext(r.Context(), "failed to write health check results", "error", err)
+		}
+	})
+}
@@ -0,0 +1,128 @@
+//go:build unit_test
+
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestRun(t *testing.T) {
+	c := NewChecker(nil)
+	c.AddReadiness("database", func(context.Context) error { return errors.New("connection refused") })
+	c.AddLiveness("broadcast", func(context.Context) error { return nil })
+	c.AddReadiness("slow", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	// The checks stop at the deadline of ctx if it is before CheckTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	results := c.Run(ctx, false)
+	require.Equal(t, []Result{
+		{Name: "database", Err: errors.New("connection refused")},
+		{Name: "broadcast"},
+		{Name: "slow", Err: context.DeadlineExceeded},
+	}, results)
+
+	require.Equal(t, []Result{{Name: "broadcast"}}, c.Run(context.Background(), true))
+}
+
+func TestHandlers(t *testing.T) {
+	tests := []struct {
+		name           string
+		handler        func(*Checker) http.Handler
+		databaseErr    error
+		expectedStatus int
+		expectedBody   map[string]any
+	}{
+		{
+			name:           "live",
+			handler:        (*Checker).LivenessHandler,
+			databaseErr:    errors.New("connection refused"),
+			expectedStatus: http.StatusOK,
+			expectedBody:   map[string]any{"status": "ok", "checks": map[string]any{"broadcast": "ok"}},
+		},
+		{
+			name:           "ready",
+			handler:        (*Checker).ReadinessHandler,
+			expectedStatus: http.StatusOK,
+			expectedBody:   map[string]any{"status": "ok", "checks": map[string]any{"broadcast": "ok", "database": "ok"}},
+		},
+		{
+			name:           "not ready",
+			handler:        (*Checker).ReadinessHandler,
+			databaseErr:    errors.New("connection refused"),
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   map[string]any{"status": "unavailable", "checks": map[string]any{"broadcast": "ok", "database": "connection refused"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			c := NewChecker(nil)
+			c.AddLiveness("broadcast", func(context.Context) error { return nil })
+			c.AddReadiness("database", func(context.Context) error { return tt.databaseErr })
+
+			rec := httptest.NewRecorder()
+			tt.handler(c).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			require.Equal(tt.expectedStatus, rec.Code)
+			require.Equal("application/json", rec.Header().Get("Content-Type"))
+			var body map[string]any
+			require.NoError(json.Unmarshal(rec.Body.Bytes(), &body))
+			require.Equal(tt.expectedBody, body)
+		})
+	}
+}
+
+func TestWatch(t *testing.T) {
+	require := require.New(t)
+	server := health.NewServer()
+	c := NewChecker(server)
+	var down atomic.Bool
+	down.Store(true)
+	c.AddReadiness("database", func(context.Context) error {
+		if down.Load() {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.Watch(ctx, time.Millisecond, "chat.v1.ChatService")
+		close(done)
+	}()
+
+	servingStatus := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		resp, err := server.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		require.NoError(err)
+		return resp.GetStatus()
+	}
+	require.Eventually(func() bool {
+		return servingStatus("chat.v1.ChatService") == healthpb.HealthCheckResponse_NOT_SERVING &&
+			servingStatus("") == healthpb.HealthCheckResponse_NOT_SERVING
+	}, time.Second, time.Millisecond)
+
+	down.Store(false)
+	require.Eventually(func() bool {
+		return servingStatus("chat.v1.ChatService") == healthpb.HealthCheckResponse_SERVING &&
+			servingStatus("") == healthpb.HealthCheckResponse_SERVING
+	}, time.Second, time.Millisecond)
+
+	cancel()
+	<-done
+}
@@ -1,27 +1,68 @@
 package jwt
 
 import (
+	"sync"
+	"time"
+
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/zjy-dev/grpc-go-chatroom/internal/config"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-// GenerateJwt function generates a JWT token with the given username
-func GenerateJwt(username string) (string, error) {
+// TokenLifetime is how long a token is valid after it was generated, clients log in
+// again afterwards.
+const TokenLifetime = 24 * time.Hour
+
+var (
+	keyMu      sync.RWMutex
+	signingKey []byte
+)
+
+// SetKey sets the key signing and verifying the tokens, it must be called before
+// GenerateJwt and ParseJwt.
+func SetKey(key string) {
+	keyMu.Lock()
+	defer keyMu.Unlock()
+	signingKey = []byte(key)
+}
+
+func getKey() ([]byte, error) {
+	keyMu.RLock()
+	defer keyMu.RUnlock()
+	if len(signingKey) == 0 {
+		return nil, status.Errorf(codes.Internal, "jwt key is not set")
+	}
+	return signingKey, nil
+}
+
+// GenerateJwt function generates a JWT token with the given username, identifying
+// the login session sessionID so that the server can revoke it. It expires after
+// TokenLifetime.
+func GenerateJwt(username, sessionID string) (string, error) {
 	if username == "" {
 		return "", status.Errorf(codes.InvalidArgument, "username is empty")
 	}
+	if sessionID == "" {
+		return "", status.Errorf(codes.InvalidArgument, "session id is empty")
+	}
 
 	// Create a new JWT token with the given username
+	now := time.Now()
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256,
 		jwt.RegisteredClaims{
-			Subject: username,
+			Subject:   username,
+			ID:        sessionID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(TokenLifetime)),
 		},
 	)
 
+	key, err := getKey()
+	if err != nil {
+		return "", err
+	}
 	// Sign the token with the jwtKey
-	tokenString, err := token.SignedString([]byte(config.JWT.JWTKey))
+	tokenString, err := token.SignedString(key)
 	if err != nil {
 		return "", status.Errorf(codes.Internal, "failed to sign token: %v", err)
 	}
@@ -33,10 +74,15 @@ func ParseJwt(tokenString string) (*jwt.RegisteredClaims, error) {
 	if tokenString == "" {
 		return nil, status.Errorf(codes.Unauthenticated, "token is empty")
 	}
+	key, err := getKey()
+	if err != nil {
+		return nil, err
+	}
 	// Parse the token with the jwtKey
+	// Tokens without an expiry, generated by older servers, are not accepted.
 	token, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(config.JWT.JWTKey), nil
-	})
+		return key, nil
+	}, jwt.WithExpirationRequired())
 
 	// Check if the token is valid
 	if err != nil || !token.Valid {
@@ -3,14 +3,22 @@
 package jwt_test
 
 import (
+	"os"
 	"testing"
+	"time"
 
+	gojwt "github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/require"
 	"github.com/zjy-dev/grpc-go-chatroom/internal/jwt"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+func TestMain(m *testing.M) {
+	jwt.SetKey("some_key")
+	os.Exit(m.Run())
+}
+
 func TestGenerateJwt(t *testing.T) {
 	require := require.New(t)
 
@@ -36,7 +44,7 @@ func TestGenerateJwt(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			// Generate JWT token
-			token, err := jwt.GenerateJwt(tt.username)
+			token, err := jwt.GenerateJwt(tt.username, "session-1")
 
 			// Verify the result
 			if tt.expectedErr != nil {
@@ -51,9 +59,14 @@ func TestGenerateJwt(t *testing.T) {
 				claims, err := jwt.ParseJwt(token)
 				require.NoError(err)
 				require.Equal(tt.username, claims.Subject)
+				require.Equal("session-1", claims.ID)
+				require.WithinDuration(time.Now().Add(jwt.TokenLifetime), claims.ExpiresAt.Time, time.Minute)
 			}
 		})
 	}
+
+	_, err := jwt.GenerateJwt("testuser", "")
+	require.Equal(status.Errorf(codes.InvalidArgument, "session id is empty"), err)
 }
 
 func TestParseJwt(t *testing.T) {
@@ -68,7 +81,7 @@ func TestParseJwt(t *testing.T) {
 	}{
 		{
 			name:        "valid token",
-			tokenString: func() string { token, _ := jwt.GenerateJwt("testuser"); return token }(),
+			tokenString: func() string { token, _ := jwt.GenerateJwt("testuser", "session-1"); return token }(),
 			expectedErr: nil,
 			username:    "testuser",
 		},
@@ -77,6 +90,24 @@ func TestParseJwt(t *testing.T) {
 			tokenString: "",
 			expectedErr: status.Errorf(codes.Unauthenticated, "token is empty"),
 		},
+		{
+			name: "token without expiry",
+			tokenString: func() string {
+				token, _ := gojwt.NewWithClaims(gojwt.SigningMethodHS256, gojwt.RegisteredClaims{Subject: "testuser"}).SignedString([]byte("some_key"))
+				return token
+			}(),
+			expectedErr: status.Errorf(codes.Unauthenticated, "failed to parse token"),
+		},
+		{
+			name: "expired token",
+			tokenString: func() string {
+				token, _ := gojwt.NewWithClaims(gojwt.SigningMethodHS256, gojwt.RegisteredClaims{
+					Subject: "testuser", ExpiresAt: gojwt.NewNumericDate(time.Now().Add(-time.Minute)),
+				}).SignedString([]byte("some_key"))
+				return token
+			}(),
+			expectedErr: status.Errorf(codes.Unauthenticated, "failed to parse token"),
+		},
 		{
 			name:        "invalid token",
 			tokenString: "invalidtoken",
@@ -103,3 +134,14 @@ func TestParseJwt(t *testing.T) {
 		})
 	}
 }
+
+func TestKeyNotSet(t *testing.T) {
+	require := require.New(t)
+	jwt.SetKey("")
+	t.Cleanup(func() { jwt.SetKey("some_key") })
+
+	_, err := jwt.GenerateJwt("testuser", "session-1")
+	require.Equal(status.Errorf(codes.Internal, "jwt key is not set"), err)
+	_, err = jwt.ParseJwt("sometoken")
+	require.Equal(status.Errorf(codes.Internal, "jwt key is not set"), err)
+}
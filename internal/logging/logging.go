@@ -0,0 +1,182 @@
+// Package logging sets up the structured logs of the server: the slog handlers,
+// the request IDs that correlate the logs of a request across the gateway and
+// the bridges, and the redaction of secrets.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Log formats.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// RequestIDKey is the gRPC metadata key and the HTTP header carrying request IDs.
+const RequestIDKey = "x-request-id"
+
+// maxRequestIDLength caps the request IDs accepted from clients.
+const maxRequestIDLength = 64
+
+// Redacted replaces the values of secrets in the logs.
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are parts of the attribute keys, query parameters and header
+// names whose values are never logged.
+var sensitiveKeys = []string{"password", "token", "authorization", "secret", "api_key", "apikey"}
+
+// IsSensitive reports whether the value of key is a secret.
+func IsSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// redact is a slog.HandlerOptions.ReplaceAttr hiding the values of secrets.
+func redact(_ []string, a slog.Attr) slog.Attr {
+	if IsSensitive(a.Key) {
+		return slog.String(a.Key, Redacted)
+	}
+	if a.Value.Kind() == slog.KindString && strings.HasPrefix(strings.ToLower(a.Value.String()), "bearer ") {
+		return slog.String(a.Key, Redacted)
+	}
+	return a
+}
+
+// RedactURL returns the path and query of u with the values of secret query
+// parameters, e.g. the token of EventSource requests, redacted.
+func RedactURL(u *url.URL) string {
+	query := u.Query()
+	if len(query) == 0 {
+		return u.Path
+	}
+	for key := range query {
+		if IsSensitive(key) {
+			query[key] = []string{Redacted}
+		}
+	}
+	return u.Path + "?" + query.Encode()
+}
+
+// New returns a logger writing to w in format, FormatText or FormatJSON, from
+// level up. Records logged with a request context carry its request ID and user.
+func New(w io.Writer, format string, level slog.Leveler) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+	var handler slog.Handler
+	if format == FormatJSON {
+		handler = slog.NewJSONHandler(w, opts)
+	} else {
+		handler = slog.NewTextHandler(w, opts)
+	}
+	return slog.New(contextHandler{handler})
+}
+
+// contextHandler adds the request ID and the user of the context to the records,
+// and the trace ID if the context has a sampled span.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		r.AddAttrs(slog.String("request_id", info.id))
+		if user := info.getUser(); user != "" {
+			r.AddAttrs(slog.String("user", user))
+		}
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsSampled() {
+		r.AddAttrs(slog.String("trace_id", span.TraceID().String()), slog.String("span_id", span.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+type requestInfoKey struct{}
+
+// requestInfo describes the request a context belongs to. The user is learnt
+// after the request started, when it is authenticated.
+type requestInfo struct {
+	id string
+
+	mu   sync.Mutex
+	user string
+}
+
+func (info *requestInfo) getUser() string {
+	info.mu.Lock()
+	defer info.mu.Unlock()
+	return info.user
+}
+
+// NewContext returns a context of the request with id.
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, &requestInfo{id: id})
+}
+
+// RequestID returns the ID of the request of ctx, "" if there is none.
+func RequestID(ctx context.Context) string {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info.id
+	}
+	return ""
+}
+
+// SetUser records the user who sent the request of ctx.
+func SetUser(ctx context.Context, user string) {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		info.mu.Lock()
+		info.user = user
+		info.mu.Unlock()
+	}
+}
+
+// User returns the user recorded by SetUser, "" if unknown.
+func User(ctx context.Context) string {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info.getUser()
+	}
+	return ""
+}
+
+// NewRequestID returns a random request ID.
+func NewRequestID() string {
+	id := make([]byte, 8)
+	// crypto/rand.Read never returns an error on supported platforms.
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// RequestIDOrNew returns id if it is a valid request ID sent by a client, or a
+// new one otherwise, so that clients can't inject lines into the logs.
+func RequestIDOrNew(id string) string {
+	if id == "" || len(id) > maxRequestIDLength {
+		return NewRequestID()
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return NewRequestID()
+		}
+	}
+	return id
+}
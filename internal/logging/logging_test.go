@@ -0,0 +1,129 @@
+//go:build unit_test
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, FormatJSON, slog.LevelInfo)
+
+	ctx := NewContext(context.Background(), "req-1")
+	SetUser(ctx, "alice")
+	logger.InfoContext(ctx, "logged in",
+		"password", "hunter2",
+		"refresh_token", "abc",
+		"header", "Bearer abc",
+		"room", "general",
+	)
+	logger.DebugContext(ctx, "not logged")
+
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	require.Equal(t, "logged in", record["msg"])
+	require.Equal(t, "req-1", record["request_id"])
+	require.Equal(t, "alice", record["user"])
+	require.Equal(t, Redacted, record["password"])
+	require.Equal(t, Redacted, record["refresh_token"])
+	require.Equal(t, Redacted, record["header"])
+	require.Equal(t, "general", record["room"])
+	require.NotContains(t, buf.String(), "hunter2")
+	require.Equal(t, 1, strings.Count(buf.String(), "\n"))
+
+	// Records logged outside of a request have no request attributes
+	buf.Reset()
+	logger.With("component", "webhook").Info("started")
+	record = nil
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	require.NotContains(t, record, "request_id")
+	require.Equal(t, "webhook", record["component"])
+}
+
+func TestRedactURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "/events", want: "/events"},
+		{url: "/events?room=general", want: "/events?room=general"},
+		{url: "/events?token=abc&room=general", want: "/events?room=general&token=%5BREDACTED%5D"},
+		{url: "/ws?access_token=abc", want: "/ws?access_token=%5BREDACTED%5D"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, RedactURL(u))
+		})
+	}
+}
+
+func TestRequestIDOrNew(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		keep bool
+	}{
+		{name: "valid", id: "0f3a-b_c.1", keep: true},
+		{name: "empty", id: ""},
+		{name: "too long", id: strings.Repeat("a", maxRequestIDLength+1)},
+		{name: "newline", id: "abc\nlevel=ERROR"},
+		{name: "space", id: "a b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := RequestIDOrNew(tt.id)
+			if tt.keep {
+				require.Equal(t, tt.id, got)
+				return
+			}
+			require.NotEqual(t, tt.id, got)
+			require.Len(t, got, 16)
+		})
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	ctx := context.Background()
+	require.Empty(t, RequestID(ctx))
+	SetUser(ctx, "alice")
+	require.Empty(t, User(ctx))
+
+	ctx = NewContext(ctx, "req-1")
+	require.Equal(t, "req-1", RequestID(ctx))
+	require.Empty(t, User(ctx))
+
+	// The user is seen by the contexts derived before it was set
+	derived, cancel := context.WithCancel(ctx)
+	defer cancel()
+	SetUser(ctx, "alice")
+	require.Equal(t, "alice", User(derived))
+}
+
+func TestNewTraceID(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, FormatJSON, slog.LevelInfo)
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	span := trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID, TraceFlags: trace.FlagsSampled})
+	logger.InfoContext(trace.ContextWithSpanContext(context.Background(), span), "traced")
+
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", record["trace_id"])
+	require.Equal(t, "00f067aa0ba902b7", record["span_id"])
+}
@@ -0,0 +1,326 @@
+// Package metrics implements the counters, gauges and histograms of the server,
+// and writes them in the Prometheus text exposition format. It only covers what
+// the server needs, so that it does not depend on the Prometheus client library.
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the buckets of latency
+// histograms.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// desc describes a metric.
+type desc struct {
+	name, help, typ string
+	labels          []string
+}
+
+// labelPairs returns the labels of desc with values, formatted as `{a="1",b="2"}`,
+// or "" if there are none.
+func (d *desc) labelPairs(values []string) string {
+	if len(d.labels) != len(values) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", d.name, len(d.labels), len(values)))
+	}
+	if len(values) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(values))
+	for i, value := range values {
+		pairs[i] = d.labels[i] + `="` + labelValueReplacer.Replace(value) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	desc *desc // nil if c belongs to a CounterVec
+	bits atomic.Uint64
+}
+
+// Inc adds 1 to c.
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add adds v, which must not be negative, to c.
+func (c *Counter) Add(v float64) {
+	addFloat(&c.bits, v)
+}
+
+// Value returns the value of c.
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(c.bits.Load())
+}
+
+func (c *Counter) write(w *writer, name, labels string) {
+	w.sample(name, labels, c.Value())
+}
+
+func (c *Counter) describe() *desc {
+	return c.desc
+}
+
+func (c *Counter) collect(w *writer) {
+	c.write(w, c.desc.name, "")
+}
+
+// Gauge is a value that goes up and down.
+type Gauge struct {
+	desc *desc // nil if g belongs to a GaugeVec
+	bits atomic.Uint64
+}
+
+// Set sets g to v.
+func (g *Gauge) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+}
+
+// Inc adds 1 to g.
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+// Dec subtracts 1 from g.
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+// Add adds v to g.
+func (g *Gauge) Add(v float64) {
+	addFloat(&g.bits, v)
+}
+
+// Value returns the value of g.
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+func (g *Gauge) write(w *writer, name, labels string) {
+	w.sample(name, labels, g.Value())
+}
+
+func (g *Gauge) describe() *desc {
+	return g.desc
+}
+
+func (g *Gauge) collect(w *writer) {
+	g.write(w, g.desc.name, "")
+}
+
+// addFloat atomically adds v to the float64 stored in bits.
+func addFloat(bits *atomic.Uint64, v float64) {
+	for {
+		old := bits.Load()
+		if bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// Histogram counts observations, e.g. latencies, in buckets.
+type Histogram struct {
+	desc        *desc // nil if h belongs to a HistogramVec
+	upperBounds []float64
+
+	mu     sync.Mutex
+	counts []uint64 // counts[i] counts the observations in (upperBounds[i-1], upperBounds[i]]
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic("metrics: histogram buckets must be sorted")
+	}
+	return &Histogram{upperBounds: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// Observe adds v to h.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upperBounds, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+// Count returns the number of observations of h.
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+func (h *Histogram) write(w *writer, name, labels string) {
+	h.mu.Lock()
+	counts, count, sum := append([]uint64(nil), h.counts...), h.count, h.sum
+	h.mu.Unlock()
+
+	// Buckets are cumulative, and the "le" label comes last.
+	prefix := "{"
+	if labels != "" {
+		prefix = labels[:len(labels)-1] + ","
+	}
+	var cumulative uint64
+	for i, upperBound := range h.upperBounds {
+		cumulative += counts[i]
+		w.sample(name+"_bucket", prefix+`le="`+formatFloat(upperBound)+`"}`, float64(cumulative))
+	}
+	w.sample(name+"_bucket", prefix+`le="+Inf"}`, float64(count))
+	w.sample(name+"_sum", labels, sum)
+	w.sample(name+"_count", labels, float64(count))
+}
+
+func (h *Histogram) describe() *desc {
+	return h.desc
+}
+
+func (h *Histogram) collect(w *writer) {
+	h.write(w, h.desc.name, "")
+}
+
+// metric is a Counter, a Gauge or a Histogram.
+type metric interface {
+	write(w *writer, name, labels string)
+}
+
+// vec is a metric partitioned by labels.
+type vec[M metric] struct {
+	desc
+	newMetric func() M
+
+	mu      sync.Mutex
+	metrics map[string]M // by label pairs
+}
+
+func newVec[M metric](d desc, newMetric func() M) *vec[M] {
+	return &vec[M]{desc: d, newMetric: newMetric, metrics: make(map[string]M)}
+}
+
+// with returns the metric of the label values, creating it if needed.
+func (v *vec[M]) with(values []string) M {
+	labels := v.labelPairs(values)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	m, ok := v.metrics[labels]
+	if !ok {
+		m = v.newMetric()
+		v.metrics[labels] = m
+	}
+	return m
+}
+
+func (v *vec[M]) describe() *desc {
+	return &v.desc
+}
+
+func (v *vec[M]) collect(w *writer) {
+	v.mu.Lock()
+	labels := make([]string, 0, len(v.metrics))
+	for l := range v.metrics {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	metrics := make([]M, len(labels))
+	for i, l := range labels {
+		metrics[i] = v.metrics[l]
+	}
+	v.mu.Unlock()
+
+	for i, m := range metrics {
+		m.write(w, v.name, labels[i])
+	}
+}
+
+// CounterVec is a Counter partitioned by labels.
+type CounterVec struct {
+	*vec[*Counter]
+}
+
+// NewCounterVec returns a counter partitioned by labels. Counter names end in "_total".
+func NewCounterVec(name, help string, labels ...string) CounterVec {
+	return CounterVec{newVec(desc{name, help, "counter", labels}, func() *Counter { return &Counter{} })}
+}
+
+// With returns the counter of the label values, given in the order of the labels.
+func (v CounterVec) With(values ...string) *Counter {
+	return v.with(values)
+}
+
+// GaugeVec is a Gauge partitioned by labels.
+type GaugeVec struct {
+	*vec[*Gauge]
+}
+
+// NewGaugeVec returns a gauge partitioned by labels.
+func NewGaugeVec(name, help string, labels ...string) GaugeVec {
+	return GaugeVec{newVec(desc{name, help, "gauge", labels}, func() *Gauge { return &Gauge{} })}
+}
+
+// With returns the gauge of the label values, given in the order of the labels.
+func (v GaugeVec) With(values ...string) *Gauge {
+	return v.with(values)
+}
+
+// HistogramVec is a Histogram partitioned by labels.
+type HistogramVec struct {
+	*vec[*Histogram]
+}
+
+// NewHistogramVec returns a histogram with buckets, sorted upper bounds,
+// partitioned by labels.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) HistogramVec {
+	return HistogramVec{newVec(desc{name, help, "histogram", labels}, func() *Histogram { return newHistogram(buckets) })}
+}
+
+// With returns the histogram of the label values, given in the order of the labels.
+func (v HistogramVec) With(values ...string) *Histogram {
+	return v.with(values)
+}
+
+// NewCounter returns a counter without labels.
+func NewCounter(name, help string) *Counter {
+	return &Counter{desc: &desc{name: name, help: help, typ: "counter"}}
+}
+
+// NewGauge returns a gauge without labels.
+func NewGauge(name, help string) *Gauge {
+	return &Gauge{desc: &desc{name: name, help: help, typ: "gauge"}}
+}
+
+// NewHistogram returns a histogram with buckets, sorted upper bounds, without labels.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	h.desc = &desc{name: name, help: help, typ: "histogram"}
+	return h
+}
+
+// gaugeFunc is a gauge whose value is computed when it is collected.
+type gaugeFunc struct {
+	desc
+	value func() float64
+}
+
+// NewGaugeFunc returns a gauge whose value is returned by value every time it
+// is collected. value must be safe for concurrent use.
+func NewGaugeFunc(name, help string, value func() float64) Collector {
+	return &gaugeFunc{desc{name: name, help: help, typ: "gauge"}, value}
+}
+
+func (g *gaugeFunc) describe() *desc {
+	return &g.desc
+}
+
+func (g *gaugeFunc) collect(w *writer) {
+	w.sample(g.name, "", g.value())
+}
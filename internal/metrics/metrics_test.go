@@ -0,0 +1,128 @@
+//go:build unit_test
+
+package metrics
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryWriteTo(t *testing.T) {
+	reg := NewRegistry()
+	requests := NewCounterVec("http_requests_total", "Requests by path\nand code.", "path", "code")
+	connections := NewGauge("connections", "Open connections.")
+	latency := NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	queries := NewHistogramVec("query_seconds", "Query latency.", []float64{1}, "query")
+	reg.MustRegister(requests, connections, latency, queries,
+		NewGaugeFunc("queue_length", "Queued items.", func() float64 { return 3 }))
+
+	requests.With("/a", "200").Add(2)
+	requests.With(`/"b"`, "500").Inc()
+	connections.Inc()
+	connections.Inc()
+	connections.Dec()
+	latency.Observe(0.05)
+	latency.Observe(0.1)
+	latency.Observe(0.5)
+	latency.Observe(2)
+	queries.With("insert").Observe(0.5)
+
+	var b strings.Builder
+	n, err := reg.WriteTo(&b)
+	require.NoError(t, err)
+	require.EqualValues(t, b.Len(), n)
+	require.Equal(t, `# HELP connections Open connections.
+# TYPE connections gauge
+connections 1
+# HELP http_requests_total Requests by path\nand code.
+# TYPE http_requests_total counter
+http_requests_total{path="/\"b\"",code="500"} 1
+http_requests_total{path="/a",code="200"} 2
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum 2.65
+latency_seconds_count 4
+# HELP query_seconds Query latency.
+# TYPE query_seconds histogram
+query_seconds_bucket{query="insert",le="1"} 1
+query_seconds_bucket{query="insert",le="+Inf"} 1
+query_seconds_sum{query="insert"} 0.5
+query_seconds_count{query="insert"} 1
+# HELP queue_length Queued items.
+# TYPE queue_length gauge
+queue_length 3
+`, b.String())
+}
+
+func TestRegistryRegister(t *testing.T) {
+	tests := []struct {
+		name       string
+		collectors []Collector
+		wantErr    string
+	}{
+		{name: "duplicate", collectors: []Collector{NewGauge("a", ""), NewCounter("a", "")}, wantErr: "a is already registered"},
+		{name: "already registered", collectors: []Collector{NewGauge("registered", "")}, wantErr: "registered is already registered"},
+		{name: "invalid name", collectors: []Collector{NewGauge("a-b", "")}, wantErr: `invalid metric name "a-b"`},
+		{name: "invalid label", collectors: []Collector{NewCounterVec("a", "", "le")}, wantErr: `invalid label "le" of a`},
+		{name: "vector member", collectors: []Collector{NewCounterVec("a", "", "b").With("c")}, wantErr: "register the vector"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := NewRegistry()
+			reg.MustRegister(NewGauge("registered", ""))
+			require.ErrorContains(t, reg.Register(tt.collectors...), tt.wantErr)
+			// Nothing is registered on errors
+			var b strings.Builder
+			reg.WriteTo(&b)
+			require.Equal(t, 1, strings.Count(b.String(), "# TYPE"))
+		})
+	}
+
+	require.Panics(t, func() {
+		NewCounterVec("a", "", "b").With("c", "d")
+	})
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	counter := NewCounter("c_total", "")
+	gauge := NewGaugeVec("g", "", "l")
+	histogram := NewHistogram("h", "", DefaultBuckets)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				counter.Inc()
+				gauge.With("x").Add(0.5)
+				histogram.Observe(0.01)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 8000.0, counter.Value())
+	require.Equal(t, 4000.0, gauge.With("x").Value())
+	require.EqualValues(t, 8000, histogram.Count())
+}
+
+func TestServeHTTP(t *testing.T) {
+	reg := NewRegistry()
+	reg.MustRegister(NewGaugeFunc("inf", "", func() float64 { return math.Inf(1) }))
+
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, ContentType, w.Header().Get("Content-Type"))
+	require.Contains(t, w.Body.String(), "inf +Inf\n")
+}
@@ -0,0 +1,145 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	nameRegexp         = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelRegexp        = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	helpReplacer       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// Collector is a metric that can be registered: a metric created by NewCounter,
+// NewGauge, NewHistogram or NewGaugeFunc, or a vector of metrics.
+type Collector interface {
+	describe() *desc
+	collect(w *writer)
+}
+
+// Registry holds the metrics exposed by its handler.
+type Registry struct {
+	mu         sync.Mutex
+	collectors map[string]Collector // by name
+}
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]Collector)}
+}
+
+// Register adds collectors to r. It fails if a name or a label is invalid, or
+// if a name is already registered, in which case none of collectors is added.
+func (r *Registry) Register(collectors ...Collector) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make(map[string]bool, len(collectors))
+	for _, c := range collectors {
+		d := c.describe()
+		if d == nil {
+			return fmt.Errorf("metrics: %T belongs to a vector, register the vector", c)
+		}
+		if !nameRegexp.MatchString(d.name) {
+			return fmt.Errorf("metrics: invalid metric name %q", d.name)
+		}
+		for _, label := range d.labels {
+			if !labelRegexp.MatchString(label) || label == "le" {
+				return fmt.Errorf("metrics: invalid label %q of %s", label, d.name)
+			}
+		}
+		if _, ok := r.collectors[d.name]; ok || names[d.name] {
+			return fmt.Errorf("metrics: %s is already registered", d.name)
+		}
+		names[d.name] = true
+	}
+	for _, c := range collectors {
+		r.collectors[c.describe().name] = c
+	}
+	return nil
+}
+
+// MustRegister is Register, panicking on errors.
+func (r *Registry) MustRegister(collectors ...Collector) {
+	if err := r.Register(collectors...); err != nil {
+		panic(err)
+	}
+}
+
+// WriteTo writes the metrics of r to w in the text exposition format, sorted by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := make([]Collector, 0, len(r.collectors))
+	for _, c := range r.collectors {
+		collectors = append(collectors, c)
+	}
+	r.mu.Unlock()
+	sort.Slice(collectors, func(i, j int) bool {
+		return collectors[i].describe().name < collectors[j].describe().name
+	})
+
+	cw := &countingWriter{w: w}
+	mw := &writer{w: bufio.NewWriter(cw)}
+	for _, c := range collectors {
+		d := c.describe()
+		fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", d.name, helpReplacer.Replace(d.help), d.name, d.typ)
+		c.collect(mw)
+	}
+	err := mw.w.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP serves the metrics of r to Prometheus.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	r.WriteTo(w)
+}
+
+// writer writes samples.
+type writer struct {
+	w *bufio.Writer
+}
+
+// sample writes a sample of name, with labels formatted by desc.labelPairs.
+func (w *writer) sample(name, labels string, value float64) {
+	w.w.WriteString(name)
+	w.w.WriteString(labels)
+	w.w.WriteByte(' ')
+	w.w.WriteString(formatFloat(value))
+	w.w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/zjy-dev/grpc-go-chatroom/internal/logging"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// withRequestID returns the context of a call with the request ID sent by the
+// client, or a new one.
+func withRequestID(ctx context.Context) context.Context {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(logging.RequestIDKey); len(ids) > 0 {
+			id = ids[0]
+		}
+	}
+	return logging.NewContext(ctx, logging.RequestIDOrNew(id))
+}
+
+// logCall logs a finished call, at a level telling whether the server failed.
+func logCall(ctx context.Context, logger *slog.Logger, msg, method string, start time.Time, err error) {
+	code := status.Code(err)
+	level := slog.LevelInfo
+	switch code {
+	case codes.Internal, codes.Unknown, codes.DataLoss, codes.Unimplemented:
+		level = slog.LevelError
+	case codes.Unavailable, codes.DeadlineExceeded:
+		level = slog.LevelWarn
+	}
+
+	attrs := []slog.Attr{
+		slog.String("method", method),
+		slog.String("code", code.String()),
+		slog.Duration("duration", time.Since(start)),
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		attrs = append(attrs, slog.String("peer", p.Addr.String()))
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", status.Convert(err).Message()))
+	}
+	logger.LogAttrs(ctx, level, msg, attrs...)
+}
+
+// UnaryServerLoggingInterceptor assigns a request ID to every unary call, sends
+// it back in the header, and logs the call once it returns. It must come before
+// the authentication, which records the user with logging.SetUser.
+func UnaryServerLoggingInterceptor(logger *slog.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		ctx = withRequestID(ctx)
+		grpc.SetHeader(ctx, metadata.Pairs(logging.RequestIDKey, logging.RequestID(ctx)))
+
+		resp, err := handler(ctx, req)
+		logCall(ctx, logger, "finished unary call", info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+// StreamServerLoggingInterceptor is UnaryServerLoggingInterceptor for streams,
+// which are logged once they end.
+func StreamServerLoggingInterceptor(logger *slog.Logger) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		stream := &requestIDStream{ServerStream: ss, ctx: withRequestID(ss.Context())}
+
+		err := handler(srv, stream)
+		logCall(stream.ctx, logger, "finished streaming call", info.FullMethod, start, err)
+		return err
+	}
+}
+
+// requestIDStream carries the context with the request ID, and sends the request
+// ID along with the header. The header is not sent on its own, since clients tell
+// a failed stream by its missing header.
+type requestIDStream struct {
+	grpc.ServerStream
+	ctx        context.Context
+	headerOnce sync.Once
+}
+
+func (s *requestIDStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *requestIDStream) setRequestID() {
+	s.headerOnce.Do(func() {
+		s.ServerStream.SetHeader(metadata.Pairs(logging.RequestIDKey, logging.RequestID(s.ctx)))
+	})
+}
+
+func (s *requestIDStream) SendHeader(md metadata.MD) error {
+	s.setRequestID()
+	return s.ServerStream.SendHeader(md)
+}
+
+func (s *requestIDStream) SendMsg(m any) error {
+	s.setRequestID()
+	return s.ServerStream.SendMsg(m)
+}
+
+// outgoingRequestID returns ctx with the request ID of ctx, if any, in the
+// outgoing metadata, so that the server logs the call with the same ID.
+func outgoingRequestID(ctx context.Context) context.Context {
+	if id := logging.RequestID(ctx); id != "" {
+		return metadata.AppendToOutgoingContext(ctx, logging.RequestIDKey, id)
+	}
+	return ctx
+}
+
+// UnaryClientRequestIDInterceptor propagates the request ID of the context of
+// unary calls, e.g. from the HTTP request a gateway call is made for.
+func UnaryClientRequestIDInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(outgoingRequestID(ctx), method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientRequestIDInterceptor is UnaryClientRequestIDInterceptor for streams.
+func StreamClientRequestIDInterceptor() grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(outgoingRequestID(ctx), desc, cc, method, opts...)
+	}
+}
@@ -0,0 +1,147 @@
+//go:build unit_test
+
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/zjy-dev/grpc-go-chatroom/internal/logging"
+)
+
+// fakeServerStream is a grpc.ServerStream recording the header it is given.
+type fakeServerStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	header metadata.MD
+	sent   bool
+}
+
+func (s *fakeServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *fakeServerStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *fakeServerStream) SendHeader(md metadata.MD) error {
+	s.sent = true
+	return s.SetHeader(md)
+}
+
+func (s *fakeServerStream) SendMsg(any) error {
+	s.sent = true
+	return nil
+}
+
+func decodeRecord(t *testing.T, buf *bytes.Buffer) map[string]any {
+	t.Helper()
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	return record
+}
+
+func TestUnaryServerLoggingInterceptor(t *testing.T) {
+	tests := []struct {
+		name      string
+		requestID string
+		err       error
+		wantLevel string
+		wantCode  string
+	}{
+		{name: "ok with client request ID", requestID: "req-1", wantLevel: "INFO", wantCode: "OK"},
+		{name: "client error", err: status.Error(codes.NotFound, "no such user"), wantLevel: "INFO", wantCode: "NotFound"},
+		{name: "server error", err: status.Error(codes.Internal, "database is down"), wantLevel: "ERROR", wantCode: "Internal"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			interceptor := UnaryServerLoggingInterceptor(logging.New(&buf, logging.FormatJSON, slog.LevelInfo))
+
+			ctx := context.Background()
+			if tt.requestID != "" {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(logging.RequestIDKey, tt.requestID))
+			}
+			var handlerID string
+			_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/chat.v1.ChatService/WhoAmI"},
+				func(ctx context.Context, req any) (any, error) {
+					handlerID = logging.RequestID(ctx)
+					logging.SetUser(ctx, "alice")
+					return nil, tt.err
+				})
+			require.Equal(t, tt.err, err)
+			require.NotEmpty(t, handlerID)
+			if tt.requestID != "" {
+				require.Equal(t, tt.requestID, handlerID)
+			}
+
+			record := decodeRecord(t, &buf)
+			require.Equal(t, "finished unary call", record["msg"])
+			require.Equal(t, tt.wantLevel, record["level"])
+			require.Equal(t, tt.wantCode, record["code"])
+			require.Equal(t, handlerID, record["request_id"])
+			require.Equal(t, "alice", record["user"])
+			require.Equal(t, "/chat.v1.ChatService/WhoAmI", record["method"])
+		})
+	}
+}
+
+func TestStreamServerLoggingInterceptor(t *testing.T) {
+	var buf bytes.Buffer
+	interceptor := StreamServerLoggingInterceptor(logging.New(&buf, logging.FormatJSON, slog.LevelInfo))
+	info := &grpc.StreamServerInfo{FullMethod: "/chat.v1.ChatService/Chat"}
+
+	// A stream failing before sending anything gets no header
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(logging.RequestIDKey, "req-1"))
+	ss := &fakeServerStream{ctx: ctx}
+	err := interceptor(nil, ss, info, func(srv any, stream grpc.ServerStream) error {
+		require.Equal(t, "req-1", logging.RequestID(stream.Context()))
+		return status.Error(codes.Unauthenticated, "invalid token")
+	})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	require.Nil(t, ss.header)
+	record := decodeRecord(t, &buf)
+	require.Equal(t, "finished streaming call", record["msg"])
+	require.Equal(t, "req-1", record["request_id"])
+	require.Equal(t, "invalid token", record["error"])
+
+	// A stream sending its header carries the request ID
+	buf.Reset()
+	ss = &fakeServerStream{ctx: ctx}
+	err = interceptor(nil, ss, info, func(srv any, stream grpc.ServerStream) error {
+		return stream.SendHeader(metadata.MD{})
+	})
+	require.NoError(t, err)
+	require.True(t, ss.sent)
+	require.Equal(t, []string{"req-1"}, ss.header.Get(logging.RequestIDKey))
+}
+
+func TestUnaryClientRequestIDInterceptor(t *testing.T) {
+	interceptor := UnaryClientRequestIDInterceptor()
+	invoke := func(ctx context.Context) metadata.MD {
+		var md metadata.MD
+		err := interceptor(ctx, "/chat.v1.ChatService/WhoAmI", nil, nil, nil,
+			func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				md, _ = metadata.FromOutgoingContext(ctx)
+				return nil
+			})
+		require.NoError(t, err)
+		return md
+	}
+
+	require.Empty(t, invoke(context.Background()).Get(logging.RequestIDKey))
+	ctx := logging.NewContext(context.Background(), "req-1")
+	require.Equal(t, []string{"req-1"}, invoke(ctx).Get(logging.RequestIDKey))
+}
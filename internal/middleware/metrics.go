@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"github.com/zjy-dev/grpc-go-chatroom/internal/metrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// ServerMetrics counts the RPCs handled by the server.
+type ServerMetrics struct {
+	handled  metrics.CounterVec
+	duration metrics.HistogramVec
+	streams  metrics.GaugeVec
+}
+
+// NewServerMetrics returns the metrics of the RPCs, to be registered with Collectors.
+func NewServerMetrics() *ServerMetrics {
+	return &ServerMetrics{
+		handled: metrics.NewCounterVec("grpc_server_handled_total",
+			"RPCs completed by the server, by method and status code.", "method", "code"),
+		duration: metrics.NewHistogramVec("grpc_server_handling_seconds",
+			"Duration of the RPCs until they completed, by method.", metrics.DefaultBuckets, "method"),
+		streams: metrics.NewGaugeVec("grpc_server_streams_open",
+			"Streaming RPCs currently open, by method.", "method"),
+	}
+}
+
+// Collectors returns the metrics to register.
+func (m *ServerMetrics) Collectors() []metrics.Collector {
+	return []metrics.Collector{m.handled, m.duration, m.streams}
+}
+
+func (m *ServerMetrics) observe(method string, start time.Time, err error) {
+	m.handled.With(method, status.Code(err).String()).Inc()
+	m.duration.With(method).Observe(time.Since(start).Seconds())
+}
+
+// UnaryServerInterceptor counts unary calls and their duration.
+func (m *ServerMetrics) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		m.observe(info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+// StreamServerInterceptor counts streaming calls, the open ones and their duration.
+func (m *ServerMetrics) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		open := m.streams.With(info.FullMethod)
+		open.Inc()
+		defer open.Dec()
+
+		err := handler(srv, ss)
+		m.observe(info.FullMethod, start, err)
+		return err
+	}
+}
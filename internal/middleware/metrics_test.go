@@ -0,0 +1,53 @@
+//go:build unit_test
+
+package middleware
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/zjy-dev/grpc-go-chatroom/internal/metrics"
+)
+
+func TestServerMetrics(t *testing.T) {
+	m := NewServerMetrics()
+	reg := metrics.NewRegistry()
+	reg.MustRegister(m.Collectors()...)
+
+	unary := m.UnaryServerInterceptor()
+	info := &grpc.UnaryServerInfo{FullMethod: "/chat.v1.ChatService/WhoAmI"}
+	unary(context.Background(), nil, info, func(ctx context.Context, req any) (any, error) {
+		return nil, nil
+	})
+	unary(context.Background(), nil, info, func(ctx context.Context, req any) (any, error) {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	})
+
+	stream := m.StreamServerInterceptor()
+	streamInfo := &grpc.StreamServerInfo{FullMethod: "/chat.v1.ChatService/Chat"}
+	err := stream(nil, &fakeServerStream{ctx: context.Background()}, streamInfo, func(srv any, ss grpc.ServerStream) error {
+		require.Equal(t, 1.0, m.streams.With(streamInfo.FullMethod).Value())
+		return status.Error(codes.Aborted, "logged out")
+	})
+	require.Equal(t, codes.Aborted, status.Code(err))
+	require.Equal(t, 0.0, m.streams.With(streamInfo.FullMethod).Value())
+
+	var b strings.Builder
+	_, err = reg.WriteTo(&b)
+	require.NoError(t, err)
+	for _, line := range []string{
+		`grpc_server_handled_total{method="/chat.v1.ChatService/WhoAmI",code="OK"} 1`,
+		`grpc_server_handled_total{method="/chat.v1.ChatService/WhoAmI",code="Unauthenticated"} 1`,
+		`grpc_server_handled_total{method="/chat.v1.ChatService/Chat",code="Aborted"} 1`,
+		`grpc_server_handling_seconds_count{method="/chat.v1.ChatService/WhoAmI"} 2`,
+		`grpc_server_streams_open{method="/chat.v1.ChatService/Chat"} 0`,
+	} {
+		require.Contains(t, b.String(), line+"\n")
+	}
+}
@@ -0,0 +1,189 @@
+//go:build unit_test
+
+package tlsutil
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+// newTestCA creates a CA and writes its certificate to a file.
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	ca := &testCA{cert: cert, key: key, file: filepath.Join(t.TempDir(), "ca.pem")}
+	require.NoError(t, os.WriteFile(ca.file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	return ca
+}
+
+// issue writes a certificate for commonName signed by ca, and returns the files.
+func (ca *testCA) issue(t *testing.T, commonName string, serial int64) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+func TestCertReloader(t *testing.T) {
+	require := require.New(t)
+	ca := newTestCA(t)
+	certFile, keyFile := ca.issue(t, "localhost", 2)
+	r, err := NewCertReloader(certFile, keyFile)
+	require.NoError(err)
+	first := r.Certificate()
+
+	// Unchanged files are not loaded again
+	require.Same(first, r.Certificate())
+
+	// Rotated files are loaded on the next handshake
+	newCert, newKey := ca.issue(t, "localhost", 3)
+	require.NoError(os.Rename(newCert, certFile))
+	require.NoError(os.Rename(newKey, keyFile))
+	// Make sure the modification time differs on coarse file systems.
+	later := time.Now().Add(time.Second)
+	require.NoError(os.Chtimes(certFile, later, later))
+	rotated := r.Certificate()
+	require.NotSame(first, rotated)
+	leaf, err := x509.ParseCertificate(rotated.Certificate[0])
+	require.NoError(err)
+	require.Equal(int64(3), leaf.SerialNumber.Int64())
+
+	// A broken rotation keeps the previous certificate
+	require.NoError(os.WriteFile(keyFile, []byte("not a key"), 0o600))
+	require.Same(rotated, r.Certificate())
+
+	_, err = NewCertReloader(certFile, filepath.Join(t.TempDir(), "missing.pem"))
+	require.Error(err)
+}
+
+// identityServer records the identity of its callers.
+type identityServer struct {
+	pb.UnimplementedChatServiceServer
+	identity chan string
+}
+
+func (s *identityServer) LogOut(ctx context.Context, _ *pb.LogOutRequest) (*pb.LogOutResponse, error) {
+	identity, _ := PeerIdentity(ctx)
+	s.identity <- identity
+	return &pb.LogOutResponse{}, nil
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert, serverKey := ca.issue(t, "localhost", 2)
+	clientCert, clientKey := ca.issue(t, "alice", 3)
+
+	serverConfig, err := ServerConfig(config.TLSConfig{
+		CertFile:     serverCert,
+		KeyFile:      serverKey,
+		ClientCAFile: ca.file,
+		ClientAuth:   config.ClientAuthOptional,
+	})
+	require.NoError(t, err)
+	srv := &identityServer{identity: make(chan string, 1)}
+	grpcServer := grpc.NewServer(grpc.Creds(credentials.NewTLS(serverConfig)))
+	pb.RegisterChatServiceServer(grpcServer, srv)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	tests := []struct {
+		name         string
+		config       config.ClientTLSConfig
+		wantIdentity string
+		wantCode     codes.Code
+	}{
+		{
+			name:         "client certificate",
+			config:       config.ClientTLSConfig{CAFile: ca.file, CertFile: clientCert, KeyFile: clientKey},
+			wantIdentity: "alice",
+		},
+		{
+			name:   "no client certificate",
+			config: config.ClientTLSConfig{CAFile: ca.file},
+		},
+		{
+			name:     "unknown server CA",
+			config:   config.ClientTLSConfig{Enabled: true},
+			wantCode: codes.Unavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			clientConfig, err := ClientConfig(tt.config)
+			require.NoError(err)
+			conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(clientConfig)))
+			require.NoError(err)
+			defer conn.Close()
+
+			_, err = pb.NewChatServiceClient(conn).LogOut(context.Background(), &pb.LogOutRequest{})
+			if tt.wantCode != codes.OK {
+				require.Equal(tt.wantCode, status.Code(err))
+				return
+			}
+			require.NoError(err)
+			require.Equal(tt.wantIdentity, <-srv.identity)
+		})
+	}
+}
@@ -6,7 +6,8 @@ import (
 
 // Auth is an implementation of grpc.PerRPCCredentials interface
 type Auth struct {
-	token string
+	token  string
+	secure bool // only send the token over TLS
 }
 
 // New creates a new Auth object with the given token
@@ -16,6 +17,15 @@ func New(token string) Auth {
 	}
 }
 
+// NewSecure creates a new Auth object with the given token, which gRPC refuses
+// to send over connections without transport security.
+func NewSecure(token string) Auth {
+	return Auth{
+		token:  token,
+		secure: true,
+	}
+}
+
 // GetRequestMetadata returns the metadata for the request
 func (a Auth) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
 	// Create a map to store the metadata
@@ -30,6 +40,5 @@ func (a Auth) GetRequestMetadata(ctx context.Context, uri ...string) (map[string
 
 // RequireTransportSecurity returns whether or not the transport security is required
 func (a Auth) RequireTransportSecurity() bool {
-	// Return false as the transport security is not required
-	return false
+	return a.secure
 }
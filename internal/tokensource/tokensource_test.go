@@ -76,9 +76,14 @@ func TestRequireTransportSecurity(t *testing.T) {
 	}{
 		{
 			name: "any token",
-			auth: Auth{token: "any_token"},
+			auth: New("any_token"),
 			want: false,
 		},
+		{
+			name: "secure token",
+			auth: NewSecure("any_token"),
+			want: true,
+		},
 	}
 
 	for _, tt := range tests {
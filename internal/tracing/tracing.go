@@ -0,0 +1,75 @@
+// Package tracing sets up OpenTelemetry tracing. The spans of the server are
+// exported as configured by config.TracingConfig, and the W3C trace context is
+// propagated through gRPC metadata and HTTP headers.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/zjy-dev/grpc-go-chatroom/internal/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentationName names the tracers of the packages of the module.
+const InstrumentationName = "github.com/zjy-dev/grpc-go-chatroom"
+
+// Tracer returns the tracer of the spans started by the module.
+func Tracer() trace.Tracer {
+	return otel.Tracer(InstrumentationName)
+}
+
+// Setup installs the global tracer provider and propagator. stdout receives the
+// spans of the stdout exporter. The returned function flushes the spans not
+// exported yet, it must be called before the process exits.
+func Setup(ctx context.Context, cfg config.TracingConfig, stdout io.Writer) (shutdown func(context.Context) error, err error) {
+	// The trace context of clients is passed on even if the spans are not exported,
+	// so that a trace is not cut at this server.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	switch cfg.Exporter {
+	case config.TracingExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case config.TracingExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(stdout))
+	case config.TracingExporterOTLP:
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		// The exporter connects in the background, it does not fail if the collector is down.
+		exporter, err = otlptracegrpc.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter: %q", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the %s trace exporter: %w", cfg.Exporter, err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(serviceResource(cfg.ServiceName)),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// serviceResource describes the process exporting the spans as serviceName.
+func serviceResource(serviceName string) *resource.Resource {
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", serviceName)))
+	if err != nil {
+		// Only resources of different schemas conflict.
+		return resource.Default()
+	}
+	return res
+}
@@ -0,0 +1,67 @@
+//go:build unit_test
+
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+
+	"github.com/zjy-dev/grpc-go-chatroom/internal/config"
+)
+
+func TestSetup(t *testing.T) {
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+
+	var stdout bytes.Buffer
+	shutdown, err := Setup(context.Background(), config.TracingConfig{
+		Exporter:    config.TracingExporterStdout,
+		SampleRatio: 1,
+		ServiceName: "chatroom-test",
+	}, &stdout)
+	require.NoError(t, err)
+
+	// The trace of the incoming trace context is continued
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(header))
+	_, span := Tracer().Start(ctx, "test")
+	span.End()
+	require.NoError(t, shutdown(context.Background()))
+
+	var exported struct {
+		Name        string
+		SpanContext struct{ TraceID string }
+		Parent      struct{ SpanID string }
+		Resource    []struct {
+			Key   string
+			Value struct{ Value any }
+		}
+	}
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &exported))
+	require.Equal(t, "test", exported.Name)
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", exported.SpanContext.TraceID)
+	require.Equal(t, "00f067aa0ba902b7", exported.Parent.SpanID)
+	serviceName := ""
+	for _, attr := range exported.Resource {
+		if attr.Key == "service.name" {
+			serviceName, _ = attr.Value.Value.(string)
+		}
+	}
+	require.Equal(t, "chatroom-test", serviceName)
+}
+
+func TestSetupErrors(t *testing.T) {
+	shutdown, err := Setup(context.Background(), config.TracingConfig{Exporter: config.TracingExporterNone}, nil)
+	require.NoError(t, err)
+	require.NoError(t, shutdown(context.Background()))
+
+	_, err = Setup(context.Background(), config.TracingConfig{Exporter: "zipkin"}, nil)
+	require.ErrorContains(t, err, `unknown trace exporter: "zipkin"`)
+}
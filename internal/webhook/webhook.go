@@ -0,0 +1,343 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Headers set on every delivery.
+const (
+	SignatureHeader = "X-Chatroom-Signature"
+	TimestampHeader = "X-Chatroom-Timestamp"
+	EventHeader     = "X-Chatroom-Event"
+	DeliveryHeader  = "X-Chatroom-Delivery"
+)
+
+// Filter selects chat events by type and room.
+type Filter struct {
+	EventTypes []pb.EventType // all types if empty
+	Rooms      []string       // all rooms if empty
+}
+
+// Matches reports whether evt passes the filter.
+func (f Filter) Matches(evt *pb.Event) bool {
+	if len(f.EventTypes) > 0 && !slices.Contains(f.EventTypes, evt.GetType()) {
+		return false
+	}
+	// Events not related to a room, e.g. moderation of API keys, pass the room filter.
+	if len(f.Rooms) > 0 && evt.GetRoom() != "" && !slices.Contains(f.Rooms, evt.GetRoom()) {
+		return false
+	}
+	return true
+}
+
+// Subscription is a webhook subscribed to the chat events matching its filter.
+type Subscription struct {
+	Filter
+	ID     int64
+	URL    string
+	Secret string
+}
+
+// DeadLetter is a delivery that failed after all the attempts.
+type DeadLetter struct {
+	WebhookID int64
+	EventID   string
+	EventType pb.EventType
+	Payload   []byte
+	Attempts  int
+	LastError string
+}
+
+// Store loads the subscriptions and keeps the dead letters.
+type Store interface {
+	ListSubscriptions() ([]*Subscription, error)
+	InsertDeadLetter(dl *DeadLetter) error
+}
+
+// Options configures a Dispatcher, zero values are replaced by defaults.
+type Options struct {
+	Workers        int           // concurrent deliveries, defaults to 4
+	QueueSize      int           // events buffered before new ones are dropped, defaults to 1024
+	MaxAttempts    int           // attempts before a delivery is dead-lettered, defaults to 5
+	InitialBackoff time.Duration // delay before the first retry, doubled per retry, defaults to 1s
+	MaxBackoff     time.Duration // upper bound of the retry delay, defaults to 1m
+	Client         *http.Client  // defaults to a client with a 10s timeout
+}
+
+func (o *Options) setDefaults() {
+	if o.Workers <= 0 {
+		o.Workers = 4
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = 1024
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = 5
+	}
+	if o.InitialBackoff <= 0 {
+		o.InitialBackoff = time.Second
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = time.Minute
+	}
+	if o.Client == nil {
+		o.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+}
+
+type delivery struct {
+	sub       *Subscription
+	event     *pb.Event
+	payload   []byte
+	attempt   int // attempts made so far
+	lastError string
+}
+
+// Dispatcher delivers events to the matching subscriptions in the background.
+type Dispatcher struct {
+	store      Store
+	opts       Options
+	events     chan *pb.Event // published events, handled by the dispatch routine
+	deliveries chan *delivery // pending deliveries, handled by the worker routines
+	stale      chan struct{}  // signals the dispatch routine to reload the subscriptions
+	done       chan struct{}  // closed by Close
+	wg         sync.WaitGroup // waits for the dispatch and worker routines
+	retries    sync.WaitGroup // waits for the scheduled retries
+	closeOnce  sync.Once
+}
+
+// NewDispatcher creates a Dispatcher and starts its routines, Close stops them.
+func NewDispatcher(store Store, opts Options) *Dispatcher {
+	opts.setDefaults()
+	d := &Dispatcher{
+		store:      store,
+		opts:       opts,
+		events:     make(chan *pb.Event, opts.QueueSize),
+		deliveries: make(chan *delivery, opts.QueueSize),
+		stale:      make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+
+	d.wg.Add(1 + opts.Workers)
+	go d.dispatch()
+	for range opts.Workers {
+		go d.work()
+	}
+	return d
+}
+
+// Publish queues evt for delivery without blocking, it reports false if the queue is full
+// and the event was dropped.
+func (d *Dispatcher) Publish(evt *pb.Event) bool {
+	select {
+	case <-d.done:
+		return false
+	default:
+	}
+
+	select {
+	case d.events <- evt:
+		return true
+	default:
+		slog.Warn("webhook queue is full, dropped event", "event", evt.GetId())
+		return false
+	}
+}
+
+// Invalidate makes the dispatcher reload the subscriptions before the next event,
+// call it after the subscriptions changed.
+func (d *Dispatcher) Invalidate() {
+	select {
+	case d.stale <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops the dispatcher. Queued events are dropped and pending retries are cancelled.
+func (d *Dispatcher) Close() {
+	d.closeOnce.Do(func() {
+		close(d.done)
+		// Workers schedule retries, so wait for them first.
+		d.wg.Wait()
+		d.retries.Wait()
+	})
+}
+
+// dispatch matches the published events against the subscriptions.
+func (d *Dispatcher) dispatch() {
+	defer d.wg.Done()
+
+	var subs []*Subscription
+	loaded := false
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-d.stale:
+			loaded = false
+		case evt := <-d.events:
+			// The subscriptions may have changed before evt was published.
+			select {
+			case <-d.stale:
+				loaded = false
+			default:
+			}
+			if !loaded {
+				s, err := d.store.ListSubscriptions()
+				if err != nil {
+					slog.Error("failed to load webhook subscriptions", "error", err)
+				} else {
+					subs, loaded = s, true
+				}
+			}
+
+			var payload []byte
+			for _, sub := range subs {
+				if !sub.Matches(evt) {
+					continue
+				}
+				if payload == nil {
+					var err error
+					if payload, err = protojson.Marshal(evt); err != nil {
+						slog.Error("failed to marshal event", "event", evt.GetId(), "error", err)
+						break
+					}
+				}
+				d.enqueue(&delivery{sub: sub, event: evt, payload: payload})
+			}
+		}
+	}
+}
+
+// enqueue queues a delivery, dead-lettering it if the queue is full.
+func (d *Dispatcher) enqueue(dl *delivery) {
+	select {
+	case d.deliveries <- dl:
+	case <-d.done:
+	default:
+		dl.lastError = "delivery queue is full"
+		d.deadLetter(dl)
+	}
+}
+
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.done:
+			return
+		case dl := <-d.deliveries:
+			d.deliver(dl)
+		}
+	}
+}
+
+// deliver makes one attempt, then schedules a retry or dead-letters the delivery if it failed.
+func (d *Dispatcher) deliver(dl *delivery) {
+	dl.attempt++
+	retryable, err := d.post(dl)
+	if err == nil {
+		return
+	}
+	dl.lastError = err.Error()
+
+	if !retryable || dl.attempt >= d.opts.MaxAttempts {
+		d.deadLetter(dl)
+		return
+	}
+
+	// Retry later without holding a worker.
+	d.retries.Add(1)
+	timer := time.NewTimer(d.backoff(dl.attempt))
+	go func() {
+		defer d.retries.Done()
+		select {
+		case <-d.done:
+			timer.Stop()
+		case <-timer.C:
+			d.enqueue(dl)
+		}
+	}()
+}
+
+// backoff returns the delay before the retry following attempt.
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	delay := d.opts.InitialBackoff << (attempt - 1)
+	if delay <= 0 || delay > d.opts.MaxBackoff {
+		delay = d.opts.MaxBackoff
+	}
+	return delay
+}
+
+// post sends the signed payload, and reports whether a failure is worth retrying.
+func (d *Dispatcher) post(dl *delivery) (retryable bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, dl.sub.URL, bytes.NewReader(dl.payload))
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %v", err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(dl.sub.Secret, timestamp, dl.payload))
+	req.Header.Set(EventHeader, dl.event.GetType().String())
+	req.Header.Set(DeliveryHeader, dl.event.GetId())
+
+	resp, err := d.opts.Client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("failed to post event: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	// Client errors won't fix themselves, except timeouts and rate limits.
+	retryable = resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout ||
+		resp.StatusCode == http.StatusTooManyRequests
+	return retryable, fmt.Errorf("receiver responded %s", resp.Status)
+}
+
+func (d *Dispatcher) deadLetter(dl *delivery) {
+	err := d.store.InsertDeadLetter(&DeadLetter{
+		WebhookID: dl.sub.ID,
+		EventID:   dl.event.GetId(),
+		EventType: dl.event.GetType(),
+		Payload:   dl.payload,
+		Attempts:  dl.attempt,
+		LastError: dl.lastError,
+	})
+	if err != nil {
+		slog.Error("failed to dead-letter event", "event", dl.event.GetId(), "webhook", dl.sub.ID, "error", err)
+	}
+}
+
+// Sign returns the signature header value of a payload sent at timestamp:
+// "sha256=" followed by the hex encoded HMAC-SHA256 of "<timestamp>.<payload>".
+func Sign(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is valid for the payload sent at timestamp,
+// receivers written in Go may use it.
+func Verify(secret, timestamp string, payload []byte, signature string) bool {
+	return hmac.Equal([]byte(Sign(secret, timestamp, payload)), []byte(signature))
+}
@@ -0,0 +1,207 @@
+//go:build unit_test
+
+package webhook
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// fakeStore is an in-memory Store.
+type fakeStore struct {
+	mu          sync.Mutex
+	subs        []*Subscription
+	deadLetters []*DeadLetter
+	loads       int
+}
+
+func (s *fakeStore) ListSubscriptions() ([]*Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loads++
+	return s.subs, nil
+}
+
+func (s *fakeStore) InsertDeadLetter(dl *DeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deadLetters = append(s.deadLetters, dl)
+	return nil
+}
+
+func (s *fakeStore) deadLettersLen() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.deadLetters)
+}
+
+var testOptions = Options{
+	Workers:        2,
+	MaxAttempts:    3,
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     5 * time.Millisecond,
+}
+
+func TestFilterMatches(t *testing.T) {
+	messageEvent := &pb.Event{Type: pb.EventType_EVENT_TYPE_MESSAGE, Room: "general"}
+	tests := []struct {
+		name   string
+		filter Filter
+		evt    *pb.Event
+		want   bool
+	}{
+		{name: "no filter", filter: Filter{}, evt: messageEvent, want: true},
+		{name: "type matches", filter: Filter{EventTypes: []pb.EventType{pb.EventType_EVENT_TYPE_MESSAGE}}, evt: messageEvent, want: true},
+		{name: "type differs", filter: Filter{EventTypes: []pb.EventType{pb.EventType_EVENT_TYPE_USER_JOIN}}, evt: messageEvent, want: false},
+		{name: "room matches", filter: Filter{Rooms: []string{"random", "general"}}, evt: messageEvent, want: true},
+		{name: "room differs", filter: Filter{Rooms: []string{"random"}}, evt: messageEvent, want: false},
+		{name: "event without room", filter: Filter{Rooms: []string{"random"}}, evt: &pb.Event{Type: pb.EventType_EVENT_TYPE_MODERATION}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, tt.filter.Matches(tt.evt))
+		})
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	require := require.New(t)
+
+	signature := Sign("secret", "1723680000", []byte(`{"id":"1"}`))
+	require.Equal("sha256=", signature[:7])
+	require.True(Verify("secret", "1723680000", []byte(`{"id":"1"}`), signature))
+	require.False(Verify("other", "1723680000", []byte(`{"id":"1"}`), signature))
+	require.False(Verify("secret", "1723680001", []byte(`{"id":"1"}`), signature))
+}
+
+func TestDispatcherDelivers(t *testing.T) {
+	require := require.New(t)
+
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer receiver.Close()
+
+	store := &fakeStore{subs: []*Subscription{
+		{ID: 1, URL: receiver.URL, Secret: "secret", Filter: Filter{EventTypes: []pb.EventType{pb.EventType_EVENT_TYPE_MESSAGE}}},
+	}}
+	d := NewDispatcher(store, testOptions)
+	defer d.Close()
+
+	// Filtered out by the event type.
+	require.True(d.Publish(&pb.Event{Id: "join", Type: pb.EventType_EVENT_TYPE_USER_JOIN}))
+	require.True(d.Publish(&pb.Event{Id: "msg", Type: pb.EventType_EVENT_TYPE_MESSAGE, Message: &pb.Message{TextContent: "hi"}}))
+
+	select {
+	case r := <-received:
+		body := <-bodies
+		require.Equal("msg", r.Header.Get(DeliveryHeader))
+		require.Equal("EVENT_TYPE_MESSAGE", r.Header.Get(EventHeader))
+		require.True(Verify("secret", r.Header.Get(TimestampHeader), body, r.Header.Get(SignatureHeader)))
+
+		var evt pb.Event
+		require.NoError(protojson.Unmarshal(body, &evt))
+		require.Equal("hi", evt.GetMessage().GetTextContent())
+	case <-time.After(5 * time.Second):
+		t.Fatal("event was not delivered")
+	}
+	require.Empty(received)
+}
+
+func TestDispatcherRetriesThenDeadLetters(t *testing.T) {
+	require := require.New(t)
+
+	var attempts atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first attempt of "flaky", always fail "broken".
+		if attempts.Add(1) == 1 || r.Header.Get(DeliveryHeader) == "broken" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+
+	store := &fakeStore{subs: []*Subscription{{ID: 1, URL: receiver.URL, Secret: "secret"}}}
+	d := NewDispatcher(store, testOptions)
+	defer d.Close()
+
+	d.Publish(&pb.Event{Id: "flaky", Type: pb.EventType_EVENT_TYPE_MESSAGE})
+	require.Eventually(func() bool { return attempts.Load() == 2 }, 5*time.Second, time.Millisecond)
+
+	d.Publish(&pb.Event{Id: "broken", Type: pb.EventType_EVENT_TYPE_MESSAGE})
+	require.Eventually(func() bool { return store.deadLettersLen() == 1 }, 5*time.Second, time.Millisecond)
+	require.Equal(int32(2+testOptions.MaxAttempts), attempts.Load())
+
+	dl := store.deadLetters[0]
+	require.Equal(int64(1), dl.WebhookID)
+	require.Equal("broken", dl.EventID)
+	require.Equal(testOptions.MaxAttempts, dl.Attempts)
+	require.Equal("receiver responded 503 Service Unavailable", dl.LastError)
+}
+
+func TestDispatcherDoesNotRetryClientErrors(t *testing.T) {
+	require := require.New(t)
+
+	var attempts atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer receiver.Close()
+
+	store := &fakeStore{subs: []*Subscription{{ID: 1, URL: receiver.URL}}}
+	d := NewDispatcher(store, testOptions)
+	defer d.Close()
+
+	d.Publish(&pb.Event{Id: "gone", Type: pb.EventType_EVENT_TYPE_MESSAGE})
+	require.Eventually(func() bool { return store.deadLettersLen() == 1 }, 5*time.Second, time.Millisecond)
+	require.Equal(int32(1), attempts.Load())
+}
+
+func TestDispatcherInvalidate(t *testing.T) {
+	require := require.New(t)
+
+	store := &fakeStore{}
+	d := NewDispatcher(store, testOptions)
+	defer d.Close()
+
+	loads := func() int {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return store.loads
+	}
+
+	d.Publish(&pb.Event{Id: "1"})
+	require.Eventually(func() bool { return loads() == 1 }, 5*time.Second, time.Millisecond)
+	d.Publish(&pb.Event{Id: "2"})
+	require.Eventually(func() bool { return len(d.events) == 0 }, 5*time.Second, time.Millisecond)
+	require.Equal(1, loads())
+
+	d.Invalidate()
+	d.Publish(&pb.Event{Id: "3"})
+	require.Eventually(func() bool { return loads() == 2 }, 5*time.Second, time.Millisecond)
+}
+
+func TestBackoff(t *testing.T) {
+	require := require.New(t)
+	d := &Dispatcher{opts: Options{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}}
+
+	require.Equal(time.Second, d.backoff(1))
+	require.Equal(2*time.Second, d.backoff(2))
+	require.Equal(4*time.Second, d.backoff(3))
+	require.Equal(5*time.Second, d.backoff(4))
+	require.Equal(5*time.Second, d.backoff(100))
+}
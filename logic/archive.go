@@ -0,0 +1,261 @@
+package logic
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/db"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// archiveVersion is the version of the archives ExportHistory streams and
+	// ImportHistory accepts.
+	archiveVersion = 1
+	// exportPageSize is the number of messages ExportHistory reads per query.
+	exportPageSize = 500
+)
+
+// ExportHistory is a method that implements the ExportHistory method of the ChatServiceServer interface.
+// The attachments manifest is empty, as the binary content of messages is only
+// delivered live and never stored, except the ciphertext of encrypted messages,
+// which is exported within them.
+func (cs *chatServiceServer) ExportHistory(req *pb.ExportHistoryRequest, stream grpc.ServerStreamingServer[pb.ExportRecord]) error {
+	ctx := stream.Context()
+	username, err := cs.requireAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	for _, room := range req.GetRooms() {
+		if !roomNameRegexp.MatchString(room) {
+			return status.Errorf(codes.InvalidArgument, "invalid room name: %q", room)
+		}
+	}
+	if req.GetSince() < 0 || req.GetUntil() < 0 || (req.GetUntil() > 0 && req.GetUntil() <= req.GetSince()) {
+		return status.Errorf(codes.InvalidArgument, "invalid time range: since %d, until %d", req.GetSince(), req.GetUntil())
+	}
+	filter := db.ExportFilter{
+		Rooms:          req.GetRooms(),
+		Since:          req.GetSince(),
+		Until:          req.GetUntil(),
+		IncludePrivate: req.GetIncludePrivate(),
+	}
+
+	conn, err := dBConn()
+	if err != nil {
+		return err
+	}
+	source, err := db.GetInstanceID(ctx, conn)
+	if err != nil {
+		return dbError(err, "failed to get instance id")
+	}
+	if err := stream.Send(&pb.ExportRecord{Record: &pb.ExportRecord_Header{Header: &pb.ExportHeader{
+		Version:    archiveVersion,
+		ExportedAt: time.Now().Unix(),
+		Filter:     req,
+		Source:     source,
+	}}}); err != nil {
+		return err
+	}
+
+	rooms, err := db.ExportRooms(ctx, conn, filter)
+	if err != nil {
+		return dbError(err, "failed to export rooms")
+	}
+	cs.mu.Lock()
+	for _, room := range rooms {
+		room.Topic = cs.topics[room.GetName()]
+	}
+	cs.mu.Unlock()
+	for _, room := range rooms {
+		if err := stream.Send(&pb.ExportRecord{Record: &pb.ExportRecord_Room{Room: room}}); err != nil {
+			return err
+		}
+	}
+
+	users, err := db.ExportUsers(ctx, conn, filter)
+	if err != nil {
+		return dbError(err, "failed to export users")
+	}
+	for _, user := range users {
+		if err := stream.Send(&pb.ExportRecord{Record: &pb.ExportRecord_User{User: user}}); err != nil {
+			return err
+		}
+	}
+
+	var after uint64
+	var total int
+	for {
+		messages, err := db.ExportMessages(ctx, conn, filter, after, exportPageSize)
+		if err != nil {
+			return dbError(err, "failed to export messages")
+		}
+		for _, msg := range messages {
+			if err := stream.Send(&pb.ExportRecord{Record: &pb.ExportRecord_Message{Message: msg}}); err != nil {
+				return err
+			}
+			after = msg.GetMessageNumber()
+		}
+		total += len(messages)
+		if len(messages) < exportPageSize {
+			break
+		}
+	}
+	slog.InfoContext(ctx, "history exported by an admin", "admin", username, "rooms", len(rooms), "users", len(users), "messages", total)
+	return nil
+}
+
+// ImportHistory is a method that implements the ImportHistory method of the ChatServiceServer interface.
+func (cs *chatServiceServer) ImportHistory(stream grpc.ClientStreamingServer[pb.ImportHistoryRequest, pb.ImportHistoryResponse]) error {
+	ctx := stream.Context()
+	username, err := cs.requireAdmin(ctx)
+	if err != nil {
+		return err
+	}
+
+	conn, err := dBConn()
+	if err != nil {
+		return err
+	}
+	local, err := db.GetInstanceID(ctx, conn)
+	if err != nil {
+		return dbError(err, "failed to get instance id")
+	}
+	resp := &pb.ImportHistoryResponse{}
+	var source string
+	for n := 0; ; n++ {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+		rec := req.GetRecord()
+		if n == 0 {
+			if rec.GetHeader() == nil {
+				return status.Errorf(codes.InvalidArgument, "the archive does not start with a header")
+			}
+			if v := rec.GetHeader().GetVersion(); v != archiveVersion {
+				return status.Errorf(codes.InvalidArgument, "unsupported archive version %d", v)
+			}
+			if source = rec.GetHeader().GetSource(); source == "" {
+				return status.Errorf(codes.InvalidArgument, "the archive header has no source")
+			}
+			continue
+		}
+
+		switch r := rec.GetRecord().(type) {
+		case *pb.ExportRecord_Room:
+			err = cs.importRoom(r.Room, resp)
+		case *pb.ExportRecord_User:
+			err = cs.importUser(ctx, conn, r.User, resp)
+		case *pb.ExportRecord_Message:
+			err = cs.importMessage(ctx, conn, source, source == local, r.Message, resp)
+		case *pb.ExportRecord_Attachment:
+			// The binary content of messages is not stored.
+		default:
+			err = status.Errorf(codes.InvalidArgument, "record %d: unexpected record", n)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	slog.InfoContext(ctx, "history imported by an admin", "admin", username, "users_created", resp.UsersCreated,
+		"messages_imported", resp.MessagesImported, "messages_skipped", resp.MessagesSkipped)
+	return stream.SendAndClose(resp)
+}
+
+// importRoom restores the topic of room unless the room has one.
+func (cs *chatServiceServer) importRoom(room *pb.ExportedRoom, resp *pb.ImportHistoryResponse) error {
+	if !roomNameRegexp.MatchString(room.GetName()) {
+		return status.Errorf(codes.InvalidArgument, "invalid room name: %q", room.GetName())
+	}
+	if room.GetTopic() == "" {
+		return nil
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.topics[room.GetName()] == "" {
+		cs.topics[room.GetName()] = room.GetTopic()
+		resp.TopicsRestored++
+	}
+	return nil
+}
+
+// importUser creates user unless a user of the same name exists, whose profile is kept.
+func (cs *chatServiceServer) importUser(ctx context.Context, conn *sql.DB, user *pb.ExportedUser, resp *pb.ImportHistoryResponse) error {
+	username := user.GetProfile().GetUsername()
+	if username == "" {
+		return status.Errorf(codes.InvalidArgument, "user without a username")
+	}
+	if err := validateProfileUpdate(&pb.UpdateProfileRequest{
+		DisplayName: &user.GetProfile().DisplayName,
+		AvatarUrl:   &user.GetProfile().AvatarUrl,
+		StatusText:  &user.GetProfile().StatusText,
+		Bio:         &user.GetProfile().Bio,
+	}); err != nil {
+		return status.Errorf(codes.InvalidArgument, "user %s: %s", username, status.Convert(err).Message())
+	}
+
+	exists, err := db.UserExistsByName(ctx, conn, username)
+	if err != nil {
+		return dbError(err, "failed to check user")
+	}
+	if exists {
+		return nil
+	}
+	id, err := db.InsertImportedUser(ctx, conn, user)
+	if err != nil {
+		return dbError(err, "failed to create user")
+	}
+	cs.authors.put(username, author{id: id, displayName: user.GetProfile().GetDisplayName(), loadedAt: time.Now()})
+	resp.UsersCreated++
+	return nil
+}
+
+// importMessage inserts msg of an archive exported from source unless it was
+// imported before, or, when the archive was exported by this deployment (local),
+// unless the message is still there.
+func (cs *chatServiceServer) importMessage(ctx context.Context, conn *sql.DB, source string, local bool, msg *pb.Message, resp *pb.ImportHistoryResponse) error {
+	if msg.GetMessageNumber() == 0 {
+		return status.Errorf(codes.InvalidArgument, "message without a message number")
+	}
+	if !roomNameRegexp.MatchString(msg.GetRoom()) {
+		return status.Errorf(codes.InvalidArgument, "message %d: invalid room name: %q", msg.GetMessageNumber(), msg.GetRoom())
+	}
+	a, err := cs.resolveAuthor(ctx, msg.GetUsername())
+	if status.Code(err) == codes.NotFound {
+		return status.Errorf(codes.InvalidArgument, "message %d: user %s is neither in the archive nor on the server", msg.GetMessageNumber(), msg.GetUsername())
+	} else if err != nil {
+		return dbError(err, "failed to resolve author")
+	}
+
+	if local {
+		exists, err := db.MessageExists(ctx, conn, msg.GetMessageNumber())
+		if err != nil {
+			return dbError(err, "failed to check message")
+		}
+		if exists {
+			resp.MessagesSkipped++
+			return nil
+		}
+	}
+	inserted, err := db.ImportMessage(ctx, conn, a.id, source, msg)
+	if err != nil {
+		return dbError(err, "failed to import message")
+	}
+	if inserted {
+		resp.MessagesImported++
+	} else {
+		resp.MessagesSkipped++
+	}
+	return nil
+}
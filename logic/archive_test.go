@@ -0,0 +1,291 @@
+//go:build unit_test
+
+package logic
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+type mockExportStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	records []*pb.ExportRecord
+}
+
+func (m *mockExportStream) Context() context.Context { return m.ctx }
+
+func (m *mockExportStream) Send(rec *pb.ExportRecord) error {
+	m.records = append(m.records, rec)
+	return nil
+}
+
+type mockImportStream struct {
+	grpc.ServerStream
+	ctx     context.Context
+	records []*pb.ExportRecord
+	resp    *pb.ImportHistoryResponse
+}
+
+func (m *mockImportStream) Context() context.Context { return m.ctx }
+
+func (m *mockImportStream) Recv() (*pb.ImportHistoryRequest, error) {
+	if len(m.records) == 0 {
+		return nil, io.EOF
+	}
+	rec := m.records[0]
+	m.records = m.records[1:]
+	return &pb.ImportHistoryRequest{Record: rec}, nil
+}
+
+func (m *mockImportStream) SendAndClose(resp *pb.ImportHistoryResponse) error {
+	m.resp = resp
+	return nil
+}
+
+var archiveHeader = &pb.ExportRecord{Record: &pb.ExportRecord_Header{Header: &pb.ExportHeader{Version: archiveVersion, ExportedAt: 1723766400, Source: "remote"}}}
+
+// expectInstanceID expects the query of the ID of the deployment, which is "local".
+func expectInstanceID(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM instance;")).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("local"))
+}
+
+func TestExportHistory(t *testing.T) {
+	require := require.New(t)
+	db, mock := mockDB()
+	defer db.Close()
+	dbConn.Store(db)
+	defer dbConn.Store(nil)
+	cs := newCommandTestServer()
+	cs.topics["general"] = "Anything goes"
+
+	expectInstanceID(mock)
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT room, COUNT(*) FROM messages WHERE room IN (?) AND type NOT IN (?, ?) GROUP BY room ORDER BY room;")).
+		WithArgs("general", int32(pb.MessageType_MESSAGE_TYPE_PRIVATE), int32(pb.MessageType_MESSAGE_TYPE_ENCRYPTED)).
+		WillReturnRows(sqlmock.NewRows([]string{"room", "count"}).AddRow("general", 1))
+	mock.ExpectQuery("SELECT username, display_name, .* FROM users").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "display_name", "avatar_url", "status_text", "bio", "is_bot", "created_at"}).
+			AddRow("alice", "Alice", "", "", "", false, 1723680000))
+	mock.ExpectQuery("SELECT id, username, room, message, type, recipient, .* FROM messages").
+		WithArgs(0, "general", int32(pb.MessageType_MESSAGE_TYPE_PRIVATE), int32(pb.MessageType_MESSAGE_TYPE_ENCRYPTED), exportPageSize).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "room", "message", "type", "recipient", "binary_content", "wrapped_keys", "created_at"}).
+			AddRow(11, "alice", "general", "Hello", 3, "", nil, nil, 1723680000))
+
+	stream := &mockExportStream{ctx: context.WithValue(context.Background(), JWTContextKey, "admin")}
+	require.NoError(cs.ExportHistory(&pb.ExportHistoryRequest{Rooms: []string{"general"}}, stream))
+	require.Len(stream.records, 4)
+	require.EqualValues(archiveVersion, stream.records[0].GetHeader().GetVersion())
+	require.Equal([]string{"general"}, stream.records[0].GetHeader().GetFilter().GetRooms())
+	require.Equal("local", stream.records[0].GetHeader().GetSource())
+	require.True(proto.Equal(&pb.ExportedRoom{Name: "general", Topic: "Anything goes", MessageCount: 1}, stream.records[1].GetRoom()))
+	require.Equal("alice", stream.records[2].GetUser().GetProfile().GetUsername())
+	require.True(proto.Equal(&pb.Message{
+		MessageNumber: 11, Username: "alice", Room: "general", TextContent: "Hello",
+		Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Timestamp: 1723680000,
+	}, stream.records[3].GetMessage()))
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestExportHistoryErrors(t *testing.T) {
+	cs := newCommandTestServer()
+	adminCtx := context.WithValue(context.Background(), JWTContextKey, "admin")
+	tests := []struct {
+		name         string
+		ctx          context.Context
+		req          *pb.ExportHistoryRequest
+		expectedCode codes.Code
+	}{
+		{
+			name:         "not an admin",
+			ctx:          context.WithValue(context.Background(), JWTContextKey, "alice"),
+			req:          &pb.ExportHistoryRequest{},
+			expectedCode: codes.PermissionDenied,
+		},
+		{
+			name:         "invalid room",
+			ctx:          adminCtx,
+			req:          &pb.ExportHistoryRequest{Rooms: []string{"#general"}},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "empty time range",
+			ctx:          adminCtx,
+			req:          &pb.ExportHistoryRequest{Since: 1723680000, Until: 1723680000},
+			expectedCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := &mockExportStream{ctx: tt.ctx}
+			err := cs.ExportHistory(tt.req, stream)
+			require.Equal(t, tt.expectedCode, status.Code(err))
+			require.Empty(t, stream.records)
+		})
+	}
+}
+
+func TestImportHistory(t *testing.T) {
+	require := require.New(t)
+	db, mock := mockDB()
+	defer db.Close()
+	dbConn.Store(db)
+	defer dbConn.Store(nil)
+	cs := newCommandTestServer("alice")
+	cs.topics["random"] = "Off topic"
+
+	userExists := regexp.QuoteMeta("SELECT id FROM users WHERE username = ?;")
+	importMessage := regexp.QuoteMeta("INSERT INTO messages (user_id, username, room, message, type, recipient, binary_content, wrapped_keys, created_at, import_source, import_id)")
+	expectInstanceID(mock)
+	mock.ExpectQuery(userExists).WithArgs("alice").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(userExists).WithArgs("carol").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectExec("INSERT INTO users").WithArgs("carol", false, "Carol", "", "", "", 1723680000).
+		WillReturnResult(sqlmock.NewResult(7, 1))
+	// alice's message was imported before, the message numbers of the archive may
+	// be taken by local messages, which are not checked
+	mock.ExpectExec(importMessage).WithArgs(1, "alice", "general", "Hello", 3, "", nil, nil, 1723680000, "remote", 11).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(importMessage).WithArgs(7, "carol", "general", "Hi", 3, "", nil, nil, 1723680001, "remote", 12).
+		WillReturnResult(sqlmock.NewResult(40, 1))
+
+	stream := &mockImportStream{
+		ctx: context.WithValue(context.Background(), JWTContextKey, "admin"),
+		records: []*pb.ExportRecord{
+			archiveHeader,
+			{Record: &pb.ExportRecord_Room{Room: &pb.ExportedRoom{Name: "general", Topic: "Anything goes"}}},
+			{Record: &pb.ExportRecord_Room{Room: &pb.ExportedRoom{Name: "random", Topic: "Cats"}}},
+			{Record: &pb.ExportRecord_User{User: &pb.ExportedUser{Profile: &pb.UserProfile{Username: "alice"}}}},
+			{Record: &pb.ExportRecord_User{User: &pb.ExportedUser{Profile: &pb.UserProfile{Username: "carol", DisplayName: "Carol"}, CreatedAt: 1723680000}}},
+			{Record: &pb.ExportRecord_Message{Message: &pb.Message{MessageNumber: 11, Username: "alice", Room: "general", TextContent: "Hello", Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Timestamp: 1723680000}}},
+			{Record: &pb.ExportRecord_Message{Message: &pb.Message{MessageNumber: 12, Username: "carol", Room: "general", TextContent: "Hi", Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Timestamp: 1723680001}}},
+			{Record: &pb.ExportRecord_Attachment{Attachment: &pb.ExportedAttachment{MessageNumber: 12, Name: "cat.png"}}},
+		},
+	}
+	require.NoError(cs.ImportHistory(stream))
+	require.True(proto.Equal(&pb.ImportHistoryResponse{TopicsRestored: 1, UsersCreated: 1, MessagesImported: 1, MessagesSkipped: 1}, stream.resp))
+	// The topic set on the server wins
+	require.Equal("Anything goes", cs.topics["general"])
+	require.Equal("Off topic", cs.topics["random"])
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestImportHistoryLocalArchive(t *testing.T) {
+	require := require.New(t)
+	db, mock := mockDB()
+	defer db.Close()
+	dbConn.Store(db)
+	defer dbConn.Store(nil)
+	cs := newCommandTestServer("alice")
+
+	messageExists := regexp.QuoteMeta("SELECT EXISTS (SELECT 1 FROM messages WHERE id = ?);")
+	expectInstanceID(mock)
+	mock.ExpectQuery(messageExists).WithArgs(11).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	// A deleted message is restored
+	mock.ExpectQuery(messageExists).WithArgs(12).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec("INSERT INTO messages").WithArgs(1, "alice", "general", "Bye", 3, "", nil, nil, 1723680001, "local", 12).
+		WillReturnResult(sqlmock.NewResult(40, 1))
+
+	stream := &mockImportStream{
+		ctx: context.WithValue(context.Background(), JWTContextKey, "admin"),
+		records: []*pb.ExportRecord{
+			{Record: &pb.ExportRecord_Header{Header: &pb.ExportHeader{Version: archiveVersion, Source: "local"}}},
+			{Record: &pb.ExportRecord_Message{Message: &pb.Message{MessageNumber: 11, Username: "alice", Room: "general", TextContent: "Hello", Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Timestamp: 1723680000}}},
+			{Record: &pb.ExportRecord_Message{Message: &pb.Message{MessageNumber: 12, Username: "alice", Room: "general", TextContent: "Bye", Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Timestamp: 1723680001}}},
+		},
+	}
+	require.NoError(cs.ImportHistory(stream))
+	require.True(proto.Equal(&pb.ImportHistoryResponse{MessagesImported: 1, MessagesSkipped: 1}, stream.resp))
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestImportHistoryErrors(t *testing.T) {
+	db, mock := mockDB()
+	defer db.Close()
+	dbConn.Store(db)
+	defer dbConn.Store(nil)
+	adminCtx := context.WithValue(context.Background(), JWTContextKey, "admin")
+	tests := []struct {
+		name         string
+		ctx          context.Context
+		records      []*pb.ExportRecord
+		mockSetup    func()
+		expectedCode codes.Code
+	}{
+		{
+			name:         "not an admin",
+			ctx:          context.WithValue(context.Background(), JWTContextKey, "alice"),
+			records:      []*pb.ExportRecord{archiveHeader},
+			expectedCode: codes.PermissionDenied,
+		},
+		{
+			name:         "no header",
+			ctx:          adminCtx,
+			records:      []*pb.ExportRecord{{Record: &pb.ExportRecord_Room{Room: &pb.ExportedRoom{Name: "general"}}}},
+			mockSetup:    func() { expectInstanceID(mock) },
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "unsupported version",
+			ctx:          adminCtx,
+			records:      []*pb.ExportRecord{{Record: &pb.ExportRecord_Header{Header: &pb.ExportHeader{Version: 2, Source: "remote"}}}},
+			mockSetup:    func() { expectInstanceID(mock) },
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "no source",
+			ctx:          adminCtx,
+			records:      []*pb.ExportRecord{{Record: &pb.ExportRecord_Header{Header: &pb.ExportHeader{Version: archiveVersion}}}},
+			mockSetup:    func() { expectInstanceID(mock) },
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name: "unknown author",
+			ctx:  adminCtx,
+			records: []*pb.ExportRecord{
+				archiveHeader,
+				{Record: &pb.ExportRecord_Message{Message: &pb.Message{MessageNumber: 11, Username: "mallory", Room: "general"}}},
+			},
+			mockSetup: func() {
+				expectInstanceID(mock)
+				mock.ExpectQuery("SELECT .* FROM users").WithArgs("mallory").WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name: "database down",
+			ctx:  adminCtx,
+			records: []*pb.ExportRecord{
+				archiveHeader,
+				{Record: &pb.ExportRecord_User{User: &pb.ExportedUser{Profile: &pb.UserProfile{Username: "carol"}}}},
+			},
+			mockSetup: func() {
+				expectInstanceID(mock)
+				mock.ExpectQuery("SELECT id FROM users").WithArgs("carol").WillReturnError(errConnRefused)
+			},
+			expectedCode: codes.Unavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.mockSetup != nil {
+				tt.mockSetup()
+			}
+			stream := &mockImportStream{ctx: tt.ctx, records: tt.records}
+			err := newCommandTestServer().ImportHistory(stream)
+			require.Equal(t, tt.expectedCode, status.Code(err))
+			require.Nil(t, stream.resp)
+			require.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
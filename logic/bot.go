@@ -0,0 +1,254 @@
+package logic
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"time"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/apikey"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/db"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// apiKeyContextKey holds the *apiKeyIdentity of a bot authenticated by an API key.
+var apiKeyContextKey = &apiKeyContext{}
+
+type apiKeyContext struct{}
+
+type apiKeyIdentity struct {
+	keyID  int64
+	scopes []string
+}
+
+// AuthAPIKey authenticates a bot by its API key, and returns a context carrying the bot's
+// username under JWTContextKey like a JWT token does, along with the key's scopes.
+func AuthAPIKey(ctx context.Context, key string) (context.Context, error) {
+	conn, err := dBConn()
+	if err != nil {
+		return nil, err
+	}
+	apiKey, err := db.GetActiveAPIKeyByHash(ctx, conn, apikey.Hash(key))
+	if err != nil {
+		return nil, dbError(err, "failed to check api key")
+	}
+	if apiKey == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid or revoked api key")
+	}
+
+	ctx = context.WithValue(ctx, JWTContextKey, apiKey.BotName)
+	return context.WithValue(ctx, apiKeyContextKey, &apiKeyIdentity{
+		keyID:  apiKey.ID,
+		scopes: apikey.ParseScopes(apiKey.Scopes),
+	}), nil
+}
+
+// isBot reports whether the caller authenticated by an API key.
+func isBot(ctx context.Context) bool {
+	_, ok := ctx.Value(apiKeyContextKey).(*apiKeyIdentity)
+	return ok
+}
+
+// requireScope checks that a bot caller was granted scope. Users authenticated by
+// JWT tokens are not limited by scopes.
+func requireScope(ctx context.Context, scope string) error {
+	identity, ok := ctx.Value(apiKeyContextKey).(*apiKeyIdentity)
+	if ok && !slices.Contains(identity.scopes, scope) {
+		return status.Errorf(codes.PermissionDenied, "api key lacks the %q scope", scope)
+	}
+	return nil
+}
+
+// requireAdmin checks that the caller is a human admin, and returns the caller's username.
+func (cs *chatServiceServer) requireAdmin(ctx context.Context) (string, error) {
+	username, ok := ctx.Value(JWTContextKey).(string)
+	if !ok || len(username) == 0 {
+		return "", status.Errorf(codes.Unauthenticated, "invalid auth token")
+	}
+	if isBot(ctx) || !cs.isAdmin(username) {
+		return "", status.Errorf(codes.PermissionDenied, "user: %s is not an admin", username)
+	}
+	return username, nil
+}
+
+// isAdmin reports whether username is one of the admins set by WithAdmins.
+func (cs *chatServiceServer) isAdmin(username string) bool {
+	return slices.Contains(cs.admins, username)
+}
+
+// PostMessage is a method that implements the PostMessage method of the ChatServiceServer interface.
+func (cs *chatServiceServer) PostMessage(ctx context.Context, req *pb.PostMessageRequest) (*pb.PostMessageResponse, error) {
+	username, ok := ctx.Value(JWTContextKey).(string)
+	if !ok || len(username) == 0 {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid auth token")
+	}
+	if err := requireScope(ctx, apikey.ScopeMessagesWrite); err != nil {
+		return nil, err
+	}
+	// A message with a recipient is an encrypted direct message.
+	encrypted := req.GetRecipient() != ""
+	if !encrypted && len(req.GetTextContent()) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "text_content is empty")
+	}
+	if encrypted && len(req.GetTextContent()) != 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "an encrypted message has no text_content")
+	}
+	room := req.GetRoom()
+	if room == "" {
+		room = DefaultRoom
+	}
+	if !roomNameRegexp.MatchString(room) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid room name: %q", room)
+	}
+
+	msg := &pb.Message{
+		Type:      pb.MessageType_MESSAGE_TYPE_NORMAL,
+		Timestamp: time.Now().Unix(),
+		Username:  username,
+		Room:      room,
+		Bot:       isBot(ctx),
+	}
+	if encrypted {
+		if err := cs.checkEncryptedMessage(ctx, username, req.GetRecipient(), req.GetBinaryContent(), req.GetWrappedKeys()); err != nil {
+			return nil, err
+		}
+		msg.Type = pb.MessageType_MESSAGE_TYPE_ENCRYPTED
+		msg.Recipient = req.GetRecipient()
+		msg.BinaryContent = req.GetBinaryContent()
+		msg.WrappedKeys = req.GetWrappedKeys()
+	} else {
+		text, err := cs.checkMessage(username, req.GetTextContent())
+		if err != nil {
+			return nil, err
+		}
+		msg.TextContent = text
+	}
+	// The broadcast routine sets the message number, so hand it a copy.
+	if err := cs.enqueue(ctx, proto.Clone(msg).(*pb.Message)); err != nil {
+		return nil, err
+	}
+
+	return &pb.PostMessageResponse{Message: msg}, nil
+}
+
+// CreateBot is a method that implements the CreateBot method of the ChatServiceServer interface.
+func (cs *chatServiceServer) CreateBot(ctx context.Context, req *pb.CreateBotRequest) (*pb.CreateBotResponse, error) {
+	if _, err := cs.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if len(req.GetName()) < 2 || len(req.GetName()) > 24 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid bot name length")
+	}
+	scopes := req.GetScopes()
+	if len(scopes) == 0 {
+		scopes = []string{apikey.ScopeMessagesWrite}
+	}
+	formattedScopes, err := apikey.FormatScopes(scopes)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	key, err := apikey.Generate()
+	if err != nil {
+		return nil, util.WrapGRPCError(err, codes.Internal, "failed to generate api key")
+	}
+	conn, err := dBConn()
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the bot if it does not exist, in the transaction storing its key so
+	// that a failure leaves no bot without a key behind.
+	var keyID int64
+	err = db.WithTx(ctx, conn, func(tx *sql.Tx) error {
+		user, err := db.GetUserByUsername(ctx, tx, req.GetName())
+		if err != nil {
+			return dbError(err, "failed to check if bot exists")
+		}
+		var userID int64
+		if user == nil {
+			if userID, err = db.InsertBot(ctx, tx, req.GetName()); err != nil {
+				return dbError(err, "failed to create bot")
+			}
+		} else if !user.IsBot {
+			return status.Errorf(codes.AlreadyExists, "user: %s already exists and is not a bot", req.GetName())
+		} else {
+			userID = user.ID
+		}
+
+		if keyID, err = db.InsertAPIKey(ctx, tx, userID, key.DisplayPrefix, key.Hash, formattedScopes); err != nil {
+			return dbError(err, "failed to store api key")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, dbError(err, "failed to create bot")
+	}
+
+	return &pb.CreateBotResponse{
+		ApiKey: key.Plaintext,
+		Key: &pb.APIKey{
+			KeyId:     uint64(keyID),
+			BotName:   req.GetName(),
+			Prefix:    key.DisplayPrefix,
+			Scopes:    scopes,
+			CreatedAt: time.Now().Unix(),
+		},
+	}, nil
+}
+
+// ListAPIKeys is a method that implements the ListAPIKeys method of the ChatServiceServer interface.
+func (cs *chatServiceServer) ListAPIKeys(ctx context.Context, _ *pb.ListAPIKeysRequest) (*pb.ListAPIKeysResponse, error) {
+	if _, err := cs.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	conn, err := dBConn()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := db.ListAPIKeys(ctx, conn)
+	if err != nil {
+		return nil, dbError(err, "failed to list api keys")
+	}
+
+	resp := &pb.ListAPIKeysResponse{Keys: make([]*pb.APIKey, 0, len(keys))}
+	for _, key := range keys {
+		resp.Keys = append(resp.Keys, &pb.APIKey{
+			KeyId:     uint64(key.ID),
+			BotName:   key.BotName,
+			Prefix:    key.Prefix,
+			Scopes:    apikey.ParseScopes(key.Scopes),
+			CreatedAt: key.CreatedAt,
+			RevokedAt: key.RevokedAt,
+		})
+	}
+	return resp, nil
+}
+
+// RevokeAPIKey is a method that implements the RevokeAPIKey method of the ChatServiceServer interface.
+func (cs *chatServiceServer) RevokeAPIKey(ctx context.Context, req *pb.RevokeAPIKeyRequest) (*pb.RevokeAPIKeyResponse, error) {
+	admin, err := cs.requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dBConn()
+	if err != nil {
+		return nil, err
+	}
+	revoked, err := db.RevokeAPIKey(ctx, conn, int64(req.GetKeyId()))
+	if err != nil {
+		return nil, dbError(err, "failed to revoke api key")
+	}
+	if !revoked {
+		return nil, status.Errorf(codes.NotFound, "active api key: %d not found", req.GetKeyId())
+	}
+	cs.publish(newEvent(pb.EventType_EVENT_TYPE_MODERATION, "", admin, fmt.Sprintf("revoked api key %d", req.GetKeyId())))
+	return &pb.RevokeAPIKeyResponse{}, nil
+}
@@ -0,0 +1,249 @@
+//go:build unit_test
+
+package logic
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/apikey"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// botContext returns a context of a bot authenticated by an API key with scopes.
+func botContext(name string, scopes ...string) context.Context {
+	ctx := context.WithValue(context.Background(), JWTContextKey, name)
+	return context.WithValue(ctx, apiKeyContextKey, &apiKeyIdentity{keyID: 1, scopes: scopes})
+}
+
+func TestAuthAPIKey(t *testing.T) {
+	require := require.New(t)
+
+	db, mock := mockDB()
+	defer db.Close()
+	dbConn.Store(db)
+	defer func() { dbConn.Store(nil) }()
+
+	key, err := apikey.Generate()
+	require.NoError(err)
+	mock.ExpectQuery("SELECT .* FROM api_keys").
+		WithArgs(key.Hash).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "username", "prefix", "scopes", "created_at"}).
+			AddRow(3, 7, "ci-bot", key.DisplayPrefix, "messages:write", 1723680000))
+	mock.ExpectQuery("SELECT .* FROM api_keys").
+		WithArgs(apikey.Hash("gcb_revoked")).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	ctx, err := AuthAPIKey(context.Background(), key.Plaintext)
+	require.NoError(err)
+	require.Equal("ci-bot", ctx.Value(JWTContextKey))
+	require.True(isBot(ctx))
+	require.NoError(requireScope(ctx, apikey.ScopeMessagesWrite))
+	require.Equal(codes.PermissionDenied, status.Code(requireScope(ctx, apikey.ScopeMessagesRead)))
+
+	_, err = AuthAPIKey(context.Background(), "gcb_revoked")
+	require.Equal(status.Errorf(codes.Unauthenticated, "invalid or revoked api key"), err)
+
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestPostMessage(t *testing.T) {
+	tests := []struct {
+		name          string
+		ctx           context.Context
+		req           *pb.PostMessageRequest
+		expectedRoom  string
+		expectedBot   bool
+		expectedError error
+	}{
+		{
+			name:         "bot with write scope",
+			ctx:          botContext("ci-bot", apikey.ScopeMessagesWrite),
+			req:          &pb.PostMessageRequest{TextContent: "build passed"},
+			expectedRoom: DefaultRoom,
+			expectedBot:  true,
+		},
+		{
+			name:         "user to another room",
+			ctx:          context.WithValue(context.Background(), JWTContextKey, "alice"),
+			req:          &pb.PostMessageRequest{TextContent: "hi", Room: "random"},
+			expectedRoom: "random",
+			expectedBot:  false,
+		},
+		{
+			name:          "bot without write scope",
+			ctx:           botContext("ci-bot", apikey.ScopeMessagesRead),
+			req:           &pb.PostMessageRequest{TextContent: "build passed"},
+			expectedError: status.Errorf(codes.PermissionDenied, "api key lacks the %q scope", apikey.ScopeMessagesWrite),
+		},
+		{
+			name:          "empty text",
+			ctx:           botContext("ci-bot", apikey.ScopeMessagesWrite),
+			req:           &pb.PostMessageRequest{},
+			expectedError: status.Errorf(codes.InvalidArgument, "text_content is empty"),
+		},
+		{
+			name:          "invalid room",
+			ctx:           botContext("ci-bot", apikey.ScopeMessagesWrite),
+			req:           &pb.PostMessageRequest{TextContent: "hi", Room: "no spaces"},
+			expectedError: status.Errorf(codes.InvalidArgument, "invalid room name: %q", "no spaces"),
+		},
+		{
+			name:          "invalid auth token",
+			ctx:           context.Background(),
+			req:           &pb.PostMessageRequest{TextContent: "hi"},
+			expectedError: status.Errorf(codes.Unauthenticated, "invalid auth token"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			cs := newCommandTestServer()
+
+			resp, err := cs.PostMessage(tt.ctx, tt.req)
+			if tt.expectedError != nil {
+				require.Equal(tt.expectedError, err)
+				require.Empty(cs.receiveChan)
+				return
+			}
+			require.NoError(err)
+			msg := (<-cs.receiveChan).msg
+			require.Equal(tt.expectedRoom, msg.GetRoom())
+			require.Equal(tt.expectedBot, msg.GetBot())
+			require.Equal(tt.req.GetTextContent(), msg.GetTextContent())
+			require.Equal(msg.GetTimestamp(), resp.GetMessage().GetTimestamp())
+		})
+	}
+}
+
+func TestCreateBot(t *testing.T) {
+	adminCtx := context.WithValue(context.Background(), JWTContextKey, "admin")
+
+	tests := []struct {
+		name          string
+		ctx           context.Context
+		req           *pb.CreateBotRequest
+		mockSetup     func(mock sqlmock.Sqlmock)
+		expectedError error
+	}{
+		{
+			name: "new bot",
+			ctx:  adminCtx,
+			req:  &pb.CreateBotRequest{Name: "ci-bot"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id, username, password_hash, is_bot FROM users WHERE username = ?").
+					WithArgs("ci-bot").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password_hash", "is_bot"}))
+				mock.ExpectExec("INSERT INTO users").
+					WithArgs("ci-bot").
+					WillReturnResult(sqlmock.NewResult(7, 1))
+				mock.ExpectExec("INSERT INTO api_keys").
+					WithArgs(7, sqlmock.AnyArg(), sqlmock.AnyArg(), apikey.ScopeMessagesWrite).
+					WillReturnResult(sqlmock.NewResult(3, 1))
+				mock.ExpectCommit()
+			},
+		},
+		{
+			name: "the bot is not created without its key",
+			ctx:  adminCtx,
+			req:  &pb.CreateBotRequest{Name: "ci-bot"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id, username, password_hash, is_bot FROM users WHERE username = ?").
+					WithArgs("ci-bot").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password_hash", "is_bot"}))
+				mock.ExpectExec("INSERT INTO users").
+					WithArgs("ci-bot").
+					WillReturnResult(sqlmock.NewResult(7, 1))
+				mock.ExpectExec("INSERT INTO api_keys").
+					WillReturnError(errors.New("disk full"))
+				mock.ExpectRollback()
+			},
+			expectedError: status.Errorf(codes.Internal, "failed to store api key: failed to insert api key to database: disk full"),
+		},
+		{
+			name: "name taken by a user",
+			ctx:  adminCtx,
+			req:  &pb.CreateBotRequest{Name: "alice"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectQuery("SELECT id, username, password_hash, is_bot FROM users WHERE username = ?").
+					WithArgs("alice").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password_hash", "is_bot"}).
+						AddRow(1, "alice", "hash", false))
+				mock.ExpectRollback()
+			},
+			expectedError: status.Errorf(codes.AlreadyExists, "user: %s already exists and is not a bot", "alice"),
+		},
+		{
+			name:          "unknown scope",
+			ctx:           adminCtx,
+			req:           &pb.CreateBotRequest{Name: "ci-bot", Scopes: []string{"admin"}},
+			mockSetup:     func(mock sqlmock.Sqlmock) {},
+			expectedError: status.Errorf(codes.InvalidArgument, "unknown scope: %q", "admin"),
+		},
+		{
+			name:          "not an admin",
+			ctx:           context.WithValue(context.Background(), JWTContextKey, "alice"),
+			req:           &pb.CreateBotRequest{Name: "ci-bot"},
+			mockSetup:     func(mock sqlmock.Sqlmock) {},
+			expectedError: status.Errorf(codes.PermissionDenied, "user: %s is not an admin", "alice"),
+		},
+		{
+			name:          "bots are never admins",
+			ctx:           botContext("admin", apikey.AllScopes...),
+			req:           &pb.CreateBotRequest{Name: "ci-bot"},
+			mockSetup:     func(mock sqlmock.Sqlmock) {},
+			expectedError: status.Errorf(codes.PermissionDenied, "user: %s is not an admin", "admin"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			db, mock := mockDB()
+			defer db.Close()
+			dbConn.Store(db)
+			defer func() { dbConn.Store(nil) }()
+			tt.mockSetup(mock)
+
+			cs := newCommandTestServer()
+			resp, err := cs.CreateBot(tt.ctx, tt.req)
+			if tt.expectedError != nil {
+				require.Equal(tt.expectedError, err)
+			} else {
+				require.NoError(err)
+				require.True(apikey.IsAPIKey(resp.GetApiKey()))
+				require.Equal(uint64(3), resp.GetKey().GetKeyId())
+				require.Equal([]string{apikey.ScopeMessagesWrite}, resp.GetKey().GetScopes())
+			}
+			require.NoError(mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestRevokeAPIKey(t *testing.T) {
+	require := require.New(t)
+
+	db, mock := mockDB()
+	defer db.Close()
+	dbConn.Store(db)
+	defer func() { dbConn.Store(nil) }()
+	mock.ExpectExec("UPDATE api_keys").WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE api_keys").WithArgs(4).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	cs := newCommandTestServer()
+	ctx := context.WithValue(context.Background(), JWTContextKey, "admin")
+	_, err := cs.RevokeAPIKey(ctx, &pb.RevokeAPIKeyRequest{KeyId: 3})
+	require.NoError(err)
+	_, err = cs.RevokeAPIKey(ctx, &pb.RevokeAPIKeyRequest{KeyId: 4})
+	require.Equal(status.Errorf(codes.NotFound, "active api key: %d not found", 4), err)
+	require.NoError(mock.ExpectationsWereMet())
+}
@@ -2,61 +2,112 @@ package logic
 
 import (
 	"context"
-	"database/sql"
+	"crypto/rand"
+	"encoding/hex"
 	"io"
-	"log"
+	"log/slog"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
 	"github.com/zjy-dev/grpc-go-chatroom/internal/config"
 	"github.com/zjy-dev/grpc-go-chatroom/internal/db"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/health"
 	"github.com/zjy-dev/grpc-go-chatroom/internal/jwt"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/tlsutil"
 	"github.com/zjy-dev/grpc-go-chatroom/internal/util"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/webhook"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
-var (
-	JWTContextKey         = &jwtContext{}
-	dbConn        *sql.DB = nil
-)
-
-func dBConn() *sql.DB {
-	if dbConn == nil {
-		dbConn = db.MustConnect(config.Mysql.User, config.Mysql.Password, config.Mysql.Host, config.Mysql.Port, config.Mysql.DBName)
-	}
-	return dbConn
-}
+var JWTContextKey = &jwtContext{}
 
 type jwtContext struct{}
 
+// SessionContextKey holds the ID of the login session of the JWT token of a request.
+var SessionContextKey = &sessionContext{}
+
+type sessionContext struct{}
+
 // chatServiceServer is a struct that implements the chatServiceServer interface.
 type chatServiceServer struct {
 	pb.UnimplementedChatServiceServer
 
-	clientsMap  map[string]client // username -> client struct
-	receiveChan chan *pb.Message  // receive messages from clients, handled by broadcast routine
-	mu          sync.Mutex        // mu guards the clientsMap
+	clientsMap  map[string]client    // username -> client struct
+	topics      map[string]string    // room -> topic
+	revoked     map[string]time.Time // session ID -> when its token expires, for logged out and kicked sessions
+	receiveChan chan queuedMessage   // receive messages from clients, handled by broadcast routine
+	mu          sync.Mutex           // mu guards the clientsMap, topics and revoked
+	commands    *commandRegistry     // slash commands typed in the chat stream
+	webhooks    *webhook.Dispatcher  // delivers events to webhooks, nil if disabled
+	events      eventHub             // delivers events to Subscribe streams
+	admins      []string             // usernames allowed to call admin RPCs
+
+	reloader  *config.Reloader                       // reloads the runtime settings, nil if disabled
+	settings  atomic.Pointer[messageSettings]        // nil until a config is applied
+	limiter   userLimiter                            // rate limits the messages of every user
+	retention atomic.Pointer[config.RetentionConfig] // nil until a config is applied
+	metrics   *serverMetrics
+
+	authors     authorCache     // user IDs and display names of the senders of messages
+	broadcaster broadcastState  // liveness of the broadcast routine
+	database    dbState         // whether the database is reachable
+	health      *health.Checker // nil if the health is not reported
+	startTime   time.Time
 }
 
 type client struct {
 	messageChan chan *pb.Message
+	room        string // the room the client is currently in
+	displayName string // set by `/nick`, empty means username
+	session     string // the login session of the user's token, empty for certificates
 }
 
-func NewChatServiceServer() *chatServiceServer {
+func NewChatServiceServer(opts ...ServerOption) *chatServiceServer {
 	server := &chatServiceServer{
 		clientsMap:  make(map[string]client, 64),
-		receiveChan: make(chan *pb.Message, 1024),
+		topics:      make(map[string]string),
+		revoked:     make(map[string]time.Time),
+		receiveChan: make(chan queuedMessage, 1024),
 		mu:          sync.Mutex{},
+		commands:    newCommandRegistry(),
+		metrics:     newServerMetrics(),
+		startTime:   time.Now(),
 	}
+	for _, opt := range opts {
+		opt(server)
+	}
+	server.registerBuiltinCommands()
+	server.broadcaster.running.Store(true)
 	go server.Broadcast()
 	return server
 }
 
 // LogInOrRegister is a method that implements the LogInOrRegister method of the ChatServiceServer interface.
 func (cs *chatServiceServer) LogInOrRegister(ctx context.Context, req *pb.LogInOrRegisterRequest) (*pb.LogInOrRegisterResponse, error) {
-	if len(req.GetUsername()) < 2 || len(req.GetUsername()) > 24 || len(req.GetPassword()) < 3 || len(req.GetPassword()) > 25 {
+	resp, err := cs.logInOrRegister(ctx, req)
+	cs.metrics.logins.With(loginResult(err)).Inc()
+	return resp, err
+}
+
+func (cs *chatServiceServer) logInOrRegister(ctx context.Context, req *pb.LogInOrRegisterRequest) (*pb.LogInOrRegisterResponse, error) {
+	username := req.GetUsername()
+	// Users with a verified client certificate log in as its common name, without a password.
+	identity, byCert := tlsutil.PeerIdentity(ctx)
+	if byCert {
+		if username != "" && username != identity {
+			return nil, status.Errorf(codes.PermissionDenied, "the client certificate belongs to user: %s", identity)
+		}
+		username = identity
+	}
+	if len(username) < 2 || len(username) > 24 || (!byCert && (len(req.GetPassword()) < 3 || len(req.GetPassword()) > 25)) {
 		return nil, status.Errorf(codes.InvalidArgument, "invalid username or password length")
 	}
 
@@ -65,51 +116,85 @@ func (cs *chatServiceServer) LogInOrRegister(ctx context.Context, req *pb.LogInO
 	defer cs.mu.Unlock()
 
 	// Check if the user has already logged in.
-	if _, ok := cs.clientsMap[req.GetUsername()]; ok {
-		return nil, status.Errorf(codes.AlreadyExists, "user: %s has already logged in", req.GetUsername())
+	if _, ok := cs.clientsMap[username]; ok {
+		return nil, status.Errorf(codes.AlreadyExists, "user: %s has already logged in", username)
 	}
 
 	// Check if the user has registered.
-	userRegisterd, err := db.UserExistsByName(dBConn(), req.GetUsername())
+	conn, err := dBConn()
+	if err != nil {
+		return nil, err
+	}
+	user, err := db.GetUserByUsername(ctx, conn, username)
 	if err != nil {
-		return nil, util.WrapGRPCError(err, codes.Internal, "failed to check if user exists")
+		return nil, dbError(err, "failed to check if user exists")
 	}
 
-	if !userRegisterd {
+	if user == nil {
+		password := req.GetPassword()
+		if byCert {
+			// Nobody knows the password of users registered by certificates.
+			password = randomPassword()
+		}
 		// Insert the user into the database.
-		hashedPwd, err := util.HashPassword(req.GetPassword())
+		hashedPwd, err := util.HashPassword(password)
 		if err != nil {
 			return nil, util.WrapGRPCError(err, codes.Internal, "failed to hash password")
 		}
-		if _, err := db.InsertUser(dBConn(), req.GetUsername(), hashedPwd); err != nil {
-			return nil, util.WrapGRPCError(err, codes.Internal, "failed to register user")
+		// The unique username lets only one of concurrent registrations of a name,
+		// e.g. on other replicas, insert it.
+		if _, err := db.InsertUser(ctx, conn, username, hashedPwd); err != nil {
+			if db.IsDuplicateKey(err) {
+				return nil, status.Errorf(codes.AlreadyExists, "user: %s has just been registered by another request, please log in again", username)
+			}
+			return nil, dbError(err, "failed to register user")
 		}
 	} else {
-		// User Registered
-		// Check password
-		user, err := db.GetUserByUsername(dBConn(), req.GetUsername())
-		if err != nil {
-			return nil, util.WrapGRPCError(err, codes.Internal, "failed to check password")
+		// Bots have no password
+		if user.IsBot {
+			return nil, status.Errorf(codes.PermissionDenied, "user: %s is a bot, use an api key instead", username)
+		}
+		// Imported users have no password, see InsertImportedUser.
+		if !byCert && user.PasswordHash == "" {
+			return nil, status.Errorf(codes.PermissionDenied, "user: %s was imported without a password, log in with a client certificate", username)
 		}
 
 		// Check password
-		if !util.CheckPasswordHash(req.GetPassword(), user.PasswordHash) {
+		if !byCert && !util.CheckPasswordHash(req.GetPassword(), user.PasswordHash) {
 			return nil, status.Errorf(codes.Unauthenticated, "incorrect password")
 		}
 	}
 
-	// Generate a JWT token for the user.
-	token, err := jwt.GenerateJwt(req.GetUsername())
+	// Generate a JWT token for the user. Every login is a session of its own, which
+	// LogOut and /kick revoke.
+	session := newSessionID()
+	token, err := jwt.GenerateJwt(username, session)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to generate jwt: %v", err)
 	}
 
 	// Add the user to the clientsMap.
-	cs.clientsMap[req.GetUsername()] = client{}
+	cs.clientsMap[username] = client{session: session}
 
 	return &pb.LogInOrRegisterResponse{Token: token}, nil
 }
 
+// randomPassword returns a password nobody can guess.
+func randomPassword() string {
+	password := make([]byte, 24)
+	// crypto/rand.Read never returns an error on supported platforms.
+	rand.Read(password)
+	return hex.EncodeToString(password)
+}
+
+// newSessionID returns a random ID of a login session.
+func newSessionID() string {
+	id := make([]byte, 16)
+	// crypto/rand.Read never returns an error on supported platforms.
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
 // LogOut is a method that implements the LogOut method of the ChatServiceServer interface.
 func (cs *chatServiceServer) LogOut(ctx context.Context, _ *pb.LogOutRequest) (*pb.LogOutResponse, error) {
 	// Get the username from the context.
@@ -118,22 +203,53 @@ func (cs *chatServiceServer) LogOut(ctx context.Context, _ *pb.LogOutRequest) (*
 		return &pb.LogOutResponse{}, status.Errorf(codes.Unauthenticated, "invalid auth token")
 	}
 	cs.mu.Lock()
-	defer cs.mu.Unlock()
+	// The token can not open chat streams anymore, even if the server forgot the
+	// login, e.g. after a restart.
+	session, _ := ctx.Value(SessionContextKey).(string)
+	cs.revokeLocked(session)
 	// Check if the user exists in the clientsMap.
 	cli, ok := cs.clientsMap[username]
 	if !ok {
+		cs.mu.Unlock()
 		return &pb.LogOutResponse{}, status.Errorf(codes.NotFound, "user: %s not found", username)
 	}
+	cs.revokeLocked(cli.session)
 
 	// Remove the user from the clientsMap.
-	// NOTE: Close the messageChan of the user. Otherwise goroutine will block forever.
+	// NOTE: Closing the messageChan of the user ends the user's Chat stream.
+	cs.removeClientLocked(username)
+	cs.mu.Unlock()
+
 	if cli.messageChan != nil {
-		close(cli.messageChan)
+		cs.publish(newEvent(pb.EventType_EVENT_TYPE_USER_LEAVE, cli.room, username, "logged out"))
 	}
-	delete(cs.clientsMap, username)
 	return &pb.LogOutResponse{}, nil
 }
 
+// WhoAmI is a method that implements the WhoAmI method of the ChatServiceServer interface.
+func (cs *chatServiceServer) WhoAmI(ctx context.Context, _ *pb.WhoAmIRequest) (*pb.WhoAmIResponse, error) {
+	username, ok := ctx.Value(JWTContextKey).(string)
+	if !ok || len(username) == 0 {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid auth token")
+	}
+	resp := &pb.WhoAmIResponse{Username: username}
+	if identity, ok := ctx.Value(apiKeyContextKey).(*apiKeyIdentity); ok {
+		resp.Bot, resp.Scopes = true, identity.scopes
+	} else {
+		resp.Admin = cs.isAdmin(username)
+	}
+
+	cs.mu.Lock()
+	if cli, ok := cs.clientsMap[username]; ok {
+		resp.DisplayName = cli.displayName
+		if cli.messageChan != nil {
+			resp.Online, resp.Room = true, cli.room
+		}
+	}
+	cs.mu.Unlock()
+	return resp, nil
+}
+
 // Chat is a method that implements the Chat method of the ChatServiceServer interface.
 func (cs *chatServiceServer) Chat(stream pb.ChatService_ChatServer) error {
 	// Get the username from the context.
@@ -141,86 +257,371 @@ func (cs *chatServiceServer) Chat(stream pb.ChatService_ChatServer) error {
 	if !ok || len(username) == 0 {
 		return status.Errorf(codes.Unauthenticated, "invalid auth token")
 	}
+	session, _ := stream.Context().Value(SessionContextKey).(string)
 	cs.mu.Lock()
 
-	// Check if the user exists in the clientsMap.
-	if _, ok := cs.clientsMap[username]; !ok {
+	// A valid token resumes the session of a user whose stream dropped, or who logged
+	// in before the server restarted, so that clients can reconnect without logging
+	// in again, unless the session was logged out or kicked. Bots never log in.
+	if cs.revokedLocked(session) {
+		cs.mu.Unlock()
+		return status.Errorf(codes.Unauthenticated, "the session has ended, please log in again")
+	}
+	oldCli, ok := cs.clientsMap[username]
+	if !ok && isBot(stream.Context()) {
 		cs.mu.Unlock()
 		return status.Errorf(codes.NotFound, "user: %s has not logged in, please log in first", username)
 	}
+	// The token of an older login can not take over the current one.
+	if session != "" && oldCli.session != "" && session != oldCli.session {
+		cs.mu.Unlock()
+		return status.Errorf(codes.Unauthenticated, "the token belongs to an older session, please log in again")
+	}
+	if session == "" {
+		session = oldCli.session
+	}
+	// The user reconnected before the previous stream was noticed to be gone,
+	// closing its messageChan ends it.
+	if oldCli.messageChan != nil {
+		close(oldCli.messageChan)
+	}
 
-	// Add the user(stream) to the clientsMap.
-	// TODO
-	cliMessageChan := make(chan *pb.Message, 1<<3)
-	cs.clientsMap[username] = client{messageChan: cliMessageChan}
+	// Add the user(stream) to the clientsMap, keeping the nickname of a resumed session.
+	cliMessageChan := make(chan *pb.Message, clientQueueSize)
+	cs.clientsMap[username] = client{messageChan: cliMessageChan, room: DefaultRoom, displayName: oldCli.displayName, session: session}
 	cs.mu.Unlock()
+	if oldCli.messageChan != nil {
+		cs.publish(newEvent(pb.EventType_EVENT_TYPE_USER_LEAVE, oldCli.room, username, "reconnected"))
+	}
+	cs.publish(newEvent(pb.EventType_EVENT_TYPE_USER_JOIN, DefaultRoom, username, ""))
+	// Send the header right away, so that clients know they joined before any message arrives.
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		slog.WarnContext(stream.Context(), "failed to send header to client", "error", err)
+	}
 
+	// Receive in another goroutine, so that the stream ends as soon as
+	// cliMessageChan is closed by LogOut or /kick.
+	recvErrChan := make(chan error, 1)
 	go func() {
-		// TODO
-		// cliMessageChan must be closed after logout
-		for msg := range cliMessageChan {
+		recvErrChan <- cs.receive(stream, username)
+	}()
+
+	for {
+		select {
+		case msg, ok := <-cliMessageChan:
+			if !ok {
+				return cs.streamClosed(username)
+			}
 			if err := stream.Send(&pb.ChatResponse{Message: msg}); err != nil {
-				log.Printf("failed to send message to client: %v\n", err)
+				slog.WarnContext(stream.Context(), "failed to send message to client", "error", err)
+			}
+		case err := <-recvErrChan:
+			cs.mu.Lock()
+			cli, removed := cs.removeStreamLocked(username, cliMessageChan)
+			cs.mu.Unlock()
+			if removed {
+				cs.publish(newEvent(pb.EventType_EVENT_TYPE_USER_LEAVE, cli.room, username, ""))
 			}
+			return err
 		}
-	}()
+	}
+}
 
+// receive receives messages from the client of username until the stream ends,
+// it returns nil if the client closed the stream.
+func (cs *chatServiceServer) receive(stream pb.ChatService_ChatServer, username string) error {
 	for {
 		// Receive message from client
 		req, err := stream.Recv()
 
-		// TODO: Support other type of messages, currently only support text message
+		// Clients send text and encrypted messages only.
 		// Check if the request is valid
-		reqNotValid := req == nil || req.GetMessage() == nil || (req.GetMessage().GetType() != pb.MessageType_MESSAGE_TYPE_NORMAL)
+		reqNotValid := req == nil || req.GetMessage() == nil || (req.GetMessage().GetType() != pb.MessageType_MESSAGE_TYPE_NORMAL &&
+			req.GetMessage().GetType() != pb.MessageType_MESSAGE_TYPE_ENCRYPTED)
 		if reqNotValid && err != io.EOF {
-			cs.mu.Lock()
-			if cliMessageChan != nil {
-				close(cliMessageChan)
-			}
-			delete(cs.clientsMap, username)
-			cs.mu.Unlock()
 			return status.Errorf(codes.InvalidArgument, "empty request or invalid message type")
 		}
 		if err != nil {
-			cs.mu.Lock()
-			if cliMessageChan != nil {
-				close(cliMessageChan)
-			}
-			delete(cs.clientsMap, username)
-			cs.mu.Unlock()
 			if err == io.EOF {
 				return nil
 			}
 			return status.Errorf(codes.Internal, "failed to receive message from client: %v", err)
 		}
 
-		// Send message to broadcast routine
-		msg := req.GetMessage()
-		msg.Timestamp = time.Now().Unix()
-		msg.Username = username
-		cs.receiveChan <- msg
+		cs.handleMessage(stream.Context(), username, req.GetMessage())
+	}
+}
+
+// handleMessage checks a message received from the client of username, and runs
+// it if it is a command or hands it to the broadcast routine otherwise.
+func (cs *chatServiceServer) handleMessage(ctx context.Context, username string, msg *pb.Message) {
+	ctx, span := tracer.Start(ctx, "chat.receive")
+	defer span.End()
+
+	if msg.GetType() == pb.MessageType_MESSAGE_TYPE_ENCRYPTED {
+		cs.handleEncryptedMessage(ctx, username, msg)
+		return
+	}
+	text, err := cs.checkMessage(username, msg.GetTextContent())
+	if err != nil {
+		span.SetStatus(otelcodes.Error, err.Error())
+		cs.systemReply(username, "error: "+status.Convert(err).Message())
+		return
+	}
+	msg.TextContent = text
+
+	// Slash commands are handled here and never broadcast.
+	if strings.HasPrefix(msg.GetTextContent(), commandPrefix) {
+		span.SetAttributes(attribute.Bool("chat.command", true))
+		cs.runCommand(username, msg.GetTextContent())
+		return
+	}
+
+	// Send message to broadcast routine
+	cs.mu.Lock()
+	cli := cs.clientsMap[username]
+	cs.mu.Unlock()
+	msg.Timestamp = time.Now().Unix()
+	msg.Username = username
+	msg.Room = cli.room
+	msg.DisplayName = cli.displayName
+	msg.Recipient = ""
+	span.SetAttributes(attribute.String("chat.room", msg.GetRoom()))
+	if err := cs.enqueue(ctx, msg); err != nil {
+		span.SetStatus(otelcodes.Error, err.Error())
+		cs.systemReply(username, "error: "+status.Convert(err).Message())
+	}
+}
+
+// handleEncryptedMessage checks an encrypted message received from the client of
+// username, and hands it to the broadcast routine as it is.
+func (cs *chatServiceServer) handleEncryptedMessage(ctx context.Context, username string, msg *pb.Message) {
+	span := trace.SpanFromContext(ctx)
+	if err := cs.checkEncryptedMessage(ctx, username, msg.GetRecipient(), msg.GetBinaryContent(), msg.GetWrappedKeys()); err != nil {
+		span.SetStatus(otelcodes.Error, err.Error())
+		cs.systemReply(username, "error: "+status.Convert(err).Message())
+		return
+	}
+
+	cs.mu.Lock()
+	cli := cs.clientsMap[username]
+	cs.mu.Unlock()
+	msg.Timestamp = time.Now().Unix()
+	msg.Username = username
+	msg.Room = cli.room
+	msg.DisplayName = cli.displayName
+	msg.TextContent = ""
+	span.SetAttributes(attribute.String("chat.room", msg.GetRoom()))
+	if err := cs.enqueue(ctx, msg); err != nil {
+		span.SetStatus(otelcodes.Error, err.Error())
+		cs.systemReply(username, "error: "+status.Convert(err).Message())
+	}
+}
+
+// removeClientLocked removes username from the clientsMap, closing the message
+// channel of its stream if any, and returns the removed client.
+// NOTE: The caller must hold cs.mu.
+func (cs *chatServiceServer) removeClientLocked(username string) (client, bool) {
+	cli, ok := cs.clientsMap[username]
+	if !ok {
+		return client{}, false
+	}
+	if cli.messageChan != nil {
+		close(cli.messageChan)
+	}
+	delete(cs.clientsMap, username)
+	return cli, true
+}
+
+// removeStreamLocked removes username from the clientsMap only if messageChan still
+// belongs to its current stream, i.e. the user has not logged out, been kicked or
+// opened another stream in the meantime.
+// NOTE: The caller must hold cs.mu.
+func (cs *chatServiceServer) removeStreamLocked(username string, messageChan chan *pb.Message) (client, bool) {
+	if cs.clientsMap[username].messageChan != messageChan {
+		return client{}, false
+	}
+	return cs.removeClientLocked(username)
+}
+
+// revokeLocked ends session, whose token is rejected by every RPC until it
+// expires, see CheckSession. Sessions whose tokens expired are forgotten.
+// NOTE: The caller must hold cs.mu.
+func (cs *chatServiceServer) revokeLocked(session string) {
+	if session == "" {
+		return
+	}
+	now := time.Now()
+	for id, expiry := range cs.revoked {
+		if now.After(expiry) {
+			delete(cs.revoked, id)
+		}
+	}
+	if cs.revoked == nil {
+		cs.revoked = make(map[string]time.Time)
+	}
+	cs.revoked[session] = now.Add(jwt.TokenLifetime)
+}
+
+// CheckSession returns an Unauthenticated error if session was logged out or kicked.
+// The authentication of every RPC calls it for the session of the caller's token.
+// Revoked sessions are kept in memory, so a restart lets their tokens work again
+// until they expire.
+func (cs *chatServiceServer) CheckSession(session string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.revokedLocked(session) {
+		return status.Errorf(codes.Unauthenticated, "the session has ended, please log in again")
+	}
+	return nil
+}
+
+// revokedLocked reports whether session was logged out or kicked.
+// NOTE: The caller must hold cs.mu.
+func (cs *chatServiceServer) revokedLocked(session string) bool {
+	_, ok := cs.revoked[session]
+	return session != "" && ok
+}
+
+// storeMessage inserts msg written by the user of userID, and returns its message number.
+func storeMessage(ctx context.Context, userID int64, msg *pb.Message) (int64, error) {
+	conn, err := dBConn()
+	if err != nil {
+		return 0, err
+	}
+	if msg.GetType() == pb.MessageType_MESSAGE_TYPE_ENCRYPTED {
+		return db.InsertEncryptedMessage(ctx, conn, userID, msg)
 	}
+	return db.InsertMessage(ctx, conn, userID, msg)
 }
 
 // Broadcast broadcasts messages to all the clients(Fan-out).
 // msg from receiveChan already specified timestamp and username if exists
 func (cs *chatServiceServer) Broadcast() {
+	cs.broadcaster.running.Store(true)
+	defer cs.broadcaster.running.Store(false)
+	for queued := range cs.receiveChan {
+		cs.broadcaster.busySince.Store(time.Now().UnixNano())
+		cs.broadcast(queued)
+		cs.broadcaster.busySince.Store(0)
+	}
+}
 
-	for msg := range cs.receiveChan {
-		id, err := db.InsertMessage(dBConn(), 42, msg.Username, msg.TextContent)
-		if err != nil || id == 0 {
-			log.Printf("failed to insert message: %v\n", err)
-			continue
+// broadcast stores a message and delivers it to its recipients. Its span is linked
+// to the span that queued the message, which may have ended already.
+func (cs *chatServiceServer) broadcast(queued queuedMessage) {
+	msg := queued.msg
+	ctx, span := tracer.Start(context.Background(), "chat.broadcast",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithLinks(trace.Link{SpanContext: queued.span}),
+		trace.WithAttributes(attribute.String("chat.room", msg.GetRoom()), attribute.String("chat.message_type", msg.GetType().String())))
+	defer span.End()
+
+	// Messages are stored with the ID of their author, and carry the display name
+	// of the author's profile unless it was set by `/nick`.
+	author, err := cs.resolveAuthor(ctx, msg.GetUsername())
+	var id int64
+	if err == nil {
+		if msg.GetDisplayName() == "" {
+			msg.DisplayName = author.displayName
 		}
-		msg.MessageNumber = uint64(id)
-		cs.mu.Lock()
+		id, err = storeMessage(ctx, author.id, msg)
+	}
+	cs.database.record(err)
+	if err != nil || id == 0 {
+		span.SetStatus(otelcodes.Error, "failed to insert message")
+		slog.ErrorContext(ctx, "failed to insert message", "error", err)
+		return
+	}
+	msg.MessageNumber = uint64(id)
+	// Private and encrypted messages are not shared with webhooks or subscribers.
+	if !isDirectMessage(msg) {
+		evt := newEvent(pb.EventType_EVENT_TYPE_MESSAGE, msg.GetRoom(), msg.GetUsername(), "")
+		evt.Message = msg
+		cs.publish(evt)
+	}
+	start := time.Now()
+	_, fanOut := tracer.Start(ctx, "chat.fan_out")
+	cs.mu.Lock()
 
-		for username, cli := range cs.clientsMap {
-			if username == msg.Username {
-				continue
-			}
-			cli.messageChan <- msg
+	recipients := 0
+	for username, cli := range cs.clientsMap {
+		if !shouldDeliver(msg, username, cli) {
+			continue
 		}
-		cs.mu.Unlock()
+		cs.metrics.clientQueue.Observe(float64(len(cli.messageChan)))
+		if cs.deliverLocked(username, cli, msg) {
+			recipients++
+		}
+	}
+	cs.mu.Unlock()
+	fanOut.SetAttributes(attribute.Int("chat.recipients", recipients))
+	fanOut.End()
+	cs.metrics.fanOut.Observe(time.Since(start).Seconds())
+}
+
+// shouldDeliver reports whether msg should be delivered to the client of username.
+// Private and encrypted messages only go to their recipient, others go to everyone
+// in the same room except the sender of a normal message, who already has it locally.
+func shouldDeliver(msg *pb.Message, username string, cli client) bool {
+	// The client has logged in but not opened a Chat stream yet.
+	if cli.messageChan == nil {
+		return false
+	}
+	if isDirectMessage(msg) {
+		return username == msg.GetRecipient()
+	}
+	if msg.GetType() == pb.MessageType_MESSAGE_TYPE_NORMAL && username == msg.GetUsername() {
+		return false
+	}
+	return cli.room == msg.GetRoom()
+}
+
+// isDirectMessage reports whether msg is a private or encrypted message to a single recipient.
+func isDirectMessage(msg *pb.Message) bool {
+	return msg.GetType() == pb.MessageType_MESSAGE_TYPE_PRIVATE || msg.GetType() == pb.MessageType_MESSAGE_TYPE_ENCRYPTED
+}
+
+// sendTo sends msg to the Chat stream of username only, without persisting it.
+// It returns false if the user has no open stream or it is too slow, see deliverLocked.
+// NOTE: The caller must hold cs.mu.
+func (cs *chatServiceServer) sendTo(username string, msg *pb.Message) bool {
+	cli, ok := cs.clientsMap[username]
+	if !ok || cli.messageChan == nil {
+		return false
+	}
+	return cs.deliverLocked(username, cli, msg)
+}
+
+// deliverLocked queues msg for the stream of cli without blocking, so that a slow
+// client never blocks cs.mu. The stream of a client whose queue is full is closed
+// instead, and the user stays logged in to reconnect and catch up from the history.
+// NOTE: The caller must hold cs.mu.
+func (cs *chatServiceServer) deliverLocked(username string, cli client, msg *pb.Message) bool {
+	select {
+	case cli.messageChan <- msg:
+		return true
+	default:
+	}
+	close(cli.messageChan)
+	cli.messageChan = nil
+	cs.clientsMap[username] = cli
+	cs.metrics.slowClients.Inc()
+	return false
+}
+
+// streamClosed returns the error ending the Chat stream of username, whose message
+// channel was closed by LogOut, /kick, another stream of the user or deliverLocked.
+func (cs *chatServiceServer) streamClosed(username string) error {
+	cs.mu.Lock()
+	cli, ok := cs.clientsMap[username]
+	cs.mu.Unlock()
+	if !ok {
+		return status.Errorf(codes.Aborted, "user: %s has logged out or been kicked", username)
+	}
+	if cli.messageChan != nil {
+		return status.Errorf(codes.Aborted, "user: %s has opened another chat stream", username)
 	}
+	cs.publish(newEvent(pb.EventType_EVENT_TYPE_USER_LEAVE, cli.room, username, "too slow"))
+	return status.Errorf(codes.Unavailable, "user: %s is too slow, messages were dropped, reconnect to catch up", username)
 }
@@ -5,6 +5,7 @@ package logic
 import (
 	"context"
 	"io"
+	"log"
 	"os"
 	"sync"
 	"testing"
@@ -12,22 +13,38 @@ import (
 
 	"github.com/stretchr/testify/require"
 	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/config"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/db"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/jwt"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
 func TestMain(m *testing.M) {
-	os.Setenv("DBUSER", "root")
-	os.Setenv("DBPASS", "123456")
-	os.Setenv("JWT_KEY", "zjy-dev")
-
-	code := m.Run()
-
-	os.Unsetenv("DBUSER")
-	os.Unsetenv("DBPASS")
-	os.Unsetenv("JWT_KEY")
+	// The database is configured by the env vars, see test.env.
+	cfg, err := config.LoadServer(config.Options{})
+	if err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Database.ConnectTimeout)
+	conn, err := db.Connect(ctx, db.ConnectOptions{
+		Dialect:      db.Dialect(cfg.Database.Driver),
+		Host:         cfg.Database.Host,
+		Port:         uint64(cfg.Database.Port),
+		User:         cfg.Database.User,
+		Password:     cfg.Database.Password,
+		DBName:       cfg.Database.DBName,
+		QueryTimeout: cfg.Database.QueryTimeout,
+	})
+	cancel()
+	if err != nil {
+		log.Fatalf("failed to connect to database: %v", err)
+	}
+	dbConn.Store(conn)
+	jwt.SetKey("zjy-dev")
 
-	os.Exit(code)
+	os.Exit(m.Run())
 }
 
 type mockChatServerStream struct {
@@ -49,6 +66,10 @@ func (m *mockChatServerStream) Context() context.Context {
 	return context.WithValue(context.Background(), JWTContextKey, m.username)
 }
 
+func (m *mockChatServerStream) SendHeader(metadata.MD) error {
+	return nil
+}
+
 func (m *mockChatServerStream) Send(resp *pb.ChatResponse) error {
 	m.mux.Lock()
 	defer m.mux.Unlock()
@@ -4,7 +4,11 @@ package logic
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"database/sql"
+	"fmt"
 	"io"
 	"log"
 	"os"
@@ -13,12 +17,19 @@ import (
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
 	"github.com/stretchr/testify/require"
 	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/apikey"
 	"github.com/zjy-dev/grpc-go-chatroom/internal/jwt"
 	"github.com/zjy-dev/grpc-go-chatroom/internal/util"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
@@ -32,14 +43,11 @@ func mockDB() (*sql.DB, sqlmock.Sqlmock) {
 }
 
 func TestMain(m *testing.M) {
-	os.Setenv("JWT_KEY", "zjy-dev")
-
-	code := m.Run()
-
-	os.Unsetenv("JWT_KEY")
-
-	os.Exit(code)
+	jwt.SetKey("zjy-dev")
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	os.Exit(m.Run())
 }
+
 func TestLogInOrRegister(t *testing.T) {
 	require := require.New(t)
 
@@ -63,16 +71,34 @@ func TestLogInOrRegister(t *testing.T) {
 			},
 			alreadyLoggedIn: false,
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery("SELECT id FROM `users` WHERE username = ?").
+				mock.ExpectQuery("SELECT id, username, password_hash, is_bot FROM users WHERE username = ?").
 					WithArgs("newuser").
-					WillReturnRows(sqlmock.NewRows([]string{"id"})) // No rows returned
+					WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password_hash", "is_bot"})) // No rows returned
 
-				mock.ExpectExec("INSERT INTO `users` \\(`username`, `password_hash`\\) VALUES \\(\\?, \\?\\);").
+				mock.ExpectExec("INSERT INTO users \\(username, password_hash\\) VALUES \\(\\?, \\?\\);").
 					WithArgs("newuser", sqlmock.AnyArg()).
 					WillReturnResult(sqlmock.NewResult(1, 1))
 			},
 			expectedError: nil,
 		},
+		{
+			name: "registered at the same time by another request",
+			args: args{
+				req: &pb.LogInOrRegisterRequest{
+					Username: "newuser",
+					Password: "password123",
+				},
+			},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT id, username, password_hash, is_bot FROM users WHERE username = ?").
+					WithArgs("newuser").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password_hash", "is_bot"}))
+				mock.ExpectExec("INSERT INTO users \\(username, password_hash\\) VALUES \\(\\?, \\?\\);").
+					WithArgs("newuser", sqlmock.AnyArg()).
+					WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry 'newuser' for key 'users.username'"})
+			},
+			expectedError: status.Errorf(codes.AlreadyExists, "user: %s has just been registered by another request, please log in again", "newuser"),
+		},
 		{
 			name: "already logged in",
 			args: args{
@@ -96,16 +122,12 @@ func TestLogInOrRegister(t *testing.T) {
 			},
 			alreadyLoggedIn: false,
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery("SELECT id FROM `users` WHERE username = ?").
-					WithArgs("existinguser").
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
-
 				hashedPassword, err := util.HashPassword("password123")
 				require.NoError(err)
-				mock.ExpectQuery("SELECT id, username, password_hash FROM `users` WHERE username = ?").
+				mock.ExpectQuery("SELECT id, username, password_hash, is_bot FROM users WHERE username = ?").
 					WithArgs("existinguser").
-					WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password_hash"}).
-						AddRow(1, "existinguser", hashedPassword))
+					WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password_hash", "is_bot"}).
+						AddRow(1, "existinguser", hashedPassword, false))
 			},
 			expectedError: nil,
 		},
@@ -119,18 +141,30 @@ func TestLogInOrRegister(t *testing.T) {
 			},
 			alreadyLoggedIn: false,
 			mockSetup: func(mock sqlmock.Sqlmock) {
-				mock.ExpectQuery("SELECT id FROM `users` WHERE username = ?").
-					WithArgs("existinguser").
-					WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
-
 				hashedPassword, _ := util.HashPassword("password123") // Correct password
-				mock.ExpectQuery("SELECT id, username, password_hash FROM `users` WHERE username = ?").
+				mock.ExpectQuery("SELECT id, username, password_hash, is_bot FROM users WHERE username = ?").
 					WithArgs("existinguser").
-					WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password_hash"}).
-						AddRow(1, "existinguser", hashedPassword))
+					WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password_hash", "is_bot"}).
+						AddRow(1, "existinguser", hashedPassword, false))
 			},
 			expectedError: status.Errorf(codes.Unauthenticated, "incorrect password"),
 		},
+		{
+			name: "imported user without a password",
+			args: args{
+				req: &pb.LogInOrRegisterRequest{
+					Username: "importeduser",
+					Password: "password123",
+				},
+			},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT id, username, password_hash, is_bot FROM users WHERE username = ?").
+					WithArgs("importeduser").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password_hash", "is_bot"}).
+						AddRow(1, "importeduser", "", false))
+			},
+			expectedError: status.Errorf(codes.PermissionDenied, "user: importeduser was imported without a password, log in with a client certificate"),
+		},
 		{
 			name: "invalid username or password length",
 			args: args{
@@ -151,8 +185,8 @@ func TestLogInOrRegister(t *testing.T) {
 			tt.mockSetup(mock)
 
 			// Use the mock db connection
-			dbConn = db
-			defer func() { dbConn = nil }() // reset dbConn after test
+			dbConn.Store(db)
+			defer func() { dbConn.Store(nil) }() // reset dbConn after test
 
 			cs := NewChatServiceServer()
 
@@ -171,12 +205,97 @@ func TestLogInOrRegister(t *testing.T) {
 				require.NoError(err)
 				require.Equal(claims.Subject, tt.args.req.Username)
 			}
+			result := "success"
+			if tt.expectedError != nil {
+				result = "rejected"
+			}
+			require.Equal(1.0, cs.metrics.logins.With(result).Value())
 
 			require.NoError(mock.ExpectationsWereMet())
 		})
 	}
 }
 
+// peerWithCert returns ctx carrying a gRPC peer that presented a verified client certificate of commonName.
+func peerWithCert(ctx context.Context, commonName string) context.Context {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+	return peer.NewContext(ctx, &peer.Peer{AuthInfo: credentials.TLSInfo{
+		State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+	}})
+}
+
+func TestLogInOrRegisterByCertificate(t *testing.T) {
+	tests := []struct {
+		name          string
+		req           *pb.LogInOrRegisterRequest
+		mockSetup     func(mock sqlmock.Sqlmock)
+		expectedError error
+	}{
+		{
+			name: "registers without a password",
+			req:  &pb.LogInOrRegisterRequest{},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT id, username, password_hash, is_bot FROM users WHERE username = ?").
+					WithArgs("alice").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password_hash", "is_bot"}))
+				mock.ExpectExec("INSERT INTO users \\(username, password_hash\\) VALUES \\(\\?, \\?\\);").
+					WithArgs("alice", sqlmock.AnyArg()).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+			},
+		},
+		{
+			name: "logs in without checking the password",
+			req:  &pb.LogInOrRegisterRequest{Username: "alice", Password: "wrongpassword"},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT id, username, password_hash, is_bot FROM users WHERE username = ?").
+					WithArgs("alice").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password_hash", "is_bot"}).
+						AddRow(1, "alice", "hash", false))
+			},
+		},
+		{
+			name:          "certificate of another user",
+			req:           &pb.LogInOrRegisterRequest{Username: "bob"},
+			mockSetup:     func(mock sqlmock.Sqlmock) {},
+			expectedError: status.Errorf(codes.PermissionDenied, "the client certificate belongs to user: alice"),
+		},
+		{
+			name: "bots can not log in",
+			req:  &pb.LogInOrRegisterRequest{},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery("SELECT id, username, password_hash, is_bot FROM users WHERE username = ?").
+					WithArgs("alice").
+					WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password_hash", "is_bot"}).
+						AddRow(1, "alice", "", true))
+			},
+			expectedError: status.Errorf(codes.PermissionDenied, "user: alice is a bot, use an api key instead"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			db, mock := mockDB()
+			defer db.Close()
+			tt.mockSetup(mock)
+			dbConn.Store(db)
+			defer func() { dbConn.Store(nil) }()
+
+			cs := NewChatServiceServer()
+			resp, err := cs.LogInOrRegister(peerWithCert(context.Background(), "alice"), tt.req)
+			if tt.expectedError != nil {
+				require.Equal(tt.expectedError, err)
+			} else {
+				require.NoError(err)
+				claims, err := jwt.ParseJwt(resp.Token)
+				require.NoError(err)
+				require.Equal("alice", claims.Subject)
+			}
+			require.NoError(mock.ExpectationsWereMet())
+		})
+	}
+}
+
 // TestLogOut tests the LogOut method.
 func TestLogOut(t *testing.T) {
 	require := require.New(t)
@@ -248,12 +367,15 @@ func TestChat(t *testing.T) {
 	defer db.Close()
 
 	// Mock db connection
-	dbConn = db
+	prev := dbConn.Swap(db)
+	t.Cleanup(func() { dbConn.Store(prev) })
 
 	t.Run("TwoUsers", func(t *testing.T) {
 		cs := NewChatServiceServer()
 		cs.clientsMap["user1"] = client{}
 		cs.clientsMap["user2"] = client{}
+		cs.authors.put("user1", author{id: 1, loadedAt: time.Now()})
+		cs.authors.put("user2", author{id: 2, loadedAt: time.Now()})
 
 		stream1 := &mockChatServerStream{
 			cs:                cs,
@@ -279,8 +401,8 @@ func TestChat(t *testing.T) {
 
 		// Mock InsertMessage calls
 		for range 5 {
-			mock.ExpectExec("INSERT INTO `messages` (user_id, username, message) VALUES (?, ?, ?);").
-				WithArgs(42, sqlmock.AnyArg(), sqlmock.AnyArg()).
+			mock.ExpectExec("INSERT INTO messages (user_id, username, room, message, type, recipient) VALUES (?, ?, ?, ?, ?, ?);").
+				WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), DefaultRoom, sqlmock.AnyArg(), int32(pb.MessageType_MESSAGE_TYPE_NORMAL), "").
 				WillReturnResult(sqlmock.NewResult(1, 1))
 		}
 
@@ -309,6 +431,155 @@ func TestChat(t *testing.T) {
 	})
 }
 
+func TestWhoAmI(t *testing.T) {
+	require := require.New(t)
+	cs := newCommandTestServer("admin")
+	cs.clientsMap["admin"] = client{messageChan: make(chan *pb.Message, 1), room: "random", displayName: "Boss"}
+	cs.clientsMap["alice"] = client{}
+
+	resp, err := cs.WhoAmI(context.WithValue(context.Background(), JWTContextKey, "admin"), &pb.WhoAmIRequest{})
+	require.NoError(err)
+	require.Equal(&pb.WhoAmIResponse{Username: "admin", DisplayName: "Boss", Online: true, Room: "random", Admin: true}, resp)
+
+	// Logged in without a chat stream
+	resp, err = cs.WhoAmI(context.WithValue(context.Background(), JWTContextKey, "alice"), &pb.WhoAmIRequest{})
+	require.NoError(err)
+	require.Equal(&pb.WhoAmIResponse{Username: "alice"}, resp)
+
+	resp, err = cs.WhoAmI(botContext("ci-bot", apikey.ScopeMessagesWrite), &pb.WhoAmIRequest{})
+	require.NoError(err)
+	require.Equal(&pb.WhoAmIResponse{Username: "ci-bot", Bot: true, Scopes: []string{apikey.ScopeMessagesWrite}}, resp)
+
+	_, err = cs.WhoAmI(context.Background(), &pb.WhoAmIRequest{})
+	require.Equal(codes.Unauthenticated, status.Code(err))
+}
+
+func TestChatResumesSession(t *testing.T) {
+	require := require.New(t)
+	cs := NewChatServiceServer()
+
+	// Users who are not logged in on this server, e.g. after it restarted, resume
+	// their session by the token
+	require.NoError(cs.Chat(&mockChatServerStream{cs: cs, username: "user1"}))
+
+	// A stream that is still registered is replaced by the new one
+	oldChan := make(chan *pb.Message, 1)
+	cs.clientsMap["user1"] = client{messageChan: oldChan, room: "random"}
+	require.NoError(cs.Chat(&mockChatServerStream{cs: cs, username: "user1"}))
+	_, ok := <-oldChan
+	require.False(ok)
+	require.Empty(cs.clientsMap)
+
+	// Bots can not open a chat stream
+	err := cs.Chat(&mockChatServerStream{cs: cs, ctx: botContext("ci-bot"), username: "ci-bot"})
+	require.Equal(codes.NotFound, status.Code(err))
+}
+
+func TestChatRevokedSession(t *testing.T) {
+	require := require.New(t)
+	cs := newCommandTestServer("admin")
+	sessionStream := func(username, session string) *mockChatServerStream {
+		return &mockChatServerStream{cs: cs, username: username, ctx: context.WithValue(context.Background(), SessionContextKey, session)}
+	}
+
+	// The token resumes the session after the stream ended
+	cs.clientsMap["bob"] = client{session: "bob-1"}
+	require.NoError(cs.Chat(sessionStream("bob", "bob-1")))
+	require.NoError(cs.Chat(sessionStream("bob", "bob-1")))
+
+	// but not after a kick
+	cs.clientsMap["bob"] = client{messageChan: make(chan *pb.Message, 1), room: DefaultRoom, session: "bob-1"}
+	cs.runCommand("admin", "/kick bob")
+	require.Equal("kicked bob", lastReply(t, cs, "admin").GetTextContent())
+	err := cs.Chat(sessionStream("bob", "bob-1"))
+	require.Equal(codes.Unauthenticated, status.Code(err))
+	require.NotContains(cs.clientsMap, "bob")
+
+	// nor after logging out
+	cs.clientsMap["carol"] = client{session: "carol-1"}
+	_, err = cs.LogOut(sessionStream("carol", "carol-1").Context(), &pb.LogOutRequest{})
+	require.NoError(err)
+	err = cs.Chat(sessionStream("carol", "carol-1"))
+	require.Equal(codes.Unauthenticated, status.Code(err))
+
+	// The token of an older login can not take over a newer one
+	cs.clientsMap["dave"] = client{session: "dave-2"}
+	err = cs.Chat(sessionStream("dave", "dave-1"))
+	require.Equal(codes.Unauthenticated, status.Code(err))
+	require.Equal(client{session: "dave-2"}, cs.clientsMap["dave"])
+}
+
+// blockedChatStream is the Chat stream of a client that stopped reading: Send blocks
+// until release is closed, and Recv until the test ends.
+type blockedChatStream struct {
+	mockChatServerStream
+	release chan struct{}
+	done    chan struct{}
+}
+
+func (m *blockedChatStream) Send(*pb.ChatResponse) error {
+	<-m.release
+	return nil
+}
+
+func (m *blockedChatStream) Recv() (*pb.ChatRequest, error) {
+	<-m.done
+	return nil, io.EOF
+}
+
+func TestChatDropsSlowClient(t *testing.T) {
+	require := require.New(t)
+	db, mock := mockDB()
+	defer db.Close()
+	prev := dbConn.Swap(db)
+	t.Cleanup(func() { dbConn.Store(prev) })
+	mock.ExpectExec("INSERT INTO messages").WillReturnResult(sqlmock.NewResult(1, 1))
+	cs := newCommandTestServer("alice")
+	cs.clientsMap["bob"] = client{displayName: "Robert"}
+	stream := &blockedChatStream{
+		mockChatServerStream: mockChatServerStream{cs: cs, username: "bob"},
+		release:              make(chan struct{}),
+		done:                 make(chan struct{}),
+	}
+	defer close(stream.done)
+	chatErr := make(chan error, 1)
+	go func() {
+		chatErr <- cs.Chat(stream)
+	}()
+	require.Eventually(func() bool {
+		cs.mu.Lock()
+		defer cs.mu.Unlock()
+		return streamingUsersNumber(cs) == 2
+	}, time.Second, time.Millisecond)
+
+	// Bob's stream is stuck in Send with a full queue, the commands of others and
+	// the broadcast never block on it while holding cs.mu.
+	topicsSet := make(chan struct{})
+	go func() {
+		defer close(topicsSet)
+		for i := range clientQueueSize + 2 {
+			cs.runCommand("alice", fmt.Sprintf("/topic topic %d", i))
+		}
+		cs.broadcast(queuedMessage{msg: &pb.Message{Username: "alice", Room: DefaultRoom, TextContent: "hi"}})
+	}()
+	select {
+	case <-topicsSet:
+	case <-time.After(time.Second):
+		t.Fatal("delivering to a slow client blocked")
+	}
+
+	// Bob is disconnected but stays logged in, to reconnect and catch up
+	cs.mu.Lock()
+	bob, ok := cs.clientsMap["bob"]
+	cs.mu.Unlock()
+	require.True(ok)
+	require.Nil(bob.messageChan)
+	require.Equal("Robert", bob.displayName)
+	require.NoError(mock.ExpectationsWereMet())
+	close(stream.release)
+	require.Equal(codes.Unavailable, status.Code(<-chatErr))
+}
+
 type mockChatServerStream struct {
 	grpc.ServerStream
 	requests          []*pb.ChatRequest
@@ -319,13 +590,22 @@ type mockChatServerStream struct {
 	mux               sync.Mutex
 	username          string
 	cs                *chatServiceServer
+	ctx               context.Context // the parent of Context, context.Background() if nil
 }
 
 func (m *mockChatServerStream) Context() context.Context {
+	ctx := m.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
 	if len(m.username) == 0 {
-		return context.Background()
+		return ctx
 	}
-	return context.WithValue(context.Background(), JWTContextKey, m.username)
+	return context.WithValue(ctx, JWTContextKey, m.username)
+}
+
+func (m *mockChatServerStream) SendHeader(metadata.MD) error {
+	return nil
 }
 
 func (m *mockChatServerStream) Send(resp *pb.ChatResponse) error {
@@ -347,8 +627,9 @@ func (m *mockChatServerStream) Recv() (*pb.ChatRequest, error) {
 		return nil, io.EOF
 	}
 	if m.reqIndex == 0 {
+		// Wait until every user has opened a stream, otherwise they miss the broadcast.
 		m.cs.mu.Lock()
-		for len(m.cs.clientsMap) < m.totolUsersNumber {
+		for streamingUsersNumber(m.cs) < m.totolUsersNumber {
 			m.cs.mu.Unlock()
 			time.Sleep(time.Millisecond * 100)
 			m.cs.mu.Lock()
@@ -359,3 +640,15 @@ func (m *mockChatServerStream) Recv() (*pb.ChatRequest, error) {
 	m.reqIndex++
 	return req, nil
 }
+
+// streamingUsersNumber counts the clients with an open Chat stream.
+// NOTE: The caller must hold cs.mu.
+func streamingUsersNumber(cs *chatServiceServer) int {
+	n := 0
+	for _, cli := range cs.clientsMap {
+		if cli.messageChan != nil {
+			n++
+		}
+	}
+	return n
+}
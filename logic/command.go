@@ -0,0 +1,328 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// DefaultRoom is the room every client is in after opening a Chat stream.
+	DefaultRoom = "general"
+
+	// commandPrefix marks a text message as a slash command.
+	commandPrefix = "/"
+)
+
+// roomNameRegexp limits room names to something safe to print and store.
+var roomNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// CommandHandler handles a slash command typed by caller in the chat stream.
+// args is the text after the command name with surrounding spaces trimmed.
+// A non-empty reply or a non-nil error is sent privately to the caller as a system message.
+type CommandHandler func(cs *chatServiceServer, caller, args string) (reply string, err error)
+
+type command struct {
+	name    string
+	usage   string
+	help    string
+	handler CommandHandler
+}
+
+// commandRegistry holds the slash commands known by the server.
+type commandRegistry struct {
+	mu       sync.RWMutex // mu guards the commands
+	commands map[string]command
+}
+
+func newCommandRegistry() *commandRegistry {
+	return &commandRegistry{commands: make(map[string]command, 8)}
+}
+
+func (r *commandRegistry) register(cmd command) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands[cmd.name] = cmd
+}
+
+func (r *commandRegistry) lookup(name string) (command, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cmd, ok := r.commands[name]
+	return cmd, ok
+}
+
+// list returns all the registered commands sorted by name.
+func (r *commandRegistry) list() []command {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	res := make([]command, 0, len(r.commands))
+	for _, cmd := range r.commands {
+		res = append(res, cmd)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].name < res[j].name })
+	return res
+}
+
+// RegisterCommand registers the slash command `/name`, replacing any command with the same name.
+// usage and help are shown by `/help`.
+func (cs *chatServiceServer) RegisterCommand(name, usage, help string, handler CommandHandler) {
+	cs.commands.register(command{
+		name:    strings.ToLower(name),
+		usage:   usage,
+		help:    help,
+		handler: handler,
+	})
+}
+
+// parseCommand splits text like "/msg bob hi there" into "msg" and "bob hi there".
+func parseCommand(text string) (name, args string) {
+	text = strings.TrimPrefix(text, commandPrefix)
+	name, args, _ = strings.Cut(text, " ")
+	return strings.ToLower(name), strings.TrimSpace(args)
+}
+
+// runCommand dispatches the slash command in text to its handler and replies to the caller.
+func (cs *chatServiceServer) runCommand(caller, text string) {
+	name, args := parseCommand(text)
+	cmd, ok := cs.commands.lookup(name)
+	if !ok {
+		cs.systemReply(caller, fmt.Sprintf("unknown command %s%s, type /help to list commands", commandPrefix, name))
+		return
+	}
+
+	reply, err := cmd.handler(cs, caller, args)
+	if err != nil {
+		cs.systemReply(caller, "error: "+status.Convert(err).Message())
+		return
+	}
+	if reply != "" {
+		cs.systemReply(caller, reply)
+	}
+}
+
+// systemReply sends a system message to the caller only.
+func (cs *chatServiceServer) systemReply(caller, text string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	room := cs.clientsMap[caller].room
+	cs.sendTo(caller, newSystemMessage(room, text))
+}
+
+func newSystemMessage(room, text string) *pb.Message {
+	return &pb.Message{
+		Type:        pb.MessageType_MESSAGE_TYPE_SYSTEM,
+		Timestamp:   time.Now().Unix(),
+		TextContent: text,
+		Room:        room,
+	}
+}
+
+// registerBuiltinCommands registers the IRC style commands every server supports.
+func (cs *chatServiceServer) registerBuiltinCommands() {
+	cs.RegisterCommand("help", "/help [command]", "show the commands or the usage of one", helpCommand)
+	cs.RegisterCommand("me", "/me <action>", "send an emote to the room", meCommand)
+	cs.RegisterCommand("nick", "/nick <name>", "change your display name", nickCommand)
+	cs.RegisterCommand("who", "/who", "list the users in your room", whoCommand)
+	cs.RegisterCommand("join", "/join <room>", "leave your room and join another one", joinCommand)
+	cs.RegisterCommand("msg", "/msg <user> <text>", "send a private message", msgCommand)
+	cs.RegisterCommand("topic", "/topic [topic]", "show or set the topic of your room", topicCommand)
+	cs.RegisterCommand("kick", "/kick <user> [reason]", "disconnect a user, admin only", kickCommand)
+}
+
+func helpCommand(cs *chatServiceServer, _, args string) (string, error) {
+	if args != "" {
+		cmd, ok := cs.commands.lookup(strings.ToLower(strings.TrimPrefix(args, commandPrefix)))
+		if !ok {
+			return "", status.Errorf(codes.NotFound, "unknown command %s", args)
+		}
+		return fmt.Sprintf("%s - %s", cmd.usage, cmd.help), nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString("available commands:")
+	for _, cmd := range cs.commands.list() {
+		fmt.Fprintf(&sb, "\n  %s - %s", cmd.usage, cmd.help)
+	}
+	return sb.String(), nil
+}
+
+func meCommand(cs *chatServiceServer, caller, args string) (string, error) {
+	if args == "" {
+		return "", status.Errorf(codes.InvalidArgument, "usage: /me <action>")
+	}
+
+	cs.mu.Lock()
+	cli := cs.clientsMap[caller]
+	cs.mu.Unlock()
+
+	// Command handlers have no context, so their messages are broadcast untraced.
+	return "", cs.enqueue(context.Background(), &pb.Message{
+		Type:        pb.MessageType_MESSAGE_TYPE_ACTION,
+		Timestamp:   time.Now().Unix(),
+		TextContent: args,
+		Username:    caller,
+		Room:        cli.room,
+		DisplayName: cli.displayName,
+	})
+}
+
+func nickCommand(cs *chatServiceServer, caller, args string) (string, error) {
+	if len(args) < 2 || len(args) > 24 || strings.ContainsAny(args, " \t") {
+		return "", status.Errorf(codes.InvalidArgument, "nickname must be 2 to 24 characters without spaces")
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	// Nobody may pass for another online user in /who or in messages.
+	for username, other := range cs.clientsMap {
+		if username != caller && (strings.EqualFold(args, username) || strings.EqualFold(args, other.displayName)) {
+			return "", status.Errorf(codes.AlreadyExists, "nickname %s is taken by another user", args)
+		}
+	}
+	cli := cs.clientsMap[caller]
+	cli.displayName = args
+	cs.clientsMap[caller] = cli
+	return fmt.Sprintf("you are now known as %s", args), nil
+}
+
+func whoCommand(cs *chatServiceServer, caller, _ string) (string, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	room := cs.clientsMap[caller].room
+	users := make([]string, 0, len(cs.clientsMap))
+	for username, cli := range cs.clientsMap {
+		if cli.messageChan == nil || cli.room != room {
+			continue
+		}
+		if cli.displayName != "" {
+			username = fmt.Sprintf("%s (%s)", username, cli.displayName)
+		}
+		users = append(users, username)
+	}
+	sort.Strings(users)
+	return fmt.Sprintf("%d user(s) in #%s: %s", len(users), room, strings.Join(users, ", ")), nil
+}
+
+func joinCommand(cs *chatServiceServer, caller, args string) (string, error) {
+	room := strings.TrimPrefix(args, "#")
+	if !roomNameRegexp.MatchString(room) {
+		return "", status.Errorf(codes.InvalidArgument, "usage: /join <room>, room names are 1 to 64 letters, digits, '-' or '_'")
+	}
+
+	cs.mu.Lock()
+	cli := cs.clientsMap[caller]
+	oldRoom := cli.room
+	cli.room = room
+	cs.clientsMap[caller] = cli
+	topic := cs.topics[room]
+	cs.mu.Unlock()
+
+	if oldRoom != room {
+		cs.publish(newEvent(pb.EventType_EVENT_TYPE_USER_LEAVE, oldRoom, caller, ""))
+		cs.publish(newEvent(pb.EventType_EVENT_TYPE_USER_JOIN, room, caller, ""))
+	}
+
+	reply := fmt.Sprintf("you joined #%s", room)
+	if topic != "" {
+		reply += fmt.Sprintf(", topic: %s", topic)
+	}
+	return reply, nil
+}
+
+func msgCommand(cs *chatServiceServer, caller, args string) (string, error) {
+	recipient, text, _ := strings.Cut(args, " ")
+	text = strings.TrimSpace(text)
+	if recipient == "" || text == "" {
+		return "", status.Errorf(codes.InvalidArgument, "usage: /msg <user> <text>")
+	}
+
+	cs.mu.Lock()
+	cli := cs.clientsMap[caller]
+	target, ok := cs.clientsMap[recipient]
+	cs.mu.Unlock()
+	if !ok || target.messageChan == nil {
+		return "", status.Errorf(codes.NotFound, "user: %s is not online", recipient)
+	}
+
+	return "", cs.enqueue(context.Background(), &pb.Message{
+		Type:        pb.MessageType_MESSAGE_TYPE_PRIVATE,
+		Timestamp:   time.Now().Unix(),
+		TextContent: text,
+		Username:    caller,
+		Room:        cli.room,
+		Recipient:   recipient,
+		DisplayName: cli.displayName,
+	})
+}
+
+func topicCommand(cs *chatServiceServer, caller, args string) (string, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	room := cs.clientsMap[caller].room
+	if args == "" {
+		if topic := cs.topics[room]; topic != "" {
+			return fmt.Sprintf("topic of #%s: %s", room, topic), nil
+		}
+		return fmt.Sprintf("#%s has no topic", room), nil
+	}
+
+	cs.topics[room] = args
+	notice := newSystemMessage(room, fmt.Sprintf("%s changed the topic of #%s to: %s", caller, room, args))
+	// sendTo never blocks, clients too slow to take the notice are disconnected.
+	for username, cli := range cs.clientsMap {
+		if cli.room == room {
+			cs.sendTo(username, notice)
+		}
+	}
+	return "", nil
+}
+
+func kickCommand(cs *chatServiceServer, caller, args string) (string, error) {
+	if !cs.isAdmin(caller) {
+		return "", status.Errorf(codes.PermissionDenied, "only admins can kick users")
+	}
+	target, reason, _ := strings.Cut(args, " ")
+	reason = strings.TrimSpace(reason)
+	if target == "" {
+		return "", status.Errorf(codes.InvalidArgument, "usage: /kick <user> [reason]")
+	}
+	if target == caller {
+		return "", status.Errorf(codes.InvalidArgument, "you can not kick yourself")
+	}
+
+	detail := fmt.Sprintf("%s kicked %s", caller, target)
+	if reason != "" {
+		detail += ": " + reason
+	}
+
+	cs.mu.Lock()
+	cli, ok := cs.clientsMap[target]
+	if !ok || cli.messageChan == nil {
+		cs.mu.Unlock()
+		return "", status.Errorf(codes.NotFound, "user: %s is not online", target)
+	}
+	// Tell the user why before closing the stream, unless its queue is full.
+	select {
+	case cli.messageChan <- newSystemMessage(cli.room, "you have been kicked: "+detail):
+	default:
+	}
+	// The user can not reconnect with the token of the session.
+	cs.revokeLocked(cli.session)
+	cs.removeClientLocked(target)
+	cs.mu.Unlock()
+
+	cs.publish(newEvent(pb.EventType_EVENT_TYPE_MODERATION, cli.room, caller, detail))
+	cs.publish(newEvent(pb.EventType_EVENT_TYPE_USER_LEAVE, cli.room, target, "kicked"))
+	return fmt.Sprintf("kicked %s", target), nil
+}
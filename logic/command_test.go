@@ -0,0 +1,240 @@
+//go:build unit_test
+
+package logic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+)
+
+// newCommandTestServer creates a server without the broadcast routine,
+// so that messages produced by commands stay in receiveChan. "admin" is an admin.
+// The users are cached as authors with the IDs 1, 2, ... in order.
+func newCommandTestServer(usernames ...string) *chatServiceServer {
+	cs := &chatServiceServer{
+		clientsMap:  make(map[string]client),
+		topics:      make(map[string]string),
+		receiveChan: make(chan queuedMessage, 8),
+		commands:    newCommandRegistry(),
+		admins:      []string{"admin"},
+		metrics:     newServerMetrics(),
+	}
+	cs.registerBuiltinCommands()
+	for i, username := range usernames {
+		cs.clientsMap[username] = client{messageChan: make(chan *pb.Message, 8), room: DefaultRoom}
+		cs.authors.put(username, author{id: int64(i + 1), loadedAt: time.Now()})
+	}
+	return cs
+}
+
+// lastReply returns the last message sent to the stream of username.
+func lastReply(t *testing.T, cs *chatServiceServer, username string) *pb.Message {
+	t.Helper()
+	var msg *pb.Message
+	for {
+		select {
+		case m := <-cs.clientsMap[username].messageChan:
+			msg = m
+		default:
+			require.NotNil(t, msg, "no message sent to %s", username)
+			return msg
+		}
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	tests := []struct {
+		text string
+		name string
+		args string
+	}{
+		{text: "/who", name: "who", args: ""},
+		{text: "/MSG bob  hi there ", name: "msg", args: "bob  hi there"},
+		{text: "/", name: "", args: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			require := require.New(t)
+			name, args := parseCommand(tt.text)
+			require.Equal(tt.name, name)
+			require.Equal(tt.args, args)
+		})
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		wantReply string
+	}{
+		{name: "unknown command", text: "/dance", wantReply: "unknown command /dance, type /help to list commands"},
+		{name: "help of one command", text: "/help /join", wantReply: "/join <room> - leave your room and join another one"},
+		{name: "nick", text: "/nick Ally", wantReply: "you are now known as Ally"},
+		{name: "invalid nick", text: "/nick a", wantReply: "error: nickname must be 2 to 24 characters without spaces"},
+		{name: "nick of another user", text: "/nick BOB", wantReply: "error: nickname BOB is taken by another user"},
+		{name: "nick of another user's nick", text: "/nick robert", wantReply: "error: nickname robert is taken by another user"},
+		{name: "own username as nick", text: "/nick Alice", wantReply: "you are now known as Alice"},
+		{name: "who", text: "/who", wantReply: "2 user(s) in #general: alice, bob (Robert)"},
+		{name: "join", text: "/join #random", wantReply: "you joined #random"},
+		{name: "invalid room", text: "/join a b", wantReply: "error: usage: /join <room>, room names are 1 to 64 letters, digits, '-' or '_'"},
+		{name: "msg to offline user", text: "/msg carol hi", wantReply: "error: user: carol is not online"},
+		{name: "topic not set", text: "/topic", wantReply: "#general has no topic"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			cs := newCommandTestServer("alice", "bob")
+			cs.runCommand("bob", "/nick Robert")
+
+			cs.runCommand("alice", tt.text)
+
+			reply := lastReply(t, cs, "alice")
+			require.Equal(pb.MessageType_MESSAGE_TYPE_SYSTEM, reply.GetType())
+			require.Equal(tt.wantReply, reply.GetTextContent())
+			require.Empty(cs.receiveChan)
+		})
+	}
+}
+
+func TestMessageProducingCommands(t *testing.T) {
+	require := require.New(t)
+	cs := newCommandTestServer("alice", "bob")
+	cs.runCommand("alice", "/nick Ally")
+	cs.runCommand("alice", "/join random")
+
+	cs.runCommand("alice", "/me waves")
+	msg := (<-cs.receiveChan).msg
+	require.Equal(pb.MessageType_MESSAGE_TYPE_ACTION, msg.GetType())
+	require.Equal("waves", msg.GetTextContent())
+	require.Equal("random", msg.GetRoom())
+	require.Equal("Ally", msg.GetDisplayName())
+
+	cs.runCommand("alice", "/msg bob see you in #random")
+	msg = (<-cs.receiveChan).msg
+	require.Equal(pb.MessageType_MESSAGE_TYPE_PRIVATE, msg.GetType())
+	require.Equal("bob", msg.GetRecipient())
+	require.Equal("see you in #random", msg.GetTextContent())
+
+	cs.runCommand("bob", "/join random")
+	cs.runCommand("alice", "/topic release party")
+	require.Equal("alice changed the topic of #random to: release party", lastReply(t, cs, "bob").GetTextContent())
+	cs.runCommand("bob", "/topic")
+	require.Equal("topic of #random: release party", lastReply(t, cs, "bob").GetTextContent())
+}
+
+func TestShouldDeliver(t *testing.T) {
+	streaming := client{messageChan: make(chan *pb.Message), room: DefaultRoom}
+	tests := []struct {
+		name     string
+		msg      *pb.Message
+		username string
+		cli      client
+		want     bool
+	}{
+		{
+			name:     "same room",
+			msg:      &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Username: "alice", Room: DefaultRoom},
+			username: "bob",
+			cli:      streaming,
+			want:     true,
+		},
+		{
+			name:     "sender of normal message",
+			msg:      &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Username: "bob", Room: DefaultRoom},
+			username: "bob",
+			cli:      streaming,
+			want:     false,
+		},
+		{
+			name:     "sender of action",
+			msg:      &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_ACTION, Username: "bob", Room: DefaultRoom},
+			username: "bob",
+			cli:      streaming,
+			want:     true,
+		},
+		{
+			name:     "other room",
+			msg:      &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Username: "alice", Room: "random"},
+			username: "bob",
+			cli:      streaming,
+			want:     false,
+		},
+		{
+			name:     "private message to someone else",
+			msg:      &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_PRIVATE, Username: "alice", Room: DefaultRoom, Recipient: "carol"},
+			username: "bob",
+			cli:      streaming,
+			want:     false,
+		},
+		{
+			name:     "encrypted message to its recipient",
+			msg:      &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_ENCRYPTED, Username: "alice", Room: "random", Recipient: "bob"},
+			username: "bob",
+			cli:      streaming,
+			want:     true,
+		},
+		{
+			name:     "encrypted message to someone else",
+			msg:      &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_ENCRYPTED, Username: "alice", Room: DefaultRoom, Recipient: "carol"},
+			username: "bob",
+			cli:      streaming,
+			want:     false,
+		},
+		{
+			name:     "no stream",
+			msg:      &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Username: "alice", Room: DefaultRoom},
+			username: "bob",
+			cli:      client{},
+			want:     false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, shouldDeliver(tt.msg, tt.username, tt.cli))
+		})
+	}
+}
+
+func TestKickCommand(t *testing.T) {
+	require := require.New(t)
+
+	cs := newCommandTestServer("admin", "alice", "bob")
+	bobChan := cs.clientsMap["bob"].messageChan
+
+	cs.runCommand("alice", "/kick bob")
+	require.Equal("error: only admins can kick users", lastReply(t, cs, "alice").GetTextContent())
+
+	cs.runCommand("admin", "/kick carol")
+	require.Equal("error: user: carol is not online", lastReply(t, cs, "admin").GetTextContent())
+
+	cs.runCommand("admin", "/kick bob spamming")
+	require.Equal("kicked bob", lastReply(t, cs, "admin").GetTextContent())
+	require.NotContains(cs.clientsMap, "bob")
+
+	notice, ok := <-bobChan
+	require.True(ok)
+	require.Equal("you have been kicked: admin kicked bob: spamming", notice.GetTextContent())
+	_, ok = <-bobChan
+	require.False(ok, "the stream of a kicked user must be closed")
+
+	// Kicking a user whose queue is full never blocks
+	cs.clientsMap["alice"] = client{messageChan: make(chan *pb.Message), room: DefaultRoom}
+	kicked := make(chan struct{})
+	go func() {
+		defer close(kicked)
+		cs.runCommand("admin", "/kick alice")
+	}()
+	select {
+	case <-kicked:
+	case <-time.After(time.Second):
+		t.Fatal("kicking a slow user blocked")
+	}
+	require.NotContains(cs.clientsMap, "alice")
+}
@@ -0,0 +1,95 @@
+package logic
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/zjy-dev/grpc-go-chatroom/internal/db"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// dbRecheckInterval is how often the messages rejected while the database is down
+// ping it again, so that they are accepted soon after it is back.
+const dbRecheckInterval = time.Second
+
+// dbConn is the database of the server, see WithDB.
+var dbConn atomic.Pointer[sql.DB]
+
+// errNoDB is returned by the calls needing the database of a server created without WithDB.
+var errNoDB = status.Errorf(codes.Unavailable, "the database is not set, create the server with WithDB")
+
+// dBConn returns the database of the server, or errNoDB if it is not set.
+func dBConn() (*sql.DB, error) {
+	conn := dbConn.Load()
+	if conn == nil {
+		return nil, errNoDB
+	}
+	return conn, nil
+}
+
+// dbState tracks whether the database is reachable. Messages are stored by the
+// broadcast routine after their senders were answered, so they are rejected while
+// the database is down rather than lost.
+type dbState struct {
+	down      atomic.Bool
+	lastCheck atomic.Int64 // Unix time in nanoseconds of the last ping while down
+}
+
+// record updates the state with the result of a call to the database.
+func (s *dbState) record(err error) {
+	if err == nil {
+		if s.down.Swap(false) {
+			slog.Info("the database is reachable again, messages are accepted")
+		}
+		return
+	}
+	if db.IsUnavailable(err) && !s.down.Swap(true) {
+		s.lastCheck.Store(time.Now().UnixNano())
+		slog.Error("the database is unreachable, messages are rejected until it is back", "error", err)
+	}
+}
+
+// CheckDatabase returns an error if the database is unreachable, in which case
+// the server can not store messages.
+func (cs *chatServiceServer) CheckDatabase(ctx context.Context) error {
+	conn, err := dBConn()
+	if err != nil {
+		return err
+	}
+	err = db.Ping(ctx, conn)
+	cs.database.record(err)
+	return err
+}
+
+// requireDatabase returns an Unavailable error if the database is down. The database
+// is pinged again if it was not for dbRecheckInterval.
+func (cs *chatServiceServer) requireDatabase(ctx context.Context) error {
+	if !cs.database.down.Load() {
+		return nil
+	}
+	last, now := cs.database.lastCheck.Load(), time.Now().UnixNano()
+	if now-last >= int64(dbRecheckInterval) && cs.database.lastCheck.CompareAndSwap(last, now) {
+		if cs.CheckDatabase(ctx) == nil {
+			return nil
+		}
+	}
+	return status.Errorf(codes.Unavailable, "the database is unavailable, please try again later")
+}
+
+// dbError wraps err of a database call in a gRPC status error with msg, Unavailable
+// if the database is unreachable or too slow, so that clients know to retry,
+// AlreadyExists if a unique key is taken, and Internal otherwise.
+func dbError(err error, msg string) error {
+	code := codes.Internal
+	if db.IsUnavailable(err) {
+		code = codes.Unavailable
+	} else if db.IsDuplicateKey(err) {
+		code = codes.AlreadyExists
+	}
+	return util.WrapGRPCError(err, code, msg)
+}
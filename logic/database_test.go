@@ -0,0 +1,116 @@
+//go:build unit_test
+
+package logic
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errConnRefused is returned by the database drivers when the database is down.
+var errConnRefused = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+func TestDBError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		code codes.Code
+	}{
+		{name: "unreachable", err: fmt.Errorf("failed to get messages: %w", driver.ErrBadConn), code: codes.Unavailable},
+		{name: "timeout", err: fmt.Errorf("failed to get messages: %w", context.DeadlineExceeded), code: codes.Unavailable},
+		{name: "query", err: errors.New("failed to get messages: syntax error"), code: codes.Internal},
+		{name: "status", err: status.Errorf(codes.NotFound, "not found"), code: codes.NotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := dbError(tt.err, "failed to get history")
+			require.Equal(t, tt.code, status.Code(err))
+		})
+	}
+}
+
+func TestMessagesRejectedWhileDatabaseDown(t *testing.T) {
+	require := require.New(t)
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	require.NoError(err)
+	defer db.Close()
+	dbConn.Store(db)
+	defer dbConn.Store(nil)
+	cs := newCommandTestServer("alice", "bob")
+
+	// The broadcast routine fails to store a message
+	mock.ExpectExec("INSERT INTO messages").WillReturnError(errConnRefused)
+	cs.handleMessage(context.Background(), "alice", &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_NORMAL, TextContent: "lost"})
+	cs.broadcast(<-cs.receiveChan)
+	require.True(cs.database.down.Load())
+
+	// Messages are rejected until the database answers a ping again
+	cs.handleMessage(context.Background(), "alice", &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_NORMAL, TextContent: "rejected"})
+	require.Empty(cs.receiveChan)
+	require.Equal("error: the database is unavailable, please try again later", lastReply(t, cs, "alice").GetTextContent())
+	_, err = cs.PostMessage(context.WithValue(context.Background(), JWTContextKey, "alice"), &pb.PostMessageRequest{TextContent: "rejected"})
+	require.Equal(codes.Unavailable, status.Code(err))
+
+	mock.ExpectPing()
+	cs.database.lastCheck.Store(time.Now().Add(-dbRecheckInterval).UnixNano())
+	cs.handleMessage(context.Background(), "alice", &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_NORMAL, TextContent: "accepted"})
+	require.False(cs.database.down.Load())
+	require.Equal("accepted", (<-cs.receiveChan).msg.GetTextContent())
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestCheckDatabase(t *testing.T) {
+	require := require.New(t)
+	db, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	require.NoError(err)
+	defer db.Close()
+	dbConn.Store(db)
+	defer dbConn.Store(nil)
+	cs := newCommandTestServer()
+
+	mock.ExpectPing().WillReturnError(errConnRefused)
+	require.Error(cs.CheckDatabase(context.Background()))
+	require.True(cs.database.down.Load())
+
+	mock.ExpectPing()
+	require.NoError(cs.CheckDatabase(context.Background()))
+	require.False(cs.database.down.Load())
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestNoDatabase(t *testing.T) {
+	require := require.New(t)
+	prev := dbConn.Swap(nil)
+	t.Cleanup(func() { dbConn.Store(prev) })
+	cs := newCommandTestServer("alice")
+	ctx := context.WithValue(context.Background(), JWTContextKey, "alice")
+
+	_, err := dBConn()
+	require.Equal(codes.Unavailable, status.Code(err))
+	require.Equal(codes.Unavailable, status.Code(cs.CheckDatabase(context.Background())))
+	_, err = cs.LogInOrRegister(context.Background(), &pb.LogInOrRegisterRequest{Username: "bob", Password: "password123"})
+	require.Equal(codes.Unavailable, status.Code(err))
+	_, err = cs.GetHistory(ctx, &pb.GetHistoryRequest{})
+	require.Equal(codes.Unavailable, status.Code(err))
+	_, err = cs.GetProfile(ctx, &pb.GetProfileRequest{Username: "carol"})
+	require.Equal(codes.Unavailable, status.Code(err))
+	_, err = AuthAPIKey(context.Background(), "key")
+	require.Equal(codes.Unavailable, status.Code(err))
+
+	// The broadcast routine drops the message instead of exiting
+	cs.handleMessage(ctx, "alice", &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_NORMAL, TextContent: "lost"})
+	cs.broadcast(<-cs.receiveChan)
+	require.Empty(cs.clientsMap["alice"].messageChan)
+}
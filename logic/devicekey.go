@@ -0,0 +1,148 @@
+package logic
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/apikey"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/db"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// maxDeviceKeys is the number of devices a user may register.
+	maxDeviceKeys = 16
+	// devicePublicKeySize is the size of the X25519 public keys of devices, and
+	// of the ephemeral keys of wrapped keys.
+	devicePublicKeySize = 32
+	// maxWrappedKeySize is the size limit of a wrapped message key.
+	maxWrappedKeySize = 256
+	// maxCiphertextSize is the size limit of the ciphertext of an encrypted message.
+	maxCiphertextSize = 64 << 10
+)
+
+// deviceIDRegexp matches the IDs devices register their keys with.
+var deviceIDRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// RegisterDeviceKey is a method that implements the RegisterDeviceKey method of the ChatServiceServer interface.
+func (cs *chatServiceServer) RegisterDeviceKey(ctx context.Context, req *pb.RegisterDeviceKeyRequest) (*pb.RegisterDeviceKeyResponse, error) {
+	username, ok := ctx.Value(JWTContextKey).(string)
+	if !ok || len(username) == 0 {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid auth token")
+	}
+	if err := requireScope(ctx, apikey.ScopeMessagesWrite); err != nil {
+		return nil, err
+	}
+	if !deviceIDRegexp.MatchString(req.GetDeviceId()) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid device id: %q", req.GetDeviceId())
+	}
+	if len(req.GetPublicKey()) != devicePublicKeySize {
+		return nil, status.Errorf(codes.InvalidArgument, "public_key must be a %d bytes X25519 key", devicePublicKeySize)
+	}
+
+	a, err := cs.resolveAuthor(ctx, username)
+	if err != nil {
+		return nil, dbError(err, "failed to resolve user")
+	}
+	conn, err := dBConn()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := db.ListDeviceKeys(ctx, conn, username)
+	if err != nil {
+		return nil, dbError(err, "failed to list device keys")
+	}
+	registered := false
+	for _, key := range keys {
+		registered = registered || key.DeviceID == req.GetDeviceId()
+	}
+	if !registered && len(keys) >= maxDeviceKeys {
+		return nil, status.Errorf(codes.ResourceExhausted, "too many devices, the limit is %d", maxDeviceKeys)
+	}
+	if err := db.UpsertDeviceKey(ctx, conn, a.id, req.GetDeviceId(), req.GetPublicKey()); err != nil {
+		return nil, dbError(err, "failed to register device key")
+	}
+
+	return &pb.RegisterDeviceKeyResponse{Key: &pb.DeviceKey{
+		DeviceId:  req.GetDeviceId(),
+		PublicKey: req.GetPublicKey(),
+		CreatedAt: time.Now().Unix(),
+	}}, nil
+}
+
+// GetUserKeys is a method that implements the GetUserKeys method of the ChatServiceServer interface.
+func (cs *chatServiceServer) GetUserKeys(ctx context.Context, req *pb.GetUserKeysRequest) (*pb.GetUserKeysResponse, error) {
+	caller, ok := ctx.Value(JWTContextKey).(string)
+	if !ok || len(caller) == 0 {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid auth token")
+	}
+	if err := requireScope(ctx, apikey.ScopeMessagesRead); err != nil {
+		return nil, err
+	}
+	username := req.GetUsername()
+	if username == "" {
+		username = caller
+	}
+
+	if _, err := cs.resolveAuthor(ctx, username); err != nil {
+		return nil, dbError(err, "failed to resolve user")
+	}
+	conn, err := dBConn()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := db.ListDeviceKeys(ctx, conn, username)
+	if err != nil {
+		return nil, dbError(err, "failed to list device keys")
+	}
+	resp := &pb.GetUserKeysResponse{Keys: make([]*pb.DeviceKey, 0, len(keys))}
+	for _, key := range keys {
+		resp.Keys = append(resp.Keys, &pb.DeviceKey{DeviceId: key.DeviceID, PublicKey: key.PublicKey, CreatedAt: key.CreatedAt})
+	}
+	return resp, nil
+}
+
+// checkEncryptedMessage checks the encrypted message of username to recipient,
+// without inspecting its ciphertext or keys, which the server cannot read. The
+// keys may only be wrapped for the devices of the sender and of the recipient,
+// and at least one must be for the recipient.
+func (cs *chatServiceServer) checkEncryptedMessage(ctx context.Context, username, recipient string, ciphertext []byte, keys []*pb.WrappedKey) error {
+	if !cs.limiter.allow(username) {
+		return status.Errorf(codes.ResourceExhausted, "too many messages, slow down")
+	}
+	if recipient == "" {
+		return status.Errorf(codes.InvalidArgument, "an encrypted message needs a recipient")
+	}
+	if len(ciphertext) == 0 || len(ciphertext) > maxCiphertextSize {
+		return status.Errorf(codes.InvalidArgument, "the ciphertext must be 1 to %d bytes", maxCiphertextSize)
+	}
+	if len(keys) == 0 || len(keys) > 2*maxDeviceKeys {
+		return status.Errorf(codes.InvalidArgument, "an encrypted message needs 1 to %d wrapped keys", 2*maxDeviceKeys)
+	}
+	forRecipient := false
+	for _, key := range keys {
+		if key.GetUsername() != username && key.GetUsername() != recipient {
+			return status.Errorf(codes.InvalidArgument, "a key is wrapped for %s, who is neither the sender nor the recipient", key.GetUsername())
+		}
+		if !deviceIDRegexp.MatchString(key.GetDeviceId()) {
+			return status.Errorf(codes.InvalidArgument, "invalid device id: %q", key.GetDeviceId())
+		}
+		if len(key.GetEphemeralPublicKey()) != devicePublicKeySize {
+			return status.Errorf(codes.InvalidArgument, "ephemeral_public_key must be a %d bytes X25519 key", devicePublicKeySize)
+		}
+		if len(key.GetWrappedKey()) == 0 || len(key.GetWrappedKey()) > maxWrappedKeySize {
+			return status.Errorf(codes.InvalidArgument, "a wrapped key must be 1 to %d bytes", maxWrappedKeySize)
+		}
+		forRecipient = forRecipient || key.GetUsername() == recipient
+	}
+	if !forRecipient {
+		return status.Errorf(codes.InvalidArgument, "no key is wrapped for %s", recipient)
+	}
+	if _, err := cs.resolveAuthor(ctx, recipient); err != nil {
+		return dbError(err, "failed to resolve recipient")
+	}
+	return nil
+}
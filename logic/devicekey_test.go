@@ -0,0 +1,274 @@
+//go:build unit_test
+
+package logic
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/apikey"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/webhook"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const listDeviceKeys = "SELECT k.device_id, k.public_key, COALESCE(UNIX_TIMESTAMP(k.created_at), 0) " +
+	"FROM device_keys k JOIN users u ON u.id = k.user_id WHERE u.username = ? ORDER BY k.id;"
+
+var deviceKeyColumns = []string{"device_id", "public_key", "created_at"}
+
+// testPublicKey returns a fake X25519 public key filled with b.
+func testPublicKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, devicePublicKeySize)
+}
+
+// testWrappedKey returns a fake key of an encrypted message wrapped for the device of username.
+func testWrappedKey(username, deviceID string) *pb.WrappedKey {
+	return &pb.WrappedKey{Username: username, DeviceId: deviceID, EphemeralPublicKey: testPublicKey(9), WrappedKey: []byte("wrapped")}
+}
+
+func TestRegisterDeviceKey(t *testing.T) {
+	db, mock := mockDB()
+	defer db.Close()
+	dbConn.Store(db)
+	defer dbConn.Store(nil)
+	aliceCtx := context.WithValue(context.Background(), JWTContextKey, "alice")
+	// alice has registered as many devices as she may
+	fullKeys := func() *sqlmock.Rows {
+		rows := sqlmock.NewRows(deviceKeyColumns)
+		for i := range maxDeviceKeys {
+			rows.AddRow(fmt.Sprintf("device-%d", i), testPublicKey(1), 1723680000)
+		}
+		return rows
+	}
+
+	tests := []struct {
+		name         string
+		ctx          context.Context
+		req          *pb.RegisterDeviceKeyRequest
+		mockSetup    func()
+		expectedCode codes.Code
+	}{
+		{
+			name: "new device",
+			ctx:  aliceCtx,
+			req:  &pb.RegisterDeviceKeyRequest{DeviceId: "laptop", PublicKey: testPublicKey(1)},
+			mockSetup: func() {
+				mock.ExpectQuery(regexp.QuoteMeta(listDeviceKeys)).WithArgs("alice").WillReturnRows(sqlmock.NewRows(deviceKeyColumns))
+				mock.ExpectExec("INSERT INTO device_keys").WithArgs(1, "laptop", testPublicKey(1)).WillReturnResult(sqlmock.NewResult(1, 1))
+			},
+			expectedCode: codes.OK,
+		},
+		{
+			name: "replaced key of a device",
+			ctx:  aliceCtx,
+			req:  &pb.RegisterDeviceKeyRequest{DeviceId: "device-0", PublicKey: testPublicKey(2)},
+			mockSetup: func() {
+				mock.ExpectQuery(regexp.QuoteMeta(listDeviceKeys)).WithArgs("alice").WillReturnRows(fullKeys())
+				mock.ExpectExec("INSERT INTO device_keys").WithArgs(1, "device-0", testPublicKey(2)).WillReturnResult(sqlmock.NewResult(1, 2))
+			},
+			expectedCode: codes.OK,
+		},
+		{
+			name: "too many devices",
+			ctx:  aliceCtx,
+			req:  &pb.RegisterDeviceKeyRequest{DeviceId: "phone", PublicKey: testPublicKey(1)},
+			mockSetup: func() {
+				mock.ExpectQuery(regexp.QuoteMeta(listDeviceKeys)).WithArgs("alice").WillReturnRows(fullKeys())
+			},
+			expectedCode: codes.ResourceExhausted,
+		},
+		{
+			name:         "invalid device id",
+			ctx:          aliceCtx,
+			req:          &pb.RegisterDeviceKeyRequest{DeviceId: "my laptop", PublicKey: testPublicKey(1)},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "invalid public key",
+			ctx:          aliceCtx,
+			req:          &pb.RegisterDeviceKeyRequest{DeviceId: "laptop", PublicKey: []byte("short")},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "bot without write scope",
+			ctx:          botContext("ci-bot", apikey.ScopeMessagesRead),
+			req:          &pb.RegisterDeviceKeyRequest{DeviceId: "laptop", PublicKey: testPublicKey(1)},
+			expectedCode: codes.PermissionDenied,
+		},
+		{
+			name:         "invalid auth token",
+			ctx:          context.Background(),
+			req:          &pb.RegisterDeviceKeyRequest{DeviceId: "laptop", PublicKey: testPublicKey(1)},
+			expectedCode: codes.Unauthenticated,
+		},
+		{
+			name: "database down",
+			ctx:  aliceCtx,
+			req:  &pb.RegisterDeviceKeyRequest{DeviceId: "laptop", PublicKey: testPublicKey(1)},
+			mockSetup: func() {
+				mock.ExpectQuery(regexp.QuoteMeta(listDeviceKeys)).WithArgs("alice").WillReturnError(errConnRefused)
+			},
+			expectedCode: codes.Unavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			if tt.mockSetup != nil {
+				tt.mockSetup()
+			}
+			resp, err := newCommandTestServer("alice").RegisterDeviceKey(tt.ctx, tt.req)
+			require.Equal(tt.expectedCode, status.Code(err))
+			if err == nil {
+				require.Equal(tt.req.GetDeviceId(), resp.GetKey().GetDeviceId())
+				require.Equal(tt.req.GetPublicKey(), resp.GetKey().GetPublicKey())
+			}
+			require.NoError(mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestGetUserKeys(t *testing.T) {
+	require := require.New(t)
+	db, mock := mockDB()
+	defer db.Close()
+	dbConn.Store(db)
+	defer dbConn.Store(nil)
+	cs := newCommandTestServer("alice", "bob")
+	ctx := context.WithValue(context.Background(), JWTContextKey, "alice")
+
+	mock.ExpectQuery(regexp.QuoteMeta(listDeviceKeys)).WithArgs("bob").
+		WillReturnRows(sqlmock.NewRows(deviceKeyColumns).AddRow("phone", testPublicKey(2), 1723680000))
+	resp, err := cs.GetUserKeys(ctx, &pb.GetUserKeysRequest{Username: "bob"})
+	require.NoError(err)
+	require.True(proto.Equal(&pb.GetUserKeysResponse{Keys: []*pb.DeviceKey{
+		{DeviceId: "phone", PublicKey: testPublicKey(2), CreatedAt: 1723680000},
+	}}, resp))
+
+	// The caller's keys by default
+	mock.ExpectQuery(regexp.QuoteMeta(listDeviceKeys)).WithArgs("alice").WillReturnRows(sqlmock.NewRows(deviceKeyColumns))
+	resp, err = cs.GetUserKeys(ctx, &pb.GetUserKeysRequest{})
+	require.NoError(err)
+	require.Empty(resp.GetKeys())
+
+	mock.ExpectQuery(regexp.QuoteMeta(selectProfile)).WithArgs("ghost").WillReturnRows(sqlmock.NewRows(profileColumns))
+	_, err = cs.GetUserKeys(ctx, &pb.GetUserKeysRequest{Username: "ghost"})
+	require.Equal(codes.NotFound, status.Code(err))
+
+	_, err = cs.GetUserKeys(botContext("ci-bot", apikey.ScopeMessagesWrite), &pb.GetUserKeysRequest{Username: "bob"})
+	require.Equal(codes.PermissionDenied, status.Code(err))
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestPostEncryptedMessage(t *testing.T) {
+	aliceCtx := context.WithValue(context.Background(), JWTContextKey, "alice")
+	tests := []struct {
+		name         string
+		req          *pb.PostMessageRequest
+		expectedCode codes.Code
+	}{
+		{
+			name: "encrypted for the devices of both",
+			req: &pb.PostMessageRequest{Recipient: "bob", BinaryContent: []byte("ciphertext"),
+				WrappedKeys: []*pb.WrappedKey{testWrappedKey("bob", "phone"), testWrappedKey("alice", "laptop")}},
+			expectedCode: codes.OK,
+		},
+		{
+			name:         "no ciphertext",
+			req:          &pb.PostMessageRequest{Recipient: "bob", WrappedKeys: []*pb.WrappedKey{testWrappedKey("bob", "phone")}},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name: "plain text",
+			req: &pb.PostMessageRequest{Recipient: "bob", TextContent: "hi", BinaryContent: []byte("ciphertext"),
+				WrappedKeys: []*pb.WrappedKey{testWrappedKey("bob", "phone")}},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name:         "no keys",
+			req:          &pb.PostMessageRequest{Recipient: "bob", BinaryContent: []byte("ciphertext")},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name: "no key for the recipient",
+			req: &pb.PostMessageRequest{Recipient: "bob", BinaryContent: []byte("ciphertext"),
+				WrappedKeys: []*pb.WrappedKey{testWrappedKey("alice", "laptop")}},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name: "key for a third user",
+			req: &pb.PostMessageRequest{Recipient: "bob", BinaryContent: []byte("ciphertext"),
+				WrappedKeys: []*pb.WrappedKey{testWrappedKey("bob", "phone"), testWrappedKey("carol", "laptop")}},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name: "invalid ephemeral key",
+			req: &pb.PostMessageRequest{Recipient: "bob", BinaryContent: []byte("ciphertext"),
+				WrappedKeys: []*pb.WrappedKey{{Username: "bob", DeviceId: "phone", EphemeralPublicKey: []byte("short"), WrappedKey: []byte("wrapped")}}},
+			expectedCode: codes.InvalidArgument,
+		},
+		{
+			name: "ciphertext too large",
+			req: &pb.PostMessageRequest{Recipient: "bob", BinaryContent: make([]byte, maxCiphertextSize+1),
+				WrappedKeys: []*pb.WrappedKey{testWrappedKey("bob", "phone")}},
+			expectedCode: codes.InvalidArgument,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			cs := newCommandTestServer("alice", "bob")
+			resp, err := cs.PostMessage(aliceCtx, tt.req)
+			require.Equal(tt.expectedCode, status.Code(err))
+			if err != nil {
+				require.Empty(cs.receiveChan)
+				return
+			}
+			msg := (<-cs.receiveChan).msg
+			require.Equal(pb.MessageType_MESSAGE_TYPE_ENCRYPTED, msg.GetType())
+			require.Equal("bob", msg.GetRecipient())
+			require.Equal(tt.req.GetBinaryContent(), msg.GetBinaryContent())
+			require.Len(msg.GetWrappedKeys(), len(tt.req.GetWrappedKeys()))
+			require.Equal(msg.GetTimestamp(), resp.GetMessage().GetTimestamp())
+		})
+	}
+}
+
+func TestBroadcastEncryptedMessage(t *testing.T) {
+	require := require.New(t)
+	db, mock := mockDB()
+	defer db.Close()
+	dbConn.Store(db)
+	defer dbConn.Store(nil)
+	cs := newCommandTestServer("alice", "bob", "carol")
+	sub := cs.events.subscribe(webhook.Filter{})
+	defer cs.events.unsubscribe(sub)
+
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO messages (user_id, username, room, message, type, recipient, binary_content, wrapped_keys)")).
+		WithArgs(1, "alice", DefaultRoom, int32(pb.MessageType_MESSAGE_TYPE_ENCRYPTED), "bob", []byte("ciphertext"), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(5, 1))
+	cs.handleMessage(context.Background(), "alice", &pb.Message{
+		Type: pb.MessageType_MESSAGE_TYPE_ENCRYPTED, Recipient: "bob", BinaryContent: []byte("ciphertext"),
+		WrappedKeys: []*pb.WrappedKey{testWrappedKey("bob", "phone")},
+	})
+	cs.broadcast(<-cs.receiveChan)
+
+	msg := lastReply(t, cs, "bob")
+	require.EqualValues(5, msg.GetMessageNumber())
+	require.Equal([]byte("ciphertext"), msg.GetBinaryContent())
+	require.Empty(cs.clientsMap["carol"].messageChan)
+	require.Empty(cs.clientsMap["alice"].messageChan)
+	// Encrypted messages are not shared with subscribers
+	require.Empty(sub.eventChan)
+	require.NoError(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,143 @@
+package logic
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/db"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/webhook"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ServerOption configures the server created by NewChatServiceServer.
+type ServerOption func(cs *chatServiceServer)
+
+// WithDB sets the database used by the server.
+// NOTE: The database is shared by all the servers in the process.
+func WithDB(conn *sql.DB) ServerOption {
+	return func(cs *chatServiceServer) {
+		dbConn.Store(conn)
+	}
+}
+
+// WithAdmins sets the usernames allowed to call admin RPCs and commands.
+func WithAdmins(admins []string) ServerOption {
+	return func(cs *chatServiceServer) {
+		cs.admins = admins
+	}
+}
+
+// WithWebhooks enables delivering chat events to the webhook subscriptions stored in the database.
+func WithWebhooks(opts webhook.Options) ServerOption {
+	return func(cs *chatServiceServer) {
+		cs.webhooks = webhook.NewDispatcher(webhookStore{}, opts)
+	}
+}
+
+// newEvent creates an event with a unique ID.
+func newEvent(eventType pb.EventType, room, username, detail string) *pb.Event {
+	id := make([]byte, 16)
+	// crypto/rand.Read never returns an error on supported platforms.
+	rand.Read(id)
+	return &pb.Event{
+		Id:        hex.EncodeToString(id),
+		Type:      eventType,
+		Timestamp: time.Now().Unix(),
+		Room:      room,
+		Username:  username,
+		Detail:    detail,
+	}
+}
+
+// publish hands evt to the event consumers without blocking.
+func (cs *chatServiceServer) publish(evt *pb.Event) {
+	if cs.webhooks != nil {
+		cs.webhooks.Publish(evt)
+	}
+	cs.events.publish(evt)
+}
+
+// validateEventFilter checks the event types and rooms a webhook or subscriber asked for.
+func validateEventFilter(eventTypes []pb.EventType, rooms []string) error {
+	for _, t := range eventTypes {
+		if _, ok := pb.EventType_name[int32(t)]; !ok || t == pb.EventType_EVENT_TYPE_UNSPECIFIED {
+			return status.Errorf(codes.InvalidArgument, "invalid event type: %v", t)
+		}
+	}
+	for _, room := range rooms {
+		if !roomNameRegexp.MatchString(room) {
+			return status.Errorf(codes.InvalidArgument, "invalid room name: %q", room)
+		}
+	}
+	return nil
+}
+
+// webhookStore implements webhook.Store with the database.
+type webhookStore struct{}
+
+func (webhookStore) ListSubscriptions() ([]*webhook.Subscription, error) {
+	conn, err := dBConn()
+	if err != nil {
+		return nil, err
+	}
+	webhooks, err := db.ListWebhooks(context.Background(), conn)
+	if err != nil {
+		return nil, err
+	}
+
+	subs := make([]*webhook.Subscription, 0, len(webhooks))
+	for _, w := range webhooks {
+		subs = append(subs, &webhook.Subscription{
+			Filter: webhook.Filter{
+				EventTypes: parseEventTypes(w.EventTypes),
+				Rooms:      splitList(w.Rooms),
+			},
+			ID:     w.ID,
+			URL:    w.URL,
+			Secret: w.Secret,
+		})
+	}
+	return subs, nil
+}
+
+func (webhookStore) InsertDeadLetter(dl *webhook.DeadLetter) error {
+	conn, err := dBConn()
+	if err != nil {
+		return err
+	}
+	return db.InsertWebhookDeadLetter(context.Background(), conn, dl.WebhookID, dl.EventID, dl.EventType.String(), dl.Payload, dl.Attempts, dl.LastError)
+}
+
+// parseEventTypes parses comma separated event type names, unknown names are skipped.
+func parseEventTypes(s string) []pb.EventType {
+	var res []pb.EventType
+	for _, name := range splitList(s) {
+		if v, ok := pb.EventType_value[name]; ok {
+			res = append(res, pb.EventType(v))
+		}
+	}
+	return res
+}
+
+// formatEventTypes formats event types as comma separated names.
+func formatEventTypes(eventTypes []pb.EventType) string {
+	names := make([]string, 0, len(eventTypes))
+	for _, t := range eventTypes {
+		names = append(names, t.String())
+	}
+	return strings.Join(names, ",")
+}
+
+// splitList splits a comma separated list, an empty string is an empty list.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
@@ -0,0 +1,57 @@
+package logic
+
+import (
+	"github.com/zjy-dev/grpc-go-chatroom/internal/metrics"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// clientQueueSize is the number of messages queued for a client, a client falling
+// further behind is disconnected.
+const clientQueueSize = 1 << 3
+
+// serverMetrics are the metrics of the chat server, see WithMetrics.
+type serverMetrics struct {
+	logins      metrics.CounterVec // by result
+	fanOut      *metrics.Histogram
+	clientQueue *metrics.Histogram
+	slowClients *metrics.Counter
+	purged      *metrics.Counter
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		logins: metrics.NewCounterVec("chatroom_logins_total",
+			`LogInOrRegister calls, by result: "success", "rejected", e.g. for a wrong password, or "error".`, "result"),
+		fanOut: metrics.NewHistogram("chatroom_broadcast_fan_out_seconds",
+			"Duration of the delivery of a message to the queues of its recipients.", metrics.DefaultBuckets),
+		clientQueue: metrics.NewHistogram("chatroom_client_queue_length",
+			"Messages already queued for a client when a message is queued for it. Clients whose queue is full are disconnected.",
+			[]float64{0, 1, 2, 4, clientQueueSize - 1}),
+		slowClients: metrics.NewCounter("chatroom_slow_clients_total",
+			"Chat streams closed because their client fell behind."),
+		purged: metrics.NewCounter("chatroom_messages_purged_total",
+			"Messages deleted by the retention policies."),
+	}
+}
+
+// WithMetrics registers the metrics of the server in reg.
+func WithMetrics(reg *metrics.Registry) ServerOption {
+	return func(cs *chatServiceServer) {
+		reg.MustRegister(cs.metrics.logins, cs.metrics.fanOut, cs.metrics.clientQueue, cs.metrics.slowClients, cs.metrics.purged,
+			metrics.NewGaugeFunc("chatroom_receive_queue_length",
+				"Messages received from clients and waiting to be broadcast.",
+				func() float64 { return float64(len(cs.receiveChan)) }))
+	}
+}
+
+// loginResult returns the result label of a LogInOrRegister call returning err.
+func loginResult(err error) string {
+	switch status.Code(err) {
+	case codes.OK:
+		return "success"
+	case codes.Internal, codes.Unknown:
+		return "error"
+	}
+	return "rejected"
+}
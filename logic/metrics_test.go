@@ -0,0 +1,52 @@
+//go:build unit_test
+
+package logic
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/metrics"
+)
+
+func TestLoginResult(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{err: nil, want: "success"},
+		{err: status.Error(codes.Unauthenticated, "incorrect password"), want: "rejected"},
+		{err: status.Error(codes.AlreadyExists, "already logged in"), want: "rejected"},
+		{err: status.Error(codes.Internal, "failed to check if user exists"), want: "error"},
+		{err: errors.New("not a status"), want: "error"},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.want, loginResult(tt.err), "%v", tt.err)
+	}
+}
+
+func TestWithMetrics(t *testing.T) {
+	reg := metrics.NewRegistry()
+	cs := newCommandTestServer("alice", "bob")
+	WithMetrics(reg)(cs)
+
+	cs.enqueue(context.Background(), &pb.Message{TextContent: "hi"})
+	cs.metrics.clientQueue.Observe(float64(clientQueueSize))
+
+	var b strings.Builder
+	_, err := reg.WriteTo(&b)
+	require.NoError(t, err)
+	require.Contains(t, b.String(), "chatroom_receive_queue_length 1\n")
+	require.Contains(t, b.String(), `chatroom_client_queue_length_bucket{le="7"} 0`)
+	require.Contains(t, b.String(), "chatroom_client_queue_length_count 1\n")
+	require.Contains(t, b.String(), "# TYPE chatroom_logins_total counter\n")
+	require.Contains(t, b.String(), "# TYPE chatroom_broadcast_fan_out_seconds histogram\n")
+}
@@ -0,0 +1,193 @@
+package logic
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/apikey"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/db"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// authorCacheTTL is how long the user ID and display name of an author are
+	// cached, so that the profiles updated on other replicas show up on messages soon.
+	authorCacheTTL = time.Minute
+	// maxCachedAuthors bounds the authors kept in memory before expired ones are forgotten.
+	maxCachedAuthors = 10000
+
+	maxDisplayNameLength = 32   // in characters
+	maxAvatarURLLength   = 2048 // in bytes
+	maxStatusTextLength  = 128  // in characters
+	maxBioLength         = 1024 // in characters
+)
+
+// author is what the broadcast routine needs to know about the sender of a message.
+type author struct {
+	id          int64
+	displayName string // from the profile, empty means username
+	loadedAt    time.Time
+}
+
+// authorCache caches the authors of messages by username, the zero value is ready to use.
+type authorCache struct {
+	mu      sync.Mutex
+	authors map[string]author
+}
+
+// get returns the author of username if it was cached less than authorCacheTTL ago.
+func (c *authorCache) get(username string) (author, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a, ok := c.authors[username]
+	if !ok || time.Since(a.loadedAt) >= authorCacheTTL {
+		return author{}, false
+	}
+	return a, true
+}
+
+// put caches the author of username.
+func (c *authorCache) put(username string, a author) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.authors == nil {
+		c.authors = make(map[string]author)
+	}
+	if len(c.authors) >= maxCachedAuthors {
+		for name, cached := range c.authors {
+			if time.Since(cached.loadedAt) >= authorCacheTTL {
+				delete(c.authors, name)
+			}
+		}
+	}
+	c.authors[username] = a
+}
+
+// resolveAuthor returns the author of the messages of username, from the cache if
+// it is fresh or from the profile of the user otherwise.
+func (cs *chatServiceServer) resolveAuthor(ctx context.Context, username string) (author, error) {
+	if a, ok := cs.authors.get(username); ok {
+		return a, nil
+	}
+	conn, err := dBConn()
+	if err != nil {
+		return author{}, err
+	}
+	profile, err := db.GetProfile(ctx, conn, username)
+	if err != nil {
+		return author{}, err
+	}
+	if profile == nil {
+		return author{}, status.Errorf(codes.NotFound, "user: %s not found", username)
+	}
+	a := author{id: profile.UserID, displayName: profile.DisplayName, loadedAt: time.Now()}
+	cs.authors.put(username, a)
+	return a, nil
+}
+
+// GetProfile is a method that implements the GetProfile method of the ChatServiceServer interface.
+func (cs *chatServiceServer) GetProfile(ctx context.Context, req *pb.GetProfileRequest) (*pb.GetProfileResponse, error) {
+	caller, ok := ctx.Value(JWTContextKey).(string)
+	if !ok || len(caller) == 0 {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid auth token")
+	}
+	if err := requireScope(ctx, apikey.ScopeMessagesRead); err != nil {
+		return nil, err
+	}
+	username := req.GetUsername()
+	if username == "" {
+		username = caller
+	}
+
+	conn, err := dBConn()
+	if err != nil {
+		return nil, err
+	}
+	profile, err := db.GetProfile(ctx, conn, username)
+	if err != nil {
+		return nil, dbError(err, "failed to get profile")
+	}
+	if profile == nil {
+		return nil, status.Errorf(codes.NotFound, "user: %s not found", username)
+	}
+	return &pb.GetProfileResponse{Profile: profileToPB(profile)}, nil
+}
+
+// UpdateProfile is a method that implements the UpdateProfile method of the ChatServiceServer interface.
+func (cs *chatServiceServer) UpdateProfile(ctx context.Context, req *pb.UpdateProfileRequest) (*pb.UpdateProfileResponse, error) {
+	username, ok := ctx.Value(JWTContextKey).(string)
+	if !ok || len(username) == 0 {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid auth token")
+	}
+	if err := requireScope(ctx, apikey.ScopeMessagesWrite); err != nil {
+		return nil, err
+	}
+	if err := validateProfileUpdate(req); err != nil {
+		return nil, err
+	}
+
+	conn, err := dBConn()
+	if err != nil {
+		return nil, err
+	}
+	var profile *db.Profile
+	err = db.WithTx(ctx, conn, func(tx *sql.Tx) error {
+		err := db.UpdateProfile(ctx, tx, username, db.ProfileUpdate{
+			DisplayName: req.DisplayName,
+			AvatarURL:   req.AvatarUrl,
+			StatusText:  req.StatusText,
+			Bio:         req.Bio,
+		})
+		if err != nil {
+			return err
+		}
+		profile, err = db.GetProfile(ctx, tx, username)
+		return err
+	})
+	if err != nil {
+		return nil, dbError(err, "failed to update profile")
+	}
+	if profile == nil {
+		return nil, status.Errorf(codes.NotFound, "user: %s not found", username)
+	}
+	// The next messages of the user carry the new display name right away.
+	cs.authors.put(username, author{id: profile.UserID, displayName: profile.DisplayName, loadedAt: time.Now()})
+	return &pb.UpdateProfileResponse{Profile: profileToPB(profile)}, nil
+}
+
+// validateProfileUpdate checks the length of the fields to update, and that the
+// avatar is an http or https URL. Empty fields are valid, they clear the fields.
+func validateProfileUpdate(req *pb.UpdateProfileRequest) error {
+	if utf8.RuneCountInString(req.GetDisplayName()) > maxDisplayNameLength {
+		return status.Errorf(codes.InvalidArgument, "display_name must be at most %d characters", maxDisplayNameLength)
+	}
+	if utf8.RuneCountInString(req.GetStatusText()) > maxStatusTextLength {
+		return status.Errorf(codes.InvalidArgument, "status_text must be at most %d characters", maxStatusTextLength)
+	}
+	if utf8.RuneCountInString(req.GetBio()) > maxBioLength {
+		return status.Errorf(codes.InvalidArgument, "bio must be at most %d characters", maxBioLength)
+	}
+	if avatar := req.GetAvatarUrl(); avatar != "" {
+		u, err := url.Parse(avatar)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(avatar) > maxAvatarURLLength {
+			return status.Errorf(codes.InvalidArgument, "avatar_url must be an http or https URL of at most %d bytes", maxAvatarURLLength)
+		}
+	}
+	return nil
+}
+
+func profileToPB(p *db.Profile) *pb.UserProfile {
+	return &pb.UserProfile{
+		Username:    p.Username,
+		DisplayName: p.DisplayName,
+		AvatarUrl:   p.AvatarURL,
+		StatusText:  p.StatusText,
+		Bio:         p.Bio,
+	}
+}
@@ -0,0 +1,199 @@
+//go:build unit_test
+
+package logic
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/apikey"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	selectProfile = "SELECT id, username, display_name, avatar_url, status_text, bio FROM users WHERE username = ?;"
+	updateProfile = "UPDATE users SET display_name = COALESCE(?, display_name), avatar_url = COALESCE(?, avatar_url), " +
+		"status_text = COALESCE(?, status_text), bio = COALESCE(?, bio) WHERE username = ?;"
+	insertMessage = "INSERT INTO messages (user_id, username, room, message, type, recipient) VALUES (?, ?, ?, ?, ?, ?);"
+)
+
+var profileColumns = []string{"id", "username", "display_name", "avatar_url", "status_text", "bio"}
+
+func TestBroadcastResolvesAuthor(t *testing.T) {
+	require := require.New(t)
+	db, mock := mockDB()
+	defer db.Close()
+	dbConn.Store(db)
+	defer dbConn.Store(nil)
+	cs := newCommandTestServer("bob")
+
+	// The author is looked up once, then cached
+	mock.ExpectQuery(regexp.QuoteMeta(selectProfile)).WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows(profileColumns).AddRow(7, "alice", "Alice", "", "", ""))
+	for range 2 {
+		mock.ExpectExec(regexp.QuoteMeta(insertMessage)).
+			WithArgs(7, "alice", DefaultRoom, "hi", int32(pb.MessageType_MESSAGE_TYPE_NORMAL), "").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+	}
+	cs.broadcast(queuedMessage{msg: &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Username: "alice", Room: DefaultRoom, TextContent: "hi"}})
+	require.Equal("Alice", lastReply(t, cs, "bob").GetDisplayName())
+
+	// A nickname set by `/nick` wins over the profile
+	cs.broadcast(queuedMessage{msg: &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Username: "alice", Room: DefaultRoom, TextContent: "hi", DisplayName: "Al"}})
+	require.Equal("Al", lastReply(t, cs, "bob").GetDisplayName())
+
+	// The messages of unknown users are dropped
+	mock.ExpectQuery(regexp.QuoteMeta(selectProfile)).WithArgs("ghost").WillReturnRows(sqlmock.NewRows(profileColumns))
+	cs.broadcast(queuedMessage{msg: &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_NORMAL, Username: "ghost", Room: DefaultRoom, TextContent: "boo"}})
+	require.Empty(cs.clientsMap["bob"].messageChan)
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestAuthorCacheExpires(t *testing.T) {
+	require := require.New(t)
+	var c authorCache
+	c.put("alice", author{id: 1, loadedAt: time.Now()})
+	c.put("bob", author{id: 2, loadedAt: time.Now().Add(-authorCacheTTL)})
+
+	a, ok := c.get("alice")
+	require.True(ok)
+	require.EqualValues(1, a.id)
+	_, ok = c.get("bob")
+	require.False(ok)
+	_, ok = c.get("carol")
+	require.False(ok)
+}
+
+func TestGetProfile(t *testing.T) {
+	require := require.New(t)
+	db, mock := mockDB()
+	defer db.Close()
+	dbConn.Store(db)
+	defer dbConn.Store(nil)
+	cs := newCommandTestServer()
+	ctx := context.WithValue(context.Background(), JWTContextKey, "alice")
+
+	// The caller's profile by default
+	mock.ExpectQuery(regexp.QuoteMeta(selectProfile)).WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows(profileColumns).AddRow(1, "alice", "Alice", "https://example.com/a.png", "busy", "Hi"))
+	resp, err := cs.GetProfile(ctx, &pb.GetProfileRequest{})
+	require.NoError(err)
+	require.True(proto.Equal(&pb.UserProfile{Username: "alice", DisplayName: "Alice", AvatarUrl: "https://example.com/a.png", StatusText: "busy", Bio: "Hi"}, resp.GetProfile()))
+
+	mock.ExpectQuery(regexp.QuoteMeta(selectProfile)).WithArgs("ghost").WillReturnRows(sqlmock.NewRows(profileColumns))
+	_, err = cs.GetProfile(ctx, &pb.GetProfileRequest{Username: "ghost"})
+	require.Equal(codes.NotFound, status.Code(err))
+
+	mock.ExpectQuery(regexp.QuoteMeta(selectProfile)).WithArgs("bob").WillReturnError(errConnRefused)
+	_, err = cs.GetProfile(ctx, &pb.GetProfileRequest{Username: "bob"})
+	require.Equal(codes.Unavailable, status.Code(err))
+
+	_, err = cs.GetProfile(botContext("ci-bot", apikey.ScopeMessagesWrite), &pb.GetProfileRequest{Username: "alice"})
+	require.Equal(codes.PermissionDenied, status.Code(err))
+	_, err = cs.GetProfile(context.Background(), &pb.GetProfileRequest{Username: "alice"})
+	require.Equal(codes.Unauthenticated, status.Code(err))
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestUpdateProfile(t *testing.T) {
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		req       *pb.UpdateProfileRequest
+		mockSetup func(mock sqlmock.Sqlmock)
+		expected  *pb.UserProfile
+		code      codes.Code
+	}{
+		{
+			name: "update",
+			ctx:  context.WithValue(context.Background(), JWTContextKey, "alice"),
+			req:  &pb.UpdateProfileRequest{DisplayName: proto.String("Alice"), Bio: proto.String("")},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(regexp.QuoteMeta(updateProfile)).
+					WithArgs("Alice", nil, nil, "", "alice").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery(regexp.QuoteMeta(selectProfile)).WithArgs("alice").
+					WillReturnRows(sqlmock.NewRows(profileColumns).AddRow(1, "alice", "Alice", "", "busy", ""))
+				mock.ExpectCommit()
+			},
+			expected: &pb.UserProfile{Username: "alice", DisplayName: "Alice", StatusText: "busy"},
+		},
+		{
+			name: "database failure",
+			ctx:  context.WithValue(context.Background(), JWTContextKey, "alice"),
+			req:  &pb.UpdateProfileRequest{StatusText: proto.String("away")},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectBegin()
+				mock.ExpectExec(regexp.QuoteMeta(updateProfile)).WillReturnError(errors.New("syntax error"))
+				mock.ExpectRollback()
+			},
+			code: codes.Internal,
+		},
+		{
+			name: "display name too long",
+			ctx:  context.WithValue(context.Background(), JWTContextKey, "alice"),
+			req:  &pb.UpdateProfileRequest{DisplayName: proto.String(strings.Repeat("名", maxDisplayNameLength+1))},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "avatar not an http URL",
+			ctx:  context.WithValue(context.Background(), JWTContextKey, "alice"),
+			req:  &pb.UpdateProfileRequest{AvatarUrl: proto.String("javascript:alert(1)")},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "bio too long",
+			ctx:  context.WithValue(context.Background(), JWTContextKey, "alice"),
+			req:  &pb.UpdateProfileRequest{Bio: proto.String(strings.Repeat("a", maxBioLength+1))},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "bot without write scope",
+			ctx:  botContext("ci-bot", apikey.ScopeMessagesRead),
+			req:  &pb.UpdateProfileRequest{DisplayName: proto.String("CI")},
+			code: codes.PermissionDenied,
+		},
+		{
+			name: "unauthenticated",
+			ctx:  context.Background(),
+			req:  &pb.UpdateProfileRequest{},
+			code: codes.Unauthenticated,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			db, mock := mockDB()
+			defer db.Close()
+			dbConn.Store(db)
+			defer dbConn.Store(nil)
+			if tt.mockSetup != nil {
+				tt.mockSetup(mock)
+			}
+			cs := newCommandTestServer()
+
+			resp, err := cs.UpdateProfile(tt.ctx, tt.req)
+			require.Equal(tt.code, status.Code(err))
+			require.NoError(mock.ExpectationsWereMet())
+			if tt.code != codes.OK {
+				return
+			}
+			require.True(proto.Equal(tt.expected, resp.GetProfile()))
+			// The new display name goes on the next messages right away
+			a, ok := cs.authors.get("alice")
+			require.True(ok)
+			require.Equal(tt.expected.GetDisplayName(), a.displayName)
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package logic
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"slices"
+	"time"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/config"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/db"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// retentionIdleInterval is how often RunRetention checks whether a reload enabled
+// the retention policies while they are disabled.
+const retentionIdleInterval = time.Minute
+
+// RunRetention purges the messages beyond the retention policies every
+// retention.interval until ctx is done. The policies follow config reloads.
+// Replicas purging at the same time only delete the same messages.
+func (cs *chatServiceServer) RunRetention(ctx context.Context) {
+	for {
+		interval := retentionIdleInterval
+		if policy := cs.retention.Load(); policy != nil && policy.Enabled() {
+			interval = policy.Interval
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		policy := cs.retention.Load()
+		if policy == nil || !policy.Enabled() {
+			continue
+		}
+		start := time.Now()
+		rooms, err := cs.purge(ctx, policy, false)
+		var total uint64
+		for _, room := range rooms {
+			total += room.GetMessages()
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to purge messages", "purged", total, "error", err)
+			continue
+		}
+		slog.InfoContext(ctx, "purged messages", "purged", total, "rooms", len(rooms), "duration", time.Since(start))
+	}
+}
+
+// purge deletes the messages beyond policy, or only counts them if dryRun, and
+// returns the rooms with messages to delete. The messages of a room are deleted
+// in batches of policy.BatchSize, so that other queries are not held up.
+// The rooms purged before an error are returned along with it.
+func (cs *chatServiceServer) purge(ctx context.Context, policy *config.RetentionConfig, dryRun bool) ([]*pb.RoomPurge, error) {
+	conn, err := dBConn()
+	if err != nil {
+		return nil, err
+	}
+	rooms, err := db.ListMessageRooms(ctx, conn)
+	cs.database.record(err)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var purged []*pb.RoomPurge
+	for _, room := range rooms {
+		maxAge, maxMessages := policy.Policy(room)
+		if slices.Contains(policy.LegalHold.Rooms, room) || (maxAge == 0 && maxMessages == 0) {
+			continue
+		}
+		filter := db.PurgeFilter{Room: room, HeldUsers: policy.LegalHold.Users}
+		if maxAge > 0 {
+			filter.Before = now.Add(-maxAge)
+		}
+		if maxMessages > 0 {
+			if filter.BelowID, err = db.NthNewestMessageID(ctx, conn, room, maxMessages); err != nil {
+				cs.database.record(err)
+				return purged, err
+			}
+		}
+
+		var n int64
+		if dryRun {
+			n, err = db.CountPurgeableMessages(ctx, conn, filter)
+		} else {
+			n, err = cs.purgeRoom(ctx, conn, filter, policy.BatchSize, policy.BatchPause)
+		}
+		cs.database.record(err)
+		if n > 0 {
+			purged = append(purged, &pb.RoomPurge{
+				Room:        room,
+				Messages:    uint64(n),
+				MaxAge:      int64(maxAge / time.Second),
+				MaxMessages: uint32(maxMessages),
+			})
+		}
+		if err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+// purgeRoom deletes the messages selected by filter in batches, pausing between
+// them, and returns how many it deleted.
+func (cs *chatServiceServer) purgeRoom(ctx context.Context, conn *sql.DB, filter db.PurgeFilter, batchSize int, pause time.Duration) (int64, error) {
+	var total int64
+	for {
+		n, err := db.PurgeMessages(ctx, conn, filter, batchSize)
+		total += n
+		cs.metrics.purged.Add(float64(n))
+		if err != nil || n < int64(batchSize) {
+			return total, err
+		}
+		select {
+		case <-ctx.Done():
+			return total, ctx.Err()
+		case <-time.After(pause):
+		}
+	}
+}
+
+// PurgeMessages is a method that implements the PurgeMessages method of the ChatServiceServer interface.
+func (cs *chatServiceServer) PurgeMessages(ctx context.Context, req *pb.PurgeMessagesRequest) (*pb.PurgeMessagesResponse, error) {
+	username, err := cs.requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	policy := cs.retention.Load()
+	if policy == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "the server has no retention policy")
+	}
+
+	rooms, err := cs.purge(ctx, policy, req.GetDryRun())
+	resp := &pb.PurgeMessagesResponse{Rooms: rooms}
+	for _, room := range rooms {
+		resp.Total += room.GetMessages()
+	}
+	if !req.GetDryRun() {
+		slog.InfoContext(ctx, "messages purged by an admin", "admin", username, "purged", resp.Total)
+	}
+	if err != nil {
+		return nil, dbError(err, "failed to purge messages")
+	}
+	return resp, nil
+}
@@ -0,0 +1,112 @@
+//go:build unit_test
+
+package logic
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	listMessageRooms = "SELECT DISTINCT room FROM messages ORDER BY room;"
+	nthNewestMessage = "SELECT id FROM messages WHERE room = ? ORDER BY id DESC LIMIT 1 OFFSET ?;"
+)
+
+// testRetention keeps 100 messages in general, 30 days of messages in random,
+// and every message of audit and of mallory.
+var testRetention = config.RetentionConfig{
+	MaxMessages: 100,
+	Rooms:       []config.RoomRetention{{Room: "random", MaxAge: 720 * time.Hour}},
+	LegalHold:   config.LegalHoldConfig{Rooms: []string{"audit"}, Users: []string{"mallory"}},
+	Interval:    time.Hour,
+	BatchSize:   2,
+}
+
+func TestPurgeMessagesDryRun(t *testing.T) {
+	require := require.New(t)
+	db, mock := mockDB()
+	defer db.Close()
+	dbConn.Store(db)
+	defer dbConn.Store(nil)
+	cs := newCommandTestServer()
+	cs.retention.Store(&testRetention)
+
+	mock.ExpectQuery(regexp.QuoteMeta(listMessageRooms)).
+		WillReturnRows(sqlmock.NewRows([]string{"room"}).AddRow("audit").AddRow("general").AddRow("random"))
+	mock.ExpectQuery(regexp.QuoteMeta(nthNewestMessage)).WithArgs("general", 99).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(500))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM messages WHERE room = ? AND (id < ?) AND username NOT IN (?);")).
+		WithArgs("general", 500, "mallory").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(399))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM messages WHERE room = ? AND (created_at < FROM_UNIXTIME(?)) AND username NOT IN (?);")).
+		WithArgs("random", sqlmock.AnyArg(), "mallory").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+
+	resp, err := cs.PurgeMessages(context.WithValue(context.Background(), JWTContextKey, "admin"), &pb.PurgeMessagesRequest{DryRun: true})
+	require.NoError(err)
+	require.True(proto.Equal(&pb.PurgeMessagesResponse{
+		Rooms: []*pb.RoomPurge{{Room: "general", Messages: 399, MaxMessages: 100}},
+		Total: 399,
+	}, resp))
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestPurgeMessagesInBatches(t *testing.T) {
+	require := require.New(t)
+	db, mock := mockDB()
+	defer db.Close()
+	dbConn.Store(db)
+	defer dbConn.Store(nil)
+	cs := newCommandTestServer()
+	policy := config.RetentionConfig{MaxMessages: 100, BatchSize: 2}
+
+	selectIDs := regexp.QuoteMeta("SELECT id FROM messages WHERE room = ? AND (id < ?) ORDER BY id LIMIT ?;")
+	deleteIDs := regexp.QuoteMeta("DELETE FROM messages WHERE id IN (")
+	mock.ExpectQuery(regexp.QuoteMeta(listMessageRooms)).WillReturnRows(sqlmock.NewRows([]string{"room"}).AddRow("general"))
+	mock.ExpectQuery(regexp.QuoteMeta(nthNewestMessage)).WithArgs("general", 99).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4))
+	mock.ExpectQuery(selectIDs).WithArgs("general", 4, 2).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+	mock.ExpectExec(deleteIDs).WithArgs(1, 2).WillReturnResult(sqlmock.NewResult(0, 2))
+	// The last batch is not full
+	mock.ExpectQuery(selectIDs).WithArgs("general", 4, 2).WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectExec(deleteIDs).WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	rooms, err := cs.purge(context.Background(), &policy, false)
+	require.NoError(err)
+	require.Len(rooms, 1)
+	require.EqualValues(3, rooms[0].GetMessages())
+	require.EqualValues(3, cs.metrics.purged.Value())
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestPurgeMessagesErrors(t *testing.T) {
+	require := require.New(t)
+	db, mock := mockDB()
+	defer db.Close()
+	dbConn.Store(db)
+	defer dbConn.Store(nil)
+	cs := newCommandTestServer()
+	adminCtx := context.WithValue(context.Background(), JWTContextKey, "admin")
+
+	_, err := cs.PurgeMessages(context.WithValue(context.Background(), JWTContextKey, "alice"), &pb.PurgeMessagesRequest{DryRun: true})
+	require.Equal(codes.PermissionDenied, status.Code(err))
+
+	_, err = cs.PurgeMessages(adminCtx, &pb.PurgeMessagesRequest{DryRun: true})
+	require.Equal(codes.FailedPrecondition, status.Code(err))
+
+	cs.retention.Store(&testRetention)
+	mock.ExpectQuery(regexp.QuoteMeta(listMessageRooms)).WillReturnError(errConnRefused)
+	_, err = cs.PurgeMessages(adminCtx, &pb.PurgeMessagesRequest{})
+	require.Equal(codes.Unavailable, status.Code(err))
+	require.NoError(mock.ExpectationsWereMet())
+}
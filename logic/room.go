@@ -0,0 +1,110 @@
+package logic
+
+import (
+	"context"
+	"sort"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/apikey"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/db"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ListOnlineUsers is a method that implements the ListOnlineUsers method of the ChatServiceServer interface.
+func (cs *chatServiceServer) ListOnlineUsers(ctx context.Context, req *pb.ListOnlineUsersRequest) (*pb.ListOnlineUsersResponse, error) {
+	if username, ok := ctx.Value(JWTContextKey).(string); !ok || len(username) == 0 {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid auth token")
+	}
+	if err := requireScope(ctx, apikey.ScopeMessagesRead); err != nil {
+		return nil, err
+	}
+
+	cs.mu.Lock()
+	users := make([]*pb.OnlineUser, 0, len(cs.clientsMap))
+	for username, cli := range cs.clientsMap {
+		// Users who logged in but have not opened a Chat stream are not online.
+		if cli.messageChan == nil || (req.GetRoom() != "" && cli.room != req.GetRoom()) {
+			continue
+		}
+		users = append(users, &pb.OnlineUser{Username: username, DisplayName: cli.displayName, Room: cli.room})
+	}
+	cs.mu.Unlock()
+
+	sort.Slice(users, func(i, j int) bool { return users[i].GetUsername() < users[j].GetUsername() })
+	return &pb.ListOnlineUsersResponse{Users: users}, nil
+}
+
+// ListRooms is a method that implements the ListRooms method of the ChatServiceServer interface.
+func (cs *chatServiceServer) ListRooms(ctx context.Context, _ *pb.ListRoomsRequest) (*pb.ListRoomsResponse, error) {
+	if username, ok := ctx.Value(JWTContextKey).(string); !ok || len(username) == 0 {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid auth token")
+	}
+	if err := requireScope(ctx, apikey.ScopeMessagesRead); err != nil {
+		return nil, err
+	}
+
+	cs.mu.Lock()
+	rooms := map[string]*pb.Room{DefaultRoom: {Name: DefaultRoom}}
+	for name, topic := range cs.topics {
+		rooms[name] = &pb.Room{Name: name, Topic: topic}
+	}
+	for _, cli := range cs.clientsMap {
+		if cli.messageChan == nil {
+			continue
+		}
+		room, ok := rooms[cli.room]
+		if !ok {
+			room = &pb.Room{Name: cli.room}
+			rooms[cli.room] = room
+		}
+		room.UserCount++
+	}
+	cs.mu.Unlock()
+
+	resp := &pb.ListRoomsResponse{Rooms: make([]*pb.Room, 0, len(rooms))}
+	for _, room := range rooms {
+		resp.Rooms = append(resp.Rooms, room)
+	}
+	sort.Slice(resp.Rooms, func(i, j int) bool { return resp.Rooms[i].GetName() < resp.Rooms[j].GetName() })
+	return resp, nil
+}
+
+const (
+	// defaultHistoryLimit is the number of messages GetHistory returns if not asked for a number.
+	defaultHistoryLimit = 50
+	// maxHistoryLimit caps the number of messages one GetHistory call returns.
+	maxHistoryLimit = 500
+)
+
+// GetHistory is a method that implements the GetHistory method of the ChatServiceServer interface.
+func (cs *chatServiceServer) GetHistory(ctx context.Context, req *pb.GetHistoryRequest) (*pb.GetHistoryResponse, error) {
+	if username, ok := ctx.Value(JWTContextKey).(string); !ok || len(username) == 0 {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid auth token")
+	}
+	if err := requireScope(ctx, apikey.ScopeMessagesRead); err != nil {
+		return nil, err
+	}
+	room := req.GetRoom()
+	if room == "" {
+		room = DefaultRoom
+	}
+	if !roomNameRegexp.MatchString(room) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid room name: %q", room)
+	}
+	limit := int(req.GetLimit())
+	if limit == 0 {
+		limit = defaultHistoryLimit
+	}
+	limit = min(limit, maxHistoryLimit)
+
+	conn, err := dBConn()
+	if err != nil {
+		return nil, err
+	}
+	messages, err := db.GetRoomMessages(ctx, conn, room, req.GetBefore(), limit)
+	if err != nil {
+		return nil, dbError(err, "failed to get messages")
+	}
+	return &pb.GetHistoryResponse{Messages: messages}, nil
+}
@@ -0,0 +1,140 @@
+//go:build unit_test
+
+package logic
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/apikey"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestListOnlineUsers(t *testing.T) {
+	require := require.New(t)
+	cs := newCommandTestServer("bob", "alice")
+	cs.clientsMap["carol"] = client{messageChan: make(chan *pb.Message, 8), room: "random", displayName: "Carol"}
+	// Logged in without a Chat stream
+	cs.clientsMap["dave"] = client{room: DefaultRoom}
+	ctx := context.WithValue(context.Background(), JWTContextKey, "alice")
+
+	resp, err := cs.ListOnlineUsers(ctx, &pb.ListOnlineUsersRequest{})
+	require.NoError(err)
+	require.Equal([]string{"alice", "bob", "carol"}, onlineUsernames(resp))
+	require.Equal("Carol", resp.GetUsers()[2].GetDisplayName())
+	require.Equal("random", resp.GetUsers()[2].GetRoom())
+
+	resp, err = cs.ListOnlineUsers(ctx, &pb.ListOnlineUsersRequest{Room: "random"})
+	require.NoError(err)
+	require.Equal([]string{"carol"}, onlineUsernames(resp))
+
+	_, err = cs.ListOnlineUsers(context.Background(), &pb.ListOnlineUsersRequest{})
+	require.Equal(codes.Unauthenticated, status.Code(err))
+
+	_, err = cs.ListOnlineUsers(botContext("ci-bot", apikey.ScopeMessagesWrite), &pb.ListOnlineUsersRequest{})
+	require.Equal(codes.PermissionDenied, status.Code(err))
+}
+
+func onlineUsernames(resp *pb.ListOnlineUsersResponse) []string {
+	usernames := make([]string, 0, len(resp.GetUsers()))
+	for _, user := range resp.GetUsers() {
+		usernames = append(usernames, user.GetUsername())
+	}
+	return usernames
+}
+
+func TestListRooms(t *testing.T) {
+	require := require.New(t)
+	cs := newCommandTestServer("alice", "bob")
+	cs.clientsMap["carol"] = client{messageChan: make(chan *pb.Message, 8), room: "random"}
+	cs.topics["go"] = "all things Go"
+	ctx := context.WithValue(context.Background(), JWTContextKey, "alice")
+
+	resp, err := cs.ListRooms(ctx, &pb.ListRoomsRequest{})
+	require.NoError(err)
+	require.Len(resp.GetRooms(), 3)
+	require.Equal(&pb.Room{Name: DefaultRoom, UserCount: 2}, resp.GetRooms()[0])
+	require.Equal(&pb.Room{Name: "go", Topic: "all things Go"}, resp.GetRooms()[1])
+	require.Equal(&pb.Room{Name: "random", UserCount: 1}, resp.GetRooms()[2])
+
+	_, err = cs.ListRooms(context.Background(), &pb.ListRoomsRequest{})
+	require.Equal(codes.Unauthenticated, status.Code(err))
+}
+
+func TestGetHistory(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	prev := dbConn.Swap(db)
+	t.Cleanup(func() { dbConn.Store(prev) })
+
+	cs := newCommandTestServer("alice")
+	ctx := context.WithValue(context.Background(), JWTContextKey, "alice")
+	rows := func() *sqlmock.Rows {
+		return sqlmock.NewRows([]string{"id", "username", "room", "message", "type", "created_at"}).
+			AddRow(3, "bob", "random", "hi", 3, 1723680000)
+	}
+
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		req       *pb.GetHistoryRequest
+		mock      func()
+		wantCode  codes.Code
+		wantCount int
+	}{
+		{
+			name: "defaults",
+			ctx:  ctx,
+			req:  &pb.GetHistoryRequest{},
+			mock: func() {
+				mock.ExpectQuery("SELECT (.+) FROM messages").WithArgs(DefaultRoom, 6, 7, sqlmock.AnyArg(), defaultHistoryLimit).WillReturnRows(rows())
+			},
+			wantCount: 1,
+		},
+		{
+			name: "limit is capped",
+			ctx:  ctx,
+			req:  &pb.GetHistoryRequest{Room: "random", Limit: 10000, Before: 9},
+			mock: func() {
+				mock.ExpectQuery("SELECT (.+) FROM messages").WithArgs("random", 6, 7, 9, maxHistoryLimit).WillReturnRows(rows())
+			},
+			wantCount: 1,
+		},
+		{
+			name:     "invalid room",
+			ctx:      ctx,
+			req:      &pb.GetHistoryRequest{Room: "no spaces"},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "bot without read scope",
+			ctx:      botContext("ci-bot", apikey.ScopeMessagesWrite),
+			req:      &pb.GetHistoryRequest{},
+			wantCode: codes.PermissionDenied,
+		},
+		{
+			name:     "unauthenticated",
+			ctx:      context.Background(),
+			req:      &pb.GetHistoryRequest{},
+			wantCode: codes.Unauthenticated,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			if tt.mock != nil {
+				tt.mock()
+			}
+			resp, err := cs.GetHistory(tt.ctx, tt.req)
+			require.Equal(tt.wantCode, status.Code(err))
+			require.Len(resp.GetMessages(), tt.wantCount)
+			require.NoError(mock.ExpectationsWereMet())
+		})
+	}
+}
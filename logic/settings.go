@@ -0,0 +1,162 @@
+package logic
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/config"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxLimitedUsers bounds the rate limiters kept in memory before idle ones are forgotten.
+const maxLimitedUsers = 10000
+
+// messageSettings are the reloadable settings applied to the messages of users and bots.
+// The zero value applies no limit and no filter.
+type messageSettings struct {
+	maxLength     int            // in bytes, 0 means unlimited
+	blocked       *regexp.Regexp // matches the blocked words, nil if there are none
+	rejectBlocked bool           // reject messages with blocked words instead of masking them
+}
+
+func newMessageSettings(limits config.LimitsConfig, filter config.ContentFilterConfig) *messageSettings {
+	settings := &messageSettings{
+		maxLength:     limits.MaxMessageLength,
+		rejectBlocked: filter.Action == config.FilterActionReject,
+	}
+	if len(filter.BlockedWords) > 0 {
+		words := make([]string, len(filter.BlockedWords))
+		for i, word := range filter.BlockedWords {
+			words[i] = regexp.QuoteMeta(strings.TrimSpace(word))
+		}
+		settings.blocked = regexp.MustCompile("(?i)" + strings.Join(words, "|"))
+	}
+	return settings
+}
+
+// WithConfigReloader applies the reloadable settings of the reloader's config and
+// follows its reloads, and lets admins trigger reloads by ReloadConfig.
+func WithConfigReloader(r *config.Reloader) ServerOption {
+	return func(cs *chatServiceServer) {
+		cs.reloader = r
+		cs.applyConfig(r.Current())
+		r.OnChange(cs.applyConfig)
+	}
+}
+
+// applyConfig swaps in the reloadable settings of cfg.
+func (cs *chatServiceServer) applyConfig(cfg *config.ServerConfig) {
+	cs.settings.Store(newMessageSettings(cfg.Limits, cfg.ContentFilter))
+	cs.limiter.setLimit(cfg.Limits.MessagesPerSecond, cfg.Limits.MessageBurst)
+	cs.retention.Store(&cfg.Retention)
+}
+
+func (cs *chatServiceServer) messageSettings() *messageSettings {
+	if settings := cs.settings.Load(); settings != nil {
+		return settings
+	}
+	return &messageSettings{}
+}
+
+// checkMessage applies the rate limit, the size limit and the content filter to
+// text sent by username, and returns the text to send, with blocked words masked.
+func (cs *chatServiceServer) checkMessage(username, text string) (string, error) {
+	if !cs.limiter.allow(username) {
+		return "", status.Errorf(codes.ResourceExhausted, "too many messages, slow down")
+	}
+	settings := cs.messageSettings()
+	if settings.maxLength > 0 && len(text) > settings.maxLength {
+		return "", status.Errorf(codes.InvalidArgument, "message is too long, the limit is %d bytes", settings.maxLength)
+	}
+	if settings.blocked == nil || !settings.blocked.MatchString(text) {
+		return text, nil
+	}
+	if settings.rejectBlocked {
+		return "", status.Errorf(codes.InvalidArgument, "message contains blocked words")
+	}
+	return settings.blocked.ReplaceAllStringFunc(text, func(word string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(word))
+	}), nil
+}
+
+// userLimiter rate limits the messages of every user, the zero value limits nothing.
+type userLimiter struct {
+	mu    sync.Mutex
+	limit rate.Limit // messages per second, 0 means unlimited
+	burst int
+	users map[string]*rate.Limiter
+}
+
+// allow reports whether username may send a message now.
+func (l *userLimiter) allow(username string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit == 0 {
+		return true
+	}
+	lim, ok := l.users[username]
+	if !ok {
+		if l.users == nil {
+			l.users = make(map[string]*rate.Limiter)
+		}
+		if len(l.users) >= maxLimitedUsers {
+			l.pruneLocked()
+		}
+		lim = rate.NewLimiter(l.limit, l.burst)
+		l.users[username] = lim
+	}
+	return lim.Allow()
+}
+
+// setLimit changes the limit of every user, keeping the tokens they have left.
+func (l *userLimiter) setLimit(perSecond float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit, l.burst = rate.Limit(perSecond), burst
+	if l.limit == 0 {
+		l.users = nil
+		return
+	}
+	for _, lim := range l.users {
+		lim.SetLimit(l.limit)
+		lim.SetBurst(burst)
+	}
+}
+
+// pruneLocked forgets the users with full buckets, who would start over with a full bucket anyway.
+// NOTE: The caller must hold l.mu.
+func (l *userLimiter) pruneLocked() {
+	now := time.Now()
+	for username, lim := range l.users {
+		if lim.TokensAt(now) >= float64(l.burst) {
+			delete(l.users, username)
+		}
+	}
+}
+
+// ReloadConfig is a method that implements the ReloadConfig method of the ChatServiceServer interface.
+func (cs *chatServiceServer) ReloadConfig(ctx context.Context, _ *pb.ReloadConfigRequest) (*pb.ReloadConfigResponse, error) {
+	admin, err := cs.requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cs.reloader == nil {
+		return nil, status.Errorf(codes.Unimplemented, "config reloading is not enabled")
+	}
+
+	changed, err := cs.reloader.Reload()
+	if err != nil {
+		slog.WarnContext(ctx, "config reload rejected", "admin", admin, "error", err)
+		return nil, status.Errorf(codes.FailedPrecondition, "config reload rejected: %v", err)
+	}
+	slog.InfoContext(ctx, "config reloaded", "admin", admin, "changed", changed)
+	return &pb.ReloadConfigResponse{ChangedKeys: changed}, nil
+}
@@ -0,0 +1,147 @@
+//go:build unit_test
+
+package logic
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheckMessage(t *testing.T) {
+	tests := []struct {
+		name          string
+		limits        config.LimitsConfig
+		filter        config.ContentFilterConfig
+		text          string
+		expectedText  string
+		expectedError error
+	}{
+		{
+			name:         "no limits",
+			text:         "hello",
+			expectedText: "hello",
+		},
+		{
+			name:          "too long",
+			limits:        config.LimitsConfig{MaxMessageLength: 4},
+			text:          "hello",
+			expectedError: status.Errorf(codes.InvalidArgument, "message is too long, the limit is 4 bytes"),
+		},
+		{
+			name:         "blocked words are masked",
+			filter:       config.ContentFilterConfig{BlockedWords: []string{"darn", "h.ck"}, Action: config.FilterActionMask},
+			text:         "DARN it, what the h.ck, heck",
+			expectedText: "**** it, what the ****, heck",
+		},
+		{
+			name:          "blocked words are rejected",
+			filter:        config.ContentFilterConfig{BlockedWords: []string{"darn"}, Action: config.FilterActionReject},
+			text:          "darn it",
+			expectedError: status.Errorf(codes.InvalidArgument, "message contains blocked words"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			cs := newCommandTestServer()
+			cs.applyConfig(&config.ServerConfig{Limits: tt.limits, ContentFilter: tt.filter})
+
+			text, err := cs.checkMessage("alice", tt.text)
+			if tt.expectedError != nil {
+				require.Equal(tt.expectedError, err)
+				return
+			}
+			require.NoError(err)
+			require.Equal(tt.expectedText, text)
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	require := require.New(t)
+	cs := newCommandTestServer("alice")
+	cs.applyConfig(&config.ServerConfig{Limits: config.LimitsConfig{MessagesPerSecond: 0.001, MessageBurst: 2}})
+
+	for i := 0; i < 2; i++ {
+		_, err := cs.checkMessage("alice", "hi")
+		require.NoError(err)
+	}
+	_, err := cs.checkMessage("alice", "hi")
+	require.Equal(status.Errorf(codes.ResourceExhausted, "too many messages, slow down"), err)
+	// Others have their own limit
+	_, err = cs.checkMessage("bob", "hi")
+	require.NoError(err)
+
+	// Bots are limited as well
+	_, err = cs.PostMessage(botContext("alice", "messages:write"), &pb.PostMessageRequest{TextContent: "hi"})
+	require.Equal(codes.ResourceExhausted, status.Code(err))
+
+	// Zero disables the limit
+	cs.applyConfig(&config.ServerConfig{})
+	for i := 0; i < 10; i++ {
+		_, err = cs.checkMessage("alice", "hi")
+		require.NoError(err)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	adminCtx := context.WithValue(context.Background(), JWTContextKey, "admin")
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(file, []byte("limits:\n  max_message_length: 10\n"), 0o600))
+	env := map[string]string{
+		"GRPC_GO_CHATROOM_DATABASE_USER":     "user",
+		"GRPC_GO_CHATROOM_DATABASE_PASSWORD": "pwd",
+		"GRPC_GO_CHATROOM_DATABASE_DBNAME":   "chat",
+		"GRPC_GO_CHATROOM_JWT_KEY":           "key",
+	}
+	opts := config.Options{File: file, LookupEnv: func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}}
+	cfg, err := config.LoadServer(opts)
+	require.NoError(t, err)
+
+	t.Run("not admin", func(t *testing.T) {
+		cs := newCommandTestServer()
+		_, err := cs.ReloadConfig(context.WithValue(context.Background(), JWTContextKey, "alice"), &pb.ReloadConfigRequest{})
+		require.Equal(t, status.Errorf(codes.PermissionDenied, "user: alice is not an admin"), err)
+	})
+
+	t.Run("not enabled", func(t *testing.T) {
+		cs := newCommandTestServer()
+		_, err := cs.ReloadConfig(adminCtx, &pb.ReloadConfigRequest{})
+		require.Equal(t, codes.Unimplemented, status.Code(err))
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		require := require.New(t)
+		cs := newCommandTestServer()
+		WithConfigReloader(config.NewReloader(opts, cfg))(cs)
+		_, err := cs.checkMessage("alice", "more than ten bytes")
+		require.Error(err)
+
+		require.NoError(os.WriteFile(file, []byte("limits:\n  max_message_length: 100\n"), 0o600))
+		resp, err := cs.ReloadConfig(adminCtx, &pb.ReloadConfigRequest{})
+		require.NoError(err)
+		require.Equal([]string{"limits.max_message_length"}, resp.GetChangedKeys())
+		_, err = cs.checkMessage("alice", "more than ten bytes")
+		require.NoError(err)
+
+		// Rejected reloads keep the running config
+		require.NoError(os.WriteFile(file, []byte("limits:\n  max_message_length: 10\nserver:\n  port: 1\n"), 0o600))
+		_, err = cs.ReloadConfig(adminCtx, &pb.ReloadConfigRequest{})
+		require.Equal(codes.FailedPrecondition, status.Code(err))
+		require.Contains(status.Convert(err).Message(), "server.port: can not be changed without a restart")
+		_, err = cs.checkMessage("alice", "more than ten bytes")
+		require.NoError(err)
+	})
+}
@@ -0,0 +1,102 @@
+package logic
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/health"
+)
+
+// broadcastStallTimeout is how long the broadcast routine may spend on a message
+// before it is considered stuck, e.g. on a client whose queue stays full.
+const broadcastStallTimeout = 30 * time.Second
+
+// broadcastState tracks the broadcast routine for the health checks.
+type broadcastState struct {
+	running   atomic.Bool
+	busySince atomic.Int64 // Unix time in nanoseconds of the message being broadcast, 0 if idle
+}
+
+// WithHealthChecker adds the health of the server to the status reported by
+// GetServerStatus, see also CheckBroadcast.
+func WithHealthChecker(checker *health.Checker) ServerOption {
+	return func(cs *chatServiceServer) {
+		cs.health = checker
+	}
+}
+
+// CheckBroadcast returns an error if the broadcast routine is not running or is
+// stuck on a message, in which case the server needs a restart.
+func (cs *chatServiceServer) CheckBroadcast(context.Context) error {
+	if !cs.broadcaster.running.Load() {
+		return fmt.Errorf("the broadcast routine is not running")
+	}
+	if since := cs.broadcaster.busySince.Load(); since != 0 {
+		if busy := time.Since(time.Unix(0, since)); busy > broadcastStallTimeout {
+			return fmt.Errorf("the broadcast routine is stuck on a message for %s", busy.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// GetServerStatus is a method that implements the GetServerStatus method of the ChatServiceServer interface.
+func (cs *chatServiceServer) GetServerStatus(ctx context.Context, _ *pb.GetServerStatusRequest) (*pb.GetServerStatusResponse, error) {
+	if _, err := cs.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	resp := &pb.GetServerStatusResponse{
+		ReceiveQueueLength:   uint32(len(cs.receiveChan)),
+		ReceiveQueueCapacity: uint32(cap(cs.receiveChan)),
+		Build:                buildInfo(),
+		StartTime:            cs.startTime.Unix(),
+	}
+	if cs.health != nil {
+		for _, result := range cs.health.Run(ctx, false) {
+			check := &pb.HealthCheck{Name: result.Name, Healthy: result.Err == nil}
+			if result.Err != nil {
+				check.Error = result.Err.Error()
+			}
+			resp.Checks = append(resp.Checks, check)
+		}
+	}
+
+	cs.mu.Lock()
+	for username, cli := range cs.clientsMap {
+		user := &pb.UserStatus{Username: username}
+		if cli.messageChan != nil {
+			user.Online, user.Room = true, cli.room
+			user.QueueLength, user.QueueCapacity = uint32(len(cli.messageChan)), uint32(cap(cli.messageChan))
+		}
+		resp.Users = append(resp.Users, user)
+	}
+	cs.mu.Unlock()
+
+	sort.Slice(resp.Users, func(i, j int) bool { return resp.Users[i].GetUsername() < resp.Users[j].GetUsername() })
+	return resp, nil
+}
+
+// buildInfo describes the build of the running binary.
+func buildInfo() *pb.BuildInfo {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return &pb.BuildInfo{}
+	}
+	build := &pb.BuildInfo{Version: info.Main.Version, GoVersion: info.GoVersion}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			build.Revision = setting.Value
+		case "vcs.time":
+			build.RevisionTime = setting.Value
+		case "vcs.modified":
+			build.Modified = setting.Value == "true"
+		}
+	}
+	return build
+}
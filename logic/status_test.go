@@ -0,0 +1,94 @@
+//go:build unit_test
+
+package logic
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/health"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheckBroadcast(t *testing.T) {
+	tests := []struct {
+		name          string
+		running       bool
+		busyFor       time.Duration
+		expectedError string
+	}{
+		{name: "not running", expectedError: "the broadcast routine is not running"},
+		{name: "idle", running: true},
+		{name: "busy", running: true, busyFor: time.Second},
+		{name: "stuck", running: true, busyFor: time.Minute, expectedError: "the broadcast routine is stuck on a message for 1m0s"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := newCommandTestServer()
+			cs.broadcaster.running.Store(tt.running)
+			if tt.busyFor != 0 {
+				cs.broadcaster.busySince.Store(time.Now().Add(-tt.busyFor).UnixNano())
+			}
+
+			err := cs.CheckBroadcast(context.Background())
+			if tt.expectedError == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tt.expectedError)
+			}
+		})
+	}
+}
+
+func TestGetServerStatus(t *testing.T) {
+	adminCtx := context.WithValue(context.Background(), JWTContextKey, "admin")
+
+	t.Run("not admin", func(t *testing.T) {
+		cs := newCommandTestServer("alice")
+		_, err := cs.GetServerStatus(context.WithValue(context.Background(), JWTContextKey, "alice"), &pb.GetServerStatusRequest{})
+		require.Equal(t, status.Errorf(codes.PermissionDenied, "user: alice is not an admin"), err)
+	})
+
+	t.Run("status", func(t *testing.T) {
+		require := require.New(t)
+		cs := newCommandTestServer("carol", "alice")
+		cs.clientsMap["bob"] = client{}
+		cs.clientsMap["alice"].messageChan <- &pb.Message{TextContent: "hi"}
+		cs.receiveChan <- queuedMessage{msg: &pb.Message{TextContent: "hi"}}
+		cs.startTime = time.Unix(1700000000, 0)
+
+		checker := health.NewChecker(nil)
+		checker.AddReadiness("database", func(context.Context) error { return errors.New("connection refused") })
+		WithHealthChecker(checker)(cs)
+
+		resp, err := cs.GetServerStatus(adminCtx, &pb.GetServerStatusRequest{})
+		require.NoError(err)
+		require.Equal(uint32(1), resp.GetReceiveQueueLength())
+		require.Equal(uint32(8), resp.GetReceiveQueueCapacity())
+		require.Equal(int64(1700000000), resp.GetStartTime())
+		require.NotEmpty(resp.GetBuild().GetGoVersion())
+
+		// Users are sorted, and offline users have no queue
+		require.Len(resp.GetUsers(), 3)
+		require.Equal("alice", resp.GetUsers()[0].GetUsername())
+		require.True(resp.GetUsers()[0].GetOnline())
+		require.Equal(DefaultRoom, resp.GetUsers()[0].GetRoom())
+		require.Equal(uint32(1), resp.GetUsers()[0].GetQueueLength())
+		require.Equal(uint32(8), resp.GetUsers()[0].GetQueueCapacity())
+		require.Equal("bob", resp.GetUsers()[1].GetUsername())
+		require.False(resp.GetUsers()[1].GetOnline())
+		require.Zero(resp.GetUsers()[1].GetQueueCapacity())
+		require.Equal("carol", resp.GetUsers()[2].GetUsername())
+
+		require.Len(resp.GetChecks(), 1)
+		require.Equal("database", resp.GetChecks()[0].GetName())
+		require.False(resp.GetChecks()[0].GetHealthy())
+		require.Equal("connection refused", resp.GetChecks()[0].GetError())
+	})
+}
@@ -0,0 +1,100 @@
+package logic
+
+import (
+	"sync"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/apikey"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/webhook"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// subscriberBufferSize is the number of events buffered for a subscriber,
+// a subscriber falling further behind is disconnected.
+const subscriberBufferSize = 256
+
+// subscriber is a Subscribe stream waiting for events.
+type subscriber struct {
+	filter    webhook.Filter
+	eventChan chan *pb.Event // closed when the subscriber is too slow
+}
+
+// eventHub fans events out to the subscribers, the zero value is ready to use.
+type eventHub struct {
+	mu          sync.Mutex // mu guards the subscribers
+	subscribers map[*subscriber]struct{}
+}
+
+func (h *eventHub) subscribe(filter webhook.Filter) *subscriber {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers == nil {
+		h.subscribers = make(map[*subscriber]struct{})
+	}
+	sub := &subscriber{filter: filter, eventChan: make(chan *pb.Event, subscriberBufferSize)}
+	h.subscribers[sub] = struct{}{}
+	return sub
+}
+
+func (h *eventHub) unsubscribe(sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, sub)
+}
+
+// publish hands evt to the matching subscribers without blocking, so that a slow
+// subscriber never delays Broadcast. Subscribers with a full buffer are dropped.
+func (h *eventHub) publish(evt *pb.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subscribers {
+		if !sub.filter.Matches(evt) {
+			continue
+		}
+		select {
+		case sub.eventChan <- evt:
+		default:
+			close(sub.eventChan)
+			delete(h.subscribers, sub)
+		}
+	}
+}
+
+// Subscribe is a method that implements the Subscribe method of the ChatServiceServer interface.
+func (cs *chatServiceServer) Subscribe(req *pb.SubscribeRequest, stream grpc.ServerStreamingServer[pb.Event]) error {
+	username, ok := stream.Context().Value(JWTContextKey).(string)
+	if !ok || len(username) == 0 {
+		return status.Errorf(codes.Unauthenticated, "invalid auth token")
+	}
+	if err := requireScope(stream.Context(), apikey.ScopeMessagesRead); err != nil {
+		return err
+	}
+	if err := validateEventFilter(req.GetEventTypes(), req.GetRooms()); err != nil {
+		return err
+	}
+
+	sub := cs.events.subscribe(webhook.Filter{EventTypes: req.GetEventTypes(), Rooms: req.GetRooms()})
+	defer cs.events.unsubscribe(sub)
+	// Send the header right away, so that clients know the subscription is active
+	// before any event happens.
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case evt, ok := <-sub.eventChan:
+			if !ok {
+				return status.Errorf(codes.ResourceExhausted, "subscriber is too slow, events were dropped")
+			}
+			if err := stream.Send(evt); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
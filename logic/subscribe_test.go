@@ -0,0 +1,128 @@
+//go:build unit_test
+
+package logic
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/apikey"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/webhook"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type mockSubscribeStream struct {
+	grpc.ServerStream
+	ctx        context.Context
+	headerSent chan struct{}
+	events     chan *pb.Event
+}
+
+func newMockSubscribeStream(ctx context.Context) *mockSubscribeStream {
+	return &mockSubscribeStream{ctx: ctx, headerSent: make(chan struct{}), events: make(chan *pb.Event, 8)}
+}
+
+func (m *mockSubscribeStream) Context() context.Context { return m.ctx }
+
+func (m *mockSubscribeStream) SendHeader(metadata.MD) error {
+	close(m.headerSent)
+	return nil
+}
+
+func (m *mockSubscribeStream) Send(evt *pb.Event) error {
+	m.events <- evt
+	return nil
+}
+
+func TestEventHub(t *testing.T) {
+	require := require.New(t)
+	var hub eventHub
+
+	general := hub.subscribe(webhook.Filter{Rooms: []string{"general"}})
+	joins := hub.subscribe(webhook.Filter{EventTypes: []pb.EventType{pb.EventType_EVENT_TYPE_USER_JOIN}})
+
+	hub.publish(&pb.Event{Type: pb.EventType_EVENT_TYPE_MESSAGE, Room: "general"})
+	hub.publish(&pb.Event{Type: pb.EventType_EVENT_TYPE_USER_JOIN, Room: "random"})
+	require.Len(general.eventChan, 1)
+	require.Len(joins.eventChan, 1)
+
+	hub.unsubscribe(joins)
+	hub.publish(&pb.Event{Type: pb.EventType_EVENT_TYPE_USER_JOIN, Room: "general"})
+	require.Len(general.eventChan, 2)
+	require.Len(joins.eventChan, 1)
+
+	// A subscriber that does not keep up is dropped instead of blocking the publisher.
+	for i := 0; i < subscriberBufferSize; i++ {
+		hub.publish(&pb.Event{Type: pb.EventType_EVENT_TYPE_MESSAGE, Room: "general"})
+	}
+	require.Empty(hub.subscribers)
+	for range general.eventChan {
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	require := require.New(t)
+	cs := newCommandTestServer()
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), JWTContextKey, "dashboard"))
+	stream := newMockSubscribeStream(ctx)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- cs.Subscribe(&pb.SubscribeRequest{Rooms: []string{"random"}}, stream)
+	}()
+	<-stream.headerSent
+
+	cs.publish(newEvent(pb.EventType_EVENT_TYPE_USER_JOIN, "general", "alice", ""))
+	cs.publish(newEvent(pb.EventType_EVENT_TYPE_USER_JOIN, "random", "bob", ""))
+	select {
+	case evt := <-stream.events:
+		require.Equal("bob", evt.GetUsername())
+	case <-time.After(time.Second):
+		require.Fail("event not delivered")
+	}
+
+	cancel()
+	require.NoError(<-errChan)
+	require.Empty(cs.events.subscribers)
+}
+
+func TestSubscribeRejectsInvalidRequests(t *testing.T) {
+	tests := []struct {
+		name          string
+		ctx           context.Context
+		req           *pb.SubscribeRequest
+		expectedError error
+	}{
+		{
+			name:          "Unauthenticated",
+			ctx:           context.Background(),
+			req:           &pb.SubscribeRequest{},
+			expectedError: status.Errorf(codes.Unauthenticated, "invalid auth token"),
+		},
+		{
+			name:          "Bot Without Read Scope",
+			ctx:           botContext("ci-bot", apikey.ScopeMessagesWrite),
+			req:           &pb.SubscribeRequest{},
+			expectedError: status.Errorf(codes.PermissionDenied, "api key lacks the %q scope", apikey.ScopeMessagesRead),
+		},
+		{
+			name:          "Invalid Room",
+			ctx:           context.WithValue(context.Background(), JWTContextKey, "dashboard"),
+			req:           &pb.SubscribeRequest{Rooms: []string{"a b"}},
+			expectedError: status.Errorf(codes.InvalidArgument, "invalid room name: %q", "a b"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := newCommandTestServer().Subscribe(tt.req, newMockSubscribeStream(tt.ctx))
+			require.Equal(t, tt.expectedError, err)
+		})
+	}
+}
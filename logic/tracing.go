@@ -0,0 +1,27 @@
+package logic
+
+import (
+	"context"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/tracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = tracing.Tracer()
+
+// queuedMessage is a message waiting in receiveChan for the broadcast routine.
+type queuedMessage struct {
+	msg  *pb.Message
+	span trace.SpanContext // of the request that queued msg, invalid if untraced
+}
+
+// enqueue hands msg to the broadcast routine, which links its span to the span of ctx.
+// It returns an Unavailable error if the database is down, as msg could not be stored.
+func (cs *chatServiceServer) enqueue(ctx context.Context, msg *pb.Message) error {
+	if err := cs.requireDatabase(ctx); err != nil {
+		return err
+	}
+	cs.receiveChan <- queuedMessage{msg: msg, span: trace.SpanContextFromContext(ctx)}
+	return nil
+}
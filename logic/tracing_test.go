@@ -0,0 +1,73 @@
+//go:build unit_test
+
+package logic
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+)
+
+// spanRecorder records the spans of the tests, see TestMain.
+var spanRecorder = tracetest.NewSpanRecorder()
+
+// endedSpans returns the ended spans of the trace of span by name.
+func endedSpans(span trace.Span) map[string]sdktrace.ReadOnlySpan {
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range spanRecorder.Ended() {
+		if s.SpanContext().TraceID() == span.SpanContext().TraceID() {
+			spans[s.Name()] = s
+		}
+	}
+	return spans
+}
+
+func TestBroadcastLinksQueuedSpan(t *testing.T) {
+	db, mock := mockDB()
+	defer db.Close()
+	dbConn.Store(db)
+	defer func() { dbConn.Store(nil) }()
+	mock.ExpectExec("INSERT INTO messages").WillReturnResult(sqlmock.NewResult(7, 1))
+
+	cs := newCommandTestServer("alice", "bob")
+	ctx, request := tracer.Start(context.Background(), "request")
+	cs.handleMessage(ctx, "alice", &pb.Message{Type: pb.MessageType_MESSAGE_TYPE_NORMAL, TextContent: "hi"})
+	request.End()
+
+	// The broadcast runs in its own trace, after the request ended
+	queued := <-cs.receiveChan
+	cs.broadcast(queued)
+	require.NoError(t, mock.ExpectationsWereMet())
+	require.EqualValues(t, 7, (<-cs.clientsMap["bob"].messageChan).GetMessageNumber())
+
+	receive := endedSpans(request)["chat.receive"]
+	require.NotNil(t, receive)
+	require.Equal(t, request.SpanContext().SpanID(), receive.Parent().SpanID())
+	require.Contains(t, receive.Attributes(), attribute.String("chat.room", DefaultRoom))
+
+	var broadcast sdktrace.ReadOnlySpan
+	for _, s := range spanRecorder.Ended() {
+		if s.Name() == "chat.broadcast" && len(s.Links()) == 1 && s.Links()[0].SpanContext.Equal(receive.SpanContext()) {
+			broadcast = s
+		}
+	}
+	require.NotNil(t, broadcast)
+	require.NotEqual(t, request.SpanContext().TraceID(), broadcast.SpanContext().TraceID())
+
+	children := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range spanRecorder.Ended() {
+		if s.Parent().SpanID() == broadcast.SpanContext().SpanID() {
+			children[s.Name()] = s
+		}
+	}
+	require.Contains(t, children["db.insert_message"].Attributes(), attribute.String("db.system", "mysql"))
+	require.Contains(t, children["chat.fan_out"].Attributes(), attribute.Int("chat.recipients", 1))
+}
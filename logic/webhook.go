@@ -0,0 +1,120 @@
+package logic
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"time"
+
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/db"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/util"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// CreateWebhook is a method that implements the CreateWebhook method of the ChatServiceServer interface.
+func (cs *chatServiceServer) CreateWebhook(ctx context.Context, req *pb.CreateWebhookRequest) (*pb.CreateWebhookResponse, error) {
+	admin, err := cs.requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := url.Parse(req.GetUrl())
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid webhook url: %q", req.GetUrl())
+	}
+	if err := validateEventFilter(req.GetEventTypes(), req.GetRooms()); err != nil {
+		return nil, err
+	}
+	secret := req.GetSecret()
+	if len(secret) > 128 {
+		return nil, status.Errorf(codes.InvalidArgument, "secret is longer than 128 characters")
+	}
+	if secret == "" {
+		raw := make([]byte, 32)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, util.WrapGRPCError(err, codes.Internal, "failed to generate secret")
+		}
+		secret = hex.EncodeToString(raw)
+	}
+
+	conn, err := dBConn()
+	if err != nil {
+		return nil, err
+	}
+	id, err := db.InsertWebhook(ctx, conn, req.GetUrl(), formatEventTypes(req.GetEventTypes()),
+		strings.Join(req.GetRooms(), ","), secret, admin)
+	if err != nil {
+		return nil, dbError(err, "failed to create webhook")
+	}
+	if cs.webhooks != nil {
+		cs.webhooks.Invalidate()
+	}
+
+	return &pb.CreateWebhookResponse{
+		Webhook: &pb.Webhook{
+			WebhookId:  uint64(id),
+			Url:        req.GetUrl(),
+			EventTypes: req.GetEventTypes(),
+			Rooms:      req.GetRooms(),
+			CreatedBy:  admin,
+			CreatedAt:  time.Now().Unix(),
+		},
+		Secret: secret,
+	}, nil
+}
+
+// ListWebhooks is a method that implements the ListWebhooks method of the ChatServiceServer interface.
+func (cs *chatServiceServer) ListWebhooks(ctx context.Context, _ *pb.ListWebhooksRequest) (*pb.ListWebhooksResponse, error) {
+	if _, err := cs.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	conn, err := dBConn()
+	if err != nil {
+		return nil, err
+	}
+	webhooks, err := db.ListWebhooks(ctx, conn)
+	if err != nil {
+		return nil, dbError(err, "failed to list webhooks")
+	}
+
+	resp := &pb.ListWebhooksResponse{Webhooks: make([]*pb.Webhook, 0, len(webhooks))}
+	for _, w := range webhooks {
+		resp.Webhooks = append(resp.Webhooks, &pb.Webhook{
+			WebhookId:  uint64(w.ID),
+			Url:        w.URL,
+			EventTypes: parseEventTypes(w.EventTypes),
+			Rooms:      splitList(w.Rooms),
+			CreatedBy:  w.CreatedBy,
+			CreatedAt:  w.CreatedAt,
+		})
+	}
+	return resp, nil
+}
+
+// DeleteWebhook is a method that implements the DeleteWebhook method of the ChatServiceServer interface.
+func (cs *chatServiceServer) DeleteWebhook(ctx context.Context, req *pb.DeleteWebhookRequest) (*pb.DeleteWebhookResponse, error) {
+	if _, err := cs.requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	conn, err := dBConn()
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := db.DeleteWebhook(ctx, conn, int64(req.GetWebhookId()))
+	if err != nil {
+		return nil, dbError(err, "failed to delete webhook")
+	}
+	if !deleted {
+		return nil, status.Errorf(codes.NotFound, "webhook: %d not found", req.GetWebhookId())
+	}
+	if cs.webhooks != nil {
+		cs.webhooks.Invalidate()
+	}
+	return &pb.DeleteWebhookResponse{}, nil
+}
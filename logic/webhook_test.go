@@ -0,0 +1,134 @@
+//go:build unit_test
+
+package logic
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCreateWebhook(t *testing.T) {
+	adminCtx := context.WithValue(context.Background(), JWTContextKey, "admin")
+
+	tests := []struct {
+		name          string
+		ctx           context.Context
+		req           *pb.CreateWebhookRequest
+		mockSetup     func(sqlmock.Sqlmock)
+		expectedError error
+	}{
+		{
+			name: "Successful Creation",
+			ctx:  adminCtx,
+			req: &pb.CreateWebhookRequest{
+				Url:        "https://example.com/hook",
+				EventTypes: []pb.EventType{pb.EventType_EVENT_TYPE_MESSAGE, pb.EventType_EVENT_TYPE_USER_JOIN},
+				Rooms:      []string{"general"},
+				Secret:     "secret",
+			},
+			mockSetup: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec("INSERT INTO webhooks").
+					WithArgs("https://example.com/hook", "EVENT_TYPE_MESSAGE,EVENT_TYPE_USER_JOIN", "general", "secret", "admin").
+					WillReturnResult(sqlmock.NewResult(2, 1))
+			},
+		},
+		{
+			name:          "Not An Admin",
+			ctx:           context.WithValue(context.Background(), JWTContextKey, "alice"),
+			req:           &pb.CreateWebhookRequest{Url: "https://example.com/hook"},
+			mockSetup:     func(sqlmock.Sqlmock) {},
+			expectedError: status.Errorf(codes.PermissionDenied, "user: %s is not an admin", "alice"),
+		},
+		{
+			name:          "Invalid URL",
+			ctx:           adminCtx,
+			req:           &pb.CreateWebhookRequest{Url: "ftp://example.com/hook"},
+			mockSetup:     func(sqlmock.Sqlmock) {},
+			expectedError: status.Errorf(codes.InvalidArgument, "invalid webhook url: %q", "ftp://example.com/hook"),
+		},
+		{
+			name:          "Invalid Room",
+			ctx:           adminCtx,
+			req:           &pb.CreateWebhookRequest{Url: "https://example.com/hook", Rooms: []string{"a b"}},
+			mockSetup:     func(sqlmock.Sqlmock) {},
+			expectedError: status.Errorf(codes.InvalidArgument, "invalid room name: %q", "a b"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require := require.New(t)
+			db, mock := mockDB()
+			defer db.Close()
+			dbConn.Store(db)
+			defer func() { dbConn.Store(nil) }()
+			tt.mockSetup(mock)
+
+			resp, err := newCommandTestServer().CreateWebhook(tt.ctx, tt.req)
+			if tt.expectedError != nil {
+				require.Equal(tt.expectedError, err)
+			} else {
+				require.NoError(err)
+				require.Equal(uint64(2), resp.GetWebhook().GetWebhookId())
+				require.Equal("secret", resp.GetSecret())
+			}
+			require.NoError(mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestCreateWebhookGeneratesSecret(t *testing.T) {
+	require := require.New(t)
+
+	db, mock := mockDB()
+	defer db.Close()
+	dbConn.Store(db)
+	defer func() { dbConn.Store(nil) }()
+	mock.ExpectExec("INSERT INTO webhooks").WillReturnResult(sqlmock.NewResult(3, 1))
+
+	ctx := context.WithValue(context.Background(), JWTContextKey, "admin")
+	resp, err := newCommandTestServer().CreateWebhook(ctx, &pb.CreateWebhookRequest{Url: "http://localhost:9000/hook"})
+	require.NoError(err)
+	require.Len(resp.GetSecret(), 64)
+	require.NoError(mock.ExpectationsWereMet())
+}
+
+func TestListAndDeleteWebhooks(t *testing.T) {
+	require := require.New(t)
+
+	db, mock := mockDB()
+	defer db.Close()
+	dbConn.Store(db)
+	defer func() { dbConn.Store(nil) }()
+	mock.ExpectQuery("SELECT .* FROM webhooks").WillReturnRows(
+		sqlmock.NewRows([]string{"id", "url", "event_types", "rooms", "secret", "created_by", "created_at"}).
+			AddRow(2, "https://example.com/hook", "EVENT_TYPE_MESSAGE,EVENT_TYPE_MODERATION", "general,random", "secret", "admin", 1723680000))
+	mock.ExpectExec("DELETE FROM webhooks").WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM webhooks").WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	cs := newCommandTestServer()
+	ctx := context.WithValue(context.Background(), JWTContextKey, "admin")
+
+	resp, err := cs.ListWebhooks(ctx, &pb.ListWebhooksRequest{})
+	require.NoError(err)
+	require.Equal([]*pb.Webhook{{
+		WebhookId:  2,
+		Url:        "https://example.com/hook",
+		EventTypes: []pb.EventType{pb.EventType_EVENT_TYPE_MESSAGE, pb.EventType_EVENT_TYPE_MODERATION},
+		Rooms:      []string{"general", "random"},
+		CreatedBy:  "admin",
+		CreatedAt:  1723680000,
+	}}, resp.GetWebhooks())
+
+	_, err = cs.DeleteWebhook(ctx, &pb.DeleteWebhookRequest{WebhookId: 2})
+	require.NoError(err)
+	_, err = cs.DeleteWebhook(ctx, &pb.DeleteWebhookRequest{WebhookId: 3})
+	require.Equal(status.Errorf(codes.NotFound, "webhook: %d not found", 3), err)
+	require.NoError(mock.ExpectationsWereMet())
+}
@@ -4,22 +4,54 @@ import (
 	"context"
 
 	authmiddleware "github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/auth"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/apikey"
 	"github.com/zjy-dev/grpc-go-chatroom/internal/jwt"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/logging"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/tlsutil"
 	"github.com/zjy-dev/grpc-go-chatroom/internal/util"
 	"github.com/zjy-dev/grpc-go-chatroom/logic"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-// authFunc is a function that authenticates incoming requests.
-func authFunc(ctx context.Context) (context.Context, error) {
+// sessionChecker rejects the tokens of the sessions that were logged out or kicked.
+type sessionChecker interface {
+	CheckSession(session string) error
+}
+
+// newAuthFunc returns a function that authenticates incoming requests, rejecting the
+// tokens of the sessions ended in sessions, and records the user for the logs.
+func newAuthFunc(sessions sessionChecker) func(context.Context) (context.Context, error) {
+	return func(ctx context.Context) (context.Context, error) {
+		ctx, err := authenticate(ctx, sessions)
+		if err != nil {
+			return nil, err
+		}
+		if username, ok := ctx.Value(logic.JWTContextKey).(string); ok {
+			logging.SetUser(ctx, username)
+		}
+		return ctx, nil
+	}
+}
+
+// authenticate returns the context of an incoming request with its user.
+func authenticate(ctx context.Context, sessions sessionChecker) (context.Context, error) {
 	// Get the token from the metadata.
 	token, err := authmiddleware.AuthFromMD(ctx, "bearer")
 
 	if err != nil {
+		// Clients without a token may authenticate by a verified client certificate.
+		if identity, ok := tlsutil.PeerIdentity(ctx); ok {
+			return context.WithValue(ctx, logic.JWTContextKey, identity), nil
+		}
 		return nil, util.WrapGRPCError(err, codes.Unauthenticated, "invalid auth token prefix")
 	}
 
+	// Bots authenticate with API keys instead of JWT tokens.
+	if apikey.IsAPIKey(token) {
+		return logic.AuthAPIKey(ctx, token)
+	}
+
 	// Parse the token.
 	claims, err := jwt.ParseJwt(token)
 	if err != nil {
@@ -36,6 +68,10 @@ func authFunc(ctx context.Context) (context.Context, error) {
 	if subject == "" {
 		return nil, status.Errorf(codes.Unauthenticated, "username in jwt is empty")
 	}
+	if err := sessions.CheckSession(claims.ID); err != nil {
+		return nil, err
+	}
 
+	ctx = context.WithValue(ctx, logic.SessionContextKey, claims.ID)
 	return context.WithValue(ctx, logic.JWTContextKey, subject), nil
 }
@@ -4,25 +4,33 @@ package main
 
 import (
 	"context"
-	"os"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"log/slog"
+	"slices"
 	"testing"
 
+	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
 	"github.com/zjy-dev/grpc-go-chatroom/internal/jwt"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/metrics"
+	"github.com/zjy-dev/grpc-go-chatroom/logic"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
 func TestAuthFunc(t *testing.T) {
 	require := require.New(t)
 
-	// Load the JWT key from environment variable
-	os.Setenv("JWT_KEY", "mysecretkey")
-	t.Cleanup(func() {
-		os.Unsetenv("JWT_KEY")
-		require.Equal("", os.Getenv("JWT_KEY"))
-	})
+	jwt.SetKey("mysecretkey")
+	t.Cleanup(func() { jwt.SetKey("") })
 
 	tests := []struct {
 		name    string
@@ -49,6 +57,12 @@ func TestAuthFunc(t *testing.T) {
 			wantErr: true,
 			errCode: codes.Unauthenticated,
 		},
+		{
+			name:    "RevokedSession",
+			md:      map[string][]string{"authorization": {"bearer " + createSessionToken("testuser", "revoked")}},
+			wantErr: true,
+			errCode: codes.Unauthenticated,
+		},
 		{
 			name:    "InvalidToken",
 			md:      map[string][]string{"authorization": {"bearer invalid-token"}},
@@ -57,11 +71,12 @@ func TestAuthFunc(t *testing.T) {
 		},
 	}
 
+	authFunc := newAuthFunc(revokedSessions{"revoked"})
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 
 			ctx := metadata.NewIncomingContext(context.Background(), tt.md)
-			_, err := authFunc(ctx)
+			ctx, err := authFunc(ctx)
 
 			if tt.wantErr {
 				require.Error(err)
@@ -69,12 +84,85 @@ func TestAuthFunc(t *testing.T) {
 				require.Equal(tt.errCode, st.Code())
 			} else {
 				require.NoError(err)
+				require.Equal("testuser", ctx.Value(logic.JWTContextKey))
+				require.Equal("session-1", ctx.Value(logic.SessionContextKey))
 			}
 		})
 	}
 }
 
+// peerWithCert returns ctx carrying a gRPC peer that presented a verified client certificate of commonName.
+func peerWithCert(ctx context.Context, commonName string) context.Context {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+	return peer.NewContext(ctx, &peer.Peer{AuthInfo: credentials.TLSInfo{
+		State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}},
+	}})
+}
+
+func TestAuthFuncClientCertificate(t *testing.T) {
+	require := require.New(t)
+	authFunc := newAuthFunc(revokedSessions{})
+
+	// Clients without a token are authenticated by their certificate
+	ctx, err := authFunc(peerWithCert(context.Background(), "alice"))
+	require.NoError(err)
+	require.Equal("alice", ctx.Value(logic.JWTContextKey))
+
+	// Unverified certificates do not count
+	_, err = authFunc(peer.NewContext(context.Background(), &peer.Peer{AuthInfo: credentials.TLSInfo{}}))
+	require.Equal(codes.Unauthenticated, status.Code(err))
+}
+
+// revokedSessions is a sessionChecker rejecting the sessions it lists.
+type revokedSessions []string
+
+func (r revokedSessions) CheckSession(session string) error {
+	if slices.Contains(r, session) {
+		return status.Errorf(codes.Unauthenticated, "the session has ended, please log in again")
+	}
+	return nil
+}
+
 func createTestToken(username string) string {
-	token, _ := jwt.GenerateJwt(username)
+	return createSessionToken(username, "session-1")
+}
+
+func createSessionToken(username, session string) string {
+	token, _ := jwt.GenerateJwt(username, session)
 	return token
 }
+
+// TestLoggedOutTokenIsRejected checks that every RPC rejects the token of a
+// session that was logged out, not only Chat.
+func TestLoggedOutTokenIsRejected(t *testing.T) {
+	require := require.New(t)
+	jwt.SetKey("mysecretkey")
+	t.Cleanup(func() { jwt.SetKey("") })
+	conn, mock, err := sqlmock.New()
+	require.NoError(err)
+	defer conn.Close()
+	mock.ExpectQuery("SELECT id, username, password_hash, is_bot FROM users WHERE username = ?").
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "password_hash", "is_bot"}))
+	mock.ExpectExec("INSERT INTO users").WithArgs("alice", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+
+	chat := logic.NewChatServiceServer(logic.WithDB(conn))
+	// The database is shared by the servers of the process.
+	t.Cleanup(func() { logic.WithDB(nil)(chat) })
+	srv := grpcServer(slog.New(slog.NewTextHandler(io.Discard, nil)), metrics.NewRegistry(), chat, health.NewServer())
+	client := pb.NewChatServiceClient(serveTestGRPC(t, srv))
+
+	resp, err := client.LogInOrRegister(context.Background(), &pb.LogInOrRegisterRequest{Username: "alice", Password: "secret"})
+	require.NoError(err)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "bearer "+resp.GetToken())
+	_, err = client.WhoAmI(ctx, &pb.WhoAmIRequest{})
+	require.NoError(err)
+
+	_, err = client.LogOut(ctx, &pb.LogOutRequest{})
+	require.NoError(err)
+	_, err = client.PostMessage(ctx, &pb.PostMessageRequest{TextContent: "still here"})
+	require.Equal(codes.Unauthenticated, status.Code(err))
+	_, err = client.WhoAmI(ctx, &pb.WhoAmIRequest{})
+	require.Equal(codes.Unauthenticated, status.Code(err))
+	require.NoError(mock.ExpectationsWereMet())
+}
@@ -2,21 +2,25 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"log"
 	"net/http"
 
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
 
 	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
-	"github.com/zjy-dev/grpc-go-chatroom/internal/config"
 )
 
-func cors(next http.Handler) http.Handler {
+// cors serves the requests from the origins allowed by origins, and rejects the others.
+func cors(origins *originPolicy, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if !origins.allows(r) {
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+		}
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
 		w.Header().Set("Access-Control-Allow-Headers", "*")
 
@@ -24,21 +28,15 @@ func cors(next http.Handler) http.Handler {
 			return
 		}
 
-		// log.Printf("CORS passed! address: %s, request path: %s, http version: %d, Content-Type: %s",
-		// 	r.RemoteAddr, r.URL.Path, r.ProtoMajor, r.Header.Get("Content-Type"))
 		next.ServeHTTP(w, r)
 	})
 }
 
-func gatewayMux() http.Handler {
-	// Register gRPC server endpoint
-	// Note: Make sure the gRPC server is running properly and accessible
+func gatewayMux(conn *grpc.ClientConn, origins *originPolicy) http.Handler {
 	mux := runtime.NewServeMux()
-	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
-	err := pb.RegisterChatServiceHandlerFromEndpoint(context.Background(), mux, fmt.Sprintf("localhost:%d", config.Server.Port), opts)
-	if err != nil {
-		log.Fatalf("failed to register gateway: %v", err)
+	if err := pb.RegisterChatServiceHandler(context.Background(), mux, conn); err != nil {
+		fatal("failed to register gateway", "error", err)
 	}
 
-	return cors(mux)
+	return cors(origins, mux)
 }
@@ -0,0 +1,53 @@
+//go:build unit_test
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCORS(t *testing.T) {
+	origins := newOriginPolicy([]string{"http://app.example.com"})
+	handler := cors(origins, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	tests := []struct {
+		name        string
+		method      string
+		origin      string
+		wantStatus  int
+		allowOrigin string
+	}{
+		{name: "no origin", method: http.MethodGet, wantStatus: http.StatusTeapot},
+		{name: "same origin", method: http.MethodGet, origin: "http://chat.example.com", wantStatus: http.StatusTeapot, allowOrigin: "http://chat.example.com"},
+		{name: "allowed origin", method: http.MethodPost, origin: "http://app.example.com", wantStatus: http.StatusTeapot, allowOrigin: "http://app.example.com"},
+		{name: "preflight", method: http.MethodOptions, origin: "http://app.example.com", wantStatus: http.StatusOK, allowOrigin: "http://app.example.com"},
+		{name: "other origin", method: http.MethodPost, origin: "http://evil.example.com", wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://chat.example.com/messages", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			require.Equal(t, tt.wantStatus, w.Code)
+			require.Equal(t, tt.allowOrigin, w.Header().Get("Access-Control-Allow-Origin"))
+		})
+	}
+
+	// The allowed origins can change at runtime
+	origins.set([]string{"*"})
+	r := httptest.NewRequest(http.MethodPost, "http://chat.example.com/messages", nil)
+	r.Header.Set("Origin", "http://evil.example.com")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	require.Equal(t, http.StatusTeapot, w.Code)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// healthCheckInterval is how often the readiness checks update the gRPC health service.
+const healthCheckInterval = 10 * time.Second
+
+// healthService serves grpc.health.v1 to unauthenticated clients, such as the
+// probes of orchestrators and load balancers.
+type healthService struct {
+	*health.Server
+}
+
+// AuthFuncOverride skips the authentication of the streaming Watch method, see
+// authmiddleware.ServiceAuthFuncOverride. Check is bypassed in grpcServer.
+func (healthService) AuthFuncOverride(ctx context.Context, _ string) (context.Context, error) {
+	return ctx, nil
+}
+
+var _ healthpb.HealthServer = healthService{}
+
+// isProbe reports whether r is a metrics scrape or a health check, which are
+// frequent and neither logged at the info level nor traced.
+func isProbe(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/metrics", "/healthz", "/readyz":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+//go:build unit_test
+
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/metrics"
+	"github.com/zjy-dev/grpc-go-chatroom/logic"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestHealthServiceIsUnauthenticated(t *testing.T) {
+	require := require.New(t)
+	healthServer := health.NewServer()
+	srv := grpcServer(slog.New(slog.NewTextHandler(io.Discard, nil)), metrics.NewRegistry(), logic.NewChatServiceServer(), healthServer)
+	client := healthpb.NewHealthClient(serveTestGRPC(t, srv))
+
+	// Probes call Check and Watch without a token
+	resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(err)
+	require.Equal(healthpb.HealthCheckResponse_SERVING, resp.GetStatus())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	watch, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(err)
+	resp, err = watch.Recv()
+	require.NoError(err)
+	require.Equal(healthpb.HealthCheckResponse_SERVING, resp.GetStatus())
+
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	resp, err = watch.Recv()
+	require.NoError(err)
+	require.Equal(healthpb.HealthCheckResponse_NOT_SERVING, resp.GetStatus())
+}
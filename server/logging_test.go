@@ -0,0 +1,67 @@
+//go:build unit_test
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/zjy-dev/grpc-go-chatroom/internal/logging"
+)
+
+func TestLogRequests(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		requestID  string
+		status     int
+		wantPath   string
+		wantLevel  string
+		keepHeader bool
+	}{
+		{name: "client request ID", target: "/messages", requestID: "req-1", status: http.StatusOK, wantPath: "/messages", wantLevel: "INFO", keepHeader: true},
+		{name: "invalid request ID", target: "/messages", requestID: "bad id", status: http.StatusOK, wantPath: "/messages", wantLevel: "INFO"},
+		{name: "token redacted", target: "/events?token=secret", status: http.StatusOK, wantPath: "/events?token=%5BREDACTED%5D", wantLevel: "INFO"},
+		{name: "server error", target: "/messages", status: http.StatusBadGateway, wantPath: "/messages", wantLevel: "ERROR"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			var handlerID string
+			handler := logRequests(logging.New(&buf, logging.FormatJSON, slog.LevelInfo), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handlerID = logging.RequestID(r.Context())
+				w.WriteHeader(tt.status)
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.requestID != "" {
+				r.Header.Set("X-Request-Id", tt.requestID)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			require.Equal(t, tt.status, w.Code)
+			require.Equal(t, handlerID, w.Header().Get("X-Request-Id"))
+			if tt.keepHeader {
+				require.Equal(t, tt.requestID, handlerID)
+			} else {
+				require.NotEqual(t, tt.requestID, handlerID)
+			}
+
+			var record map[string]any
+			require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+			require.Equal(t, tt.wantLevel, record["level"])
+			require.Equal(t, tt.wantPath, record["path"])
+			require.Equal(t, float64(tt.status), record["status"])
+			require.Equal(t, handlerID, record["request_id"])
+			require.NotContains(t, buf.String(), "secret")
+		})
+	}
+}
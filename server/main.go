@@ -1,43 +1,231 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	authmiddleware "github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/auth"
 	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
 	"github.com/zjy-dev/grpc-go-chatroom/internal/config"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/db"
+	healthcheck "github.com/zjy-dev/grpc-go-chatroom/internal/health"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/jwt"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/logging"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/metrics"
 	"github.com/zjy-dev/grpc-go-chatroom/internal/middleware"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/tlsutil"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/tracing"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/webhook"
 	"github.com/zjy-dev/grpc-go-chatroom/logic"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
 )
 
+// inProcessBufferSize is the buffer size of the in-memory connections to the gRPC server.
+const inProcessBufferSize = 1 << 20
+
 func main() {
-	// Serve websocket & gRPC-gateway
-	mux := websocketMux()
-	mux.Handle("/", gatewayMux())
+	configFile := flag.String("config", "", "path of the YAML or TOML config file, defaults to ./config.yaml if it exists")
+	port := flag.Int("port", 0, "the port to listen on, overrides server.port")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: server [flags] [migrate <command>]\n\nflags:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "\n%s\n", migrateUsage)
+	}
+	flag.Parse()
+
+	// Only the flags set by the user override the other config layers.
+	flags := map[string]any{}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "port" {
+			flags["server.port"] = *port
+		}
+	})
+	opts := config.Options{File: *configFile, Flags: flags}
+	cfg, err := config.LoadServer(opts)
+	if err != nil {
+		fatal("failed to load config", "error", err)
+	}
+
+	// The log level and the allowed origins follow config reloads, see also logic.WithConfigReloader.
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(cfg.Log.SlogLevel())
+	logger := logging.New(os.Stderr, cfg.Log.Format, logLevel)
+	slog.SetDefault(logger)
+
+	if flag.Arg(0) == "migrate" {
+		conn := mustConnectDB(cfg.Database)
+		if err := runMigrate(context.Background(), conn, flag.Args()[1:], os.Stdout); err != nil {
+			fatal("failed to migrate the database", "error", err)
+		}
+		return
+	} else if flag.NArg() > 0 {
+		fatal("unknown command", "command", flag.Arg(0))
+	}
+
+	origins := newOriginPolicy(cfg.Server.AllowedOrigins)
+	reloader := config.NewReloader(opts, cfg)
+	reloader.OnChange(func(cfg *config.ServerConfig) {
+		logLevel.Set(cfg.Log.SlogLevel())
+		origins.set(cfg.Server.AllowedOrigins)
+	})
+	go reloadOnSIGHUP(reloader)
+	go func() {
+		if err := reloader.Watch(context.Background()); err != nil {
+			slog.Warn("config file will not be reloaded on changes", "error", err)
+		}
+	}()
+
+	if shutdownTracing, err = tracing.Setup(context.Background(), cfg.Tracing, os.Stdout); err != nil {
+		fatal("failed to set up tracing", "error", err)
+	}
+
+	jwt.SetKey(cfg.JWT.Key)
+	conn := mustConnectDB(cfg.Database)
+	if err := migrateOnStartup(context.Background(), conn, cfg.Database.AutoMigrate); err != nil {
+		fatal("failed to migrate the database", "error", err)
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.TLS.Enabled() {
+		if tlsConfig, err = tlsutil.ServerConfig(cfg.TLS); err != nil {
+			fatal("failed to set up TLS", "error", err)
+		}
+	}
+
+	registry := metrics.NewRegistry()
+	registry.MustRegister(db.QueryDuration, websocketConnections)
+	healthServer := health.NewServer()
+	checker := healthcheck.NewChecker(healthServer)
+	chat := logic.NewChatServiceServer(logic.WithDB(conn), logic.WithAdmins(cfg.Server.Admins),
+		logic.WithConfigReloader(reloader), logic.WithWebhooks(webhook.Options{}), logic.WithMetrics(registry),
+		logic.WithHealthChecker(checker))
+	checker.AddLiveness("broadcast", chat.CheckBroadcast)
+	checker.AddReadiness("database", chat.CheckDatabase)
+	go checker.Watch(context.Background(), healthCheckInterval, pb.ChatService_ServiceDesc.ServiceName)
+	go chat.RunRetention(context.Background())
+	grpcServer := grpcServer(logger, registry, chat, healthServer)
+	inProcessConn := mustDialInProcess(grpcServer)
+	client := pb.NewChatServiceClient(inProcessConn)
+
+	// Serve websocket, Server-Sent Events & gRPC-gateway
+	mux := websocketMux(inProcessConn, origins)
+	mux.Handle("/events", sseHandler(client, origins))
+	mux.Handle("/metrics", registry)
+	mux.Handle("/healthz", checker.LivenessHandler())
+	mux.Handle("/readyz", checker.ReadinessHandler())
+	mux.Handle("/", gatewayMux(inProcessConn, origins))
 
 	// Serve frontend
 	mux.Handle("/static", http.StripPrefix("/static", http.FileServer(http.Dir("./static"))))
 	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
 
-	grpcServer := grpcServer()
+	server := &http.Server{
+		Addr:      fmt.Sprintf("0.0.0.0:%d", cfg.Server.Port),
+		Handler:   combinedProtocolHandler(grpcServer, traceRequests(logRequests(logger, mux))),
+		TLSConfig: tlsConfig,
+	}
+	slog.Info("server will listen", "address", server.Addr, "tls", tlsConfig != nil)
+	if tlsConfig != nil {
+		fatal("server stopped", "error", server.ListenAndServeTLS("", ""))
+	}
+	fatal("server stopped", "error", server.ListenAndServe())
+}
+
+// mustConnectDB connects to the database of cfg, waiting for it up to cfg.ConnectTimeout.
+func mustConnectDB(cfg config.DatabaseConfig) *sql.DB {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ConnectTimeout)
+	defer cancel()
+	conn, err := db.Connect(ctx, db.ConnectOptions{
+		Dialect:         db.Dialect(cfg.Driver),
+		Host:            cfg.Host,
+		Port:            uint64(cfg.Port),
+		User:            cfg.User,
+		Password:        cfg.Password,
+		DBName:          cfg.DBName,
+		MaxOpenConns:    cfg.MaxOpenConns,
+		MaxIdleConns:    cfg.MaxIdleConns,
+		ConnMaxLifetime: cfg.ConnMaxLifetime,
+		ConnMaxIdleTime: cfg.ConnMaxIdleTime,
+		QueryTimeout:    cfg.QueryTimeout,
+	})
+	if err != nil {
+		fatal("failed to connect to the database", "error", err)
+	}
+	return conn
+}
+
+// shutdownTracing exports the spans not exported yet, see tracing.Setup.
+var shutdownTracing = func(context.Context) error { return nil }
+
+// tracingShutdownTimeout bounds the time spent exporting the last spans on exit.
+const tracingShutdownTimeout = 5 * time.Second
 
-	if config.Server.Port == 0 {
-		log.Fatalf("server.port is not set or invalid, check config.yaml")
+// fatal logs an error the server can not run with, and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+	shutdownTracing(ctx)
+	cancel()
+	os.Exit(1)
+}
+
+// mustDialInProcess serves grpcServer on an in-memory listener and returns a client
+// connection to it. The gateway and the websocket and SSE bridges use it, so that
+// they need neither a plaintext port nor a client certificate when TLS is enabled.
+func mustDialInProcess(grpcServer *grpc.Server) *grpc.ClientConn {
+	lis := bufconn.Listen(inProcessBufferSize)
+	go func() {
+		if err := grpcServer.Serve(lis); err != nil {
+			fatal("failed to serve in-process connections", "error", err)
+		}
+	}()
+
+	conn, err := grpc.NewClient("passthrough:///in-process",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		// The connection never leaves the process.
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		// The spans of the gateway and the bridges are the parents of the spans of the server.
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+		// The calls of the gateway and the bridges are logged with the ID of their HTTP request.
+		grpc.WithChainUnaryInterceptor(middleware.UnaryClientRequestIDInterceptor()),
+		grpc.WithChainStreamInterceptor(middleware.StreamClientRequestIDInterceptor()))
+	if err != nil {
+		fatal("failed to dial in-process server", "error", err)
 	}
-	log.Printf("server will listen at 0.0.0.0:%d", config.Server.Port)
-	log.Fatalln(http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", config.Server.Port), combinedProtocolHandler(grpcServer, mux)))
+	return conn
 }
 
-func combinedProtocolHandler(grpcServer *grpc.Server, gatewayAndWebsocketMux *http.ServeMux) http.Handler {
+// reloadOnSIGHUP reloads the config whenever the process receives SIGHUP.
+func reloadOnSIGHUP(reloader *config.Reloader) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		reloader.ReloadAndLog("received SIGHUP")
+	}
+}
+
+func combinedProtocolHandler(grpcServer *grpc.Server, gatewayAndWebsocketMux http.Handler) http.Handler {
 	return h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// log.Printf("address: %s, request path: %s, http version: %d, Content-Type: %s",
-		// 	r.RemoteAddr, r.URL.Path, r.ProtoMajor, r.Header.Get("Content-Type"))
 		if r.ProtoMajor == 2 && strings.Contains(r.Header.Get("Content-Type"), "application/grpc") {
 			grpcServer.ServeHTTP(w, r)
 		} else {
@@ -46,14 +234,36 @@ func combinedProtocolHandler(grpcServer *grpc.Server, gatewayAndWebsocketMux *ht
 	}), &http2.Server{})
 }
 
-func grpcServer() *grpc.Server {
+// chatServer is the chat service, which also tells the authentication which sessions ended.
+type chatServer interface {
+	pb.ChatServiceServer
+	sessionChecker
+}
+
+func grpcServer(logger *slog.Logger, registry *metrics.Registry, chat chatServer, healthServer *health.Server) *grpc.Server {
+	authFunc := newAuthFunc(chat)
+	rpcMetrics := middleware.NewServerMetrics()
+	registry.MustRegister(rpcMetrics.Collectors()...)
 	grpcServer := grpc.NewServer(
-		grpc.ChainStreamInterceptor(authmiddleware.StreamServerInterceptor(authFunc)),
-		// Exclude the "LogIn" method from authentication.
-		grpc.UnaryInterceptor(middleware.UnaryServerAuthInterceptorWithBypassMethods(authFunc, "LogInOrRegister")),
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		// Calls are logged with the user recorded by the authentication, so logging comes first.
+		// Metrics come before both, so that calls failing authentication are counted.
+		grpc.ChainStreamInterceptor(
+			rpcMetrics.StreamServerInterceptor(),
+			middleware.StreamServerLoggingInterceptor(logger),
+			// The health service skips it by its AuthFuncOverride, so Watch is unauthenticated like Check.
+			authmiddleware.StreamServerInterceptor(authFunc),
+		),
+		grpc.ChainUnaryInterceptor(
+			rpcMetrics.UnaryServerInterceptor(),
+			middleware.UnaryServerLoggingInterceptor(logger),
+			// Exclude the "LogIn" method and the health checks from authentication.
+			middleware.UnaryServerAuthInterceptorWithBypassMethods(authFunc, "LogInOrRegister", "/grpc.health.v1.Health/Check"),
+		),
 	)
 
-	pb.RegisterChatServiceServer(grpcServer, logic.NewChatServiceServer())
+	pb.RegisterChatServiceServer(grpcServer, chat)
+	healthpb.RegisterHealthServer(grpcServer, healthService{healthServer})
 
 	return grpcServer
 }
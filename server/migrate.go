@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/zjy-dev/grpc-go-chatroom/internal/db"
+)
+
+// migrateUsage documents the migrate subcommand.
+const migrateUsage = `usage: server [flags] migrate <command>
+
+commands:
+  up          apply the pending migrations
+  down [n]    revert the last n applied migrations, 1 by default, or all of them with "all"
+  status      list the migrations and whether they are applied`
+
+// runMigrate runs the migrate subcommand with args, e.g. ["down", "2"], and
+// reports to w.
+func runMigrate(ctx context.Context, conn *sql.DB, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing command\n%s", migrateUsage)
+	}
+
+	switch args[0] {
+	case "up":
+		if len(args) > 1 {
+			return fmt.Errorf("up takes no arguments\n%s", migrateUsage)
+		}
+		applied, err := db.MigrateUp(ctx, conn)
+		for _, m := range applied {
+			fmt.Fprintf(w, "applied %d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Fprintln(w, "the schema is up to date")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 2 {
+			return fmt.Errorf("down takes at most one argument\n%s", migrateUsage)
+		}
+		if len(args) == 2 {
+			if args[1] == "all" {
+				steps = math.MaxInt
+			} else if n, err := strconv.Atoi(args[1]); err == nil && n > 0 {
+				steps = n
+			} else {
+				return fmt.Errorf("invalid number of migrations: %q\n%s", args[1], migrateUsage)
+			}
+		}
+		reverted, err := db.MigrateDown(ctx, conn, steps)
+		for _, m := range reverted {
+			fmt.Fprintf(w, "reverted %d_%s\n", m.Version, m.Name)
+		}
+		if err == nil && len(reverted) == 0 {
+			fmt.Fprintln(w, "no migrations are applied")
+		}
+		return err
+	case "status":
+		if len(args) > 1 {
+			return fmt.Errorf("status takes no arguments\n%s", migrateUsage)
+		}
+		statuses, err := db.GetMigrationStatus(ctx, conn)
+		if err != nil {
+			return err
+		}
+		writeMigrationStatus(w, statuses)
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], migrateUsage)
+	}
+}
+
+// writeMigrationStatus writes statuses as a table.
+func writeMigrationStatus(w io.Writer, statuses []db.MigrationStatus) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT")
+	for _, status := range statuses {
+		appliedAt := "pending"
+		if !status.AppliedAt.IsZero() {
+			appliedAt = status.AppliedAt.UTC().Format(time.RFC3339)
+		}
+		if status.Unknown {
+			appliedAt += " (unknown to this version)"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", status.Version, status.Name, appliedAt)
+	}
+	tw.Flush()
+}
+
+// migrateOnStartup applies the pending migrations if autoMigrate, and otherwise
+// warns about them, since the server may fail on an outdated schema.
+func migrateOnStartup(ctx context.Context, conn *sql.DB, autoMigrate bool) error {
+	if autoMigrate {
+		applied, err := db.MigrateUp(ctx, conn)
+		for _, m := range applied {
+			slog.Info("applied schema migration", "version", m.Version, "name", m.Name)
+		}
+		return err
+	}
+
+	statuses, err := db.GetMigrationStatus(ctx, conn)
+	if err != nil {
+		return err
+	}
+	for _, status := range statuses {
+		if status.AppliedAt.IsZero() {
+			slog.Warn("the database schema is not up to date, run \"server migrate up\" or set database.auto_migrate",
+				"pending_version", status.Version, "pending_name", status.Name)
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+//go:build unit_test
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/zjy-dev/grpc-go-chatroom/internal/db"
+)
+
+func TestRunMigrateUsage(t *testing.T) {
+	tests := []struct {
+		name          string
+		args          []string
+		expectedError string
+	}{
+		{name: "no command", args: nil, expectedError: "missing command"},
+		{name: "unknown command", args: []string{"sideways"}, expectedError: `unknown command "sideways"`},
+		{name: "up with arguments", args: []string{"up", "2"}, expectedError: "up takes no arguments"},
+		{name: "invalid steps", args: []string{"down", "0"}, expectedError: `invalid number of migrations: "0"`},
+		{name: "too many arguments", args: []string{"down", "1", "2"}, expectedError: "down takes at most one argument"},
+		{name: "status with arguments", args: []string{"status", "all"}, expectedError: "status takes no arguments"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The arguments are checked before connecting to the database.
+			err := runMigrate(context.Background(), nil, tt.args, &bytes.Buffer{})
+			require.ErrorContains(t, err, tt.expectedError)
+			require.ErrorContains(t, err, migrateUsage)
+		})
+	}
+}
+
+func TestWriteMigrationStatus(t *testing.T) {
+	var buf bytes.Buffer
+	writeMigrationStatus(&buf, []db.MigrationStatus{
+		{Migration: db.Migration{Version: 1, Name: "create_users"}, AppliedAt: time.Date(2024, 8, 15, 0, 0, 0, 0, time.UTC)},
+		{Migration: db.Migration{Version: 2, Name: "create_messages"}},
+		{Migration: db.Migration{Version: 9, Name: "future"}, AppliedAt: time.Date(2024, 8, 16, 0, 0, 0, 0, time.UTC), Unknown: true},
+	})
+	require.Equal(t, ""+
+		"VERSION  NAME             APPLIED AT\n"+
+		"1        create_users     2024-08-15T00:00:00Z\n"+
+		"2        create_messages  pending\n"+
+		"9        future           2024-08-16T00:00:00Z (unknown to this version)\n", buf.String())
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/tokensource"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// sseHeartbeatInterval is how often a comment is sent to keep idle connections open through proxies.
+const sseHeartbeatInterval = 30 * time.Second
+
+// SSEServer serves the chat events as Server-Sent Events by proxying the Subscribe RPC.
+type SSEServer struct {
+	grpcClient pb.ChatServiceClient
+}
+
+// parseSubscribeRequest reads the filters from the query, both repeated and
+// comma separated values are accepted, e.g. `?event_types=EVENT_TYPE_MESSAGE,EVENT_TYPE_USER_JOIN&rooms=general`.
+func parseSubscribeRequest(r *http.Request) (*pb.SubscribeRequest, error) {
+	req := &pb.SubscribeRequest{}
+	for _, name := range queryList(r, "event_types") {
+		v, ok := pb.EventType_value[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid event type: %q", name)
+		}
+		req.EventTypes = append(req.EventTypes, pb.EventType(v))
+	}
+	req.Rooms = queryList(r, "rooms")
+	return req, nil
+}
+
+func queryList(r *http.Request, key string) []string {
+	var res []string
+	for _, value := range r.URL.Query()[key] {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				res = append(res, v)
+			}
+		}
+	}
+	return res
+}
+
+// bearerToken returns the token in the Authorization header, or in the `token` query
+// parameter since browsers' EventSource can not set headers.
+func bearerToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) > len("bearer ") && strings.EqualFold(auth[:len("bearer ")], "bearer ") {
+		return auth[len("bearer "):]
+	}
+	return r.URL.Query().Get("token")
+}
+
+func (s *SSEServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := bearerToken(r)
+	if token == "" {
+		http.Error(w, "token is empty", http.StatusUnauthorized)
+		return
+	}
+	req, err := parseSubscribeRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stream, err := s.grpcClient.Subscribe(ctx, req, grpc.PerRPCCredentials(tokensource.New(token)))
+	if err != nil {
+		writeStatusError(w, err)
+		return
+	}
+	// The server sends the header once the subscription is active, a nil header
+	// means the RPC failed, e.g. the token is invalid.
+	if md, _ := stream.Header(); md == nil {
+		_, err := stream.Recv()
+		writeStatusError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	eventChan := make(chan *pb.Event)
+	errChan := make(chan error, 1)
+	go func() {
+		for {
+			evt, err := stream.Recv()
+			if err != nil {
+				errChan <- err
+				return
+			}
+			select {
+			case eventChan <- evt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(sseHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case evt := <-eventChan:
+			data, err := protojson.Marshal(evt)
+			if err != nil {
+				slog.Error("failed to marshal event", "error", err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", evt.GetId(), evt.GetType(), data)
+		case err := <-errChan:
+			if err == io.EOF {
+				return
+			}
+			// The browser reconnects after an error event, so only report why the stream ended.
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", status.Convert(err).Message())
+			flusher.Flush()
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+		case <-ctx.Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeStatusError writes err returned by a gRPC call as a plain text HTTP error.
+func writeStatusError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	http.Error(w, st.Message(), runtime.HTTPStatusFromCode(st.Code()))
+}
+
+func sseHandler(client pb.ChatServiceClient, origins *originPolicy) http.Handler {
+	s := &SSEServer{grpcClient: client}
+	return cors(origins, http.HandlerFunc(s.handleEvents))
+}
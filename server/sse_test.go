@@ -0,0 +1,137 @@
+//go:build unit_test
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// fakeSubscribeServer streams events to callers with the "good" token.
+type fakeSubscribeServer struct {
+	pb.UnimplementedChatServiceServer
+	events []*pb.Event
+}
+
+func (s *fakeSubscribeServer) Subscribe(req *pb.SubscribeRequest, stream grpc.ServerStreamingServer[pb.Event]) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	if auth := md.Get("authorization"); len(auth) == 0 || auth[0] != "bearer good" {
+		return status.Errorf(codes.Unauthenticated, "invalid auth token")
+	}
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	for _, evt := range s.events {
+		if len(req.GetRooms()) > 0 && req.GetRooms()[0] != evt.GetRoom() {
+			continue
+		}
+		if err := stream.Send(evt); err != nil {
+			return err
+		}
+	}
+	return status.Errorf(codes.Unavailable, "server is shutting down")
+}
+
+// newTestGRPCClient serves srv in memory and returns a client of it.
+func newTestGRPCClient(t *testing.T, srv pb.ChatServiceServer) pb.ChatServiceClient {
+	return pb.NewChatServiceClient(newTestGRPCConn(t, srv))
+}
+
+// newTestGRPCConn serves srv in memory and returns a connection to it.
+func newTestGRPCConn(t *testing.T, srv pb.ChatServiceServer) *grpc.ClientConn {
+	grpcServer := grpc.NewServer()
+	pb.RegisterChatServiceServer(grpcServer, srv)
+	return serveTestGRPC(t, grpcServer)
+}
+
+// serveTestGRPC serves grpcServer in memory and returns a connection to it.
+func serveTestGRPC(t *testing.T, grpcServer *grpc.Server) *grpc.ClientConn {
+	lis := bufconn.Listen(1 << 16)
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func newTestSSEServer(t *testing.T, events ...*pb.Event) *httptest.Server {
+	s := &SSEServer{grpcClient: newTestGRPCClient(t, &fakeSubscribeServer{events: events})}
+	server := httptest.NewServer(http.HandlerFunc(s.handleEvents))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHandleEvents(t *testing.T) {
+	require := require.New(t)
+	server := newTestSSEServer(t,
+		&pb.Event{Id: "1", Type: pb.EventType_EVENT_TYPE_USER_JOIN, Room: "general", Username: "alice"},
+		&pb.Event{Id: "2", Type: pb.EventType_EVENT_TYPE_USER_JOIN, Room: "random", Username: "bob"},
+	)
+
+	resp, err := http.Get(server.URL + "?token=good&rooms=random")
+	require.NoError(err)
+	defer resp.Body.Close()
+	require.Equal(http.StatusOK, resp.StatusCode)
+	require.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+
+	var lines []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	require.Len(lines, 7)
+	require.Equal("id: 2", lines[0])
+	require.Equal("event: EVENT_TYPE_USER_JOIN", lines[1])
+	var evt pb.Event
+	require.NoError(protojson.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &evt))
+	require.Equal("bob", evt.GetUsername())
+	require.Equal([]string{"", "event: error", "data: server is shutting down", ""}, lines[3:])
+}
+
+func TestHandleEventsErrors(t *testing.T) {
+	server := newTestSSEServer(t)
+	tests := []struct {
+		name       string
+		query      string
+		header     string
+		wantStatus int
+	}{
+		{name: "no token", query: "", wantStatus: http.StatusUnauthorized},
+		{name: "invalid token", query: "?token=bad", wantStatus: http.StatusUnauthorized},
+		{name: "invalid event type", query: "?token=good&event_types=EVENT_TYPE_NOPE", wantStatus: http.StatusBadRequest},
+		{name: "token in header", header: "Bearer good", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, server.URL+tt.query, nil)
+			require.NoError(t, err)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, tt.wantStatus, resp.StatusCode)
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+
+	"github.com/zjy-dev/grpc-go-chatroom/internal/tracing"
+)
+
+var tracer = tracing.Tracer()
+
+// traceRequests starts a span for every HTTP request, in the trace of its traceparent
+// header if any. The gRPC calls of the gateway and the bridges are made in this span.
+func traceRequests(next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http",
+		// Paths contain IDs, the span names are kept few.
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return "HTTP " + r.Method
+		}),
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return !isProbe(r)
+		}),
+	)
+}
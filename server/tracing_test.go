@@ -0,0 +1,49 @@
+//go:build unit_test
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceRequests(t *testing.T) {
+	defer otel.SetTextMapPropagator(otel.GetTextMapPropagator())
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var traceID trace.TraceID
+	handler := traceRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceID = trace.SpanContextFromContext(r.Context()).TraceID()
+	}))
+
+	tests := []struct {
+		path      string
+		wantTrace bool
+	}{
+		{path: "/messages", wantTrace: true},
+		// Scrapes and probes are not traced
+		{path: "/metrics"},
+		{path: "/healthz"},
+		{path: "/readyz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			traceID = trace.TraceID{}
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			if tt.wantTrace {
+				require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", traceID.String())
+			} else {
+				require.False(t, traceID.IsValid())
+			}
+		})
+	}
+}
@@ -1,118 +1,370 @@
 package main
 
+// The websocket endpoint `/ws` speaks the "chatroom.v1" sub-protocol, every frame
+// is a JSON text message with a `type`:
+//
+//	client -> server
+//	  {"type": "auth", "id": "1", "token": "<jwt>"}            must be the first frame, unless the token is sent
+//	                                                           as the "bearer.<jwt>" sub-protocol
+//	  {"type": "message", "id": "2", "text": "hi"}             send a message or a slash command
+//
+//	server -> client
+//	  {"type": "ack", "id": "2"}                               the frame with the id was accepted,
+//	                                                           an ack without id follows authentication
+//	  {"type": "message", "message": {...}}                    a chat message, see `Message` in chat.proto
+//	  {"type": "presence", "username": "bob", "room": "general", "status": "join"}
+//	  {"type": "error", "id": "2", "code": "InvalidArgument", "error": "text is empty"}
+//
+// The server pings every wsPingPeriod and closes connections not answering in wsPongWait.
+// When the chat stream ends, the connection is closed with 1000 if it ended normally,
+// or 4000 + the HTTP status of the gRPC status code, e.g. 4401 for Unauthenticated.
+
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
-	"github.com/zjy-dev/grpc-go-chatroom/internal/config"
-	"github.com/zjy-dev/grpc-go-chatroom/internal/tokensource"
+	"github.com/zjy-dev/grpc-go-chatroom/chatclient"
+	"github.com/zjy-dev/grpc-go-chatroom/internal/metrics"
 
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
 )
 
-var (
-	upgrader websocket.Upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
-	}
+const (
+	wsSubprotocol         = "chatroom.v1"
+	wsTokenProtocolPrefix = "bearer."
+
+	wsAuthTimeout  = 10 * time.Second    // time to send the auth frame
+	wsWriteWait    = 10 * time.Second    // time to write a frame
+	wsPongWait     = 60 * time.Second    // time to answer a ping
+	wsPingPeriod   = wsPongWait * 9 / 10 // must be less than wsPongWait
+	wsMaxFrameSize = 16 << 10
+
+	// wsCloseStatusBase is added to the HTTP status of a gRPC error to get the close code.
+	wsCloseStatusBase = 4000
 )
 
-type WebSocketServer struct {
-	grpcClient pb.ChatServiceClient
+// Frame types of the "chatroom.v1" sub-protocol.
+const (
+	frameAuth     = "auth"
+	frameMessage  = "message"
+	frameAck      = "ack"
+	frameError    = "error"
+	framePresence = "presence"
+)
+
+// wsFrame is a frame of the "chatroom.v1" sub-protocol, fields are set by frame type.
+type wsFrame struct {
+	Type     string          `json:"type"`
+	ID       string          `json:"id,omitempty"`
+	Token    string          `json:"token,omitempty"`
+	Text     string          `json:"text,omitempty"`
+	Message  json.RawMessage `json:"message,omitempty"`
+	Username string          `json:"username,omitempty"`
+	Room     string          `json:"room,omitempty"`
+	Status   string          `json:"status,omitempty"`
+	Code     string          `json:"code,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// originPolicy holds the origins allowed to call the HTTP API and open websockets,
+// which can be changed at runtime.
+type originPolicy struct {
+	allowed atomic.Pointer[[]string]
 }
 
-func mustNewGRPCClient() (*grpc.ClientConn, pb.ChatServiceClient) {
-	// Create a new client connection to the server
-	conn, err := grpc.NewClient(fmt.Sprintf("localhost:%d", config.Server.Port),
-		grpc.WithTransportCredentials(insecure.NewCredentials()))
+func newOriginPolicy(allowedOrigins []string) *originPolicy {
+	p := &originPolicy{}
+	p.set(allowedOrigins)
+	return p
+}
 
-	if err != nil {
-		log.Fatalf("fail to dial: %v", err)
+func (p *originPolicy) set(allowedOrigins []string) {
+	p.allowed.Store(&allowedOrigins)
+}
+
+// allows reports whether r comes from the server's own origin or an allowed one.
+// Requests without Origin are not from browsers.
+func (p *originPolicy) allows(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
 	}
-	fmt.Println("connected to server")
+	allowedOrigins := *p.allowed.Load()
+	return slices.Contains(allowedOrigins, "*") || slices.Contains(allowedOrigins, origin)
+}
+
+// websocketConnections counts the open websocket connections.
+var websocketConnections = metrics.NewGauge("chatroom_websocket_connections", "WebSocket connections currently open.")
 
-	// Return the connection and client
-	return conn, pb.NewChatServiceClient(conn)
+type WebSocketServer struct {
+	grpcConn grpc.ClientConnInterface
+	upgrader websocket.Upgrader
 }
 
-func newWebSocketServer() (*WebSocketServer, error) {
-	_, client := mustNewGRPCClient()
-	return &WebSocketServer{grpcClient: client}, nil
+func newWebSocketServer(conn grpc.ClientConnInterface, origins *originPolicy) *WebSocketServer {
+	return &WebSocketServer{
+		grpcConn: conn,
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			Subprotocols:    []string{wsSubprotocol},
+			CheckOrigin:     origins.allows,
+		},
+	}
 }
 
-func (s *WebSocketServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	// get token from request
-	token := r.URL.Query().Get("token")
-	// log.Printf("address: %s, token: %s\n", r.RemoteAddr, token)
+// wsConn serializes the writes to a websocket, gorilla/websocket supports
+// only one concurrent writer.
+type wsConn struct {
+	ws        *websocket.Conn
+	mu        sync.Mutex // mu guards writing frames
+	closeOnce sync.Once
+}
 
-	// Check if the token is empty
-	if token == "" {
-		log.Printf("token is empty")
-		w.WriteHeader(http.StatusUnauthorized)
+func (c *wsConn) writeFrame(frame *wsFrame) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return c.ws.WriteJSON(frame)
+}
+
+func (c *wsConn) writeError(id string, err error) error {
+	st := status.Convert(err)
+	return c.writeFrame(&wsFrame{Type: frameError, ID: id, Code: st.Code().String(), Error: st.Message()})
+}
+
+// close sends a close frame with code and reason, then closes the connection.
+// Only the first call has an effect.
+func (c *wsConn) close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		// A close frame carries at most 123 bytes of reason.
+		if len(reason) > 123 {
+			reason = reason[:123]
+		}
+		c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteWait))
+		c.ws.Close()
+	})
+}
+
+// closeWithError closes the connection with the close code mapped from the gRPC status of err.
+func (c *wsConn) closeWithError(err error) {
+	if err == nil || errors.Is(err, io.EOF) {
+		c.close(websocket.CloseNormalClosure, "")
 		return
 	}
+	st := status.Convert(err)
+	c.close(closeCodeFromStatus(st), st.Message())
+}
+
+func closeCodeFromStatus(st *status.Status) int {
+	// Canceled means the client went away first.
+	if st.Code() == codes.OK || st.Code() == codes.Canceled {
+		return websocket.CloseNormalClosure
+	}
+	return wsCloseStatusBase + runtime.HTTPStatusFromCode(st.Code())
+}
 
-	// Upgrade the request to a websocket
-	ws, err := upgrader.Upgrade(w, r, nil)
+// tokenFromSubprotocols returns the token offered as the "bearer.<token>" sub-protocol.
+func tokenFromSubprotocols(r *http.Request) string {
+	for _, protocol := range websocket.Subprotocols(r) {
+		if strings.HasPrefix(protocol, wsTokenProtocolPrefix) {
+			return strings.TrimPrefix(protocol, wsTokenProtocolPrefix)
+		}
+	}
+	return ""
+}
+
+// readAuthFrame reads the first frame, which must be an auth frame carrying the token.
+func (c *wsConn) readAuthFrame() (*wsFrame, error) {
+	c.ws.SetReadDeadline(time.Now().Add(wsAuthTimeout))
+	var frame wsFrame
+	if err := c.ws.ReadJSON(&frame); err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to read auth frame: %v", err)
+	}
+	if frame.Type != frameAuth || frame.Token == "" {
+		return nil, status.Errorf(codes.Unauthenticated, "the first frame must be an auth frame with a token")
+	}
+	return &frame, nil
+}
+
+func (s *WebSocketServer) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	token := tokenFromSubprotocols(r)
+
+	// Upgrade the request to a websocket, Upgrade replies with an HTTP error on failure.
+	ws, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Fatalf("failed to upgrade to websocket: %v", err)
+		slog.WarnContext(r.Context(), "failed to upgrade to websocket", "error", err)
 		return
 	}
-	defer func() {
-		ws.Close()
-	}()
+	websocketConnections.Inc()
+	defer websocketConnections.Dec()
+	conn := &wsConn{ws: ws}
+	defer conn.close(websocket.CloseNormalClosure, "")
+	ws.SetReadLimit(wsMaxFrameSize)
 
-	// Create a stream to the server
-	stream, err := s.grpcClient.Chat(context.Background(), grpc.PerRPCCredentials(tokensource.New(token)))
-	if err != nil {
-		log.Panicf("client.Chat failed: %v\n", err)
+	authID := ""
+	if token == "" {
+		frame, err := conn.readAuthFrame()
+		if err != nil {
+			conn.closeWithError(err)
+			return
+		}
+		token, authID = frame.Token, frame.ID
 	}
 
-	go func() {
-		for {
-			// Receive message from the server
-			msg, err := stream.Recv()
-			if err == io.EOF {
-				return
-			}
-			if err != nil {
-				log.Fatalf("failed to receive from server: %v", err)
-			}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	// Browsers reconnect by themselves, and log in again if needed.
+	client := chatclient.New(s.grpcConn, chatclient.WithToken(token), chatclient.WithoutReconnect())
 
-			// return message to the web browser
-			ws.WriteJSON(msg)
-		}
+	// The session tells once the user joined, its states end if the stream failed
+	// first, e.g. the token is invalid.
+	session := client.Chat(ctx)
+	if _, ok := <-session.States(); !ok {
+		<-session.Done()
+		conn.closeWithError(session.Err())
+		return
+	}
+	if err := conn.writeFrame(&wsFrame{Type: frameAck, ID: authID}); err != nil {
+		return
+	}
+
+	forwardDone := make(chan struct{})
+	go func() {
+		defer close(forwardDone)
+		s.forwardMessages(conn, session)
 	}()
+	go s.forwardPresence(ctx, conn, client)
+	go keepAlive(ctx, conn)
 
+	ws.SetReadDeadline(time.Now().Add(wsPongWait))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
 	for {
-		var req pb.ChatRequest
-		err := ws.ReadJSON(&req)
+		_, data, err := ws.ReadMessage()
 		if err != nil {
-			log.Printf("failed to read from websocket: %v", err)
+			if errors.Is(err, websocket.ErrReadLimit) {
+				conn.close(websocket.CloseMessageTooBig, fmt.Sprintf("frames are limited to %d bytes", wsMaxFrameSize))
+			}
+			// The client is gone, stop the chat stream.
+			cancel()
 			break
 		}
-		err = stream.Send(&req)
+
+		s.handleFrame(ctx, conn, session, data)
+	}
+	session.Close()
+	<-forwardDone
+}
+
+// handleFrame sends the message of a frame received from the client to the chat
+// session, and acks it.
+func (s *WebSocketServer) handleFrame(ctx context.Context, conn *wsConn, session *chatclient.Session, data []byte) {
+	_, span := tracer.Start(ctx, "websocket.frame")
+	defer span.End()
+
+	var frame wsFrame
+	if err := json.Unmarshal(data, &frame); err != nil {
+		conn.writeError("", status.Errorf(codes.InvalidArgument, "invalid frame: %v", err))
+		return
+	}
+	span.SetAttributes(attribute.String("websocket.frame_type", frame.Type))
+	if frame.Type != frameMessage {
+		conn.writeError(frame.ID, status.Errorf(codes.InvalidArgument, "unexpected frame type: %q", frame.Type))
+		return
+	}
+	if strings.TrimSpace(frame.Text) == "" {
+		conn.writeError(frame.ID, status.Errorf(codes.InvalidArgument, "text is empty"))
+		return
+	}
+
+	session.Send(frame.Text)
+	conn.writeFrame(&wsFrame{Type: frameAck, ID: frame.ID})
+}
+
+// forwardMessages writes the messages of the chat session to the websocket until it ends.
+func (s *WebSocketServer) forwardMessages(conn *wsConn, session *chatclient.Session) {
+	for msg := range session.Messages() {
+		data, err := protojson.Marshal(msg)
 		if err != nil {
-			log.Printf("failed to send to gRPC stream: %v", err)
-			break
+			slog.Error("failed to marshal message", "error", err)
+			continue
+		}
+		if err := conn.writeFrame(&wsFrame{Type: frameMessage, Message: data}); err != nil {
+			conn.close(websocket.CloseGoingAway, "")
+			// Stop receiving, the session ends as the handler cancels it.
+			for range session.Messages() {
+			}
+			return
 		}
 	}
+	<-session.Done()
+	conn.closeWithError(session.Err())
 }
 
-func websocketMux() *http.ServeMux {
-	wsServer, err := newWebSocketServer()
+// forwardPresence writes the joins and leaves of users to the websocket.
+func (s *WebSocketServer) forwardPresence(ctx context.Context, conn *wsConn, client *chatclient.Client) {
+	sub, err := client.Subscribe(ctx, &pb.SubscribeRequest{
+		EventTypes: []pb.EventType{pb.EventType_EVENT_TYPE_USER_JOIN, pb.EventType_EVENT_TYPE_USER_LEAVE},
+	})
 	if err != nil {
-		log.Fatalf("failed to create WebSocket server: %v", err)
+		slog.WarnContext(ctx, "failed to subscribe to presence", "error", err)
+		return
 	}
+	for evt := range sub.Events() {
+		presence := "join"
+		if evt.GetType() == pb.EventType_EVENT_TYPE_USER_LEAVE {
+			presence = "leave"
+		}
+		if err := conn.writeFrame(&wsFrame{Type: framePresence, Username: evt.GetUsername(), Room: evt.GetRoom(), Status: presence}); err != nil {
+			return
+		}
+	}
+	if err := sub.Err(); err != nil {
+		slog.WarnContext(ctx, "presence stream ended", "error", err)
+	}
+}
+
+// keepAlive pings the client every wsPingPeriod until ctx is done.
+func keepAlive(ctx context.Context, conn *wsConn) {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func websocketMux(conn grpc.ClientConnInterface, origins *originPolicy) *http.ServeMux {
+	wsServer := newWebSocketServer(conn, origins)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ws", wsServer.handleWebSocket)
@@ -0,0 +1,177 @@
+//go:build unit_test
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+	pb "github.com/zjy-dev/grpc-go-chatroom/api/chat/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// fakeChatServer echoes the messages of callers with the "good" token,
+// and ends the stream when it receives "/quit".
+type fakeChatServer struct {
+	fakeSubscribeServer
+}
+
+func (s *fakeChatServer) Chat(stream grpc.BidiStreamingServer[pb.ChatRequest, pb.ChatResponse]) error {
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	if auth := md.Get("authorization"); len(auth) == 0 || auth[0] != "bearer good" {
+		return status.Errorf(codes.Unauthenticated, "invalid auth token")
+	}
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if req.GetMessage().GetTextContent() == "/quit" {
+			return status.Errorf(codes.Aborted, "user: alice has logged out or been kicked")
+		}
+		msg := req.GetMessage()
+		msg.Username = "alice"
+		if err := stream.Send(&pb.ChatResponse{Message: msg}); err != nil {
+			return err
+		}
+	}
+}
+
+func newTestWebSocketServer(t *testing.T) string {
+	s := newWebSocketServer(newTestGRPCConn(t, &fakeChatServer{}), newOriginPolicy(nil))
+	server := httptest.NewServer(http.HandlerFunc(s.handleWebSocket))
+	t.Cleanup(server.Close)
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func dialWebSocket(t *testing.T, url string, protocols ...string) *websocket.Conn {
+	dialer := websocket.Dialer{Subprotocols: protocols, HandshakeTimeout: time.Second}
+	ws, _, err := dialer.Dial(url, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { ws.Close() })
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return ws
+}
+
+// readFrame reads frames until one of type frameType, skipping presence frames.
+func readFrame(t *testing.T, ws *websocket.Conn, frameType string) *wsFrame {
+	t.Helper()
+	for {
+		var frame wsFrame
+		require.NoError(t, ws.ReadJSON(&frame))
+		if frame.Type == frameType {
+			return &frame
+		}
+		require.Equal(t, framePresence, frame.Type, "unexpected frame: %+v", frame)
+	}
+}
+
+// requireCloseCode reads until the server closes the connection and checks the close code.
+func requireCloseCode(t *testing.T, ws *websocket.Conn, code int) {
+	t.Helper()
+	for {
+		_, _, err := ws.ReadMessage()
+		if err != nil {
+			require.True(t, websocket.IsCloseError(err, code), "unexpected error: %v", err)
+			return
+		}
+	}
+}
+
+func TestWebSocketAuthFrame(t *testing.T) {
+	require := require.New(t)
+	ws := dialWebSocket(t, newTestWebSocketServer(t), wsSubprotocol)
+	require.Equal(wsSubprotocol, ws.Subprotocol())
+
+	require.NoError(ws.WriteJSON(&wsFrame{Type: frameAuth, ID: "1", Token: "good"}))
+	require.Equal("1", readFrame(t, ws, frameAck).ID)
+
+	require.NoError(ws.WriteJSON(&wsFrame{Type: frameMessage, ID: "2", Text: "hi"}))
+	require.Equal("2", readFrame(t, ws, frameAck).ID)
+	frame := readFrame(t, ws, frameMessage)
+	require.Contains(string(frame.Message), `"textContent":"hi"`)
+
+	require.NoError(ws.WriteJSON(&wsFrame{Type: frameMessage, ID: "3"}))
+	frame = readFrame(t, ws, frameError)
+	require.Equal(&wsFrame{Type: frameError, ID: "3", Code: "InvalidArgument", Error: "text is empty"}, frame)
+
+	require.NoError(ws.WriteJSON(&wsFrame{Type: frameMessage, ID: "4", Text: "/quit"}))
+	requireCloseCode(t, ws, 4409)
+}
+
+func TestWebSocketTokenInSubprotocol(t *testing.T) {
+	require := require.New(t)
+	ws := dialWebSocket(t, newTestWebSocketServer(t), wsSubprotocol, wsTokenProtocolPrefix+"good")
+	require.Equal(wsSubprotocol, ws.Subprotocol())
+	require.Equal("", readFrame(t, ws, frameAck).ID)
+
+	require.NoError(ws.WriteMessage(websocket.TextMessage, []byte("not json")))
+	require.Equal(frameError, readFrame(t, ws, frameError).Type)
+
+	require.NoError(ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")))
+	requireCloseCode(t, ws, websocket.CloseNormalClosure)
+}
+
+func TestWebSocketClosesOnErrors(t *testing.T) {
+	url := newTestWebSocketServer(t)
+
+	t.Run("invalid token", func(t *testing.T) {
+		ws := dialWebSocket(t, url, wsSubprotocol, wsTokenProtocolPrefix+"bad")
+		requireCloseCode(t, ws, 4401)
+	})
+
+	t.Run("first frame is not auth", func(t *testing.T) {
+		ws := dialWebSocket(t, url, wsSubprotocol)
+		require.NoError(t, ws.WriteJSON(&wsFrame{Type: frameMessage, Text: "hi"}))
+		requireCloseCode(t, ws, 4401)
+	})
+
+	t.Run("frame too big", func(t *testing.T) {
+		ws := dialWebSocket(t, url, wsSubprotocol, wsTokenProtocolPrefix+"good")
+		readFrame(t, ws, frameAck)
+		require.NoError(t, ws.WriteJSON(&wsFrame{Type: frameMessage, Text: strings.Repeat("a", wsMaxFrameSize)}))
+		requireCloseCode(t, ws, websocket.CloseMessageTooBig)
+	})
+}
+
+func TestOriginPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{name: "no origin", origin: "", want: true},
+		{name: "same origin", origin: "http://chat.example.com", want: true},
+		{name: "other origin", origin: "http://evil.example.com", want: false},
+		{name: "allowed origin", allowed: []string{"http://app.example.com"}, origin: "http://app.example.com", want: true},
+		{name: "same origin is always allowed", allowed: []string{"http://app.example.com"}, origin: "http://chat.example.com", want: true},
+		{name: "not allowed origin", allowed: []string{"http://app.example.com"}, origin: "http://evil.example.com", want: false},
+		{name: "any origin", allowed: []string{"*"}, origin: "http://evil.example.com", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://chat.example.com/ws", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			require.Equal(t, tt.want, newOriginPolicy(tt.allowed).allows(r))
+		})
+	}
+}
@@ -1,45 +1,99 @@
 "use strict";
 
-let token = localStorage.getItem("grpc_go_chatroom_token");
-if (!token) {
-  alert("No token found");
-  return;
+// See server/websocket.go for the "chatroom.v1" websocket sub-protocol.
+const token = localStorage.getItem("grpc_go_chatroom_token");
+const messagesDiv = document.querySelector(".main__message-display");
+const messageInput = document.getElementById("user-input");
+const sendButton = document.querySelector(".input__submit-button-container");
+
+let wsocket = null;
+let nextFrameID = 1;
+
+function appendLine(text, className) {
+  const elem = document.createElement("div");
+  elem.textContent = text;
+  elem.className = className;
+  messagesDiv.appendChild(elem);
+  messagesDiv.scrollTop = messagesDiv.scrollHeight;
 }
 
-const SERVER_IP = "127.0.0.1";
-const SERVER_PORT = "8082";
-wsocket = new WebSocket(
-  "ws://" + SERVER_IP + ":" + SERVER_PORT + "/ws?token=" + token
-);
-
-wsocket.onopen = function () {
-  document.getElementById("messageInput").disabled = false;
-  document.getElementById("sendButton").disabled = false;
-  document.getElementById("username").disabled = true;
-};
-
-wsocket.onmessage = function (event) {
-  const message = JSON.parse(event.data);
-  const messagesDiv = document.getElementById("messages");
-  const messageElem = document.createElement("div");
-  let date = new Date(parseInt(message.timestamp));
-  messageElem.textContent = `${date.toLocaleString()}: ${message.text}`;
-  messageElem.className = "message";
-  messagesDiv.appendChild(messageElem);
+function showMessage(message) {
+  const date = new Date(parseInt(message.timestamp || "0") * 1000);
+  const name = message.displayName || message.username || "";
+  const container = document.createElement("div");
+  container.className = "main__other-message-container";
+  const elem = document.createElement("div");
+  elem.className = "main__message--other";
+  elem.textContent = `${date.toLocaleTimeString()} ${name}: ${message.textContent}`;
+  container.appendChild(elem);
+  messagesDiv.appendChild(container);
   messagesDiv.scrollTop = messagesDiv.scrollHeight;
-};
+}
+
+function connect() {
+  const scheme = location.protocol === "https:" ? "wss://" : "ws://";
+  // The token is sent as a sub-protocol, so that it never shows up in URLs or logs.
+  wsocket = new WebSocket(scheme + location.host + "/ws", [
+    "chatroom.v1",
+    "bearer." + token,
+  ]);
 
-wsocket.onclose = function () {
-  console.log("WebSocket is closed now.");
-};
+  wsocket.onmessage = function (event) {
+    const frame = JSON.parse(event.data);
+    switch (frame.type) {
+      case "ack":
+        if (!frame.id) {
+          messageInput.disabled = false;
+        }
+        break;
+      case "message":
+        showMessage(frame.message);
+        break;
+      case "presence":
+        appendLine(`${frame.username} ${frame.status === "join" ? "joined" : "left"} #${frame.room}`, "main__time");
+        break;
+      case "error":
+        appendLine(`error: ${frame.error}`, "main__time");
+        break;
+    }
+  };
 
-wsocket.onerror = function (error) {
-  console.log("WebSocket Error: ", error);
-};
+  wsocket.onclose = function (event) {
+    messageInput.disabled = true;
+    if (event.code === 4401) {
+      // The token is invalid or expired, log in again.
+      localStorage.removeItem("grpc_go_chatroom_token");
+      location.href = "/static/index.html";
+      return;
+    }
+    appendLine(`disconnected (${event.code} ${event.reason})`, "main__time");
+  };
+
+  wsocket.onerror = function (error) {
+    console.log("WebSocket Error: ", error);
+  };
+}
 
 function sendMessage() {
-  const messageInput = document.getElementById("user-input");
-  const message = { text: messageInput.value.trim(), timestamp: Date.now() };
-  wsocket.send(JSON.stringify(message));
+  const text = messageInput.value.trim();
+  if (!text || !wsocket || wsocket.readyState !== WebSocket.OPEN) {
+    return;
+  }
+  wsocket.send(JSON.stringify({ type: "message", id: String(nextFrameID++), text: text }));
   messageInput.value = "";
 }
+
+if (!token) {
+  alert("No token found");
+  location.href = "/static/index.html";
+} else {
+  messageInput.disabled = true;
+  sendButton.addEventListener("click", sendMessage);
+  messageInput.addEventListener("keydown", function (event) {
+    if (event.key === "Enter" && !event.shiftKey) {
+      event.preventDefault();
+      sendMessage();
+    }
+  });
+  connect();
+}